@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/evaluator"
+	"example.com/monkey/lexer"
+	"example.com/monkey/object"
+	"example.com/monkey/parser"
+)
+
+// monkey build [-o out.mbc] [-strip] file
+// コンパイルしたバイトコードを .mbc ファイルに書き出す
+func buildCommand(args []string) int {
+
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+
+	output := fs.String("o", "", "output file (default: the input file with the extension .mbc)")
+	strip := fs.Bool("strip", false, "omit function names and line numbers")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: monkey build [-o out.mbc] [-strip] file")
+		return 2
+	}
+
+	path := fs.Arg(0)
+
+	if *output == "" {
+		*output = strings.TrimSuffix(path, filepath.Ext(path)) + ".mbc"
+	}
+
+	options := compiler.DefaultOptions()
+	options.EmitDebugInfo = !*strip
+
+	bytecode, ok := compileFile(path, options)
+
+	if !ok {
+		return 1
+	}
+
+	out, err := os.Create(*output)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	err = bytecode.Encode(out)
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(*output)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return 1
+	}
+
+	return 0
+}
+
+// ファイルをマクロを展開してコンパイルする。エラーは標準エラー出力に書く
+// importはファイルのあるディレクトリから探す
+func compileFile(path string, options compiler.Options) (*compiler.Bytecode, bool) {
+
+	src, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, false
+	}
+
+	p := parser.New(lexer.New(string(src)))
+
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+
+		for _, msg := range p.Errors() {
+			fmt.Fprintf(os.Stderr, "%s: parser error: %s\n", path, msg)
+		}
+
+		return nil, false
+	}
+
+	macroEnv := object.NewEnvironment()
+	evaluator.DefineMacros(program, macroEnv)
+	expanded, err := evaluator.ExpandMacros(program, macroEnv)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: macro error: %s\n", path, err)
+		return nil, false
+	}
+
+	comp := compiler.NewWithOptions(options)
+	comp.SetModuleResolver(compiler.FileResolver{Dir: filepath.Dir(path)})
+
+	if err := comp.Compile(expanded); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: compiler error: %s\n", path, err)
+		return nil, false
+	}
+
+	return comp.Bytecode(), true
+}
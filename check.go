@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/evaluator"
+	"example.com/monkey/lexer"
+	"example.com/monkey/object"
+	"example.com/monkey/parser"
+)
+
+// monkey check [--explain] file...
+// 構文エラーとコンパイルエラーを検査する
+func checkCommand(args []string) int {
+
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+
+	explain := fs.Bool("explain", false,
+		"annotate each source line with the symbols defined/resolved and the instructions generated")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: monkey check [--explain] file...")
+		return 2
+	}
+
+	status := 0
+
+	for _, path := range fs.Args() {
+
+		if !checkFile(os.Stdout, path, *explain) {
+			status = 1
+		}
+	}
+
+	return status
+}
+
+func checkFile(out io.Writer, path string, explain bool) bool {
+
+	src, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		fmt.Fprintf(out, "%s: %s\n", path, err)
+		return false
+	}
+
+	p := parser.New(lexer.New(string(src)))
+
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+
+		for _, msg := range p.Errors() {
+			fmt.Fprintf(out, "%s: parser error: %s\n", path, msg)
+		}
+
+		return false
+	}
+
+	macroEnv := object.NewEnvironment()
+	evaluator.DefineMacros(program, macroEnv)
+	expanded, err := evaluator.ExpandMacros(program, macroEnv)
+
+	if err != nil {
+		fmt.Fprintf(out, "%s: macro error: %s\n", path, err)
+		return false
+	}
+
+	comp := compiler.New()
+	comp.SetModuleResolver(compiler.FileResolver{Dir: filepath.Dir(path)})
+
+	if explain {
+		comp.EnableExplain()
+	}
+
+	err = comp.Compile(expanded)
+
+	if err != nil {
+		fmt.Fprintf(out, "%s: compiler error: %s\n", path, err)
+		return false
+	}
+
+	if explain {
+		printExplanation(out, string(src), comp.Explanation())
+		return true
+	}
+
+	// 警告があっても検査は失敗にしない
+	for _, w := range comp.Warnings() {
+		fmt.Fprintf(out, "%s: warning: %s\n", path, w)
+	}
+
+	fmt.Fprintf(out, "%s: ok\n", path)
+
+	return true
+}
+
+// ソースコードの各行の下に、その行での判断を書き出す
+func printExplanation(out io.Writer, src string, e *compiler.Explanation) {
+
+	notes := map[int][]string{}
+
+	for _, s := range e.Symbols {
+
+		notes[s.Line] = append(notes[s.Line], fmt.Sprintf("%s %s %s %d",
+			s.Action,
+			s.Symbol.Name,
+			s.Symbol.Scope,
+			s.Symbol.Index))
+	}
+
+	for _, r := range e.Ranges {
+
+		notes[r.Line] = append(notes[r.Line], fmt.Sprintf("instructions %s %04d-%04d",
+			r.Function,
+			r.Start,
+			r.End-1))
+	}
+
+	for i, line := range strings.Split(src, "\n") {
+
+		fmt.Fprintf(out, "%4d | %s\n", i+1, line)
+
+		for _, note := range notes[i+1] {
+			fmt.Fprintf(out, "     |     %s\n", note)
+		}
+	}
+}
@@ -4,8 +4,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math/bits"
 )
 
+// オペランドは読み出すとintになる。intが32ビット未満の環境ではコンパイルエラーにする
+// (2バイトのオペランドと、それを足したジャンプ先のオフセットがintに収まるように)
+// 4バイトのジャンプ先は、32ビット環境ではMaxInt32までしか使えない
+const _ = uint(bits.UintSize - 32)
+
 type Instructions []byte
 
 type Opcode byte
@@ -80,6 +86,68 @@ const (
 	OpGetFree
 
 	OpCurrentClosure
+
+	// for-inループ
+	// スタックの先頭の値からイテレーターを作り、スタックに残す
+	OpIterNew
+	// スタックの先頭にあるイテレーターから次の要素を取り出してプッシュする
+	// 要素が無ければイテレーターをポップしてオペランドの位置にジャンプする
+	OpIterNext
+
+	// スライス arr[low:high]
+	// スタック上の対象、low、highを取り出して部分配列(部分文字列)をプッシュする
+	OpSlice
+
+	// 自由変数を持たない関数
+	// OpClosureと違い、参照するたびにクロージャを作らない
+	OpFunction
+
+	// スタックの先頭要素を文字列に変換する(文字列の補間用)
+	OpToString
+
+	// スタックの2つの整数から範囲を作る
+	OpRange
+
+	// スタックの先頭要素をポップして、現在のクロージャの自由変数に保存する
+	OpSetFree
+
+	// ジャンプ先を4バイトで持つジャンプ命令
+	// 64KBを超える関数の中だけで使う (widen.go)
+	OpJumpWide
+	OpJumpNotTruthyWide
+	OpIterNextWide
+
+	// ジャンプ先を次の命令からの符号付きの差で持つジャンプ命令 (relative.go)
+	OpJumpRel
+	OpJumpNotTruthyRel
+
+	// よく続けて現れる命令をまとめたもの (superinstruction.go)
+	// OpConstant;OpAdd
+	OpAddConstant
+	// OpGetLocal;OpCall
+	OpCallLocal
+
+	// 例外処理 (try/catch)
+	// 例外を受け取る位置を積む。tryの本体で例外が起きると、
+	// スタックとフレームを戻して例外の値を積み、オペランドの位置から実行する
+	OpTry
+	// 本体を最後まで実行したので、積んだ位置を取り除く
+	OpEndTry
+	// スタックの先頭の値を例外として投げる
+	OpThrow
+
+	// 剰余 a % b
+	OpMod
+
+	// a >= b (a <= b は左右を入れ替えて使う)
+	OpGreaterEqual
+
+	// スタックの先頭の関数を別のVMで実行し、結果を受け取るチャンネルを積む
+	OpSpawn
+
+	// スタックの先頭の値を返してgeneratorを止める
+	// 再開したときにnext(g, v)のvを積む
+	OpYield
 )
 
 // Opcodeの定義情報（人間が理解する用）
@@ -88,71 +156,157 @@ type Definition struct {
 	Name string
 	// operandそれぞれが占めるバイト数
 	Operandwidths []int
+
+	// スタックから取り出す値と積む値の数
+	// ジャンプしたときは取り出すだけで何も積まない
+	Pops   int
+	Pushes int
+	// 0以上なら、その番号のオペランドの値だけ余分に取り出す (OpArrayの要素、OpCallの引数など)
+	PopsOperand int
+
+	Flow Flow
 }
 
-var definitions = map[Opcode]*Definition{
+// 命令を実行した後に次にどこを実行するか
+type Flow int
+
+const (
+	// 次の命令
+	FlowNext Flow = iota
+	// 次の命令(関数を呼び出して戻ってくる)
+	FlowCall
+	// 必ず1つ目のオペランドの位置へジャンプする
+	FlowJump
+	// 1つ目のオペランドの位置へジャンプするか、次の命令
+	FlowBranch
+	// 関数から戻る
+	FlowReturn
+	// 次の命令。例外が起きたら1つ目のオペランドの位置へジャンプする(例外の値を1つ積む)
+	FlowHandler
+)
+
+// オペランドを読んだ命令がスタックから取り出す値と積む値の数
+func (d *Definition) StackEffect(operands []int) (int, int) {
+
+	pops := d.Pops
+
+	if d.PopsOperand >= 0 {
+		pops += operands[d.PopsOperand]
+	}
+
+	return pops, d.Pushes
+}
+
+// 名前, オペランドの幅, 取り出す数, 積む数, 取り出す数を足すオペランド, 制御の流れ
+// 命令ごとに引くので、mapではなくopcodeで添字を引く配列にしている。未定義のopcodeはnil
+var definitions = [256]*Definition{
 
 	// オペランドは2バイト、定数プールのインデックス
-	OpConstant: {"OpConstant", []int{2}},
+	OpConstant: {"OpConstant", []int{2}, 0, 1, -1, FlowNext},
 
 	// OpAddはオペランドが無いので空の配列
-	OpAdd:         {"OpAdd", []int{}},
-	OpPop:         {"OpPop", []int{}},
-	OpSub:         {"OpSub", []int{}},
-	OpMul:         {"OpMul", []int{}},
-	OpDiv:         {"OpDiv", []int{}},
-	OpTrue:        {"OpTrue", []int{}},
-	OpFalse:       {"OpFalse", []int{}},
-	OpEqual:       {"OpEqual", []int{}},
-	OpNotEqual:    {"OpNotEqual", []int{}},
-	OpGreaterThan: {"OpGreaterThan", []int{}},
-	OpMinus:       {"OpMinus", []int{}},
-	OpBang:        {"OpBang", []int{}},
+	OpAdd:         {"OpAdd", []int{}, 2, 1, -1, FlowNext},
+	OpPop:         {"OpPop", []int{}, 1, 0, -1, FlowNext},
+	OpSub:         {"OpSub", []int{}, 2, 1, -1, FlowNext},
+	OpMul:         {"OpMul", []int{}, 2, 1, -1, FlowNext},
+	OpDiv:         {"OpDiv", []int{}, 2, 1, -1, FlowNext},
+	OpTrue:        {"OpTrue", []int{}, 0, 1, -1, FlowNext},
+	OpFalse:       {"OpFalse", []int{}, 0, 1, -1, FlowNext},
+	OpEqual:       {"OpEqual", []int{}, 2, 1, -1, FlowNext},
+	OpNotEqual:    {"OpNotEqual", []int{}, 2, 1, -1, FlowNext},
+	OpGreaterThan: {"OpGreaterThan", []int{}, 2, 1, -1, FlowNext},
+	OpMinus:       {"OpMinus", []int{}, 1, 1, -1, FlowNext},
+	OpBang:        {"OpBang", []int{}, 1, 1, -1, FlowNext},
 
 	// Jump  オペランドは2バイト、ジャンプ先のオフセット
-	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
-	OpJump:          {"OpJump", []int{2}},
+	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}, 1, 0, -1, FlowBranch},
+	OpJump:          {"OpJump", []int{2}, 0, 0, -1, FlowJump},
 
-	OpNull: {"OpNull", []int{}},
+	OpNull: {"OpNull", []int{}, 0, 1, -1, FlowNext},
 
-	OpGetGlobal: {"OpGetGlobal", []int{2}},
-	OpSetGlobal: {"OpSetGlobal", []int{2}},
+	OpGetGlobal: {"OpGetGlobal", []int{2}, 0, 1, -1, FlowNext},
+	OpSetGlobal: {"OpSetGlobal", []int{2}, 1, 0, -1, FlowNext},
 
-	OpGetLocal: {"OpGetLocal", []int{1}},
-	OpSetLocal: {"OpSetLocal", []int{1}},
+	OpGetLocal: {"OpGetLocal", []int{1}, 0, 1, -1, FlowNext},
+	OpSetLocal: {"OpSetLocal", []int{1}, 1, 0, -1, FlowNext},
 
-	OpArray: {"OpArray", []int{2}},
-	OpHash:  {"OpHash", []int{2}},
+	OpArray: {"OpArray", []int{2}, 0, 1, 0, FlowNext},
+	OpHash:  {"OpHash", []int{2}, 0, 1, 0, FlowNext},
 
-	OpIndex: {"OpIndex", []int{}},
+	OpIndex: {"OpIndex", []int{}, 2, 1, -1, FlowNext},
 
-	OpCall:        {"OpCall", []int{1}},
-	OpReturnValue: {"OpReturnValue", []int{}},
-	OpReturn:      {"OpReturn", []int{}},
+	OpCall:        {"OpCall", []int{1}, 1, 1, 0, FlowCall},
+	OpReturnValue: {"OpReturnValue", []int{}, 1, 0, -1, FlowReturn},
+	OpReturn:      {"OpReturn", []int{}, 0, 0, -1, FlowReturn},
 
-	OpGetBuiltin: {"OpGetBuiltin", []int{1}},
+	OpGetBuiltin: {"OpGetBuiltin", []int{1}, 0, 1, -1, FlowNext},
 
 	// 1つめは、compiled functionのconstant index
 	// 2つめは、スタック上にある、転送する必要があるfree variableの数
-	OpClosure: {"OpClosure", []int{2, 1}},
-	OpGetFree: {"OpGetFree", []int{1}},
+	OpClosure: {"OpClosure", []int{2, 1}, 0, 1, 1, FlowNext},
+	OpGetFree: {"OpGetFree", []int{1}, 0, 1, -1, FlowNext},
+
+	OpCurrentClosure: {"OpCurrentClosure", []int{}, 0, 1, -1, FlowNext},
+
+	OpIterNew: {"OpIterNew", []int{}, 1, 1, -1, FlowNext},
+	// オペランドは2バイト、ループを抜けるときのジャンプ先のオフセット
+	OpIterNext: {"OpIterNext", []int{2}, 1, 2, -1, FlowBranch},
+
+	OpSlice: {"OpSlice", []int{}, 3, 1, -1, FlowNext},
+
+	// オペランドはcompiled functionのconstant index
+	OpFunction: {"OpFunction", []int{2}, 0, 1, -1, FlowNext},
+
+	OpToString: {"OpToString", []int{}, 1, 1, -1, FlowNext},
 
-	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpRange: {"OpRange", []int{}, 2, 1, -1, FlowNext},
+
+	// オペランドは自由変数のインデックス
+	OpSetFree: {"OpSetFree", []int{1}, 1, 0, -1, FlowNext},
+
+	OpJumpWide:          {"OpJumpWide", []int{4}, 0, 0, -1, FlowJump},
+	OpJumpNotTruthyWide: {"OpJumpNotTruthyWide", []int{4}, 1, 0, -1, FlowBranch},
+	OpIterNextWide:      {"OpIterNextWide", []int{4}, 1, 2, -1, FlowBranch},
+
+	// オペランドは2バイト、符号付きの差
+	OpJumpRel:          {"OpJumpRel", []int{2}, 0, 0, -1, FlowJump},
+	OpJumpNotTruthyRel: {"OpJumpNotTruthyRel", []int{2}, 1, 0, -1, FlowBranch},
+
+	// オペランドは足す値のconstant index
+	OpAddConstant: {"OpAddConstant", []int{2}, 1, 1, -1, FlowNext},
+	// 1つめは積むローカル変数のインデックス、2つめは引数の数
+	// 最後の引数(引数が無ければ関数)は自分で積むので、取り出すのは引数の数だけ
+	OpCallLocal: {"OpCallLocal", []int{1, 1}, 0, 1, 1, FlowCall},
+
+	// オペランドは4バイト、例外を受け取る位置
+	// 64KBを超える関数でもジャンプ命令のように広げなくてよいように4バイトにしている
+	OpTry:    {"OpTry", []int{4}, 0, 0, -1, FlowHandler},
+	OpEndTry: {"OpEndTry", []int{}, 0, 0, -1, FlowNext},
+	OpThrow:  {"OpThrow", []int{}, 1, 0, -1, FlowReturn},
+
+	OpMod:          {"OpMod", []int{}, 2, 1, -1, FlowNext},
+	OpGreaterEqual: {"OpGreaterEqual", []int{}, 2, 1, -1, FlowNext},
+	OpSpawn:        {"OpSpawn", []int{}, 1, 1, -1, FlowNext},
+	OpYield:        {"OpYield", []int{}, 1, 1, -1, FlowNext},
 }
 
 func Lookup(op byte) (*Definition, error) {
-	def, ok := definitions[Opcode(op)]
-	if !ok {
+	def := definitions[op]
+	if def == nil {
 		return nil, fmt.Errorf("opcode %d undefined", op)
 	}
 	return def, nil
 }
 
+// オペランドはホストのバイトオーダーに関係なくビッグエンディアンで埋め込むので、
+// どのアーキテクチャで作ったバイトコードも同じバイト列になる
+// 幅に収まらないオペランドは切り詰められるので、先にCheckOperandsで確かめるかMakeEを使う
+// 余分なオペランドは無視する
 func Make(op Opcode, operands ...int) []byte {
 
-	def, ok := definitions[op]
+	def := definitions[op]
 
-	if !ok {
+	if def == nil {
 		return []byte{}
 	}
 
@@ -173,11 +327,18 @@ func Make(op Opcode, operands ...int) []byte {
 
 	for i, o := range operands {
 
+		if i >= len(def.Operandwidths) {
+			break
+		}
+
 		// あるオペランドのバイト数
 		width := def.Operandwidths[i]
 
 		switch width {
 
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
+
 		case 2:
 			// オペランド(の値)を2バイトの幅で
 			// インストラクションの指定したオフセットを開始位置として埋め込んでいる
@@ -194,31 +355,64 @@ func Make(op Opcode, operands ...int) []byte {
 	return instruction
 }
 
-func (ins Instructions) String() string {
+// Makeと同じだが、未定義のopcode、オペランドの数の違い、幅に収まらないオペランドをエラーにする
+func MakeE(op Opcode, operands ...int) ([]byte, error) {
 
-	var out bytes.Buffer
+	if err := CheckOperands(op, operands...); err != nil {
+		return nil, err
+	}
 
-	i := 0
+	return Make(op, operands...), nil
+}
 
-	for i < len(ins) {
+// オペランドがそれぞれの幅に収まるか確かめる
+func CheckOperands(op Opcode, operands ...int) error {
 
-		// opcode(1バイト)を渡してその定義を取得
-		def, err := Lookup(ins[i])
+	def := definitions[op]
 
-		if err != nil {
+	if def == nil {
+		return fmt.Errorf("opcode %d undefined", op)
+	}
+
+	if len(operands) != len(def.Operandwidths) {
+		return fmt.Errorf("%s takes %d operands, got %d",
+			def.Name, len(def.Operandwidths), len(operands))
+	}
+
+	for i, o := range operands {
 
-			fmt.Fprintf(&out, "ERROR: %s\n", err)
+		// 32ビット環境でも桁あふれしないようにuint64で計算する
+		max := uint64(1)<<(8*def.Operandwidths[i]) - 1
 
-			continue
+		if o < 0 || uint64(o) > max {
+			return fmt.Errorf("operand %d of %s out of range: %d (max %d)", i, def.Name, o, max)
 		}
+	}
+
+	return nil
+}
+
+func (ins Instructions) String() string {
+
+	var out bytes.Buffer
 
-		operands, read := ReadOperands(def, ins[i+1:])
+	err := ins.Iterate(func(offset int, op Opcode, operands []int) bool {
+
+		// 相対ジャンプの差は符号付きで表示する
+		if _, ok := relativeJumps[op]; ok {
+			operands = []int{int(int16(uint16(operands[0])))}
+		}
 
 		fmt.Fprintf(&out, "%04d %s\n",
-			i,
-			ins.fmtInstruction(def, operands))
+			offset,
+			ins.fmtInstruction(definitions[op], operands))
 
-		i += 1 + read
+		return true
+	})
+
+	// 壊れた命令列は、読めたところまで表示する
+	if e, ok := err.(*DecodeError); ok {
+		fmt.Fprintf(&out, "%04d ERROR: %s\n", e.Offset, e.Err)
 	}
 
 	return out.String()
@@ -268,6 +462,9 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 	for i, width := range def.Operandwidths {
 
 		switch width {
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
+
 		case 2:
 			operands[i] = int(ReadUint16(ins[offset:]))
 
@@ -281,12 +478,63 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 	return operands, offset
 }
 
+// ReadOperandsと同じだが、命令列がオペランドの途中で切れていればエラーにする
+// (壊れた .mbc ファイルなど)
+func ReadOperandsChecked(def *Definition, ins Instructions) ([]int, int, error) {
+
+	width := 0
+	for _, w := range def.Operandwidths {
+		width += w
+	}
+
+	if len(ins) < width {
+		return nil, 0, fmt.Errorf("%s is truncated: want %d operand bytes, got %d",
+			def.Name, width, len(ins))
+	}
+
+	operands, read := ReadOperands(def, ins)
+
+	return operands, read, nil
+}
+
+// すべての命令が定義済みのopcodeで、オペランドが途中で切れていないか確かめる
+func CheckInstructions(ins Instructions) error {
+
+	for i := 0; i < len(ins); {
+
+		def, err := Lookup(ins[i])
+
+		if err != nil {
+			return fmt.Errorf("%04d: %s", i, err)
+		}
+
+		// VMが実行のたびに呼ぶので、オペランドは読まずに幅だけ確かめる
+		width := 0
+		for _, w := range def.Operandwidths {
+			width += w
+		}
+
+		if i+1+width > len(ins) {
+			return fmt.Errorf("%04d: %s is truncated: want %d operand bytes, got %d",
+				i, def.Name, width, len(ins)-i-1)
+		}
+
+		i += 1 + width
+	}
+
+	return nil
+}
+
 func ReadUint16(ins Instructions) uint16 {
 
 	// おそらく2バイト(16ビット)読み取っている
 	return binary.BigEndian.Uint16(ins)
 }
 
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
 func ReadUint8(ins Instructions) uint8 {
 	return uint8(ins[0])
 }
@@ -1,6 +1,14 @@
 package code
 
-import "testing"
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
 
 func TestMake(t *testing.T) {
 
@@ -33,6 +41,12 @@ func TestMake(t *testing.T) {
 			[]int{65534, 255},
 			[]byte{byte(OpClosure), 255, 254, 255},
 		},
+		{
+			// 4バイトのオペランドもビッグエンディアン
+			OpJumpWide,
+			[]int{16909060},
+			[]byte{byte(OpJumpWide), 1, 2, 3, 4},
+		},
 	}
 
 	for _, tt := range tests {
@@ -68,6 +82,7 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpConstant, 2),
 		Make(OpConstant, 65535),
 		Make(OpClosure, 65535, 255),
+		Make(OpJumpWide, 70000),
 	}
 
 	expected := `0000 OpAdd
@@ -75,6 +90,7 @@ func TestInstructionsString(t *testing.T) {
 0003 OpConstant 2
 0006 OpConstant 65535
 0009 OpClosure 65535 255
+0013 OpJumpWide 70000
 `
 
 	concatted := Instructions{}
@@ -113,6 +129,11 @@ func TestReadOperands(t *testing.T) {
 			[]int{6555, 255},
 			3,
 		},
+		{
+			OpJumpWide,
+			[]int{2147483647},
+			4,
+		},
 	}
 
 	for _, tt := range tests {
@@ -149,3 +170,552 @@ func TestReadOperands(t *testing.T) {
 
 	}
 }
+
+func TestOptimize(t *testing.T) {
+
+	concat := func(instructions ...Instructions) Instructions {
+		out := Instructions{}
+		for _, ins := range instructions {
+			out = append(out, ins...)
+		}
+		return out
+	}
+
+	tests := []struct {
+		input    Instructions
+		rules    []PeepholeRule
+		expected Instructions
+	}{
+		{
+			concat(Make(OpTrue), Make(OpBang), Make(OpPop)),
+			PeepholeRules,
+			concat(Make(OpFalse), Make(OpPop)),
+		},
+		{
+			// 後ろのジャンプ先は縮んだ分だけずれる
+			concat(
+				Make(OpNull),             // 0000
+				Make(OpBang),             // 0001
+				Make(OpJumpNotTruthy, 9), // 0002
+				Make(OpConstant, 1),      // 0005
+				Make(OpPop),              // 0008
+				Make(OpConstant, 2),      // 0009
+			),
+			PeepholeRules,
+			concat(
+				Make(OpTrue),
+				Make(OpJumpNotTruthy, 8),
+				Make(OpConstant, 1),
+				Make(OpPop),
+				Make(OpConstant, 2),
+			),
+		},
+		{
+			// 直後へのジャンプを消す
+			concat(
+				Make(OpJumpNotTruthy, 6), // 0000
+				Make(OpJump, 6),          // 0003
+				Make(OpConstant, 0),      // 0006
+			),
+			PeepholeRules,
+			concat(
+				Make(OpJumpNotTruthy, 3),
+				Make(OpConstant, 0),
+			),
+		},
+		{
+			concat(Make(OpGetLocal, 0), Make(OpPop), Make(OpConstant, 1), Make(OpReturnValue)),
+			append(PeepholeRules, DiscardRule),
+			concat(Make(OpConstant, 1), Make(OpReturnValue)),
+		},
+		{
+			// ジャンプ先の命令は一致した命令列の途中に含めない
+			concat(
+				Make(OpJumpNotTruthy, 4), // 0000
+				Make(OpTrue),             // 0003
+				Make(OpBang),             // 0004
+			),
+			PeepholeRules,
+			concat(
+				Make(OpJumpNotTruthy, 4),
+				Make(OpTrue),
+				Make(OpBang),
+			),
+		},
+	}
+
+	for i, tt := range tests {
+
+		optimized, _ := Optimize(tt.input, tt.rules)
+
+		if optimized.String() != tt.expected.String() {
+			t.Errorf("test %d: wrong instructions.\nwant=%q\ngot=%q",
+				i, tt.expected.String(), optimized.String())
+		}
+	}
+}
+
+func TestLineTable(t *testing.T) {
+
+	lines := LineTable{{Offset: 0, Line: 1}, {Offset: 3, Line: 2}, {Offset: 7, Line: 4}}
+
+	for offset, want := range map[int]int{0: 1, 2: 1, 3: 2, 6: 2, 7: 4, 100: 4} {
+		if got := lines.Line(offset); got != want {
+			t.Errorf("wrong line for offset %d. want=%d, got=%d", offset, want, got)
+		}
+	}
+
+	if got := (LineTable{{Offset: 2, Line: 5}}).Line(1); got != 0 {
+		t.Errorf("expected 0 before the first entry. got=%d", got)
+	}
+
+	// 3の命令が消えて、7の命令が3に移動した
+	remapped := lines.Remap(map[int]int{0: 0, 3: 3, 7: 3})
+
+	if len(remapped) != 2 || remapped[1] != (LineEntry{Offset: 3, Line: 4}) {
+		t.Errorf("wrong remapped table. got=%v", remapped)
+	}
+}
+
+func TestCheckOperands(t *testing.T) {
+
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected string
+	}{
+		{OpConstant, []int{65535}, ""},
+		{OpConstant, []int{65536}, "operand 0 of OpConstant out of range: 65536 (max 65535)"},
+		{OpGetLocal, []int{256}, "operand 0 of OpGetLocal out of range: 256 (max 255)"},
+		{OpClosure, []int{1, -1}, "operand 1 of OpClosure out of range: -1 (max 255)"},
+		{OpAdd, []int{1}, "OpAdd takes 0 operands, got 1"},
+	}
+
+	for _, tt := range tests {
+
+		err := CheckOperands(tt.op, tt.operands...)
+
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			continue
+		}
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+// 各アーキテクチャ向けにビルドできるか確かめる(時間がかかるので MONKEY_ARCH_MATRIX=1 のときだけ)
+// 32ビットとビッグエンディアンを含める。linux/amd64では386のバイナリを実行してテストもする
+func TestArchitectureMatrix(t *testing.T) {
+
+	if os.Getenv("MONKEY_ARCH_MATRIX") == "" {
+		t.Skip("set MONKEY_ARCH_MATRIX=1 to cross-compile for every architecture")
+	}
+
+	goTool := func(arch string, args ...string) {
+
+		cmd := exec.Command("go", args...)
+		cmd.Dir = ".."
+		cmd.Env = append(os.Environ(), "GOARCH="+arch, "GOOS=linux")
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("GOARCH=%s go %v failed: %s\n%s", arch, args, err, out)
+		}
+	}
+
+	for _, arch := range []string{"amd64", "arm64", "386", "arm", "mips", "s390x"} {
+		goTool(arch, "vet", "./...")
+	}
+
+	if runtime.GOOS == "linux" && runtime.GOARCH == "amd64" {
+		goTool("386", "test", "./code", "./compiler", "./vm")
+	}
+}
+
+func TestWidenJumps(t *testing.T) {
+
+	ins := Instructions{}
+	for _, in := range []Instructions{
+		Make(OpJumpNotTruthy, 6), // 0000
+		Make(OpJump, 0),          // 0003 本当のジャンプ先は10
+		Make(OpNull),             // 0006
+		Make(OpIterNext, 10),     // 0007
+		Make(OpPop),              // 0010
+		Make(OpTry, 7),           // 0011 4バイトのまま位置だけ付け直す
+	} {
+		ins = append(ins, in...)
+	}
+
+	widened, moved := WidenJumps(ins, map[int]int{3: 10})
+
+	expected := Instructions{}
+	for _, in := range []Instructions{
+		Make(OpJumpNotTruthyWide, 10),
+		Make(OpJumpWide, 16),
+		Make(OpNull),
+		Make(OpIterNextWide, 16),
+		Make(OpPop),
+		Make(OpTry, 11),
+	} {
+		expected = append(expected, in...)
+	}
+
+	if widened.String() != expected.String() {
+		t.Errorf("wrong instructions.\nwant=%q\ngot=%q", expected.String(), widened.String())
+	}
+
+	if moved[7] != 11 || moved[len(ins)] != len(expected) {
+		t.Errorf("wrong offsets. got=%v", moved)
+	}
+}
+
+func TestFile(t *testing.T) {
+
+	file := &File{Constants: []byte{0}, Instructions: Make(OpNull)}
+
+	var out bytes.Buffer
+
+	if err := file.Encode(&out); err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	data := out.Bytes()
+
+	// デバッグ情報を省くと、そのセクションは書き出さない
+	expected := []byte{'M', 'N', 'K', 'Y', FileVersion, 1, 1, 0, 2, 1, byte(OpNull)}
+
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("wrong encoding.\nwant=%v\ngot= %v", expected, data)
+	}
+
+	// 知らないセクションは読み飛ばす
+	decoded, err := DecodeFile(bytes.NewReader(append(append([]byte{}, data...), 9, 2, 'x', 'y')))
+
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+
+	if !bytes.Equal(decoded.Instructions, file.Instructions) || decoded.Debug != nil {
+		t.Errorf("wrong file. got=%+v", decoded)
+	}
+
+	tests := []struct {
+		input    []byte
+		expected string
+	}{
+		{[]byte("MNK"), "not a monkey bytecode file"},
+		{data[:8], "missing section 2"},
+		{data[:10], "truncated or corrupt bytecode: unexpected EOF"},
+		{append(append([]byte{}, data...), 1, 0), "duplicate section 1"},
+	}
+
+	for _, tt := range tests {
+
+		_, err := DecodeFile(bytes.NewReader(tt.input))
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+func TestStackEffect(t *testing.T) {
+
+	tests := []struct {
+		op       Opcode
+		operands []int
+		pops     int
+		pushes   int
+	}{
+		{OpAdd, []int{}, 2, 1},
+		{OpArray, []int{3}, 3, 1},
+		{OpCall, []int{2}, 3, 1},
+		{OpClosure, []int{0, 2}, 2, 1},
+		{OpIterNext, []int{0}, 1, 2},
+	}
+
+	for _, tt := range tests {
+
+		def, _ := Lookup(byte(tt.op))
+
+		pops, pushes := def.StackEffect(tt.operands)
+
+		if pops != tt.pops || pushes != tt.pushes {
+			t.Errorf("wrong stack effect for %s. want=(%d, %d), got=(%d, %d)",
+				def.Name, tt.pops, tt.pushes, pops, pushes)
+		}
+	}
+
+	for op, def := range definitions {
+
+		if def == nil {
+			continue
+		}
+
+		if def.PopsOperand >= len(def.Operandwidths) {
+			t.Errorf("%s: PopsOperand %d out of range", def.Name, def.PopsOperand)
+		}
+
+		_, jump := JumpOperands[Opcode(op)]
+
+		if jump && len(def.Operandwidths) == 0 {
+			t.Errorf("%s: jump without a target operand", def.Name)
+		}
+	}
+}
+
+func TestMakeE(t *testing.T) {
+
+	ins, err := MakeE(OpConstant, 65534)
+
+	if err != nil || !bytes.Equal(ins, []byte{byte(OpConstant), 255, 254}) {
+		t.Errorf("wrong instruction. got=%v (err=%v)", ins, err)
+	}
+
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected string
+	}{
+		{Opcode(255), []int{}, "opcode 255 undefined"},
+		{OpConstant, []int{}, "OpConstant takes 1 operands, got 0"},
+		{OpPop, []int{1}, "OpPop takes 0 operands, got 1"},
+		{OpGetLocal, []int{256}, "operand 0 of OpGetLocal out of range: 256 (max 255)"},
+	}
+
+	for _, tt := range tests {
+
+		_, err := MakeE(tt.op, tt.operands...)
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+func TestReadOperandsChecked(t *testing.T) {
+
+	def, _ := Lookup(byte(OpClosure))
+
+	operands, read, err := ReadOperandsChecked(def, Instructions{0, 1, 2})
+
+	if err != nil || read != 3 || operands[0] != 1 || operands[1] != 2 {
+		t.Errorf("wrong operands. got=%v, %d (err=%v)", operands, read, err)
+	}
+
+	_, _, err = ReadOperandsChecked(def, Instructions{0, 1})
+
+	if err == nil || err.Error() != "OpClosure is truncated: want 3 operand bytes, got 2" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	// 途中で切れた命令列
+	truncated := Instructions(append(Make(OpPop), Make(OpConstant, 1)[:2]...))
+
+	if err := CheckInstructions(truncated); err == nil ||
+		err.Error() != "0001: OpConstant is truncated: want 2 operand bytes, got 1" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	if err := CheckInstructions(Instructions{byte(OpPop), 255}); err == nil ||
+		err.Error() != "0001: opcode 255 undefined" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	expected := "0000 OpPop\n0001 ERROR: OpConstant is truncated: want 2 operand bytes, got 1\n"
+
+	if truncated.String() != expected {
+		t.Errorf("wrong string.\nwant=%q\ngot=%q", expected, truncated.String())
+	}
+}
+
+func TestIterate(t *testing.T) {
+
+	ins := Instructions{}
+	for _, in := range []Instructions{
+		Make(OpConstant, 1),
+		Make(OpClosure, 2, 3),
+		Make(OpPop),
+	} {
+		ins = append(ins, in...)
+	}
+
+	var visited []string
+
+	err := ins.Iterate(func(offset int, op Opcode, operands []int) bool {
+		visited = append(visited, fmt.Sprintf("%d %d %v", offset, op, operands))
+		return true
+	})
+
+	expected := []string{
+		fmt.Sprintf("0 %d [1]", OpConstant),
+		fmt.Sprintf("3 %d [2 3]", OpClosure),
+		fmt.Sprintf("7 %d []", OpPop),
+	}
+
+	if err != nil || strings.Join(visited, ",") != strings.Join(expected, ",") {
+		t.Errorf("wrong instructions. want=%v, got=%v (err=%v)", expected, visited, err)
+	}
+
+	// falseを返すと止まる
+	count := 0
+
+	ins.Iterate(func(int, Opcode, []int) bool {
+		count++
+		return false
+	})
+
+	if count != 1 {
+		t.Errorf("iteration did not stop. count=%d", count)
+	}
+
+	err = ins[:5].Iterate(func(int, Opcode, []int) bool { return true })
+
+	decodeErr, ok := err.(*DecodeError)
+
+	if !ok || decodeErr.Offset != 3 {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func TestRelativeJumps(t *testing.T) {
+
+	ins := Instructions{}
+	for _, in := range []Instructions{
+		Make(OpTrue),             // 0000
+		Make(OpJumpNotTruthy, 8), // 0001
+		Make(OpNull),             // 0004
+		Make(OpJump, 0),          // 0005
+		Make(OpPop),              // 0008
+	} {
+		ins = append(ins, in...)
+	}
+
+	relative := RelativizeJumps(ins)
+
+	expected := "0000 OpTrue\n0001 OpJumpNotTruthyRel 4\n0004 OpNull\n0005 OpJumpRel -8\n0008 OpPop\n"
+
+	if relative.String() != expected {
+		t.Errorf("wrong instructions.\nwant=%q\ngot=%q", expected, relative.String())
+	}
+
+	if AbsoluteJumps(relative).String() != ins.String() {
+		t.Errorf("round trip changed the instructions. got=%q", AbsoluteJumps(relative).String())
+	}
+
+	// 前に命令を足しても、相対ジャンプはそのまま使える
+	moved := AbsoluteJumps(append(Make(OpNull), relative...))
+
+	if !strings.Contains(moved.String(), "0002 OpJumpNotTruthy 9\n") ||
+		!strings.Contains(moved.String(), "0006 OpJump 1\n") {
+		t.Errorf("wrong relocated instructions. got=%q", moved.String())
+	}
+
+	// 差が2バイトに収まらなければ絶対位置のまま
+	far := Make(OpJump, 40000)
+
+	if !bytes.Equal(RelativizeJumps(far), far) {
+		t.Errorf("far jump was relativized. got=%q", RelativizeJumps(far).String())
+	}
+}
+
+// 定義の表は全体で1つなので、テストを繰り返しても一度だけ登録する
+var opTestCustom, errTestCustom = RegisterOpcode("OpTestCustom", []int{1, 2}, 2, 1)
+
+func TestRegisterOpcode(t *testing.T) {
+
+	if errTestCustom != nil {
+		t.Fatalf("register error: %s", errTestCustom)
+	}
+
+	if !IsCustom(opTestCustom) {
+		t.Errorf("opcode %d is not in the custom range", opTestCustom)
+	}
+
+	ins := Instructions(Make(opTestCustom, 7, 300))
+
+	if ins.String() != "0000 OpTestCustom 7 300\n" {
+		t.Errorf("wrong string. got=%q", ins.String())
+	}
+
+	def, _ := Lookup(byte(opTestCustom))
+
+	if pops, pushes := def.StackEffect([]int{7, 300}); pops != 2 || pushes != 1 || def.Flow != FlowNext {
+		t.Errorf("wrong definition. got=%+v", def)
+	}
+
+	tests := []struct {
+		name     string
+		widths   []int
+		expected string
+	}{
+		{"OpAdd", []int{}, "opcode OpAdd already defined"},
+		{"OpTestCustom", []int{}, "opcode OpTestCustom already defined"},
+		{"OpOdd", []int{3}, "opcode OpOdd: unsupported operand width 3"},
+		{"", []int{}, "opcode name is empty"},
+	}
+
+	for _, tt := range tests {
+
+		_, err := RegisterOpcode(tt.name, tt.widths, 0, 0)
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+func TestSuperinstructionRules(t *testing.T) {
+
+	ins := Instructions{}
+	for _, in := range []Instructions{
+		Make(OpGetLocal, 0), // 0000
+		Make(OpConstant, 1), // 0002
+		Make(OpAdd),         // 0005
+		Make(OpGetLocal, 1), // 0006
+		Make(OpGetLocal, 2), // 0008
+		Make(OpCall, 1),     // 0010
+		Make(OpReturnValue), // 0012
+	} {
+		ins = append(ins, in...)
+	}
+
+	optimized, _ := Optimize(ins, SuperinstructionRules)
+
+	expected := "0000 OpGetLocal 0\n0002 OpAddConstant 1\n0005 OpGetLocal 1\n0007 OpCallLocal 2 1\n0010 OpReturnValue\n"
+
+	if optimized.String() != expected {
+		t.Errorf("wrong instructions.\nwant=%q\ngot=%q", expected, optimized.String())
+	}
+}
+
+// 命令ごとに定義を引く、VMの実行前の検査と命令列の解読
+func BenchmarkDecodeInstructions(b *testing.B) {
+
+	ins := Instructions{}
+	for i := 0; i < 1000; i++ {
+		ins = append(ins, Make(OpGetLocal, 0)...)
+		ins = append(ins, Make(OpConstant, i)...)
+		ins = append(ins, Make(OpAdd)...)
+		ins = append(ins, Make(OpCallLocal, 1, 1)...)
+		ins = append(ins, Make(OpPop)...)
+	}
+
+	b.Run("CheckInstructions", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := CheckInstructions(ins); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Iterate", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ins.Iterate(func(int, Opcode, []int) bool { return true })
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package code
+
+import "fmt"
+
+// 組み込む側のアプリケーションが独自の命令を追加するためのもの
+// 追加した命令の実行は vm.HandleOpcode で登録する
+//
+//	var OpClamp, _ = code.RegisterOpcode("OpClamp", []int{}, 3, 1)
+//
+// 定義の表は実行中に読むだけでロックしないので、init関数などプログラムの開始時に登録する
+
+// 独自の命令に割り当てるopcodeの範囲
+const (
+	FirstCustomOpcode Opcode = 200
+	LastCustomOpcode  Opcode = 254
+)
+
+// 次に割り当てるopcode
+var nextCustomOpcode = FirstCustomOpcode
+
+// 命令を定義し、割り当てたopcodeを返す
+// 命令はpops個の値をスタックから取り出してpushes個の値を積み、次の命令に進む
+func RegisterOpcode(name string, operandWidths []int, pops int, pushes int) (Opcode, error) {
+
+	if name == "" {
+		return 0, fmt.Errorf("opcode name is empty")
+	}
+
+	for _, def := range definitions {
+		if def != nil && def.Name == name {
+			return 0, fmt.Errorf("opcode %s already defined", name)
+		}
+	}
+
+	for _, w := range operandWidths {
+		if w != 1 && w != 2 && w != 4 {
+			return 0, fmt.Errorf("opcode %s: unsupported operand width %d", name, w)
+		}
+	}
+
+	if pops < 0 || pushes < 0 {
+		return 0, fmt.Errorf("opcode %s: negative stack effect", name)
+	}
+
+	if nextCustomOpcode > LastCustomOpcode {
+		return 0, fmt.Errorf("opcode %s: too many custom opcodes (max %d)",
+			name, LastCustomOpcode-FirstCustomOpcode+1)
+	}
+
+	op := nextCustomOpcode
+	nextCustomOpcode++
+
+	widths := make([]int, len(operandWidths))
+	copy(widths, operandWidths)
+
+	definitions[op] = &Definition{name, widths, pops, pushes, -1, FlowNext}
+
+	return op, nil
+}
+
+// RegisterOpcodeで追加した命令か
+func IsCustom(op Opcode) bool {
+	return op >= FirstCustomOpcode && op <= LastCustomOpcode
+}
@@ -0,0 +1,156 @@
+package code
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// コンパイルしたプログラムを保存する .mbc ファイルの入れ物
+//
+//	magic "MNKY", バージョン(1バイト)
+//	セクションの並び: 種類(1バイト)、長さ(uvarint)、中身
+//
+// 定数とトップレベルの命令のセクションは必須で、デバッグ情報は省略できる
+// 知らない種類のセクションは読み飛ばす(後から足したセクションを古い版でも読めるように)
+// セクションの中身の形式はコンパイラーが決める (compiler/encode.go)
+
+const FileMagic = "MNKY"
+
+// 形式を変えたら上げる
+const FileVersion = 2
+
+type Section byte
+
+const (
+	SectionConstants    Section = 1
+	SectionInstructions Section = 2
+	SectionDebug        Section = 3
+)
+
+type File struct {
+	Constants    []byte
+	Instructions Instructions
+	// nilなら書き出さない
+	Debug []byte
+}
+
+var ErrNotBytecode = errors.New("not a monkey bytecode file")
+
+func (f *File) Encode(w io.Writer) error {
+
+	bw := bufio.NewWriter(w)
+
+	bw.WriteString(FileMagic)
+	bw.WriteByte(FileVersion)
+
+	writeSection(bw, SectionConstants, f.Constants)
+	writeSection(bw, SectionInstructions, f.Instructions)
+
+	if f.Debug != nil {
+		writeSection(bw, SectionDebug, f.Debug)
+	}
+
+	return bw.Flush()
+}
+
+func writeSection(w *bufio.Writer, s Section, data []byte) {
+
+	var buf [binary.MaxVarintLen64]byte
+
+	w.WriteByte(byte(s))
+	w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(data)))])
+	w.Write(data)
+}
+
+// Encodeで書き出したものを読み込む
+// 違うバージョンの形式は読み込まない
+func DecodeFile(r io.Reader) (*File, error) {
+
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(FileMagic))
+
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != FileMagic {
+		return nil, ErrNotBytecode
+	}
+
+	version, err := br.ReadByte()
+
+	if err != nil {
+		return nil, ErrNotBytecode
+	}
+
+	if version != FileVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d (want %d)", version, FileVersion)
+	}
+
+	sections := map[Section][]byte{}
+
+	for {
+
+		kind, err := br.ReadByte()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("truncated or corrupt bytecode: %s", err)
+		}
+
+		data, err := readSection(br)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := sections[Section(kind)]; ok {
+			return nil, fmt.Errorf("duplicate section %d", kind)
+		}
+
+		sections[Section(kind)] = data
+	}
+
+	for _, s := range []Section{SectionConstants, SectionInstructions} {
+		if _, ok := sections[s]; !ok {
+			return nil, fmt.Errorf("missing section %d", s)
+		}
+	}
+
+	return &File{
+		Constants:    sections[SectionConstants],
+		Instructions: sections[SectionInstructions],
+		Debug:        sections[SectionDebug],
+	}, nil
+}
+
+// 長さが壊れていても大きな領域を先に確保しないように、読めた分だけ使う
+func readSection(r *bufio.Reader) ([]byte, error) {
+
+	n, err := binary.ReadUvarint(r)
+
+	if err == nil && n > math.MaxInt32 {
+		err = fmt.Errorf("length out of range: %d", n)
+	}
+
+	var buf bytes.Buffer
+
+	if err == nil {
+		_, err = io.CopyN(&buf, r, int64(n))
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("truncated or corrupt bytecode: %s", err)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,42 @@
+package code
+
+import "fmt"
+
+// 命令列を解読できなかった位置と理由
+type DecodeError struct {
+	Offset int
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%04d: %s", e.Offset, e.Err)
+}
+
+// 命令列を先頭から1つずつ解読してfnに渡す。fnがfalseを返したらそこで止める
+// 未定義のopcodeや途中で切れた命令があれば *DecodeError を返す
+// (それより前の命令はfnに渡してある)
+func (ins Instructions) Iterate(fn func(offset int, op Opcode, operands []int) bool) error {
+
+	for i := 0; i < len(ins); {
+
+		def, err := Lookup(ins[i])
+
+		if err != nil {
+			return &DecodeError{Offset: i, Err: err}
+		}
+
+		operands, read, err := ReadOperandsChecked(def, ins[i+1:])
+
+		if err != nil {
+			return &DecodeError{Offset: i, Err: err}
+		}
+
+		if !fn(i, Opcode(ins[i]), operands) {
+			return nil
+		}
+
+		i += 1 + read
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package code
+
+import "sort"
+
+// 命令の位置とソースコードの行の対応表(実行時エラーの位置の表示用)
+// Offsetの順に並んでいて、各行は次のエントリーのOffsetの手前まで続く
+type LineEntry struct {
+	Offset int
+	Line   int
+}
+
+type LineTable []LineEntry
+
+// offsetの命令が生成されたソースコードの行を返す。分からなければ0
+func (lt LineTable) Line(offset int) int {
+
+	// offsetより後ろにある最初のエントリーの1つ前
+	i := sort.Search(len(lt), func(i int) bool { return lt[i].Offset > offset })
+
+	if i == 0 {
+		return 0
+	}
+
+	return lt[i-1].Line
+}
+
+// Optimizeで命令が移動した後の対応表を作る
+func (lt LineTable) Remap(moved map[int]int) LineTable {
+
+	remapped := LineTable{}
+
+	for _, e := range lt {
+
+		offset, ok := moved[e.Offset]
+
+		if !ok {
+			continue
+		}
+
+		// 消えた命令の行は、その位置に移ってきた命令の行で上書きする
+		if n := len(remapped); n > 0 && remapped[n-1].Offset == offset {
+			remapped = remapped[:n-1]
+		}
+
+		remapped = append(remapped, LineEntry{Offset: offset, Line: e.Line})
+	}
+
+	return remapped
+}
@@ -0,0 +1,268 @@
+package code
+
+// のぞき穴最適化
+// コンパイル後の命令列を先頭から見ていき、規則に一致した短い命令列を置き換える
+// 置き換えで命令の位置がずれるので、最後にジャンプ先を付け直す
+
+// 解読した1つの命令
+type Instruction struct {
+	Op       Opcode
+	Operands []int
+	// 元の命令列での位置
+	Offset int
+}
+
+func (ins Instruction) width() int {
+
+	w := 1
+
+	for _, ow := range definitions[ins.Op].Operandwidths {
+		w += ow
+	}
+
+	return w
+}
+
+// オペランドにジャンプ先の絶対位置を持つ命令と、そのオペランドの番号
+// 定義のFlowから作る。相対ジャンプは命令が移動してもそのままなので含めない
+var JumpOperands = jumpOperands()
+
+func jumpOperands() map[Opcode]int {
+
+	jumps := map[Opcode]int{}
+
+	for op, def := range definitions {
+
+		if def == nil {
+			continue
+		}
+
+		if _, relative := relativeJumps[Opcode(op)]; relative {
+			continue
+		}
+
+		if def.Flow == FlowJump || def.Flow == FlowBranch || def.Flow == FlowHandler {
+			jumps[Opcode(op)] = 0
+		}
+	}
+
+	return jumps
+}
+
+// 置き換えの規則
+// ins[i]から始まる命令列に一致すれば、置き換える命令の数と置き換え後の命令を返す
+// 一致しなければ0を返す
+// 置き換え後の命令のジャンプ先は元の命令列での位置で書く
+// 繰り返し適用するので、規則は命令列を短くするものにする
+type PeepholeRule struct {
+	Name  string
+	Apply func(ins []Instruction, i int) (int, []Instruction)
+}
+
+// 常に使える規則
+var PeepholeRules = []PeepholeRule{
+	{"constant-bang", constantBang},
+	{"jump-to-next", jumpToNext},
+}
+
+// 値を積んですぐ捨てる命令の組を消す
+// 最後にポップした値を結果として使うトップレベルには使えない
+var DiscardRule = PeepholeRule{"push-pop", pushPop}
+
+// OpTrue;OpBang -> OpFalse など
+func constantBang(ins []Instruction, i int) (int, []Instruction) {
+
+	if i+1 >= len(ins) || ins[i+1].Op != OpBang {
+		return 0, nil
+	}
+
+	switch ins[i].Op {
+	case OpTrue:
+		return 2, []Instruction{{Op: OpFalse}}
+	case OpFalse, OpNull:
+		return 2, []Instruction{{Op: OpTrue}}
+	}
+
+	return 0, nil
+}
+
+// 直後の命令へのジャンプは何もしないのと同じ
+func jumpToNext(ins []Instruction, i int) (int, []Instruction) {
+
+	if ins[i].Op == OpJump && ins[i].Operands[0] == ins[i].Offset+ins[i].width() {
+		return 1, []Instruction{}
+	}
+
+	return 0, nil
+}
+
+// 副作用なく値を積むだけの命令
+var pureLoads = map[Opcode]bool{
+	OpConstant:       true,
+	OpTrue:           true,
+	OpFalse:          true,
+	OpNull:           true,
+	OpGetGlobal:      true,
+	OpGetLocal:       true,
+	OpGetFree:        true,
+	OpGetBuiltin:     true,
+	OpCurrentClosure: true,
+	OpFunction:       true,
+}
+
+func pushPop(ins []Instruction, i int) (int, []Instruction) {
+
+	if pureLoads[ins[i].Op] && i+1 < len(ins) && ins[i+1].Op == OpPop {
+		return 2, []Instruction{}
+	}
+
+	return 0, nil
+}
+
+// 命令列を解読する
+func Decode(ins Instructions) []Instruction {
+
+	decoded := []Instruction{}
+
+	err := ins.Iterate(func(offset int, op Opcode, operands []int) bool {
+		decoded = append(decoded, Instruction{Op: op, Operands: operands, Offset: offset})
+		return true
+	})
+
+	if err != nil {
+		return nil
+	}
+
+	return decoded
+}
+
+// 規則をどれも適用できなくなるまで最適化する
+// 解読できない命令列はそのまま返す
+// 元の命令の位置から新しい位置への対応も返す(LineTable.Remap用)
+func Optimize(ins Instructions, rules []PeepholeRule) (Instructions, map[int]int) {
+
+	moved := map[int]int{len(ins): len(ins)}
+
+	for _, in := range Decode(ins) {
+		moved[in.Offset] = in.Offset
+	}
+
+	for {
+
+		optimized, pass, changed := optimizePass(ins, rules)
+
+		if !changed {
+			return ins, moved
+		}
+
+		for from, to := range moved {
+			moved[from] = pass[to]
+		}
+
+		ins = optimized
+	}
+}
+
+func optimizePass(ins Instructions, rules []PeepholeRule) (Instructions, map[int]int, bool) {
+
+	decoded := Decode(ins)
+
+	if decoded == nil {
+		return ins, nil, false
+	}
+
+	// ジャンプ先になっている命令は、一致した命令列の途中に含めない
+	targets := map[int]bool{}
+
+	for _, in := range decoded {
+
+		if idx, ok := JumpOperands[in.Op]; ok {
+			targets[in.Operands[idx]] = true
+		}
+	}
+
+	// 元の位置 -> 新しい位置
+	moved := map[int]int{}
+	out := Instructions{}
+	changed := false
+
+	// ジャンプ先を付け直す命令の、新しい命令列での位置
+	jumps := []int{}
+
+	emit := func(in Instruction) {
+
+		if _, ok := JumpOperands[in.Op]; ok {
+			jumps = append(jumps, len(out))
+		}
+
+		out = append(out, Make(in.Op, in.Operands...)...)
+	}
+
+	for i := 0; i < len(decoded); {
+
+		n, replacement := matchRule(decoded, i, rules, targets)
+
+		if n == 0 {
+			moved[decoded[i].Offset] = len(out)
+			emit(decoded[i])
+			i++
+			continue
+		}
+
+		for _, in := range decoded[i : i+n] {
+			moved[in.Offset] = len(out)
+		}
+
+		for _, in := range replacement {
+			emit(in)
+		}
+
+		i += n
+		changed = true
+	}
+
+	moved[len(ins)] = len(out)
+
+	for _, pos := range jumps {
+
+		def := definitions[Opcode(out[pos])]
+		operands, _ := ReadOperands(def, out[pos+1:])
+		idx := JumpOperands[Opcode(out[pos])]
+		operands[idx] = moved[operands[idx]]
+
+		copy(out[pos:], Make(Opcode(out[pos]), operands...))
+	}
+
+	return out, moved, changed
+}
+
+func matchRule(
+	decoded []Instruction,
+	i int,
+	rules []PeepholeRule,
+	targets map[int]bool,
+) (int, []Instruction) {
+
+	for _, rule := range rules {
+
+		n, replacement := rule.Apply(decoded, i)
+
+		if n == 0 {
+			continue
+		}
+
+		inside := false
+
+		for _, in := range decoded[i+1 : i+n] {
+			if targets[in.Offset] {
+				inside = true
+			}
+		}
+
+		if !inside {
+			return n, replacement
+		}
+	}
+
+	return 0, nil
+}
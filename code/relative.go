@@ -0,0 +1,87 @@
+package code
+
+import "math"
+
+// 相対ジャンプ
+// ジャンプ先を、ジャンプ命令の次の命令からの符号付きの差(2バイト)で持つ
+// 命令列をそのまま別の位置に移したりつなげたりしても、ジャンプ先を直さなくてよい
+//
+// コンパイラーは後からジャンプ先を埋めるので絶対位置のジャンプで命令を組み立て、
+// 最適化の後でRelativizeJumpsで変換する
+
+// 絶対位置のジャンプ命令と、対応する相対ジャンプの命令
+var RelativeJumps = map[Opcode]Opcode{
+	OpJump:          OpJumpRel,
+	OpJumpNotTruthy: OpJumpNotTruthyRel,
+}
+
+var relativeJumps = map[Opcode]Opcode{
+	OpJumpRel:          OpJump,
+	OpJumpNotTruthyRel: OpJumpNotTruthy,
+}
+
+// 相対ジャンプの命令の長さ(オペランドは2バイト)
+const relativeJumpWidth = 3
+
+// 符号付きの差を、オペランドとして埋め込める値にする
+func RelativeOperand(delta int) int {
+	return int(uint16(int16(delta)))
+}
+
+// offsetにあるジャンプ命令のジャンプ先の絶対位置
+func JumpTarget(offset int, op Opcode, operands []int) int {
+
+	if _, ok := relativeJumps[op]; ok {
+		return offset + relativeJumpWidth + int(int16(uint16(operands[0])))
+	}
+
+	return operands[0]
+}
+
+// 差が2バイトに収まるジャンプを相対ジャンプにする
+// 命令の長さは変わらないので、行の対応表はそのまま使える
+func RelativizeJumps(ins Instructions) Instructions {
+	return replaceJumps(ins, RelativeJumps)
+}
+
+// 相対ジャンプを絶対位置のジャンプに戻す
+// (ジャンプ先を読みやすくして比べるテストや表示用)
+func AbsoluteJumps(ins Instructions) Instructions {
+	return replaceJumps(ins, relativeJumps)
+}
+
+func replaceJumps(ins Instructions, replacements map[Opcode]Opcode) Instructions {
+
+	out := make(Instructions, len(ins))
+	copy(out, ins)
+
+	ins.Iterate(func(offset int, op Opcode, operands []int) bool {
+
+		replacement, ok := replacements[op]
+
+		if !ok {
+			return true
+		}
+
+		target := JumpTarget(offset, op, operands)
+
+		operand := target
+
+		if _, relative := relativeJumps[replacement]; relative {
+
+			delta := target - (offset + relativeJumpWidth)
+
+			if delta < math.MinInt16 || delta > math.MaxInt16 {
+				return true
+			}
+
+			operand = RelativeOperand(delta)
+		}
+
+		copy(out[offset:], Make(replacement, operand))
+
+		return true
+	})
+
+	return out
+}
@@ -0,0 +1,30 @@
+package code
+
+// スーパー命令
+// よく続けて現れる命令の組を1つの命令にまとめ、VMの命令の読み出しと分岐を減らす
+// のぞき穴最適化の規則として適用する。どれも命令列を短くする
+//
+//	OpConstant c; OpAdd       -> OpAddConstant c     (x + 1 など)
+//	OpGetLocal l; OpCall n    -> OpCallLocal l n     (f(x) など)
+var SuperinstructionRules = []PeepholeRule{
+	{"constant-add", constantAdd},
+	{"local-call", localCall},
+}
+
+func constantAdd(ins []Instruction, i int) (int, []Instruction) {
+
+	if ins[i].Op == OpConstant && i+1 < len(ins) && ins[i+1].Op == OpAdd {
+		return 2, []Instruction{{Op: OpAddConstant, Operands: ins[i].Operands}}
+	}
+
+	return 0, nil
+}
+
+func localCall(ins []Instruction, i int) (int, []Instruction) {
+
+	if ins[i].Op == OpGetLocal && i+1 < len(ins) && ins[i+1].Op == OpCall {
+		return 2, []Instruction{{Op: OpCallLocal, Operands: []int{ins[i].Operands[0], ins[i+1].Operands[0]}}}
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,62 @@
+package code
+
+// ジャンプ先は2バイトなので、64KBを超える関数の中では収まらないことがある
+// その関数のジャンプ命令をすべて4バイトのジャンプ先を持つ命令に変える
+
+// 2バイトのジャンプ命令と、対応する4バイトの命令
+var WideJumps = map[Opcode]Opcode{
+	OpJump:          OpJumpWide,
+	OpJumpNotTruthy: OpJumpNotTruthyWide,
+	OpIterNext:      OpIterNextWide,
+}
+
+// 2バイトのジャンプ先に収まる最大の位置
+const MaxJumpTarget = 1<<16 - 1
+
+// farは2バイトに収まらなかったジャンプ命令の位置と、本当のジャンプ先
+// (収まらなかった命令のオペランドは使わない)
+// 元の命令の位置から新しい位置への対応も返す(LineTable.Remap用)
+func WidenJumps(ins Instructions, far map[int]int) (Instructions, map[int]int) {
+
+	decoded := Decode(ins)
+
+	moved := map[int]int{}
+	out := Instructions{}
+
+	for _, in := range decoded {
+
+		moved[in.Offset] = len(out)
+
+		if wide, ok := WideJumps[in.Op]; ok {
+			in.Op = wide
+		}
+
+		out = append(out, Make(in.Op, in.Operands...)...)
+	}
+
+	moved[len(ins)] = len(out)
+
+	for _, in := range decoded {
+
+		wide, ok := WideJumps[in.Op]
+
+		// 初めから4バイトのジャンプ先を持つ命令(OpTry)は、位置だけ付け直す
+		if !ok {
+			if idx, ok := JumpOperands[in.Op]; ok {
+				in.Operands[idx] = moved[in.Operands[idx]]
+				copy(out[moved[in.Offset]:], Make(in.Op, in.Operands...))
+			}
+			continue
+		}
+
+		target := in.Operands[0]
+
+		if t, ok := far[in.Offset]; ok {
+			target = t
+		}
+
+		copy(out[moved[in.Offset]:], Make(wide, moved[target]))
+	}
+
+	return out, moved
+}
@@ -2,7 +2,6 @@ package compiler
 
 import (
 	"fmt"
-	"log"
 	"sort"
 
 	"example.com/monkey/ast"
@@ -19,6 +18,37 @@ type Compiler struct {
 
 	scopes     []CompilationScope
 	scopeIndex int
+
+	// EnableExplainされている場合のみ記録する
+	explanation *Explanation
+
+	// 最適化とデバッグ情報の出力 (options.go)
+	options Options
+
+	// オペランドの幅に収まらない命令を出力しようとしたときの最初のエラー
+	// (定数や変数、引数が多すぎる場合)
+	operandErr error
+
+	// letで定義した変数 (warnings.go)
+	bindings []binding
+	// 捕捉された変数への代入の警告 (warnings.go)
+	captureWarnings []string
+
+	// importの解決 (modules.go)
+	resolver ModuleResolver
+	// コンパイルしたモジュールの関数の定数のインデックス
+	modules map[string]int
+	// コンパイル中のモジュール。循環したimportを見つけるのに使う
+	importing []string
+
+	// 展開できる関数 (inline.go)
+	inlines map[inlineKey]*ast.FunctionLiteral
+	// 代入されている名前。その名前の関数は展開しない
+	assigned map[string]bool
+
+	// コンパイルの途中経過を受け取る関数 (trace.go)
+	trace      TraceFunc
+	traceDepth int
 }
 
 type EmittedInstruction struct {
@@ -32,6 +62,7 @@ func New() *Compiler {
 		instructions:        code.Instructions{},
 		lastInstruction:     EmittedInstruction{},
 		previousInstruction: EmittedInstruction{},
+		name:                "main",
 	}
 
 	symbolTable := NewSymbolTable()
@@ -46,6 +77,7 @@ func New() *Compiler {
 		symbolTable: symbolTable,
 		scopes:      []CompilationScope{mainScope},
 		scopeIndex:  0,
+		options:     DefaultOptions(),
 	}
 }
 
@@ -54,6 +86,7 @@ func (c *Compiler) loadSymbol(s Symbol) {
 	switch s.Scope {
 
 	case GlobalScope:
+		c.checkGlobalLimit(s)
 		c.emit(code.OpGetGlobal, s.Index)
 
 	case LocalScope:
@@ -70,6 +103,23 @@ func (c *Compiler) loadSymbol(s Symbol) {
 	}
 }
 
+// スタックの先頭要素をポップしてシンボルに保存する
+func (c *Compiler) storeSymbol(s Symbol) {
+
+	switch s.Scope {
+
+	case GlobalScope:
+		c.checkGlobalLimit(s)
+		c.emit(code.OpSetGlobal, s.Index)
+
+	case FreeScope:
+		c.emit(code.OpSetFree, s.Index)
+
+	default:
+		c.emit(code.OpSetLocal, s.Index)
+	}
+}
+
 func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 
 	compiler := New()
@@ -80,9 +130,14 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 
 func (c *Compiler) Bytecode() *Bytecode {
 
+	instructions, lines := c.widen(c.currentInstructions(), c.scopes[c.scopeIndex].lines)
+	instructions, lines = c.optimize(instructions, lines, false)
+	instructions = code.RelativizeJumps(instructions)
+
 	return &Bytecode{
-		Instructions: c.currentInstructions(),
+		Instructions: instructions,
 		Constants:    c.constants,
+		Lines:        lines,
 	}
 }
 
@@ -93,14 +148,37 @@ type Bytecode struct {
 	Instructions code.Instructions
 	// constant pool
 	Constants []object.Object
+	// トップレベルの命令とソースコードの行の対応
+	Lines code.LineTable
 }
 
 func (c *Compiler) Compile(node ast.Node) error {
 
+	if line := sourceLine(node); line > 0 {
+		defer c.setLine(line)()
+	}
+
+	if c.trace != nil {
+		c.traceEnter(node)
+		defer c.traceLeave(node)
+	}
+
+	if c.explanation != nil {
+
+		if line := statementLine(node); line > 0 {
+
+			start := len(c.currentInstructions())
+			function := c.scopes[c.scopeIndex].name
+
+			defer c.explainRange(line, function, start)
+		}
+	}
+
 	switch node := node.(type) {
 
 	case *ast.Program:
-		log.Println("program...")
+		c.scanAssignments(node)
+
 		for _, s := range node.Statements {
 			err := c.Compile(s)
 			if err != nil {
@@ -108,18 +186,28 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 		}
 
+		if c.operandErr != nil {
+			return c.operandErr
+		}
+
 	case *ast.FunctionLiteral:
 
 		c.enterScope()
 
+		c.scopes[c.scopeIndex].name = functionName(node)
+
 		if node.Name != "" {
 
-			c.symbolTable.DefineFunctionName(node.Name)
+			symbol := c.symbolTable.DefineFunctionName(node.Name)
+
+			c.explainSymbol(node.Token.Line, "define", symbol)
 		}
 
 		for _, p := range node.Parameters {
 
-			c.symbolTable.Define(p.Value)
+			symbol := c.symbolTable.Define(p.Value)
+
+			c.explainSymbol(p.Token.Line, "define", symbol)
 		}
 
 		err := c.Compile(node.Body)
@@ -138,12 +226,20 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		freeSymbols := c.symbolTable.FreeSymbols
 
-		numLocals := c.symbolTable.numDefinitions
+		numLocals := c.symbolTable.NumDefinitions()
+
+		if err := checkFunctionLimits(node, numLocals, len(freeSymbols)); err != nil {
+			return err
+		}
+
+		generator := c.scopes[c.scopeIndex].generator
 
-		instructions := c.leaveScope()
+		instructions, lines := c.leaveScope()
 
 		for _, s := range freeSymbols {
 
+			c.explainSymbol(node.Token.Line, "capture", s)
+
 			c.loadSymbol(s)
 		}
 
@@ -151,10 +247,23 @@ func (c *Compiler) Compile(node ast.Node) error {
 			Instructions:  instructions,
 			NumLocals:     numLocals,
 			NumParameters: len(node.Parameters),
+			Generator:     generator,
+			Name:          node.Name,
+			Lines:         lines,
+		}
+
+		if !c.options.EmitDebugInfo {
+			compiledFn.Name = ""
 		}
 
 		fnIndex := c.addConstant(compiledFn)
 
+		// 何もキャプチャしていない関数はクロージャを作る必要がない
+		if len(freeSymbols) == 0 {
+			c.emit(code.OpFunction, fnIndex)
+			return nil
+		}
+
 		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
 
 	case *ast.ReturnStatement:
@@ -168,8 +277,6 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpReturnValue)
 
 	case *ast.IfExpression:
-		log.Println("if expression...")
-		log.Println("condition...")
 		err := c.Compile(node.Condition)
 
 		if err != nil {
@@ -179,9 +286,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		// Emit an `OpJumpNotTruthy` with a bogus value
 		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
 
-		log.Println("consequence...start")
 		err = c.Compile(node.Consequence)
-		log.Println("consequence...end")
 
 		if err != nil {
 			return err
@@ -192,9 +297,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 		// そうしないとConsequenceの最後の値がポップされ、
 		// if文の値として取得できなくなる
 		// ちなみに、ExpressionStatementでのみ、最後にOpPopを追加している
-		if c.lastInstructionIs(code.OpPop) {
-			log.Println("last instruction is pop, it's removed")
+		// 最後が式文でなければ(letなど)、値はnullにする
+		if blockHasValue(node.Consequence) {
 			c.removeLastPop()
+		} else {
+			c.emit(code.OpNull)
 		}
 
 		// Emit an `OpJump` with a bogus value
@@ -217,8 +324,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 
 			// 最後がOpPopの場合、それを削除する（スタックに残しておく）
-			if c.lastInstructionIs(code.OpPop) {
+			if blockHasValue(node.Alternative) {
 				c.removeLastPop()
+			} else {
+				c.emit(code.OpNull)
 			}
 		}
 
@@ -227,7 +336,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.changeOperand(jumpPos, afterAlternativePos)
 
 	case *ast.BlockStatement:
-		log.Println("block start...")
+		c.enterBlock()
+		defer c.leaveBlock()
+
 		for _, s := range node.Statements {
 
 			err := c.Compile(s)
@@ -236,35 +347,169 @@ func (c *Compiler) Compile(node ast.Node) error {
 				return err
 			}
 		}
-		log.Println("block end")
 
 	case *ast.ExpressionStatement:
-		log.Printf("ExpressionStatement start %s\n", node.String())
 		err := c.Compile(node.Expression)
 		if err != nil {
 			return err
 		}
-		log.Printf("before OpPop %s\n", node.String())
 		// 文の実行が終わったあと、スタックから先頭要素をポップするため
 		c.emit(code.OpPop)
-		log.Printf("ExpressionStatement end %s\n", node.String())
 
 	case *ast.LetStatement:
 
+		if c.symbolTable.isConstant(node.Name.Value) {
+			return fmt.Errorf("cannot reassign constant %s", node.Name.Value)
+		}
+
 		symbol := c.symbolTable.Define(node.Name.Value)
 
+		c.explainSymbol(node.Name.Token.Line, "define", symbol)
+
+		c.bind(node, symbol)
+
 		err := c.Compile(node.Value)
 
 		if err != nil {
 			return err
 		}
 
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
+		c.storeSymbol(symbol)
+
+		c.recordInline(node, symbol)
+
+	case *ast.ConstStatement:
+
+		if c.symbolTable.isConstant(node.Name.Value) {
+			return fmt.Errorf("cannot reassign constant %s", node.Name.Value)
+		}
+
+		symbol := c.symbolTable.DefineConstant(node.Name.Value)
+
+		c.explainSymbol(node.Name.Token.Line, "define", symbol)
+
+		err := c.Compile(node.Value)
+
+		if err != nil {
+			return err
+		}
+
+		c.storeSymbol(symbol)
+
+	case *ast.ForInExpression:
+
+		if c.symbolTable.isConstant(node.Variable.Value) {
+			return fmt.Errorf("cannot reassign constant %s", node.Variable.Value)
+		}
+
+		err := c.Compile(node.Iterable)
+
+		if err != nil {
+			return err
+		}
+
+		// イテレーターはループの間スタック上に置かれたままになる
+		c.emit(code.OpIterNew)
+
+		// ループ変数はループの外からは見えない
+		c.enterBlock()
+		defer c.leaveBlock()
+
+		loopStartPos := len(c.currentInstructions())
+
+		// Emit an `OpIterNext` with a bogus value
+		iterNextPos := c.emit(code.OpIterNext, 9999)
+
+		c.enterLoop(loopStartPos, true)
+
+		// 取り出された要素をループ変数に保存する
+		symbol := c.symbolTable.Define(node.Variable.Value)
+
+		c.explainSymbol(node.Variable.Token.Line, "define", symbol)
+
+		c.storeSymbol(symbol)
+
+		err = c.Compile(node.Body)
+
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpJump, loopStartPos)
+
+		afterLoopPos := len(c.currentInstructions())
+
+		c.changeOperand(iterNextPos, afterLoopPos)
+
+		c.leaveLoop(afterLoopPos)
+
+		// for式の値はnull
+		c.emit(code.OpNull)
+
+	case *ast.AssignExpression:
+
+		symbol, ok := c.symbolTable.resolve(node.Name.Value, false)
+
+		if !ok {
+			return fmt.Errorf("undefined variable %s", node.Name.Value)
+		}
+
+		switch {
+		case symbol.Constant:
+			return fmt.Errorf("cannot reassign constant %s", node.Name.Value)
+		case symbol.Scope == BuiltinScope:
+			return fmt.Errorf("cannot assign to builtin %s", node.Name.Value)
+		case symbol.Scope == FunctionScope:
+			return fmt.Errorf("cannot assign to function %s", node.Name.Value)
+		}
+
+		err := c.Compile(node.Value)
+
+		if err != nil {
+			return err
+		}
+
+		c.explainSymbol(node.Token.Line, "assign", symbol)
+		c.checkCapturedAssignment(node, symbol)
+
+		c.storeSymbol(symbol)
+
+		// 代入式の値として、代入した値を積み直す
+		c.loadSymbol(symbol)
+
+	case *ast.WhileExpression:
+
+		loopStartPos := len(c.currentInstructions())
+
+		err := c.Compile(node.Condition)
+
+		if err != nil {
+			return err
 		}
 
+		// Emit an `OpJumpNotTruthy` with a bogus value
+		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		c.enterLoop(loopStartPos, false)
+
+		err = c.Compile(node.Body)
+
+		if err != nil {
+			return err
+		}
+
+		// 条件の評価に戻る
+		c.emit(code.OpJump, loopStartPos)
+
+		afterLoopPos := len(c.currentInstructions())
+
+		c.changeOperand(jumpNotTruthyPos, afterLoopPos)
+
+		c.leaveLoop(afterLoopPos)
+
+		// while式の値もnull
+		c.emit(code.OpNull)
+
 	case *ast.Identifier:
 
 		symbol, ok := c.symbolTable.Resolve(node.Value)
@@ -273,10 +518,23 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return fmt.Errorf("undefined variable %s", node.Value)
 		}
 
+		c.explainSymbol(node.Token.Line, "resolve", symbol)
+
 		c.loadSymbol(symbol)
 
 	case *ast.CallExpression:
 
+		// quote/unquoteはマクロ展開の中でしか使えない
+		switch node.Function.TokenLiteral() {
+		case "quote", "unquote":
+			return fmt.Errorf("%s can only be used inside a macro",
+				node.Function.TokenLiteral())
+		}
+
+		if inlined, err := c.compileInline(node); inlined {
+			return err
+		}
+
 		err := c.Compile(node.Function)
 
 		if err != nil {
@@ -292,10 +550,19 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 		}
 
+		if err := checkCallLimits(node); err != nil {
+			return err
+		}
+
 		c.emit(code.OpCall, len(node.Arguments))
 
 	case *ast.PrefixExpression:
 
+		if obj, ok := c.fold(node); ok {
+			c.emitFolded(obj)
+			return nil
+		}
+
 		err := c.Compile(node.Right)
 
 		if err != nil {
@@ -316,7 +583,16 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 	case *ast.InfixExpression:
 
-		if node.Operator == "<" {
+		if obj, ok := c.fold(node); ok {
+			c.emitFolded(obj)
+			return nil
+		}
+
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogical(node)
+		}
+
+		if node.Operator == "<" || node.Operator == "<=" {
 
 			// less than は greater thanを使用するため、
 			// 右辺からスタックに積んでいる
@@ -331,7 +607,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 				return err
 			}
 
-			c.emit(code.OpGreaterThan)
+			if node.Operator == "<" {
+				c.emit(code.OpGreaterThan)
+			} else {
+				c.emit(code.OpGreaterEqual)
+			}
 
 			return nil
 		}
@@ -362,9 +642,15 @@ func (c *Compiler) Compile(node ast.Node) error {
 		case "/":
 			c.emit(code.OpDiv)
 
+		case "%":
+			c.emit(code.OpMod)
+
 		case ">":
 			c.emit(code.OpGreaterThan)
 
+		case ">=":
+			c.emit(code.OpGreaterEqual)
+
 		case "==":
 			c.emit(code.OpEqual)
 
@@ -391,6 +677,79 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpIndex)
 
+	case *ast.SliceExpression:
+
+		err := c.Compile(node.Left)
+
+		if err != nil {
+			return err
+		}
+
+		// 省略された範囲はnullとしてスタックに積む
+		for _, bound := range []ast.Expression{node.Low, node.High} {
+
+			if bound == nil {
+				c.emit(code.OpNull)
+				continue
+			}
+
+			err := c.Compile(bound)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpSlice)
+
+	case *ast.MacroLiteral:
+		// マクロはコンパイル前に展開されるので、ここに来るのはトップレベルのletで定義されていないもの
+		return fmt.Errorf("macro literal must be bound with a top-level let statement")
+
+	case *ast.TryExpression:
+
+		return c.compileTry(node)
+
+	case *ast.SpawnExpression:
+
+		if c.options.DisallowSpawn {
+			return fmt.Errorf("spawn is not allowed")
+		}
+
+		err := c.Compile(node.Function)
+
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpSpawn)
+
+	case *ast.YieldExpression:
+
+		return c.compileYield(node)
+
+	case *ast.ThrowStatement:
+
+		err := c.Compile(node.Value)
+
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpThrow)
+
+	case *ast.BreakStatement:
+
+		return c.compileBreak()
+
+	case *ast.ContinueStatement:
+
+		return c.compileContinue()
+
+	case *ast.ImportExpression:
+
+		return c.compileImport(node)
+
 	case *ast.IntegerLiteral:
 
 		integer := &object.Integer{Value: node.Value}
@@ -399,6 +758,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpConstant, index)
 
+	case *ast.FloatLiteral:
+
+		index := c.addConstant(&object.Float{Value: node.Value})
+
+		c.emit(code.OpConstant, index)
+
 	case *ast.StringLiteral:
 
 		str := &object.String{Value: node.Value}
@@ -407,8 +772,39 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpConstant, index)
 
+	case *ast.InterpolatedString:
+
+		// 文字列の連結に変換する
+		// "a${x}b" -> "a" + string(x) + "b"
+		if len(node.Parts) == 0 {
+			index := c.addConstant(&object.String{Value: ""})
+			c.emit(code.OpConstant, index)
+			return nil
+		}
+
+		for i, part := range node.Parts {
+
+			err := c.Compile(part)
+
+			if err != nil {
+				return err
+			}
+
+			if _, ok := part.(*ast.StringLiteral); !ok {
+				c.emit(code.OpToString)
+			}
+
+			if i > 0 {
+				c.emit(code.OpAdd)
+			}
+		}
+
 	case *ast.ArrayLiteral:
 
+		if err := checkLiteralLimits(node); err != nil {
+			return err
+		}
+
 		for _, el := range node.Elements {
 
 			err := c.Compile(el)
@@ -422,6 +818,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 	case *ast.HashLiteral:
 
+		if err := checkLiteralLimits(node); err != nil {
+			return err
+		}
+
 		keys := []ast.Expression{}
 
 		for k := range node.Pairs {
@@ -464,6 +864,26 @@ func (c *Compiler) Compile(node ast.Node) error {
 		} else {
 			c.emit(code.OpFalse)
 		}
+
+	case *ast.RangeExpression:
+
+		err := c.Compile(node.Start)
+
+		if err != nil {
+			return err
+		}
+
+		err = c.Compile(node.End)
+
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpRange)
+
+	case *ast.NullLiteral:
+
+		c.emit(code.OpNull)
 	}
 
 	return nil
@@ -478,15 +898,42 @@ func (c *Compiler) addConstant(obj object.Object) int {
 // バイトコードインストラクションを生成して追加する
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 
-	ins := code.Make(op, operands...)
+	if _, ok := code.WideJumps[op]; ok && operands[0] > code.MaxJumpTarget {
+		operands = []int{c.farJump(len(c.currentInstructions()), operands[0])}
+	}
+
+	ins := c.make(op, operands...)
 
 	pos := c.addInstruction(ins)
 
+	if c.trace != nil {
+		c.traceEmit(op, operands, pos)
+	}
+
+	c.addLine(pos)
+
 	c.setLastInstruction(op, pos)
 
 	return pos
 }
 
+// 命令を作れなければ最初のエラーとして記録する
+// コンパイルは続けられるように、切り詰めた命令を返す
+func (c *Compiler) make(op code.Opcode, operands ...int) []byte {
+
+	ins, err := code.MakeE(op, operands...)
+
+	if err == nil {
+		return ins
+	}
+
+	if c.operandErr == nil {
+		c.operandErr = err
+	}
+
+	return code.Make(op, operands...)
+}
+
 func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
 
 	previous := c.scopes[c.scopeIndex].lastInstruction
@@ -546,8 +993,12 @@ func (c *Compiler) changeOperand(opPos int, operand int) {
 
 	op := code.Opcode(c.currentInstructions()[opPos])
 
+	if _, ok := code.WideJumps[op]; ok && operand > code.MaxJumpTarget {
+		operand = c.farJump(opPos, operand)
+	}
+
 	// []byte 新しくインストラクションを作る
-	newInstruction := code.Make(op, operand)
+	newInstruction := c.make(op, operand)
 
 	// もともとあったインストラクションを置き換える
 	c.replaceInstruction(opPos, newInstruction)
@@ -557,6 +1008,22 @@ type CompilationScope struct {
 	instructions        code.Instructions
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+	// コンパイル中の関数の名前(explain用)
+	name string
+	// 命令とソースコードの行の対応(lines.go)
+	lines code.LineTable
+	// コンパイル中のノードの行
+	line int
+	// コンパイル中のループ。内側のループが最後 (loops.go)
+	loops []*loop
+	// 本体をコンパイル中のtryの数 (try.go)
+	tries int
+	// yieldがあったか(generator.go)
+	generator bool
+	// モジュールの本体 (modules.go)
+	module bool
+	// ジャンプ先が2バイトに収まらないジャンプ命令の位置とジャンプ先 (jumps.go)
+	farJumps map[int]int
 }
 
 func (c *Compiler) currentInstructions() code.Instructions {
@@ -577,16 +1044,38 @@ func (c *Compiler) enterScope() {
 	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
 }
 
-func (c *Compiler) leaveScope() code.Instructions {
+// ブロックの最後の文が式文なら、その値がブロックの値になる
+func blockHasValue(block *ast.BlockStatement) bool {
+
+	if len(block.Statements) == 0 {
+		return false
+	}
+
+	_, ok := block.Statements[len(block.Statements)-1].(*ast.ExpressionStatement)
+
+	return ok
+}
+
+func (c *Compiler) enterBlock() {
+	c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+}
+
+func (c *Compiler) leaveBlock() {
+	c.symbolTable = c.symbolTable.Outer
+}
+
+func (c *Compiler) leaveScope() (code.Instructions, code.LineTable) {
 
-	instructions := c.currentInstructions()
+	instructions, lines := c.widen(c.currentInstructions(), c.scopes[c.scopeIndex].lines)
+	instructions, lines = c.optimize(instructions, lines, true)
+	instructions = code.RelativizeJumps(instructions)
 
 	c.scopes = c.scopes[:len(c.scopes)-1]
 	c.scopeIndex--
 
 	c.symbolTable = c.symbolTable.Outer
 
-	return instructions
+	return instructions, lines
 }
 
 func (c *Compiler) replaceLastPopWithReturn() {
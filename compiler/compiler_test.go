@@ -1,7 +1,9 @@
 package compiler
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 
 	"example.com/monkey/ast"
@@ -58,6 +60,13 @@ func testConstants(
 					err)
 			}
 
+		// intの範囲を超える値 (32ビット環境)
+		case int64:
+
+			if err := testIntegerObject(constant, actual[i]); err != nil {
+				return fmt.Errorf("constant %d - testIntegerObject failed: %s", i, err)
+			}
+
 		case string:
 
 			err := testStringObject(constant, actual[i])
@@ -131,6 +140,9 @@ func testInstructions(
 	// 実際の値は１次元配列
 	concatted := concatInstructions(expected)
 
+	// 期待値はジャンプ先を絶対位置で書く(相対ジャンプは TestRelativeJumps で確かめる)
+	actual = code.AbsoluteJumps(actual)
+
 	if len(actual) != len(concatted) {
 
 		return fmt.Errorf("wrong instructions length.\nwant=%q\ngot=%q",
@@ -218,6 +230,16 @@ func TestIntegerArithmetic(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:             "7 % 3",
+			expectedConstants: []interface{}{7, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+			},
+		},
 		{
 			input:             "-1",
 			expectedConstants: []interface{}{1},
@@ -244,6 +266,9 @@ func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 		program := parse(tt.input)
 
 		compiler := New()
+		// 演算子ごとのインストラクションを確認するため
+		// 最適化はTestConstantFoldingとTestPeepholeOptimizationで確認する
+		compiler.DisableOptimizations()
 
 		err := compiler.Compile(program)
 
@@ -310,6 +335,26 @@ func TestBooleanExpression(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:             "1 >= 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 <= 2",
+			expectedConstants: []interface{}{2, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterEqual),
+				code.Make(code.OpPop),
+			},
+		},
 		{
 			input:             "1 == 2",
 			expectedConstants: []interface{}{1, 2},
@@ -670,7 +715,7 @@ func TestFunctions(t *testing.T) {
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpFunction, 2),
 				code.Make(code.OpPop),
 			},
 		},
@@ -687,7 +732,7 @@ func TestFunctions(t *testing.T) {
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpFunction, 2),
 				code.Make(code.OpPop),
 			},
 		},
@@ -704,7 +749,7 @@ func TestFunctions(t *testing.T) {
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpFunction, 2),
 				code.Make(code.OpPop),
 			},
 		},
@@ -807,7 +852,7 @@ func TestFunctionsWithoutReturnValue(t *testing.T) {
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpFunction, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -832,7 +877,7 @@ func TestFunctionCalls(t *testing.T) {
 			},
 			expectedInstructions: []code.Instructions{
 				// The compiled function
-				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpFunction, 1),
 				code.Make(code.OpCall, 0),
 				code.Make(code.OpPop),
 			},
@@ -852,7 +897,7 @@ func TestFunctionCalls(t *testing.T) {
 			},
 			expectedInstructions: []code.Instructions{
 				// The compiled function
-				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpFunction, 1),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpCall, 0),
@@ -872,7 +917,7 @@ func TestFunctionCalls(t *testing.T) {
 				24,
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpFunction, 0),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 1),
@@ -899,7 +944,7 @@ func TestFunctionCalls(t *testing.T) {
 				26,
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpFunction, 0),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 1),
@@ -933,7 +978,7 @@ func TestLetStatementScopes(t *testing.T) {
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpFunction, 1),
 				code.Make(code.OpPop),
 			},
 		},
@@ -954,7 +999,7 @@ func TestLetStatementScopes(t *testing.T) {
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpFunction, 1),
 				code.Make(code.OpPop),
 			},
 		},
@@ -981,7 +1026,7 @@ func TestLetStatementScopes(t *testing.T) {
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpFunction, 2),
 				code.Make(code.OpPop),
 			},
 		},
@@ -1023,7 +1068,7 @@ func TestBuiltins(t *testing.T) {
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpFunction, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -1057,7 +1102,7 @@ func TestClosures(t *testing.T) {
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpFunction, 1),
 				code.Make(code.OpPop),
 			},
 		},
@@ -1093,7 +1138,7 @@ func TestClosures(t *testing.T) {
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpFunction, 2),
 				code.Make(code.OpPop),
 			},
 		},
@@ -1152,7 +1197,7 @@ func TestClosures(t *testing.T) {
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpClosure, 6, 0),
+				code.Make(code.OpFunction, 6),
 				code.Make(code.OpPop),
 			},
 		},
@@ -1182,7 +1227,7 @@ func TestRecursiveFunctions(t *testing.T) {
 				1,
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpFunction, 1),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpConstant, 2),
@@ -1210,7 +1255,7 @@ func TestRecursiveFunctions(t *testing.T) {
 				},
 				1,
 				[]code.Instructions{
-					code.Make(code.OpClosure, 1, 0),
+					code.Make(code.OpFunction, 1),
 					code.Make(code.OpSetLocal, 0),
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 2),
@@ -1219,7 +1264,7 @@ func TestRecursiveFunctions(t *testing.T) {
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpFunction, 3),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpCall, 0),
@@ -1230,3 +1275,1756 @@ func TestRecursiveFunctions(t *testing.T) {
 
 	runCompilerTests(t, tests)
 }
+
+func TestForInExpressions(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input:             `for (x in [1, 2]) { x }`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpConstant, 1),
+				// 0006
+				code.Make(code.OpArray, 2),
+				// 0009
+				code.Make(code.OpIterNew),
+				// 0010
+				code.Make(code.OpIterNext, 23),
+				// 0013
+				code.Make(code.OpSetGlobal, 0),
+				// 0016
+				code.Make(code.OpGetGlobal, 0),
+				// 0019
+				code.Make(code.OpPop),
+				// 0020
+				code.Make(code.OpJump, 10),
+				// 0023
+				code.Make(code.OpNull),
+				// 0024
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(a){ for (x in a) { x } }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpGetLocal, 0),
+					// 0002
+					code.Make(code.OpIterNew),
+					// 0003
+					code.Make(code.OpIterNext, 14),
+					// 0006
+					code.Make(code.OpSetLocal, 1),
+					// 0008
+					code.Make(code.OpGetLocal, 1),
+					// 0010
+					code.Make(code.OpPop),
+					// 0011
+					code.Make(code.OpJump, 3),
+					// 0014
+					code.Make(code.OpNull),
+					// 0015
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFunction, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestSliceExpressions(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input:             "[1, 2, 3][1:2]",
+			expectedConstants: []interface{}{1, 2, 3, 1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"abc"[:1]`,
+			expectedConstants: []interface{}{"abc", 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpNull),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"abc"[1:]`,
+			expectedConstants: []interface{}{"abc", 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpNull),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestInterpolatedStrings(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input:             `"a${1}b"`,
+			expectedConstants: []interface{}{"a", 1, "b"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpToString),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"${1}"`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpToString),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestExplain(t *testing.T) {
+
+	input := `let x = 1;
+let f = fn(a) {
+	fn() { a + x }
+};`
+
+	compiler := New()
+	compiler.EnableExplain()
+
+	err := compiler.Compile(parse(input))
+
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	explanation := compiler.Explanation()
+
+	expectedSymbols := []SymbolNote{
+		{Line: 1, Action: "define", Symbol: Symbol{Name: "x", Scope: GlobalScope, Index: 0}},
+		{Line: 2, Action: "define", Symbol: Symbol{Name: "f", Scope: GlobalScope, Index: 1}},
+		{Line: 2, Action: "define", Symbol: Symbol{Name: "f", Scope: FunctionScope, Index: 0}},
+		{Line: 2, Action: "define", Symbol: Symbol{Name: "a", Scope: LocalScope, Index: 0}},
+		{Line: 3, Action: "resolve", Symbol: Symbol{Name: "a", Scope: FreeScope, Index: 0}},
+		{Line: 3, Action: "resolve", Symbol: Symbol{Name: "x", Scope: GlobalScope, Index: 0}},
+		{Line: 3, Action: "capture", Symbol: Symbol{Name: "a", Scope: LocalScope, Index: 0}},
+	}
+
+	if len(explanation.Symbols) != len(expectedSymbols) {
+		t.Fatalf("wrong number of symbol notes. want=%d, got=%d (%+v)",
+			len(expectedSymbols), len(explanation.Symbols), explanation.Symbols)
+	}
+
+	for i, want := range expectedSymbols {
+		if explanation.Symbols[i] != want {
+			t.Errorf("symbol note %d wrong. want=%+v, got=%+v",
+				i, want, explanation.Symbols[i])
+		}
+	}
+
+	expectedRanges := []RangeNote{
+		{Line: 1, Function: "main", Start: 0, End: 6},
+		{Line: 3, Function: "fn@3:2", Start: 0, End: 7},
+		{Line: 3, Function: "f", Start: 0, End: 7},
+		{Line: 2, Function: "main", Start: 6, End: 12},
+	}
+
+	if len(explanation.Ranges) != len(expectedRanges) {
+		t.Fatalf("wrong number of range notes. want=%d, got=%d (%+v)",
+			len(expectedRanges), len(explanation.Ranges), explanation.Ranges)
+	}
+
+	for i, want := range expectedRanges {
+		if explanation.Ranges[i] != want {
+			t.Errorf("range note %d wrong. want=%+v, got=%+v",
+				i, want, explanation.Ranges[i])
+		}
+	}
+}
+
+func TestMacroCompileErrors(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`quote(1 + 2)`, "quote can only be used inside a macro"},
+		{`unquote(1)`, "unquote can only be used inside a macro"},
+		{`fn() { macro(x) { x } }`, "macro literal must be bound with a top-level let statement"},
+	}
+
+	for _, tt := range tests {
+
+		compiler := New()
+
+		err := compiler.Compile(parse(tt.input))
+
+		if err == nil {
+			t.Fatalf("expected compiler error for %q", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q",
+				tt.input, tt.expected, err.Error())
+		}
+	}
+}
+
+func TestConstStatements(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input: `
+			const one = 1;
+			one;
+			`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 関数の中で外側の定数を隠すのは構わない
+			input: `
+			const x = 1;
+			fn() { let x = 2; x }
+			`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpFunction, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`const x = 1; let x = 2;`, "cannot reassign constant x"},
+		{`const x = 1; const x = 2;`, "cannot reassign constant x"},
+		{`fn() { const y = 1; let y = 2; }`, "cannot reassign constant y"},
+		{`const x = 1; for (x in [1, 2]) { x }`, "cannot reassign constant x"},
+	}
+
+	for _, tt := range errorTests {
+
+		compiler := New()
+
+		err := compiler.Compile(parse(tt.input))
+
+		if err == nil {
+			t.Fatalf("expected compiler error for %q", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.expected, err.Error())
+		}
+	}
+}
+
+func TestNullLiteral(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input:             `null`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `let x = null; x == null`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpNull),
+				code.Make(code.OpEqual),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestRangeExpressions(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input:             `1..10`,
+			expectedConstants: []interface{}{1, 10},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpRange),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `[1, 2, 3][0..2]`,
+			expectedConstants: []interface{}{1, 2, 3, 0, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpRange),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestConstantFolding(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input:             "2 * 3 + 4",
+			expectedConstants: []interface{}{10},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-(1 - 5) / 2",
+			expectedConstants: []interface{}{2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"mon" + "key"`,
+			expectedConstants: []interface{}{"monkey"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 < 2 == !false",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "!null",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 変数を含む部分は畳み込まない
+			input:             "let x = 1; x + 2 * 3",
+			expectedConstants: []interface{}{1, 6},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpAddConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 0除算は実行時エラーにするため畳み込まない
+			input:             "1 / 0",
+			expectedConstants: []interface{}{1, 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// int64の範囲を超える演算はVMの設定に任せる
+			input:             "9223372036854775807 * 2",
+			expectedConstants: []interface{}{int64(9223372036854775807), 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMul),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 文字列は中身で比べる
+			input:             `"a" == "a"`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"b" <= "a"`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+
+		program := parse(tt.input)
+
+		compiler := New()
+
+		if err := compiler.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+
+		if err := testInstructions(tt.expectedInstructions, bytecode.Instructions); err != nil {
+			t.Fatalf("testInstructions failed for %q: %s", tt.input, err)
+		}
+
+		if err := testConstants(t, tt.expectedConstants, bytecode.Constants); err != nil {
+			t.Fatalf("testConstants failed for %q: %s", tt.input, err)
+		}
+	}
+}
+
+func TestPeepholeOptimization(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			// 関数の中では値を積んですぐ捨てる命令を消す
+			input: "fn(x) { x; 1; 2 }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFunction, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// トップレベルでは最後にポップした値が結果になるので消さない
+			input:             "1; 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+
+		compiler := New()
+
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+
+		if err := testInstructions(tt.expectedInstructions, bytecode.Instructions); err != nil {
+			t.Fatalf("testInstructions failed for %q: %s", tt.input, err)
+		}
+
+		if err := testConstants(t, tt.expectedConstants, bytecode.Constants); err != nil {
+			t.Fatalf("testConstants failed for %q: %s", tt.input, err)
+		}
+	}
+}
+
+func TestLogicalOperators(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input:             `true && 1`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 12),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpBang),
+				// 0008
+				code.Make(code.OpBang),
+				// 0009
+				code.Make(code.OpJump, 13),
+				// 0012
+				code.Make(code.OpFalse),
+				// 0013
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `false || 1`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpFalse),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 8),
+				// 0004
+				code.Make(code.OpTrue),
+				// 0005
+				code.Make(code.OpJump, 13),
+				// 0008
+				code.Make(code.OpConstant, 0),
+				// 0011
+				code.Make(code.OpBang),
+				// 0012
+				code.Make(code.OpBang),
+				// 0013
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestWhileExpressions(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input:             `while (true) { 1 }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 11),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpJump, 0),
+				// 0011
+				code.Make(code.OpNull),
+				// 0012
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+// バイトコードはホストのアーキテクチャに関係なく同じバイト列になる
+// (TestArchitectureMatrixで32ビットの環境でも実行する)
+func TestPortableBytecode(t *testing.T) {
+
+	program := parse(`let f = fn(a, b) { a + b }; f(300, 70000)[0]`)
+
+	// 呼び出しの命令も確かめるので展開しない
+	opts := DefaultOptions()
+	opts.EnableInlining = false
+
+	compiler := NewWithOptions(opts)
+
+	if err := compiler.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	// 2バイトのオペランドは上位バイトが先
+	expected := []byte{
+		byte(code.OpFunction), 0x00, 0x00,
+		byte(code.OpSetGlobal), 0x00, 0x00,
+		byte(code.OpGetGlobal), 0x00, 0x00,
+		byte(code.OpConstant), 0x00, 0x01,
+		byte(code.OpConstant), 0x00, 0x02,
+		byte(code.OpCall), 0x02,
+		byte(code.OpConstant), 0x00, 0x03,
+		byte(code.OpIndex),
+		byte(code.OpPop),
+	}
+
+	if string(bytecode.Instructions) != string(expected) {
+		t.Errorf("wrong bytes.\nwant=%v\ngot=%v", expected, []byte(bytecode.Instructions))
+	}
+
+	if err := testIntegerObject(70000, bytecode.Constants[2]); err != nil {
+		t.Errorf("wrong constant: %s", err)
+	}
+}
+
+func TestOperandOverflow(t *testing.T) {
+
+	args := make([]string, 300)
+
+	for i := range args {
+		args[i] = "1"
+	}
+
+	// 引数の数は1バイトのオペランドに収まらない
+	input := "let f = fn() { 1 }; f(" + strings.Join(args, ", ") + ")"
+
+	compiler := New()
+
+	err := compiler.Compile(parse(input))
+
+	expected := "too many arguments in call to f: 300 (max 255)"
+
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong compiler error. want=%q, got=%v", expected, err)
+	}
+}
+
+func TestBreakAndContinue(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input:             `while (true) { break; continue; }`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 13),
+				// 0004
+				code.Make(code.OpJump, 13),
+				// 0007
+				code.Make(code.OpJump, 0),
+				// 0010
+				code.Make(code.OpJump, 0),
+				// 0013
+				code.Make(code.OpNull),
+				// 0014
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `for (x in []) { break; }`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpArray, 0),
+				// 0003
+				code.Make(code.OpIterNew),
+				// 0004
+				code.Make(code.OpIterNext, 17),
+				// 0007
+				code.Make(code.OpSetGlobal, 0),
+				// 0010
+				// イテレーターを捨ててから抜ける
+				code.Make(code.OpPop),
+				// 0011
+				code.Make(code.OpJump, 17),
+				// 0014
+				code.Make(code.OpJump, 4),
+				// 0017
+				code.Make(code.OpNull),
+				// 0018
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`break;`, "break outside of a loop"},
+		{`continue`, "continue outside of a loop"},
+		{`if (true) { break; }`, "break outside of a loop"},
+		// 関数の外側のループは対象にならない
+		{`while (true) { fn() { continue; } }`, "continue outside of a loop"},
+	}
+
+	for _, tt := range errorTests {
+
+		err := New().Compile(parse(tt.input))
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong compiler error for %q. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input:             `let x = 1; x = 2;`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(a) { fn() { a = 3 } }`,
+			expectedConstants: []interface{}{
+				3,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetFree, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 1, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFunction, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`x = 1`, "undefined variable x"},
+		{`len = 1`, "cannot assign to builtin len"},
+		{`const c = 1; c = 2`, "cannot reassign constant c"},
+		{`const c = 1; fn() { c = 2 }`, "cannot reassign constant c"},
+		{`let f = fn() { f = 1 }`, "cannot assign to function f"},
+	}
+
+	for _, tt := range errorTests {
+
+		err := New().Compile(parse(tt.input))
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong compiler error for %q. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestCompileLimits(t *testing.T) {
+
+	// 識別子に数字は使えないので、番号をアルファベットで表す
+	names := func(n int, prefix string) []string {
+		out := make([]string, n)
+		for i := range out {
+			out[i] = fmt.Sprintf("%s%c%c", prefix, 'a'+i/26, 'a'+i%26)
+		}
+		return out
+	}
+
+	lets := func(n int) string {
+		var out strings.Builder
+		for _, name := range names(n, "v") {
+			fmt.Fprintf(&out, "let %s = 1; ", name)
+		}
+		return out.String()
+	}
+
+	pairs := func(n int) []string {
+		out := make([]string, n)
+		for i := range out {
+			out[i] = fmt.Sprintf("%d: 1", i)
+		}
+		return out
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		// 0から255までのインデックスに収まる
+		{"let f = fn() { " + lets(256) + " }", ""},
+		{"let f = fn() { " + lets(257) + " }", "function f has too many local variables: 257 (max 256)"},
+		{"let f = fn(" + strings.Join(names(256, "p"), ", ") + ") { 1 }",
+			"function f has too many parameters: 256 (max 255)"},
+		{"let f = fn(a) { " + lets(256) + " }", "function f has too many local variables: 257 (max 256)"},
+		{"[" + strings.Repeat("1, ", 65535) + "]", ""},
+		{"[" + strings.Repeat("1, ", 65536) + "]", "array literal has too many elements: 65536 (max 65535)"},
+		{"{" + strings.Join(pairs(32768), ", ") + "}", "hash literal has too many pairs: 32768 (max 32767)"},
+	}
+
+	for _, tt := range tests {
+
+		err := New().Compile(parse(tt.input))
+
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("unexpected compiler error: %s", err)
+			}
+			continue
+		}
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+func TestWarnings(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"let x = 1; x", []string{}},
+		{"let x = 1;\nlet y = 2; x", []string{"line 2: unused variable y"}},
+		{"let f = fn() { let a = 1; 2 }; f()", []string{"line 1: unused variable a"}},
+		{"let f = fn() { 1 };", []string{"line 1: unused function f"}},
+		// 代入しただけでは読んだことにならない
+		{"let x = 1; x = 2;", []string{"line 1: unused variable x"}},
+		// 内側の関数から読まれた
+		{"let x = 1; let f = fn() { fn() { x } }; f()", []string{}},
+		// 定義し直した前の変数は読まれていない
+		{"let x = 1; let x = 2; x", []string{"line 1: unused variable x"}},
+		{"let _x = 1; let main = fn() { 1 };", []string{}},
+		// 捕捉した変数への代入は外に伝わらない
+		{"let f = fn() { let n = 0; let g = fn() { n = n + 1 }; g(); n }; f()",
+			[]string{"line 1: assignment to captured variable n is not visible outside the closure"}},
+		{"let f = fn() { let n = 0; let g = fn() { n };\nn = 1; g() }; f()",
+			[]string{"line 2: assignment to n is not visible to closures that captured it"}},
+		// 捕捉する前の代入は問題ない
+		{"let f = fn() { let n = 0; n = 1; fn() { n } }; f()", []string{}},
+	}
+
+	for _, tt := range tests {
+
+		compiler := New()
+
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		warnings := compiler.Warnings()
+
+		if strings.Join(warnings, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("wrong warnings for %q.\nwant=%q\ngot=%q", tt.input, tt.expected, warnings)
+		}
+	}
+}
+
+func TestBlockScopeInstructions(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			// ブロックの中のxは別のグローバル変数
+			input:             `let x = 1; if (true) { let x = 2; x }; x`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpTrue),
+				// 0007
+				code.Make(code.OpJumpNotTruthy, 22),
+				// 0010
+				code.Make(code.OpConstant, 1),
+				// 0013
+				code.Make(code.OpSetGlobal, 1),
+				// 0016
+				code.Make(code.OpGetGlobal, 1),
+				// 0019
+				code.Make(code.OpJump, 23),
+				// 0022
+				code.Make(code.OpNull),
+				// 0023
+				code.Make(code.OpPop),
+				// 0024
+				code.Make(code.OpGetGlobal, 0),
+				// 0027
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`if (true) { let y = 1; }; y`, "undefined variable y"},
+		{`fn() { while (true) { let y = 1; break; } y }`, "undefined variable y"},
+		{`for (i in [1]) { i }; i`, "undefined variable i"},
+	}
+
+	for _, tt := range errorTests {
+
+		err := New().Compile(parse(tt.input))
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong compiler error for %q. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestEncodeBytecode(t *testing.T) {
+
+	bytecode := &Bytecode{
+		Instructions: append(code.Make(code.OpConstant, 0), code.Make(code.OpPop)...),
+		Constants: []object.Object{
+			&object.Integer{Value: 300},
+			&object.String{Value: "ab"},
+			&object.CompiledFunction{
+				Instructions:  code.Make(code.OpReturn),
+				NumLocals:     1,
+				NumParameters: 1,
+				Name:          "f",
+				Lines:         code.LineTable{{Offset: 0, Line: 2}},
+			},
+		},
+		Lines: code.LineTable{{Offset: 0, Line: 1}},
+	}
+
+	expected := []byte{
+		'M', 'N', 'K', 'Y', BytecodeVersion,
+		// 定数
+		byte(code.SectionConstants), 13,
+		3,
+		1, 0xd8, 0x04, // 300 (zigzag)
+		2, 2, 'a', 'b',
+		3, 1, byte(code.OpReturn), 1, 1,
+		// 命令
+		byte(code.SectionInstructions), 4, byte(code.OpConstant), 0, 0, byte(code.OpPop),
+		// トップレベルと関数の名前と行の対応
+		byte(code.SectionDebug), 8,
+		1, 0, 1,
+		1, 'f', 1, 0, 2,
+	}
+
+	var out bytes.Buffer
+
+	if err := bytecode.Encode(&out); err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Errorf("wrong encoding.\nwant=%v\ngot= %v", expected, out.Bytes())
+	}
+
+	bytecode.Constants = []object.Object{&object.Boolean{Value: true}}
+
+	err := bytecode.Encode(&out)
+
+	if err == nil || err.Error() != "constant 0: cannot encode constant of type BOOLEAN" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func TestDecodeBytecode(t *testing.T) {
+
+	compiler := New()
+
+	input := `let add = fn(a, b) { a + b }; let s = "monkey"; let g = fn() { yield s }; add(-3, len(s)) * 1.5`
+
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var encoded bytes.Buffer
+
+	if err := compiler.Bytecode().Encode(&encoded); err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	decoded, err := DecodeBytecode(bytes.NewReader(encoded.Bytes()))
+
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+
+	if decoded.Instructions.String() != compiler.Bytecode().Instructions.String() {
+		t.Errorf("wrong instructions.\nwant=%q\ngot=%q",
+			compiler.Bytecode().Instructions.String(), decoded.Instructions.String())
+	}
+
+	// もう一度書き出すと同じバイト列になる
+	var reencoded bytes.Buffer
+
+	if err := decoded.Encode(&reencoded); err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	if !bytes.Equal(encoded.Bytes(), reencoded.Bytes()) {
+		t.Errorf("round trip changed the encoding")
+	}
+
+	data := encoded.Bytes()
+
+	wrongVersion := append([]byte{}, data...)
+	wrongVersion[4] = BytecodeVersion + 1
+
+	var badConstant bytes.Buffer
+	(&code.File{Constants: []byte{1, 9}, Instructions: code.Instructions{}}).Encode(&badConstant)
+
+	tests := []struct {
+		input    []byte
+		expected string
+	}{
+		{[]byte("hello"), "not a monkey bytecode file"},
+		{data[:3], "not a monkey bytecode file"},
+		{wrongVersion, fmt.Sprintf("unsupported bytecode version %d (want %d)", BytecodeVersion+1, BytecodeVersion)},
+		{data[:len(data)-1], "truncated or corrupt bytecode: unexpected EOF"},
+		{badConstant.Bytes(), "constant 0: truncated or corrupt bytecode: unknown constant kind 9"},
+		{data[:6], "truncated or corrupt bytecode: unexpected EOF"},
+	}
+
+	for _, tt := range tests {
+
+		_, err := DecodeBytecode(bytes.NewReader(tt.input))
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+
+	compile := func(opts Options, input string) *Bytecode {
+		compiler := NewWithOptions(opts)
+		if err := compiler.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		return compiler.Bytecode()
+	}
+
+	concat := func(instructions ...code.Instructions) string {
+		return concatInstructions(instructions).String()
+	}
+
+	tests := []struct {
+		opts     Options
+		input    string
+		expected string
+	}{
+		{DefaultOptions(), "1 + 2", concat(code.Make(code.OpConstant, 0), code.Make(code.OpPop))},
+		{Options{EnablePeephole: true}, "1 + 2", concat(
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpConstant, 1),
+			code.Make(code.OpAdd),
+			code.Make(code.OpPop),
+		)},
+		{Options{EnablePeephole: true}, "!true", concat(code.Make(code.OpFalse), code.Make(code.OpPop))},
+		{Options{}, "!true", concat(code.Make(code.OpTrue), code.Make(code.OpBang), code.Make(code.OpPop))},
+	}
+
+	for _, tt := range tests {
+
+		got := compile(tt.opts, tt.input).Instructions.String()
+
+		if got != tt.expected {
+			t.Errorf("wrong instructions for %q with %+v.\nwant=%q\ngot=%q", tt.input, tt.opts, tt.expected, got)
+		}
+	}
+
+	input := "let f = fn() {\n1\n};\nf()"
+
+	fn := compile(DefaultOptions(), input).Constants[1].(*object.CompiledFunction)
+
+	if fn.Name != "f" || len(fn.Lines) == 0 {
+		t.Errorf("debug info missing: name=%q, lines=%v", fn.Name, fn.Lines)
+	}
+
+	bytecode := compile(Options{}, input)
+	fn = bytecode.Constants[1].(*object.CompiledFunction)
+
+	if fn.Name != "" || len(fn.Lines) != 0 || len(bytecode.Lines) != 0 {
+		t.Errorf("unexpected debug info: name=%q, lines=%v, top level=%v", fn.Name, fn.Lines, bytecode.Lines)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+
+	modules := MapResolver{
+		"a":      `let b = import "b";`,
+		"b":      `let a = import "a";`,
+		"secret": `let leak = fn() { secret };`,
+		"broken": `let = 1;`,
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`import "missing"`, `cannot import "missing": module not found`},
+		{`import "a"`, "import cycle: a -> b -> a"},
+		// モジュールからはimportした側のグローバル変数は見えない
+		{`let secret = 1; import "secret"`, "undefined variable secret"},
+		{`import "broken"`, `cannot import "broken": parser errors in broken: expected next token to be IDENT, got = instead; no prefix parse function for = found`},
+	}
+
+	for _, tt := range tests {
+
+		compiler := New()
+		compiler.SetModuleResolver(modules)
+
+		err := compiler.Compile(parse(tt.input))
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong compiler error for %q. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+
+	err := New().Compile(parse(`import "a"`))
+
+	if err == nil || err.Error() != `cannot import "a": no module resolver` {
+		t.Errorf("wrong compiler error. got=%v", err)
+	}
+}
+
+func TestInlining(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input: `let double = fn(x) { x * 2 }; double(3)`,
+			expectedConstants: []interface{}{
+				2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpMul),
+					code.Make(code.OpReturnValue),
+				},
+				3,
+				2,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFunction, 1),
+				code.Make(code.OpSetGlobal, 0),
+				// 引数を隠れた変数に保存して、本体を直接実行する
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpMul),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `let add = fn(a, b) { a + b }; fn() { add(1, 2) }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFunction, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpFunction, 3),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	// 展開だけを確かめる(runCompilerTestsは最適化をすべて止める)
+	for _, tt := range tests {
+
+		compiler := NewWithOptions(Options{EnableInlining: true})
+
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+
+		if err := testInstructions(tt.expectedInstructions, bytecode.Instructions); err != nil {
+			t.Fatalf("testInstructions failed for %q: %s", tt.input, err)
+		}
+
+		if err := testConstants(t, tt.expectedConstants, bytecode.Constants); err != nil {
+			t.Fatalf("testConstants failed for %q: %s", tt.input, err)
+		}
+	}
+
+	// 展開しない呼び出し
+	notInlined := []string{
+		// グローバル変数を参照する
+		`let k = 2; let f = fn(x) { x * k }; f(1)`,
+		// 再帰
+		`let f = fn(x) { f(x) }; f(1)`,
+		// 代入されている
+		`let f = fn(x) { x }; f = fn(x) { 0 }; f(1)`,
+		// 引数の数が違う
+		`let f = fn(x) { x }; f(1, 2)`,
+		// 文が複数ある
+		`let f = fn(x) { let y = x; y }; f(1)`,
+		// 大きすぎる
+		`let f = fn(x) { x + x + x + x + x + x + x + x + x + x }; f(1)`,
+	}
+
+	for _, input := range notInlined {
+
+		compiler := New()
+
+		if err := compiler.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		if !strings.Contains(compiler.Bytecode().Instructions.String(), "OpCall") {
+			t.Errorf("call inlined for %q", input)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	concat := func(instructions ...code.Instructions) code.Instructions {
+		return concatInstructions(instructions)
+	}
+
+	fn := &object.CompiledFunction{
+		Instructions: concat(code.Make(code.OpGetLocal, 1), code.Make(code.OpReturnValue)),
+		NumLocals:    1,
+		Name:         "f",
+	}
+
+	tests := []struct {
+		bytecode *Bytecode
+		expected string
+	}{
+		{
+			&Bytecode{Instructions: concat(
+				code.Make(code.OpTrue),             // 0000
+				code.Make(code.OpJumpNotTruthy, 7), // 0001
+				code.Make(code.OpNull),             // 0004
+				code.Make(code.OpPop),              // 0005
+				code.Make(code.OpNull),             // 0006
+			)},
+			"",
+		},
+		{
+			&Bytecode{Instructions: concat(code.Make(code.OpJump, 2), code.Make(code.OpNull))},
+			"main: 0000: jump target 0002 is not an instruction boundary",
+		},
+		{
+			&Bytecode{Instructions: concat(code.Make(code.OpTrue), code.Make(code.OpAdd))},
+			"main: 0001: OpAdd pops 2 values from a stack of 1",
+		},
+		{
+			&Bytecode{Instructions: concat(code.Make(code.OpConstant, 1)), Constants: []object.Object{&object.Integer{Value: 1}}},
+			"main: 0000: constant 1 out of range (1 constants)",
+		},
+		{
+			&Bytecode{Instructions: code.Make(code.OpConstant, 1)[:2]},
+			"main: 0000: OpConstant is truncated: want 2 operand bytes, got 1",
+		},
+		{
+			&Bytecode{Instructions: code.Instructions{255}},
+			"main: 0000: opcode 255 undefined",
+		},
+		{
+			// 条件によってスタックの深さが変わる
+			&Bytecode{Instructions: concat(
+				code.Make(code.OpTrue),             // 0000
+				code.Make(code.OpJumpNotTruthy, 5), // 0001
+				code.Make(code.OpNull),             // 0004
+				code.Make(code.OpPop),              // 0005
+			)},
+			"main: 0005: stack depth mismatch (0 and 1)",
+		},
+		{
+			&Bytecode{Instructions: code.Make(code.OpFunction, 0), Constants: []object.Object{fn}},
+			"function f: 0000: local 1 out of range (1 locals)",
+		},
+	}
+
+	for i, tt := range tests {
+
+		err := Verify(tt.bytecode)
+
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("test %d: unexpected error: %s", i, err)
+			}
+			continue
+		}
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("test %d: wrong error. want=%q, got=%v", i, tt.expected, err)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+
+	var out bytes.Buffer
+
+	compiler := New()
+	compiler.DisableOptimizations()
+	compiler.SetTrace(TraceWriter(&out))
+
+	if err := compiler.Compile(parse("1 + 2")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := `enter *ast.Program (1 + 2)
+  enter *ast.ExpressionStatement (1 + 2)
+    enter *ast.InfixExpression (1 + 2)
+      enter *ast.IntegerLiteral 1
+        emit main 0000 OpConstant [0]
+      leave *ast.IntegerLiteral 1
+      enter *ast.IntegerLiteral 2
+        emit main 0003 OpConstant [1]
+      leave *ast.IntegerLiteral 2
+      emit main 0006 OpAdd []
+    leave *ast.InfixExpression (1 + 2)
+    emit main 0007 OpPop []
+  leave *ast.ExpressionStatement (1 + 2)
+leave *ast.Program (1 + 2)
+`
+
+	if out.String() != expected {
+		t.Errorf("wrong trace.\nwant=%q\ngot=%q", expected, out.String())
+	}
+
+	// 既定では何も受け取らない
+	events := 0
+
+	compiler = New()
+	compiler.SetTrace(func(TraceEvent) { events++ })
+	compiler.SetTrace(nil)
+
+	if err := compiler.Compile(parse("1")); err != nil || events != 0 {
+		t.Errorf("unexpected trace events: %d (err=%v)", events, err)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+
+	compiler := New()
+	compiler.DisableOptimizations()
+
+	if err := compiler.Compile(parse(`let a = "x";`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	snapshot := compiler.Snapshot()
+	compiler.Reset()
+
+	// 途中まで定義してから失敗する
+	if err := compiler.Compile(parse(`let b = "y"; let c = fn() { nope };`)); err == nil {
+		t.Fatalf("expected compiler error")
+	}
+
+	compiler.Restore(snapshot)
+
+	if _, ok := compiler.symbolTable.Resolve("b"); ok {
+		t.Errorf("b should be undefined after Restore")
+	}
+
+	if len(compiler.constants) != 1 {
+		t.Errorf("wrong number of constants. want=1, got=%d", len(compiler.constants))
+	}
+
+	compiler.Reset()
+
+	if err := compiler.Compile(parse(`let b = "z"; a + b;`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	// 前の入力の命令は含まず、bは捨てた定義と同じインデックスを使う
+	expected := concatInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpSetGlobal, 1),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpGetGlobal, 1),
+		code.Make(code.OpAdd),
+		code.Make(code.OpPop),
+	})
+
+	if bytecode.Instructions.String() != expected.String() {
+		t.Errorf("wrong instructions.\nwant=%q\ngot=%q", expected.String(), bytecode.Instructions.String())
+	}
+
+	if err := testConstants(t, []interface{}{"x", "z"}, bytecode.Constants); err != nil {
+		t.Errorf("testConstants failed: %s", err)
+	}
+}
+
+func TestGlobalLimit(t *testing.T) {
+
+	// グローバル変数のインデックスを使い切ったテーブル
+	symbolTable := NewSymbolTable()
+
+	for i := 0; i < MaxGlobals-1; i++ {
+		symbolTable.Define(fmt.Sprintf("g%d", i))
+	}
+	symbolTable.Define("last")
+
+	compiler := NewWithState(symbolTable, []object.Object{})
+
+	if err := compiler.Compile(parse("last")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	compiler = NewWithState(symbolTable, []object.Object{})
+
+	err := compiler.Compile(parse("let x = 1; x"))
+
+	expected := "too many global bindings: x is binding 65537 (max 65536)"
+
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%v", expected, err)
+	}
+}
+
+func TestRelativeJumps(t *testing.T) {
+
+	compiler := New()
+	compiler.DisableOptimizations()
+
+	if err := compiler.Compile(parse("if (true) { 10 }; 3333;")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := concatInstructions([]code.Instructions{
+		// 0000
+		code.Make(code.OpTrue),
+		// 0001 0010へ
+		code.Make(code.OpJumpNotTruthyRel, 6),
+		// 0004
+		code.Make(code.OpConstant, 0),
+		// 0007 0011へ
+		code.Make(code.OpJumpRel, 1),
+		// 0010
+		code.Make(code.OpNull),
+		// 0011
+		code.Make(code.OpPop),
+		// 0012
+		code.Make(code.OpConstant, 1),
+		// 0015
+		code.Make(code.OpPop),
+	})
+
+	actual := compiler.Bytecode().Instructions
+
+	if actual.String() != expected.String() {
+		t.Errorf("wrong instructions.\nwant=%q\ngot=%q", expected.String(), actual.String())
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+
+	compiler := New()
+	compiler.DisableOptimizations()
+
+	input := `let f = fn(x) { if (x) { "yes" } else { len("") } }; f(1); f;`
+
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := `0000 OpFunction 2        ; fn f (1 params, 1 locals)
+    0000 OpGetLocal 0
+    0002 OpJumpNotTruthyRel 6 -> L1
+    0005 OpConstant 0        ; "yes"
+    0008 OpJumpRel 7 -> L2
+    L1:
+    0011 OpGetBuiltin 0      ; len
+    0013 OpConstant 1        ; ""
+    0016 OpCall 1
+    L2:
+    0018 OpReturnValue
+0003 OpSetGlobal 0
+0006 OpGetGlobal 0
+0009 OpConstant 3        ; 1
+0012 OpCall 1
+0014 OpPop
+0015 OpGetGlobal 0
+0018 OpPop
+`
+
+	if actual := Disassemble(compiler.Bytecode()); actual != expected {
+		t.Errorf("wrong output.\nwant=\n%s\ngot=\n%s", expected, actual)
+	}
+}
+
+func TestSuperinstructions(t *testing.T) {
+
+	input := `fn(f, x) { f(x) + 1 }`
+
+	compile := func(opts Options) string {
+
+		compiler := NewWithOptions(opts)
+
+		if err := compiler.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		return compiler.Bytecode().Constants[1].(*object.CompiledFunction).Instructions.String()
+	}
+
+	expected := concatInstructions([]code.Instructions{
+		code.Make(code.OpGetLocal, 0),
+		code.Make(code.OpCallLocal, 1, 1),
+		code.Make(code.OpAddConstant, 0),
+		code.Make(code.OpReturnValue),
+	}).String()
+
+	if actual := compile(DefaultOptions()); actual != expected {
+		t.Errorf("wrong instructions.\nwant=%q\ngot=%q", expected, actual)
+	}
+
+	// まとめないときは元の命令のまま
+	opts := DefaultOptions()
+	opts.EnableSuperinstructions = false
+
+	if actual := compile(opts); !strings.Contains(actual, "OpConstant 0\n") || strings.Contains(actual, "OpAddConstant") {
+		t.Errorf("superinstructions were emitted.\ngot=%q", actual)
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input:             `try { 1 } catch (e) { e }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTry, 12),
+				// 0005
+				code.Make(code.OpConstant, 0),
+				// 0008
+				code.Make(code.OpEndTry),
+				// 0009
+				code.Make(code.OpJump, 18),
+				// 0012
+				code.Make(code.OpSetGlobal, 0),
+				// 0015
+				code.Make(code.OpGetGlobal, 0),
+				// 0018
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `throw "boom"`,
+			expectedConstants: []interface{}{"boom"},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpThrow),
+			},
+		},
+		{
+			input:             `for (x in []) { try { break } catch (e) { } }`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpArray, 0),
+				// 0003
+				code.Make(code.OpIterNew),
+				// 0004
+				code.Make(code.OpIterNext, 33),
+				// 0007
+				code.Make(code.OpSetGlobal, 0),
+				// 0010
+				code.Make(code.OpTry, 25),
+				// 0015 tryを抜けてからループを抜ける
+				code.Make(code.OpEndTry),
+				// 0016
+				code.Make(code.OpPop),
+				// 0017
+				code.Make(code.OpJump, 33),
+				// 0020
+				code.Make(code.OpNull),
+				// 0021
+				code.Make(code.OpEndTry),
+				// 0022
+				code.Make(code.OpJump, 29),
+				// 0025
+				code.Make(code.OpSetGlobal, 1),
+				// 0028
+				code.Make(code.OpNull),
+				// 0029
+				code.Make(code.OpPop),
+				// 0030
+				code.Make(code.OpJump, 4),
+				// 0033
+				code.Make(code.OpNull),
+				// 0034
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestSpawn(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input: `spawn fn() { 1 }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFunction, 1),
+				code.Make(code.OpSpawn),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestGenerator(t *testing.T) {
+
+	tests := []compilerTestCase{
+		{
+			input: `fn() { let x = yield 1; yield }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpYield),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpNull),
+					code.Make(code.OpYield),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFunction, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	// yieldがある関数だけがgeneratorになる(内側の関数のyieldは外側に関係しない)
+	compiler := New()
+
+	if err := compiler.Compile(parse(`fn() { fn() { yield 1 } }`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	constants := compiler.Bytecode().Constants
+
+	if inner := constants[1].(*object.CompiledFunction); !inner.Generator {
+		t.Errorf("inner function is not a generator")
+	}
+
+	if outer := constants[2].(*object.CompiledFunction); outer.Generator {
+		t.Errorf("outer function is a generator")
+	}
+
+	errorTests := []string{
+		`yield 1`,
+		`if (true) { yield }`,
+	}
+
+	for _, input := range errorTests {
+
+		err := New().Compile(parse(input))
+
+		if err == nil || err.Error() != "yield outside function" {
+			t.Errorf("wrong error for %q. got=%v", input, err)
+		}
+	}
+}
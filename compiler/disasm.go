@@ -0,0 +1,174 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"example.com/monkey/code"
+	"example.com/monkey/object"
+)
+
+// コンパイラーの出力を読むための逆アセンブル
+//
+//	0000 OpConstant 0        ; 10
+//	0003 OpJumpNotTruthyRel 4 -> L1
+//	0006 OpClosure 1 0       ; fn add (2 params, 2 locals)
+//	    0000 OpGetLocal 0
+//	    ...
+//	L1:
+//
+// 定数の値を注釈し、関数の定数は最初に参照した場所で字下げして中身を出す
+// ジャンプ先にはラベルを付ける
+
+type disassembler struct {
+	out       bytes.Buffer
+	constants []object.Object
+	// 中身を出した関数の定数
+	shown map[int]bool
+}
+
+func Disassemble(b *Bytecode) string {
+
+	d := &disassembler{constants: b.Constants, shown: map[int]bool{}}
+
+	d.instructions(b.Instructions, 0)
+
+	return d.out.String()
+}
+
+func (d *disassembler) instructions(ins code.Instructions, depth int) {
+
+	indent := strings.Repeat("    ", depth)
+
+	labels := jumpLabels(ins)
+
+	err := ins.Iterate(func(offset int, op code.Opcode, operands []int) bool {
+
+		if label, ok := labels[offset]; ok {
+			fmt.Fprintf(&d.out, "%sL%d:\n", indent, label)
+		}
+
+		def, _ := code.Lookup(byte(op))
+
+		line := fmt.Sprintf("%04d %s", offset, def.Name)
+
+		for _, o := range operands {
+			line += fmt.Sprintf(" %d", o)
+		}
+
+		if def.Flow == code.FlowJump || def.Flow == code.FlowBranch || def.Flow == code.FlowHandler {
+			line += fmt.Sprintf(" -> L%d", labels[code.JumpTarget(offset, op, operands)])
+		}
+
+		note, fn := d.annotate(op, operands)
+
+		if note != "" {
+			line = fmt.Sprintf("%-24s ; %s", line, note)
+		}
+
+		fmt.Fprintf(&d.out, "%s%s\n", indent, line)
+
+		if fn != nil {
+			d.instructions(fn.Instructions, depth+1)
+		}
+
+		return true
+	})
+
+	if label, ok := labels[len(ins)]; ok {
+		fmt.Fprintf(&d.out, "%sL%d:\n", indent, label)
+	}
+
+	if e, ok := err.(*code.DecodeError); ok {
+		fmt.Fprintf(&d.out, "%s%04d ERROR: %s\n", indent, e.Offset, e.Err)
+	}
+}
+
+// 命令の注釈と、中身を出す関数
+func (d *disassembler) annotate(op code.Opcode, operands []int) (string, *object.CompiledFunction) {
+
+	switch op {
+
+	case code.OpConstant, code.OpClosure, code.OpFunction:
+
+		index := operands[0]
+
+		if index >= len(d.constants) {
+			return "constant out of range", nil
+		}
+
+		fn, ok := d.constants[index].(*object.CompiledFunction)
+
+		if !ok {
+			return constantNote(d.constants[index]), nil
+		}
+
+		note := fmt.Sprintf("fn %s (%d params, %d locals)", functionLabel(fn), fn.NumParameters, fn.NumLocals)
+
+		if d.shown[index] {
+			return note + " shown above", nil
+		}
+
+		d.shown[index] = true
+
+		return note, fn
+
+	case code.OpGetBuiltin:
+
+		if operands[0] < len(object.Builtins) {
+			return object.Builtins[operands[0]].Name, nil
+		}
+	}
+
+	return "", nil
+}
+
+func constantNote(obj object.Object) string {
+
+	if s, ok := obj.(*object.String); ok {
+		return fmt.Sprintf("%q", s.Value)
+	}
+
+	return obj.Inspect()
+}
+
+func functionLabel(fn *object.CompiledFunction) string {
+
+	if fn.Name == "" {
+		return "<anonymous>"
+	}
+
+	return fn.Name
+}
+
+// ジャンプ先の位置と、前から順に付けたラベルの番号
+func jumpLabels(ins code.Instructions) map[int]int {
+
+	targets := map[int]bool{}
+
+	ins.Iterate(func(offset int, op code.Opcode, operands []int) bool {
+
+		def, _ := code.Lookup(byte(op))
+
+		if def.Flow == code.FlowJump || def.Flow == code.FlowBranch || def.Flow == code.FlowHandler {
+			targets[code.JumpTarget(offset, op, operands)] = true
+		}
+
+		return true
+	})
+
+	offsets := []int{}
+	for offset := range targets {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+
+	labels := map[int]int{}
+	for i, offset := range offsets {
+		labels[offset] = i + 1
+	}
+
+	return labels
+}
@@ -0,0 +1,364 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"example.com/monkey/code"
+	"example.com/monkey/object"
+)
+
+// 一度コンパイルしたプログラムを保存して配布するためのバイナリ形式
+// 入れ物は code.File で、その各セクションの中身をここで決める
+//
+//	定数: 定数の数と各定数
+//	命令: トップレベルの命令
+//	デバッグ情報: トップレベルの行の対応表、関数の定数ごとの名前と行の対応表
+//
+// 数値はすべて可変長 (encoding/binary の Varint/Uvarint)
+// 定数は種類を表す1バイトの後に値が続く
+// デバッグ情報を出力しないでコンパイルしたものは、デバッグ情報のセクションを省く
+
+// 形式を変えたら上げる
+const BytecodeVersion = code.FileVersion
+
+var ErrNotBytecode = code.ErrNotBytecode
+
+const (
+	constantInteger  byte = 1
+	constantString   byte = 2
+	constantFunction byte = 3
+	constantFloat    byte = 4
+	// 本体にyieldがある関数。形式は constantFunction と同じ
+	constantGenerator byte = 5
+)
+
+type encoder struct {
+	w   bytes.Buffer
+	buf [binary.MaxVarintLen64]byte
+}
+
+// 命令と定数をwに書き出す
+func (b *Bytecode) Encode(w io.Writer) error {
+
+	constants := &encoder{}
+
+	constants.uint(len(b.Constants))
+
+	for i, c := range b.Constants {
+		if err := constants.constant(c); err != nil {
+			return fmt.Errorf("constant %d: %s", i, err)
+		}
+	}
+
+	file := &code.File{
+		Constants:    constants.w.Bytes(),
+		Instructions: b.Instructions,
+	}
+
+	if b.hasDebugInfo() {
+
+		debug := &encoder{}
+
+		debug.lines(b.Lines)
+
+		for _, c := range b.Constants {
+			if fn, ok := c.(*object.CompiledFunction); ok {
+				debug.string(fn.Name)
+				debug.lines(fn.Lines)
+			}
+		}
+
+		file.Debug = debug.w.Bytes()
+	}
+
+	return file.Encode(w)
+}
+
+func (b *Bytecode) hasDebugInfo() bool {
+
+	if len(b.Lines) != 0 {
+		return true
+	}
+
+	for _, c := range b.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok && (fn.Name != "" || len(fn.Lines) != 0) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *encoder) constant(obj object.Object) error {
+
+	switch obj := obj.(type) {
+
+	case *object.Integer:
+		e.w.WriteByte(constantInteger)
+		e.int(obj.Value)
+
+	case *object.String:
+		e.w.WriteByte(constantString)
+		e.string(obj.Value)
+
+	case *object.Float:
+		e.w.WriteByte(constantFloat)
+		e.float(obj.Value)
+
+	case *object.CompiledFunction:
+
+		if obj.Generator {
+			e.w.WriteByte(constantGenerator)
+		} else {
+			e.w.WriteByte(constantFunction)
+		}
+
+		e.instructions(obj.Instructions)
+		e.uint(obj.NumLocals)
+		e.uint(obj.NumParameters)
+
+	default:
+		return fmt.Errorf("cannot encode constant of type %s", obj.Type())
+	}
+
+	return nil
+}
+
+func (e *encoder) instructions(ins code.Instructions) {
+	e.uint(len(ins))
+	e.w.Write(ins)
+}
+
+func (e *encoder) lines(lines code.LineTable) {
+
+	e.uint(len(lines))
+
+	for _, l := range lines {
+		e.uint(l.Offset)
+		e.uint(l.Line)
+	}
+}
+
+func (e *encoder) string(s string) {
+	e.uint(len(s))
+	e.w.WriteString(s)
+}
+
+func (e *encoder) uint(n int) {
+	size := binary.PutUvarint(e.buf[:], uint64(n))
+	e.w.Write(e.buf[:size])
+}
+
+func (e *encoder) int(n int64) {
+	size := binary.PutVarint(e.buf[:], n)
+	e.w.Write(e.buf[:size])
+}
+
+// ビット列をそのまま書くので、NaNなども変わらずに読み込める
+func (e *encoder) float(f float64) {
+	size := binary.PutUvarint(e.buf[:], math.Float64bits(f))
+	e.w.Write(e.buf[:size])
+}
+
+type decoder struct {
+	r *bytes.Reader
+	// 最初に起きたエラー。以降の読み込みは何もしない
+	err error
+}
+
+// Encodeで書き出したものを読み込む
+// 違うバージョンの形式は読み込まない
+func DecodeBytecode(r io.Reader) (*Bytecode, error) {
+
+	file, err := code.DecodeFile(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bytecode := &Bytecode{
+		Instructions: file.Instructions,
+		Lines:        code.LineTable{},
+		Constants:    []object.Object{},
+	}
+
+	d := &decoder{r: bytes.NewReader(file.Constants)}
+
+	n := d.uint()
+
+	for i := 0; i < n && d.err == nil; i++ {
+
+		c := d.constant()
+
+		if d.err != nil {
+			return nil, fmt.Errorf("constant %d: %s", i, d.err)
+		}
+
+		bytecode.Constants = append(bytecode.Constants, c)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if file.Debug == nil {
+		return bytecode, nil
+	}
+
+	d = &decoder{r: bytes.NewReader(file.Debug)}
+
+	bytecode.Lines = d.lines()
+
+	for _, c := range bytecode.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			fn.Name = d.string()
+			fn.Lines = d.lines()
+		}
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("debug info: %s", d.err)
+	}
+
+	return bytecode, nil
+}
+
+func (d *decoder) constant() object.Object {
+
+	kind := d.byte()
+
+	switch kind {
+
+	case constantInteger:
+		return &object.Integer{Value: d.int()}
+
+	case constantString:
+		return &object.String{Value: d.string()}
+
+	case constantFloat:
+		return &object.Float{Value: d.float()}
+
+	case constantFunction, constantGenerator:
+		return &object.CompiledFunction{
+			Instructions:  d.instructions(),
+			NumLocals:     d.uint(),
+			NumParameters: d.uint(),
+			Generator:     kind == constantGenerator,
+			Lines:         code.LineTable{},
+		}
+	}
+
+	d.fail(fmt.Errorf("unknown constant kind %d", kind))
+
+	return nil
+}
+
+func (d *decoder) instructions() code.Instructions {
+	return code.Instructions(d.bytes())
+}
+
+func (d *decoder) lines() code.LineTable {
+
+	n := d.uint()
+
+	lines := code.LineTable{}
+
+	for i := 0; i < n && d.err == nil; i++ {
+		lines = append(lines, code.LineEntry{Offset: d.uint(), Line: d.uint()})
+	}
+
+	return lines
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// 長さが壊れていても大きな領域を先に確保しないように、読めた分だけ使う
+func (d *decoder) bytes() []byte {
+
+	n := d.uint()
+
+	if d.err != nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+		d.fail(err)
+	}
+
+	return buf.Bytes()
+}
+
+func (d *decoder) byte() byte {
+
+	if d.err != nil {
+		return 0
+	}
+
+	b, err := d.r.ReadByte()
+
+	d.fail(err)
+
+	return b
+}
+
+func (d *decoder) uint() int {
+
+	if d.err != nil {
+		return 0
+	}
+
+	n, err := binary.ReadUvarint(d.r)
+
+	if err == nil && n > math.MaxInt32 {
+		err = fmt.Errorf("length out of range: %d", n)
+	}
+
+	d.fail(err)
+
+	return int(n)
+}
+
+func (d *decoder) int() int64 {
+
+	if d.err != nil {
+		return 0
+	}
+
+	n, err := binary.ReadVarint(d.r)
+
+	d.fail(err)
+
+	return n
+}
+
+func (d *decoder) float() float64 {
+
+	if d.err != nil {
+		return 0
+	}
+
+	bits, err := binary.ReadUvarint(d.r)
+
+	d.fail(err)
+
+	return math.Float64frombits(bits)
+}
+
+func (d *decoder) fail(err error) {
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil && d.err == nil {
+		d.err = fmt.Errorf("truncated or corrupt bytecode: %s", err)
+	}
+}
@@ -0,0 +1,91 @@
+package compiler
+
+import (
+	"fmt"
+
+	"example.com/monkey/ast"
+)
+
+// コンパイル時の判断の記録(monkey check --explain 用)
+// どの行でどのシンボルが定義・解決されたか、
+// どの行からどの範囲のインストラクションが生成されたかを記録する
+type Explanation struct {
+	Symbols []SymbolNote
+	Ranges  []RangeNote
+}
+
+type SymbolNote struct {
+	Line int
+	// "define", "resolve", "assign" または "capture"(クロージャへの自由変数の転送)
+	Action string
+	Symbol Symbol
+}
+
+type RangeNote struct {
+	Line int
+	// インストラクションが生成された関数の名前、トップレベルは"main"
+	Function string
+	// インストラクションの範囲 [Start, End)
+	Start int
+	End   int
+}
+
+// 以降のCompileでの判断を記録するようにする
+func (c *Compiler) EnableExplain() {
+	c.explanation = &Explanation{}
+}
+
+// 記録した内容を返す。EnableExplainしていなければnil
+func (c *Compiler) Explanation() *Explanation {
+	return c.explanation
+}
+
+func (c *Compiler) explainSymbol(line int, action string, s Symbol) {
+
+	if c.explanation == nil {
+		return
+	}
+
+	c.explanation.Symbols = append(c.explanation.Symbols,
+		SymbolNote{Line: line, Action: action, Symbol: s})
+}
+
+func (c *Compiler) explainRange(line int, function string, start int) {
+
+	end := len(c.currentInstructions())
+
+	if end <= start {
+		return
+	}
+
+	c.explanation.Ranges = append(c.explanation.Ranges,
+		RangeNote{Line: line, Function: function, Start: start, End: end})
+}
+
+// 文の行番号、ブロック文の場合は記録しないので0を返す
+func statementLine(node ast.Node) int {
+
+	switch node := node.(type) {
+
+	case *ast.LetStatement:
+		return node.Token.Line
+
+	case *ast.ReturnStatement:
+		return node.Token.Line
+
+	case *ast.ExpressionStatement:
+		return node.Token.Line
+	}
+
+	return 0
+}
+
+// 関数リテラルの名前、無名関数の場合は定義された位置
+func functionName(node *ast.FunctionLiteral) string {
+
+	if node.Name != "" {
+		return node.Name
+	}
+
+	return fmt.Sprintf("fn@%d:%d", node.Token.Line, node.Token.Column)
+}
@@ -0,0 +1,50 @@
+package compiler
+
+import (
+	"example.com/monkey/ast"
+	"example.com/monkey/object"
+)
+
+// 式を1つだけコンパイルする
+// namesは式の中から参照できる変数で、先頭から順にグローバル変数0, 1, ...に割り当てる
+// 実行前にVMのグローバル変数に値をセットしておくこと
+func CompileExpression(exp ast.Expression, names []string) (*Bytecode, error) {
+	return CompileExpressionWithState(exp, names, nil, nil)
+}
+
+// CompileExpressionと同じだが、実行中のプログラムと同じ組み込み関数と定数を使う
+// builtinsは組み込み関数の名前をインデックス順に並べたもの。nilならobject.Builtins
+// 式の定数はconstantsの後ろに追加するので、プログラムの関数を式から呼べる
+// (constantsそのものは書き換えない)
+func CompileExpressionWithState(exp ast.Expression, names []string, builtins []string, constants []object.Object) (*Bytecode, error) {
+
+	symbolTable := NewSymbolTable()
+
+	if builtins == nil {
+		for i, v := range object.Builtins {
+			symbolTable.DefineBuiltin(i, v.Name)
+		}
+	}
+
+	for i, name := range builtins {
+		symbolTable.DefineBuiltin(i, name)
+	}
+
+	for _, name := range names {
+		symbolTable.Define(name)
+	}
+
+	c := NewWithState(symbolTable, constants[:len(constants):len(constants)])
+
+	program := &ast.Program{
+		Statements: []ast.Statement{
+			&ast.ExpressionStatement{Expression: exp},
+		},
+	}
+
+	if err := c.Compile(program); err != nil {
+		return nil, err
+	}
+
+	return c.Bytecode(), nil
+}
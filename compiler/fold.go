@@ -0,0 +1,224 @@
+package compiler
+
+import (
+	"example.com/monkey/ast"
+	"example.com/monkey/code"
+	"example.com/monkey/object"
+)
+
+// 定数畳み込み
+// リテラルだけでできた式(2 * 3 + 4 など)はコンパイル時に計算して
+// 1つのOpConstant(真偽値ならOpTrue/OpFalse)にする
+// VMと結果が変わらないものだけを畳み込み、
+// 0除算のように実行時エラーになるものはそのままVMに任せる
+// int64の範囲を超える演算も、VMの設定で結果が変わるので畳み込まない
+
+func (c *Compiler) fold(node ast.Expression) (object.Object, bool) {
+
+	if !c.options.EnableConstantFolding {
+		return nil, false
+	}
+
+	return foldConstant(node)
+}
+
+// 畳み込めればその値を返す
+func foldConstant(node ast.Expression) (object.Object, bool) {
+
+	switch node := node.(type) {
+
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}, true
+
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}, true
+
+	case *ast.Boolean:
+		return nativeBool(node.Value), true
+
+	case *ast.NullLiteral:
+		return null, true
+
+	case *ast.PrefixExpression:
+
+		right, ok := foldConstant(node.Right)
+
+		if !ok {
+			return nil, false
+		}
+
+		return foldPrefix(node.Operator, right)
+
+	case *ast.InfixExpression:
+
+		left, ok := foldConstant(node.Left)
+
+		if !ok {
+			return nil, false
+		}
+
+		right, ok := foldConstant(node.Right)
+
+		if !ok {
+			return nil, false
+		}
+
+		return foldInfix(node.Operator, left, right)
+	}
+
+	return nil, false
+}
+
+var (
+	trueValue  = &object.Boolean{Value: true}
+	falseValue = &object.Boolean{Value: false}
+	null       = &object.Null{}
+)
+
+func nativeBool(b bool) *object.Boolean {
+	if b {
+		return trueValue
+	}
+	return falseValue
+}
+
+func foldPrefix(operator string, right object.Object) (object.Object, bool) {
+
+	switch operator {
+
+	case "!":
+		// VMのOpBangと同じ: false と null だけが真になる
+		switch right {
+		case falseValue, null:
+			return trueValue, true
+		default:
+			return falseValue, true
+		}
+
+	case "-":
+		if right, ok := right.(*object.Integer); ok {
+			if value, overflow := object.NegInt64(right.Value); !overflow {
+				return &object.Integer{Value: value}, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+func foldInfix(operator string, left, right object.Object) (object.Object, bool) {
+
+	switch left := left.(type) {
+
+	case *object.Integer:
+
+		right, ok := right.(*object.Integer)
+
+		if !ok {
+			return nil, false
+		}
+
+		l, r := left.Value, right.Value
+
+		switch operator {
+		case "+":
+			return foldInteger(object.AddInt64(l, r))
+		case "-":
+			return foldInteger(object.SubInt64(l, r))
+		case "*":
+			return foldInteger(object.MulInt64(l, r))
+		case "/":
+			if r == 0 {
+				return nil, false
+			}
+			return foldInteger(object.DivInt64(l, r))
+		case "%":
+			if r == 0 {
+				return nil, false
+			}
+			return &object.Integer{Value: l % r}, true
+		case "<":
+			return nativeBool(l < r), true
+		case ">":
+			return nativeBool(l > r), true
+		case "<=":
+			return nativeBool(l <= r), true
+		case ">=":
+			return nativeBool(l >= r), true
+		case "==":
+			return nativeBool(l == r), true
+		case "!=":
+			return nativeBool(l != r), true
+		}
+
+	case *object.String:
+
+		right, ok := right.(*object.String)
+
+		if !ok {
+			return nil, false
+		}
+
+		l, r := left.Value, right.Value
+
+		// 比較はVMと同じく中身を辞書順(バイト列)で比べる
+		switch operator {
+		case "+":
+			return &object.String{Value: l + r}, true
+		case "<":
+			return nativeBool(l < r), true
+		case ">":
+			return nativeBool(l > r), true
+		case "<=":
+			return nativeBool(l <= r), true
+		case ">=":
+			return nativeBool(l >= r), true
+		case "==":
+			return nativeBool(l == r), true
+		case "!=":
+			return nativeBool(l != r), true
+		}
+
+	case *object.Boolean:
+
+		if _, ok := right.(*object.Boolean); !ok {
+			return nil, false
+		}
+
+		switch operator {
+		case "==":
+			return nativeBool(left == right), true
+		case "!=":
+			return nativeBool(left != right), true
+		}
+	}
+
+	return nil, false
+}
+
+func foldInteger(value int64, overflow bool) (object.Object, bool) {
+
+	if overflow {
+		return nil, false
+	}
+
+	return &object.Integer{Value: value}, true
+}
+
+// 畳み込んだ値をスタックに積む
+func (c *Compiler) emitFolded(obj object.Object) {
+
+	switch obj {
+	case trueValue:
+		c.emit(code.OpTrue)
+		return
+	case falseValue:
+		c.emit(code.OpFalse)
+		return
+	case null:
+		c.emit(code.OpNull)
+		return
+	}
+
+	c.emit(code.OpConstant, c.addConstant(obj))
+}
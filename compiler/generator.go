@@ -0,0 +1,39 @@
+package compiler
+
+import (
+	"fmt"
+
+	"example.com/monkey/ast"
+	"example.com/monkey/code"
+)
+
+// yield expr
+//
+//	expr (省いたときはOpNull)
+//	OpYield
+//
+// yieldがある関数はgeneratorになり、呼び出すと本体を実行せずにGeneratorを返す
+// next(g, v)で再開したとき、vがyield式の値になる
+func (c *Compiler) compileYield(node *ast.YieldExpression) error {
+
+	scope := &c.scopes[c.scopeIndex]
+
+	if c.scopeIndex == 0 || scope.module {
+		return fmt.Errorf("yield outside function")
+	}
+
+	if node.Value != nil {
+
+		if err := c.Compile(node.Value); err != nil {
+			return err
+		}
+	} else {
+		c.emit(code.OpNull)
+	}
+
+	c.emit(code.OpYield)
+
+	scope.generator = true
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package compiler
+
+import (
+	"fmt"
+
+	"example.com/monkey/ast"
+)
+
+// 小さな関数呼び出しのインライン展開
+//
+//	let double = fn(x) { x * 2 }; double(3)
+//
+// のような呼び出しを、引数を隠れた変数に保存してから本体の式を直接コンパイルする
+// 呼び出しのフレームを作らずに済む
+//
+// 展開するのは、本体が1つの式で、パラメーターとリテラルと演算子だけでできている関数
+// (グローバル変数や組み込み関数を参照すると、呼び出し側で別の変数に隠されることがある)
+// letで定義し、プログラムのどこでも代入していない名前だけを対象にする
+
+// 本体の式のノードの数の上限
+const maxInlineNodes = 16
+
+type inlineKey struct {
+	// 関数を定義したスコープ(関数またはグローバル)のテーブル
+	table  *SymbolTable
+	symbol Symbol
+}
+
+// プログラムの中で代入されている名前を集める
+func (c *Compiler) scanAssignments(program *ast.Program) {
+
+	if c.assigned == nil {
+		c.assigned = map[string]bool{}
+	}
+
+	ast.Modify(program, func(node ast.Node) ast.Node {
+		if assign, ok := node.(*ast.AssignExpression); ok {
+			c.assigned[assign.Name.Value] = true
+		}
+		return node
+	})
+}
+
+// letで定義した関数が展開できれば記録する
+func (c *Compiler) recordInline(node *ast.LetStatement, symbol Symbol) {
+
+	fn, ok := node.Value.(*ast.FunctionLiteral)
+
+	if !ok || !c.options.EnableInlining || c.assigned[symbol.Name] || c.explanation != nil {
+		return
+	}
+
+	if len(fn.Body.Statements) != 1 {
+		return
+	}
+
+	statement, ok := fn.Body.Statements[0].(*ast.ExpressionStatement)
+
+	if !ok {
+		return
+	}
+
+	params := map[string]bool{}
+
+	for _, p := range fn.Parameters {
+		params[p.Value] = true
+	}
+
+	nodes := 0
+
+	if !inlinable(statement.Expression, params, &nodes) {
+		return
+	}
+
+	if c.inlines == nil {
+		c.inlines = map[inlineKey]*ast.FunctionLiteral{}
+	}
+
+	c.inlines[inlineKey{c.symbolTable.owner(), symbol}] = fn
+}
+
+func inlinable(node ast.Expression, params map[string]bool, nodes *int) bool {
+
+	*nodes++
+
+	if *nodes > maxInlineNodes {
+		return false
+	}
+
+	switch node := node.(type) {
+
+	case *ast.IntegerLiteral, *ast.StringLiteral, *ast.Boolean, *ast.NullLiteral:
+		return true
+
+	case *ast.Identifier:
+		return params[node.Value]
+
+	case *ast.PrefixExpression:
+		return inlinable(node.Right, params, nodes)
+
+	case *ast.InfixExpression:
+		return inlinable(node.Left, params, nodes) && inlinable(node.Right, params, nodes)
+
+	case *ast.IndexExpression:
+		return inlinable(node.Left, params, nodes) && inlinable(node.Index, params, nodes)
+
+	case *ast.ArrayLiteral:
+		for _, e := range node.Elements {
+			if !inlinable(e, params, nodes) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// 呼び出しを展開できれば展開する
+func (c *Compiler) compileInline(node *ast.CallExpression) (bool, error) {
+
+	ident, ok := node.Function.(*ast.Identifier)
+
+	if !ok || len(c.inlines) == 0 {
+		return false, nil
+	}
+
+	symbol, ok := c.symbolTable.Resolve(ident.Value)
+
+	if !ok {
+		return false, nil
+	}
+
+	table := c.symbolTable.owner()
+
+	if symbol.Scope == GlobalScope {
+		for table.Outer != nil {
+			table = table.Outer
+		}
+	}
+
+	key := inlineKey{table, symbol}
+
+	// REPLのように入力をまたいでコンパイルすると、定義した後の入力で代入されることがある
+	if c.assigned[ident.Value] {
+		delete(c.inlines, key)
+		return false, nil
+	}
+
+	fn, ok := c.inlines[key]
+
+	// 引数の数が違う呼び出しは、VMにエラーを出させる
+	if !ok || len(fn.Parameters) != len(node.Arguments) {
+		return false, nil
+	}
+
+	for _, a := range node.Arguments {
+		if err := c.Compile(a); err != nil {
+			return true, err
+		}
+	}
+
+	// 全ての引数を評価してから保存する(引数の中の展開も同じ変数を使うため)
+	slots := make([]Symbol, len(fn.Parameters))
+
+	for i := range slots {
+		slots[i] = c.inlineSlot(i)
+	}
+
+	for i := len(slots) - 1; i >= 0; i-- {
+		c.storeSymbol(slots[i])
+	}
+
+	c.enterBlock()
+	defer c.leaveBlock()
+
+	for i, p := range fn.Parameters {
+		c.symbolTable.store[p.Value] = slots[i]
+	}
+
+	body := fn.Body.Statements[0].(*ast.ExpressionStatement)
+
+	return true, c.Compile(body.Expression)
+}
+
+// 展開した関数の引数を置く変数
+// 同じ関数(またはグローバル)の中の展開で使い回す
+func (c *Compiler) inlineSlot(i int) Symbol {
+
+	owner := c.symbolTable.owner()
+	name := fmt.Sprintf("inline %d", i)
+
+	owner.mu.RLock()
+	symbol, ok := owner.store[name]
+	owner.mu.RUnlock()
+
+	if ok {
+		return symbol
+	}
+
+	return owner.Define(name)
+}
@@ -0,0 +1,31 @@
+package compiler
+
+import "example.com/monkey/code"
+
+// ジャンプ先が2バイトに収まらないジャンプ命令を記録し、代わりに入れておく仮のジャンプ先を返す
+// 関数(またはトップレベル)のコンパイルが終わったら、widenで4バイトの命令に変える
+func (c *Compiler) farJump(pos int, target int) int {
+
+	scope := &c.scopes[c.scopeIndex]
+
+	if scope.farJumps == nil {
+		scope.farJumps = map[int]int{}
+	}
+
+	scope.farJumps[pos] = target
+
+	return 0
+}
+
+func (c *Compiler) widen(ins code.Instructions, lines code.LineTable) (code.Instructions, code.LineTable) {
+
+	far := c.scopes[c.scopeIndex].farJumps
+
+	if len(far) == 0 {
+		return ins, lines
+	}
+
+	widened, moved := code.WidenJumps(ins, far)
+
+	return widened, lines.Remap(moved)
+}
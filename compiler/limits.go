@@ -0,0 +1,91 @@
+package compiler
+
+import (
+	"fmt"
+
+	"example.com/monkey/ast"
+)
+
+// OpGetLocal/OpSetLocal/OpCall/OpClosureのオペランドは1バイトなので、
+// それを超える関数はそのままでは表現できない。黙って切り詰めずにエラーにする
+const (
+	// ローカル変数のインデックスは0から255まで
+	MaxLocals = 256
+	// OpCallの引数の数
+	MaxArguments = 255
+	// OpClosureでキャプチャする変数の数
+	MaxFreeVariables = 255
+
+	// OpArray/OpHashのオペランドは2バイト
+	// 配列の要素の数
+	MaxArrayElements = 65535
+	// ハッシュのペアの数(オペランドはキーと値の数)
+	MaxHashPairs = 65535 / 2
+
+	// OpGetGlobal/OpSetGlobalのオペランドは2バイト (VMのGlobalsSizeと同じ)
+	MaxGlobals = 65536
+)
+
+// グローバル変数のインデックスが命令に収まらなければ、最初のエラーとして記録する
+// 定義した時点ではなく、命令を出力するときに検査する(隠れた変数も含めるため)
+func (c *Compiler) checkGlobalLimit(s Symbol) {
+
+	if s.Scope != GlobalScope || s.Index < MaxGlobals || c.operandErr != nil {
+		return
+	}
+
+	c.operandErr = fmt.Errorf("too many global bindings: %s is binding %d (max %d)",
+		s.Name, s.Index+1, MaxGlobals)
+}
+
+func checkFunctionLimits(node *ast.FunctionLiteral, numLocals int, numFree int) error {
+
+	name := functionName(node)
+
+	if len(node.Parameters) > MaxArguments {
+		return fmt.Errorf("function %s has too many parameters: %d (max %d)",
+			name, len(node.Parameters), MaxArguments)
+	}
+
+	if numLocals > MaxLocals {
+		return fmt.Errorf("function %s has too many local variables: %d (max %d)",
+			name, numLocals, MaxLocals)
+	}
+
+	if numFree > MaxFreeVariables {
+		return fmt.Errorf("function %s captures too many variables: %d (max %d)",
+			name, numFree, MaxFreeVariables)
+	}
+
+	return nil
+}
+
+func checkLiteralLimits(node ast.Expression) error {
+
+	switch node := node.(type) {
+
+	case *ast.ArrayLiteral:
+		if len(node.Elements) > MaxArrayElements {
+			return fmt.Errorf("array literal has too many elements: %d (max %d)",
+				len(node.Elements), MaxArrayElements)
+		}
+
+	case *ast.HashLiteral:
+		if len(node.Pairs) > MaxHashPairs {
+			return fmt.Errorf("hash literal has too many pairs: %d (max %d)",
+				len(node.Pairs), MaxHashPairs)
+		}
+	}
+
+	return nil
+}
+
+func checkCallLimits(node *ast.CallExpression) error {
+
+	if len(node.Arguments) > MaxArguments {
+		return fmt.Errorf("too many arguments in call to %s: %d (max %d)",
+			node.Function.String(), len(node.Arguments), MaxArguments)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package compiler
+
+import (
+	"example.com/monkey/ast"
+	"example.com/monkey/code"
+)
+
+// 実行時エラーの位置を表示するため、命令ごとにどの行から生成されたかを記録する
+// ノードのコンパイル中はその行を現在の行にして、終わったら外側のノードの行に戻す
+
+// 行を記録するノード
+// 実行時エラーになりうる式と文だけで十分
+func sourceLine(node ast.Node) int {
+
+	switch node := node.(type) {
+
+	case *ast.LetStatement:
+		return node.Token.Line
+	case *ast.ConstStatement:
+		return node.Token.Line
+	case *ast.ReturnStatement:
+		return node.Token.Line
+	case *ast.ExpressionStatement:
+		return node.Token.Line
+	case *ast.ThrowStatement:
+		return node.Token.Line
+	case *ast.BreakStatement:
+		return node.Token.Line
+	case *ast.ContinueStatement:
+		return node.Token.Line
+	case *ast.PrefixExpression:
+		return node.Token.Line
+	case *ast.InfixExpression:
+		return node.Token.Line
+	case *ast.RangeExpression:
+		return node.Token.Line
+	case *ast.CallExpression:
+		return node.Token.Line
+	case *ast.IndexExpression:
+		return node.Token.Line
+	case *ast.SliceExpression:
+		return node.Token.Line
+	case *ast.ForInExpression:
+		return node.Token.Line
+	case *ast.WhileExpression:
+		return node.Token.Line
+	case *ast.AssignExpression:
+		return node.Token.Line
+	}
+
+	return 0
+}
+
+// 現在の行を変更し、元に戻す関数を返す
+func (c *Compiler) setLine(line int) func() {
+
+	scope := c.scopeIndex
+	previous := c.scopes[scope].line
+
+	c.scopes[scope].line = line
+
+	return func() {
+		c.scopes[scope].line = previous
+	}
+}
+
+// posから始まる命令を現在の行に対応付ける
+func (c *Compiler) addLine(pos int) {
+
+	scope := &c.scopes[c.scopeIndex]
+
+	if scope.line == 0 || !c.options.EmitDebugInfo {
+		return
+	}
+
+	// removeLastPopで切り詰めた位置の記録は捨てる
+	lines := scope.lines
+
+	for len(lines) > 0 && lines[len(lines)-1].Offset >= pos {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) > 0 && lines[len(lines)-1].Line == scope.line {
+		scope.lines = lines
+		return
+	}
+
+	scope.lines = append(lines, code.LineEntry{Offset: pos, Line: scope.line})
+}
@@ -0,0 +1,63 @@
+package compiler
+
+import (
+	"example.com/monkey/ast"
+	"example.com/monkey/code"
+)
+
+// && と || は右辺を必要なときだけ評価する
+// 結果は右辺の値ではなく、常にtrueかfalseになる
+//
+//	a && b                      a || b
+//	  a                           a
+//	  OpJumpNotTruthy FALSE       OpJumpNotTruthy RIGHT
+//	  b                           OpTrue
+//	  OpBang                      OpJump END
+//	  OpBang                    RIGHT:
+//	  OpJump END                  b
+//	FALSE:                        OpBang
+//	  OpFalse                     OpBang
+//	END:                        END:
+func (c *Compiler) compileLogical(node *ast.InfixExpression) error {
+
+	if err := c.Compile(node.Left); err != nil {
+		return err
+	}
+
+	jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	if node.Operator == "||" {
+		c.emit(code.OpTrue)
+	} else if err := c.compileTruthy(node.Right); err != nil {
+		return err
+	}
+
+	jumpPos := c.emit(code.OpJump, 9999)
+
+	c.changeOperand(jumpNotTruthyPos, len(c.currentInstructions()))
+
+	if node.Operator == "||" {
+		if err := c.compileTruthy(node.Right); err != nil {
+			return err
+		}
+	} else {
+		c.emit(code.OpFalse)
+	}
+
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+
+	return nil
+}
+
+// 値をtrueかfalseに変換してスタックに積む
+func (c *Compiler) compileTruthy(node ast.Expression) error {
+
+	if err := c.Compile(node); err != nil {
+		return err
+	}
+
+	c.emit(code.OpBang)
+	c.emit(code.OpBang)
+
+	return nil
+}
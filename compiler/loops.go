@@ -0,0 +1,87 @@
+package compiler
+
+import (
+	"fmt"
+
+	"example.com/monkey/code"
+)
+
+// コンパイル中のループ
+type loop struct {
+	// continueのジャンプ先(条件の評価かOpIterNext)
+	start int
+	// for-inのループ中はスタックにイテレーターが置かれている
+	iterator bool
+	// 後からループの後ろを指すように書き換えるbreakのOpJumpの位置
+	breaks []int
+	// ループに入ったときに開いていたtryの数 (try.go)
+	tries int
+}
+
+func (c *Compiler) enterLoop(start int, iterator bool) {
+
+	scope := &c.scopes[c.scopeIndex]
+
+	scope.loops = append(scope.loops, &loop{start: start, iterator: iterator, tries: scope.tries})
+}
+
+// ループの後ろの位置が決まったので、breakのジャンプ先を書き換える
+func (c *Compiler) leaveLoop(end int) {
+
+	scope := &c.scopes[c.scopeIndex]
+
+	l := scope.loops[len(scope.loops)-1]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+
+	for _, pos := range l.breaks {
+		c.changeOperand(pos, end)
+	}
+}
+
+// 関数の外のループは対象にしない
+func (c *Compiler) currentLoop() *loop {
+
+	loops := c.scopes[c.scopeIndex].loops
+
+	if len(loops) == 0 {
+		return nil
+	}
+
+	return loops[len(loops)-1]
+}
+
+func (c *Compiler) compileBreak() error {
+
+	l := c.currentLoop()
+
+	if l == nil {
+		return fmt.Errorf("break outside of a loop")
+	}
+
+	c.endTries(l)
+
+	// OpIterNextを通らずに抜けるので、イテレーターは自分で捨てる
+	if l.iterator {
+		c.emit(code.OpPop)
+	}
+
+	// Emit an `OpJump` with a bogus value
+	l.breaks = append(l.breaks, c.emit(code.OpJump, 9999))
+
+	return nil
+}
+
+func (c *Compiler) compileContinue() error {
+
+	l := c.currentLoop()
+
+	if l == nil {
+		return fmt.Errorf("continue outside of a loop")
+	}
+
+	c.endTries(l)
+
+	c.emit(code.OpJump, l.start)
+
+	return nil
+}
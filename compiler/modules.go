@@ -0,0 +1,282 @@
+package compiler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"example.com/monkey/ast"
+	"example.com/monkey/code"
+	"example.com/monkey/lexer"
+	"example.com/monkey/object"
+	"example.com/monkey/parser"
+)
+
+// import "path" でモジュールを読み込む
+//
+// モジュールは1つの関数としてコンパイルし、トップレベルのlet/constを
+// 名前をキーにしたハッシュにして返す。関数は同じ定数プールに入り、
+// 結果は隠れたグローバル変数に保存するので、何度importしても1回しか実行しない
+
+// importのパスからモジュールの構文木を返す
+// fromはimportを書いたモジュールの名前(トップレベルは"")
+// 返す名前は同じモジュールを見分けるのに使う
+type ModuleResolver interface {
+	Resolve(from string, path string) (string, *ast.Program, error)
+}
+
+func (c *Compiler) SetModuleResolver(r ModuleResolver) {
+	c.resolver = r
+}
+
+// ファイルからモジュールを読み込む
+// 相対パスはimportを書いたファイルのディレクトリ(トップレベルはDir)から探す
+type FileResolver struct {
+	Dir string
+}
+
+func (r FileResolver) Resolve(from string, path string) (string, *ast.Program, error) {
+
+	dir := r.Dir
+
+	if from != "" {
+		dir = filepath.Dir(from)
+	}
+
+	name := path
+
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(dir, path)
+	}
+
+	name = filepath.Clean(name)
+
+	src, err := ioutil.ReadFile(name)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	p := parser.New(lexer.New(string(src)))
+
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+		return "", nil, fmt.Errorf("parser errors in %s: %s", name, strings.Join(p.Errors(), "; "))
+	}
+
+	return name, program, nil
+}
+
+func (c *Compiler) compileImport(node *ast.ImportExpression) error {
+
+	if c.resolver == nil {
+		return fmt.Errorf("cannot import %q: no module resolver", node.Path)
+	}
+
+	from := ""
+
+	if len(c.importing) > 0 {
+		from = c.importing[len(c.importing)-1]
+	}
+
+	name, program, err := c.resolver.Resolve(from, node.Path)
+
+	if err != nil {
+		return fmt.Errorf("cannot import %q: %s", node.Path, err)
+	}
+
+	for i, importing := range c.importing {
+		if importing == name {
+			cycle := append(c.importing[i:len(c.importing):len(c.importing)], name)
+			return fmt.Errorf("import cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	fnIndex, ok := c.modules[name]
+
+	if !ok {
+
+		fnIndex, err = c.compileModule(name, program)
+
+		if err != nil {
+			return err
+		}
+
+		if c.modules == nil {
+			c.modules = map[string]int{}
+		}
+
+		c.modules[name] = fnIndex
+	}
+
+	// 名前に空白を入れて、スクリプトから参照できないようにする
+	global := c.moduleGlobal("module " + name)
+
+	// まだ実行していなければ(nullなら)実行して保存する
+	c.emit(code.OpGetGlobal, global.Index)
+	jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+	c.emit(code.OpGetGlobal, global.Index)
+	jumpPos := c.emit(code.OpJump, 9999)
+
+	c.changeOperand(jumpNotTruthyPos, len(c.currentInstructions()))
+
+	c.emit(code.OpFunction, fnIndex)
+	c.emit(code.OpCall, 0)
+	c.emit(code.OpSetGlobal, global.Index)
+	c.emit(code.OpGetGlobal, global.Index)
+
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+
+	return nil
+}
+
+// モジュールの結果を保存するグローバル変数
+// 一番外側のテーブルに定義するので、REPLでは次の入力でも同じものを使う
+func (c *Compiler) moduleGlobal(name string) Symbol {
+
+	root := c.symbolTable
+
+	for root.Outer != nil {
+		root = root.Outer
+	}
+
+	if symbol, ok := root.resolve(name, false); ok {
+		return symbol
+	}
+
+	return root.Define(name)
+}
+
+// モジュールをコンパイルし、関数の定数のインデックスを返す
+func (c *Compiler) compileModule(name string, program *ast.Program) (int, error) {
+
+	symbolTable := c.symbolTable
+
+	c.enterScope()
+
+	c.scopes[c.scopeIndex].name = name
+	c.scopes[c.scopeIndex].module = true
+
+	// モジュールからは組み込み関数だけが見える
+	c.symbolTable = NewEnclosedSymbolTable(c.builtinTable())
+
+	c.importing = append(c.importing, name)
+
+	err := c.compileModuleBody(program)
+
+	c.importing = c.importing[:len(c.importing)-1]
+
+	numLocals := c.symbolTable.NumDefinitions()
+
+	instructions, lines := c.leaveScope()
+
+	c.symbolTable = symbolTable
+
+	if err != nil {
+		return 0, err
+	}
+
+	if c.operandErr != nil {
+		return 0, fmt.Errorf("module %s: %s", name, c.operandErr)
+	}
+
+	compiledFn := &object.CompiledFunction{
+		Instructions: instructions,
+		NumLocals:    numLocals,
+		Name:         name,
+		Lines:        lines,
+	}
+
+	if !c.options.EmitDebugInfo {
+		compiledFn.Name = ""
+	}
+
+	return c.addConstant(compiledFn), nil
+}
+
+func (c *Compiler) compileModuleBody(program *ast.Program) error {
+
+	exports := []string{}
+	exported := map[string]bool{}
+
+	c.scanAssignments(program)
+
+	for _, s := range program.Statements {
+
+		if err := c.Compile(s); err != nil {
+			return err
+		}
+
+		name := ""
+
+		switch s := s.(type) {
+		case *ast.LetStatement:
+			name = s.Name.Value
+		case *ast.ConstStatement:
+			name = s.Name.Value
+		}
+
+		if name != "" && !exported[name] {
+			exported[name] = true
+			exports = append(exports, name)
+		}
+	}
+
+	for _, name := range exports {
+
+		symbol, _ := c.symbolTable.Resolve(name)
+
+		c.emit(code.OpConstant, c.addConstant(&object.String{Value: name}))
+		c.loadSymbol(symbol)
+	}
+
+	c.emit(code.OpHash, len(exports)*2)
+	c.emit(code.OpReturnValue)
+
+	return nil
+}
+
+// 組み込み関数だけを定義したテーブル
+func (c *Compiler) builtinTable() *SymbolTable {
+
+	root := c.symbolTable
+
+	for root.Outer != nil {
+		root = root.Outer
+	}
+
+	builtins := NewSymbolTable()
+
+	for _, symbol := range root.Symbols() {
+		if symbol.Scope == BuiltinScope {
+			builtins.DefineBuiltin(symbol.Index, symbol.Name)
+		}
+	}
+
+	return builtins
+}
+
+// メモリ上のソースコードからモジュールを読み込む(組み込み用)
+// パスをそのままキーにする
+type MapResolver map[string]string
+
+func (r MapResolver) Resolve(from string, path string) (string, *ast.Program, error) {
+
+	src, ok := r[path]
+
+	if !ok {
+		return "", nil, fmt.Errorf("module not found")
+	}
+
+	p := parser.New(lexer.New(src))
+
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+		return "", nil, fmt.Errorf("parser errors in %s: %s", path, strings.Join(p.Errors(), "; "))
+	}
+
+	return path, program, nil
+}
@@ -0,0 +1,40 @@
+package compiler
+
+import "example.com/monkey/code"
+
+// 定数畳み込み(fold.go)とのぞき穴最適化(code.Optimize)をしないようにする
+// 演算子ごとのインストラクションを確認したいときに使う
+func (c *Compiler) DisableOptimizations() {
+	c.options.EnableConstantFolding = false
+	c.options.EnablePeephole = false
+	c.options.EnableSuperinstructions = false
+	c.options.EnableInlining = false
+}
+
+// 関数の中では値を積んですぐ捨てる命令も消す
+// トップレベルは最後にポップした値が結果になるので消さない
+// explainの記録は最適化前の位置なので、explainするときは最適化しない
+func (c *Compiler) optimize(
+	ins code.Instructions,
+	lines code.LineTable,
+	function bool,
+) (code.Instructions, code.LineTable) {
+
+	if !c.options.EnablePeephole || c.explanation != nil {
+		return ins, lines
+	}
+
+	rules := code.PeepholeRules
+
+	if function {
+		rules = append(rules[:len(rules):len(rules)], code.DiscardRule)
+	}
+
+	if c.options.EnableSuperinstructions {
+		rules = append(rules[:len(rules):len(rules)], code.SuperinstructionRules...)
+	}
+
+	optimized, moved := code.Optimize(ins, rules)
+
+	return optimized, lines.Remap(moved)
+}
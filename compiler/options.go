@@ -0,0 +1,41 @@
+package compiler
+
+// コンパイルの速さと、実行の速さやデバッグのしやすさのどれを取るか
+type Options struct {
+	// 定数同士の演算をコンパイル時に計算する (fold.go)
+	EnableConstantFolding bool
+	// のぞき穴最適化 (code.Optimize)
+	EnablePeephole bool
+	// のぞき穴最適化で、よく続く命令の組を1つの命令にまとめる (code.SuperinstructionRules)
+	EnableSuperinstructions bool
+	// 小さな関数の呼び出しを展開する (inline.go)
+	EnableInlining bool
+	// 命令とソースコードの行の対応と関数の名前を出力する
+	// 実行時エラーの位置の表示に使う
+	EmitDebugInfo bool
+	// spawnをコンパイルエラーにする (信頼できないスクリプトをコンパイルするとき)
+	DisallowSpawn bool
+}
+
+// Newで使うオプション。すべて有効
+func DefaultOptions() Options {
+	return Options{
+		EnableConstantFolding:   true,
+		EnablePeephole:          true,
+		EnableSuperinstructions: true,
+		EnableInlining:          true,
+		EmitDebugInfo:           true,
+	}
+}
+
+func NewWithOptions(opts Options) *Compiler {
+
+	compiler := New()
+	compiler.options = opts
+	return compiler
+}
+
+// NewWithStateで作ったコンパイラーにオプションを設定する
+func (c *Compiler) SetOptions(opts Options) {
+	c.options = opts
+}
@@ -0,0 +1,100 @@
+package compiler
+
+import (
+	"example.com/monkey/ast"
+	"example.com/monkey/code"
+)
+
+// REPLのように、同じコンパイラーで入力を少しずつコンパイルするためのもの
+//
+//	snapshot := c.Snapshot()
+//	c.Reset()
+//	if err := c.Compile(program); err != nil {
+//		c.Restore(snapshot) // 失敗した入力の定義と定数をなかったことにする
+//	}
+//
+// シンボルテーブルと定数はコンパイラーが持ち続けるので、
+// NewWithStateで毎回作り直して定数のスライスを受け渡す必要はない
+
+// コンパイラーのある時点の定義と定数
+type Snapshot struct {
+	table        *SymbolTable
+	symbols      *SymbolTable
+	numConstants int
+	modules      map[string]int
+	inlines      map[inlineKey]*ast.FunctionLiteral
+	assigned     map[string]bool
+}
+
+// 現在の定義と定数を記録する
+// 関数のコンパイルの途中ではなく、Compileの前後に呼ぶ
+func (c *Compiler) Snapshot() *Snapshot {
+
+	s := &Snapshot{
+		table:        c.symbolTable,
+		symbols:      c.symbolTable.Copy(),
+		numConstants: len(c.constants),
+		modules:      map[string]int{},
+		inlines:      map[inlineKey]*ast.FunctionLiteral{},
+		assigned:     map[string]bool{},
+	}
+
+	for name, index := range c.modules {
+		s.modules[name] = index
+	}
+
+	for key, fn := range c.inlines {
+		s.inlines[key] = fn
+	}
+
+	for name := range c.assigned {
+		s.assigned[name] = true
+	}
+
+	return s
+}
+
+// Snapshotの時点の定義と定数に戻し、命令を捨てる
+// シンボルテーブルは同じものを使い続ける(中身だけ戻す)
+func (c *Compiler) Restore(s *Snapshot) {
+
+	c.symbolTable = s.table
+	c.symbolTable.restore(s.symbols)
+
+	// 捨てた定数の場所は、前に渡したBytecodeと共有しないように作り直させる
+	c.constants = c.constants[:s.numConstants:s.numConstants]
+
+	c.modules = map[string]int{}
+	for name, index := range s.modules {
+		c.modules[name] = index
+	}
+
+	c.inlines = map[inlineKey]*ast.FunctionLiteral{}
+	for key, fn := range s.inlines {
+		c.inlines[key] = fn
+	}
+
+	c.assigned = map[string]bool{}
+	for name := range s.assigned {
+		c.assigned[name] = true
+	}
+
+	c.Reset()
+}
+
+// 出力した命令を捨て、次の入力をコンパイルできるようにする
+// 定義と定数はそのまま残る
+func (c *Compiler) Reset() {
+
+	c.scopes = []CompilationScope{{
+		instructions: code.Instructions{},
+		name:         "main",
+	}}
+	c.scopeIndex = 0
+
+	c.operandErr = nil
+	c.bindings = nil
+	c.captureWarnings = nil
+	c.importing = nil
+	c.traceDepth = 0
+}
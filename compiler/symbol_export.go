@@ -0,0 +1,117 @@
+package compiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// このスコープで定義されているシンボル(外側のスコープは含まない)
+// スコープ、インデックス、名前の順に並べる
+func (s *SymbolTable) Symbols() []Symbol {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	symbols := make([]Symbol, 0, len(s.store))
+
+	for _, symbol := range s.store {
+		symbols = append(symbols, symbol)
+	}
+
+	sort.Slice(symbols, func(i, j int) bool {
+		a, b := symbols[i], symbols[j]
+		if a.Scope != b.Scope {
+			return a.Scope < b.Scope
+		}
+		if a.Index != b.Index {
+			return a.Index < b.Index
+		}
+		return a.Name < b.Name
+	})
+
+	return symbols
+}
+
+// prefixで始まる名前(REPLの補完用)。外側のスコープも含め、名前順
+func (s *SymbolTable) Complete(prefix string) []string {
+
+	seen := map[string]bool{}
+	names := []string{}
+
+	for t := s; t != nil; t = t.Outer {
+		for _, symbol := range t.Symbols() {
+			if strings.HasPrefix(symbol.Name, prefix) && !seen[symbol.Name] {
+				seen[symbol.Name] = true
+				names = append(names, symbol.Name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+type exportedSymbol struct {
+	Name     string      `json:"name"`
+	Scope    SymbolScope `json:"scope"`
+	Index    int         `json:"index"`
+	Constant bool        `json:"constant,omitempty"`
+}
+
+type exportedTable struct {
+	Definitions int              `json:"definitions"`
+	Symbols     []exportedSymbol `json:"symbols"`
+}
+
+// グローバルのシンボルテーブルをJSONで書き出す(REPLのセッションの保存用)
+// グローバル変数の値は含まないので、VMのグローバル変数と一緒に保存する
+func (s *SymbolTable) Export(w io.Writer) error {
+
+	if s.Outer != nil {
+		return fmt.Errorf("cannot export an enclosed symbol table")
+	}
+
+	table := exportedTable{Definitions: s.NumDefinitions(), Symbols: []exportedSymbol{}}
+
+	for _, symbol := range s.Symbols() {
+		table.Symbols = append(table.Symbols, exportedSymbol(symbol))
+	}
+
+	return json.NewEncoder(w).Encode(table)
+}
+
+// Exportで書き出したシンボルテーブルを読み込む
+func ImportSymbolTable(r io.Reader) (*SymbolTable, error) {
+
+	var table exportedTable
+
+	if err := json.NewDecoder(r).Decode(&table); err != nil {
+		return nil, fmt.Errorf("invalid symbol table: %s", err)
+	}
+
+	s := NewSymbolTable()
+
+	for _, symbol := range table.Symbols {
+
+		switch symbol.Scope {
+		case GlobalScope:
+			if symbol.Index < 0 || symbol.Index >= table.Definitions {
+				return nil, fmt.Errorf("invalid symbol table: %s has index %d of %d definitions",
+					symbol.Name, symbol.Index, table.Definitions)
+			}
+		case BuiltinScope:
+		default:
+			return nil, fmt.Errorf("invalid symbol table: %s has scope %s", symbol.Name, symbol.Scope)
+		}
+
+		s.store[symbol.Name] = Symbol(symbol)
+	}
+
+	s.numDefinitions = table.Definitions
+
+	return s, nil
+}
@@ -1,5 +1,10 @@
 package compiler
 
+import (
+	"fmt"
+	"sync"
+)
+
 type SymbolScope string
 
 const (
@@ -14,25 +19,66 @@ type Symbol struct {
 	Name  string
 	Scope SymbolScope
 	Index int
+	// constで定義されたか
+	Constant bool
 }
 
+// 複数のgoroutineから同時に使える(サーバーのREPLなどで共有する場合)
+// 途中で失敗するかもしれないコンパイルは、Forkした複製で行ってからCommitする
 type SymbolTable struct {
 	Outer          *SymbolTable
 	store          map[string]Symbol
 	numDefinitions int
 	FreeSymbols    []Symbol
+	// 一度でも読まれた変数のインデックス (未使用の変数の警告用)
+	reads map[int]bool
+	// 内側の関数に捕捉されたローカル変数のインデックス
+	captured map[int]bool
+	// ブロックのスコープか
+	block bool
+
+	mu sync.RWMutex
+	// 定義を変更するたびに増やす
+	version int
+	// Forkした時点の元のテーブルのversion
+	forkedAt int
 }
 
 func NewSymbolTable() *SymbolTable {
 	s := make(map[string]Symbol)
 	free := []Symbol{}
-	return &SymbolTable{store: s, FreeSymbols: free}
+	return &SymbolTable{store: s, FreeSymbols: free, reads: map[int]bool{}, captured: map[int]bool{}}
 }
 
 func (s *SymbolTable) Define(name string) Symbol {
+	return s.define(name, false)
+}
+
+// constで定義する
+func (s *SymbolTable) DefineConstant(name string) Symbol {
+	return s.define(name, true)
+}
+
+func (s *SymbolTable) define(name string, constant bool) Symbol {
+
+	symbol := s.owner().allocate(name, constant)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.store[name] = symbol
+	s.version++
+	return symbol
+}
+
+// 変数の置き場所を確保する
+func (s *SymbolTable) allocate(name string, constant bool) Symbol {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	// Indexは 0 から始まる
-	symbol := Symbol{Name: name, Index: s.numDefinitions}
+	symbol := Symbol{Name: name, Index: s.numDefinitions, Constant: constant}
 
 	if s.Outer == nil {
 		symbol.Scope = GlobalScope
@@ -40,18 +86,56 @@ func (s *SymbolTable) Define(name string) Symbol {
 		symbol.Scope = LocalScope
 	}
 
-	s.store[name] = symbol
 	s.numDefinitions++
+	s.version++
 	return symbol
 }
 
+// ブロックの変数を置く、外側の関数またはグローバルのテーブル
+func (s *SymbolTable) owner() *SymbolTable {
+
+	for s.block {
+		s = s.Outer
+	}
+
+	return s
+}
+
+// このスコープでconstとして定義されているか
+// 外側のスコープの定数は内側で定義し直して隠すことができる
+func (s *SymbolTable) isConstant(name string) bool {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	symbol, ok := s.store[name]
+
+	return ok && symbol.Constant
+}
+
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
+	return s.resolve(name, true)
+}
 
+// 代入先を探すときは読んだことにしない
+func (s *SymbolTable) resolve(name string, read bool) (Symbol, bool) {
+
+	s.mu.RLock()
 	obj, ok := s.store[name]
+	s.mu.RUnlock()
+
+	if ok && read {
+		s.markRead(obj)
+	}
+
+	// ブロックの外側の変数は同じフレームにあるので、そのまま使える
+	if !ok && s.block {
+		return s.Outer.resolve(name, read)
+	}
 
 	if !ok && s.Outer != nil {
 
-		obj, ok = s.Outer.Resolve(name)
+		obj, ok = s.Outer.resolve(name, read)
 
 		if !ok {
 			return obj, ok
@@ -62,6 +146,10 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 			return obj, ok
 		}
 
+		if obj.Scope == LocalScope {
+			s.Outer.owner().markCaptured(obj)
+		}
+
 		free := s.defineFree(obj)
 
 		return free, true
@@ -70,6 +158,147 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	return obj, ok
 }
 
+func (s *SymbolTable) markRead(symbol Symbol) {
+
+	if symbol.Scope != GlobalScope && symbol.Scope != LocalScope {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reads[symbol.Index] = true
+}
+
+func (s *SymbolTable) markCaptured(symbol Symbol) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.captured[symbol.Index] = true
+}
+
+// このスコープのローカル変数が内側の関数に捕捉されたか
+// 捕捉された後の代入は、捕捉した関数からは見えない
+func (s *SymbolTable) IsCaptured(symbol Symbol) bool {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return symbol.Scope == LocalScope && s.owner().captured[symbol.Index]
+}
+
+// このスコープで定義された変数が一度でも読まれたか
+func (s *SymbolTable) IsRead(symbol Symbol) bool {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.reads[symbol.Index]
+}
+
+// このスコープで定義した変数の数
+func (s *SymbolTable) NumDefinitions() int {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.numDefinitions
+}
+
+// 定義済みのグローバル変数をすべてconstにして、定義し直せないようにする
+func (s *SymbolTable) Freeze() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, symbol := range s.store {
+		if symbol.Scope == GlobalScope {
+			symbol.Constant = true
+			s.store[name] = symbol
+		}
+	}
+
+	s.version++
+}
+
+// 同じシンボルを持つ新しいシンボルテーブルを返す
+// 元のテーブルは、コピーに定義を追加しても変わらない
+func (s *SymbolTable) Copy() *SymbolTable {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	copied := NewSymbolTable()
+
+	for name, symbol := range s.store {
+		copied.store[name] = symbol
+	}
+
+	for index := range s.reads {
+		copied.reads[index] = true
+	}
+
+	copied.numDefinitions = s.numDefinitions
+	copied.forkedAt = s.version
+
+	return copied
+}
+
+// 投機的なコンパイルのための複製を返す
+// 複製への定義は、Commitするまで元のテーブルに見えない
+func (s *SymbolTable) Fork() *SymbolTable {
+	return s.Copy()
+}
+
+// Forkした複製への定義を元のテーブルに反映する
+// Forkした後に元のテーブルが変更されていれば、インデックスが重なるので反映しない
+func (s *SymbolTable) Commit(fork *SymbolTable) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fork.mu.RLock()
+	defer fork.mu.RUnlock()
+
+	if fork.forkedAt != s.version {
+		return fmt.Errorf("symbol table changed since fork")
+	}
+
+	for name, symbol := range fork.store {
+		s.store[name] = symbol
+	}
+
+	for index := range fork.reads {
+		s.reads[index] = true
+	}
+
+	s.numDefinitions = fork.numDefinitions
+	s.version++
+
+	return nil
+}
+
+// Copyした時点の定義に戻す (snapshot.go)
+func (s *SymbolTable) restore(saved *SymbolTable) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.store = map[string]Symbol{}
+	for name, symbol := range saved.store {
+		s.store[name] = symbol
+	}
+
+	s.reads = map[int]bool{}
+	for index := range saved.reads {
+		s.reads[index] = true
+	}
+
+	s.numDefinitions = saved.numDefinitions
+	s.version++
+}
+
 func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 
 	s := NewSymbolTable()
@@ -79,20 +308,42 @@ func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	return s
 }
 
+// ブロックの中で定義した変数はブロックの外からは見えない
+// 変数の置き場所は外側の関数(またはグローバル)と共有する
+func NewBlockSymbolTable(outer *SymbolTable) *SymbolTable {
+
+	s := NewEnclosedSymbolTable(outer)
+
+	s.block = true
+
+	return s
+}
+
 func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
 
 	s.store[name] = symbol
+	s.version++
 
 	return symbol
 }
 
 func (s *SymbolTable) defineFree(original Symbol) Symbol {
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.FreeSymbols = append(s.FreeSymbols, original)
 
-	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1}
+	symbol := Symbol{
+		Name:     original.Name,
+		Index:    len(s.FreeSymbols) - 1,
+		Constant: original.Constant,
+	}
 
 	symbol.Scope = FreeScope
 
@@ -103,6 +354,9 @@ func (s *SymbolTable) defineFree(original Symbol) Symbol {
 
 func (s *SymbolTable) DefineFunctionName(name string) Symbol {
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
 
 	s.store[name] = symbol
@@ -1,6 +1,13 @@
 package compiler
 
-import "testing"
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
 
 func TestDefine(t *testing.T) {
 
@@ -409,3 +416,210 @@ func TestShadowingFunctionName(t *testing.T) {
 			result)
 	}
 }
+
+func TestForkAndCommit(t *testing.T) {
+
+	global := NewSymbolTable()
+	global.Define("a")
+
+	fork := global.Fork()
+	fork.Define("b")
+
+	// Commitするまで元のテーブルには見えない
+	if _, ok := global.Resolve("b"); ok {
+		t.Errorf("b should not be visible before commit")
+	}
+
+	if err := global.Commit(fork); err != nil {
+		t.Fatalf("unexpected commit error: %s", err)
+	}
+
+	if symbol, ok := global.Resolve("b"); !ok || symbol.Index != 1 {
+		t.Errorf("b not committed. got=%+v", symbol)
+	}
+
+	if next := global.Define("c"); next.Index != 2 {
+		t.Errorf("wrong index after commit. want=2, got=%d", next.Index)
+	}
+
+	// Forkの後に元のテーブルが変わっていれば反映しない
+	stale := global.Fork()
+	stale.Define("d")
+	global.Define("e")
+
+	if err := global.Commit(stale); err == nil || err.Error() != "symbol table changed since fork" {
+		t.Errorf("expected stale fork error. got=%v", err)
+	}
+
+	if _, ok := global.Resolve("d"); ok {
+		t.Errorf("d should not be committed")
+	}
+}
+
+func TestConcurrentDefine(t *testing.T) {
+
+	global := NewSymbolTable()
+
+	var wg sync.WaitGroup
+
+	for g := 0; g < 8; g++ {
+
+		wg.Add(1)
+
+		go func(g int) {
+
+			defer wg.Done()
+
+			for i := 0; i < 100; i++ {
+
+				global.Define(fmt.Sprintf("v%d_%d", g, i))
+
+				local := NewEnclosedSymbolTable(global)
+				local.Resolve("v0_0")
+
+				fork := global.Fork()
+				fork.Define("tmp")
+				global.Commit(fork)
+			}
+		}(g)
+	}
+
+	wg.Wait()
+
+	// インデックスは重ならない
+	seen := map[int]bool{}
+
+	for g := 0; g < 8; g++ {
+		for i := 0; i < 100; i++ {
+
+			symbol, ok := global.Resolve(fmt.Sprintf("v%d_%d", g, i))
+
+			if !ok || seen[symbol.Index] {
+				t.Fatalf("wrong symbol v%d_%d: %+v", g, i, symbol)
+			}
+
+			seen[symbol.Index] = true
+		}
+	}
+}
+
+func TestBlockScopes(t *testing.T) {
+
+	global := NewSymbolTable()
+	global.Define("a")
+
+	block := NewBlockSymbolTable(global)
+	b := block.Define("b")
+	shadow := block.Define("a")
+
+	// ブロックの変数もグローバルの置き場所を使う
+	if b != (Symbol{Name: "b", Scope: GlobalScope, Index: 1}) {
+		t.Errorf("wrong symbol for b: %+v", b)
+	}
+
+	if shadow.Index != 2 || global.NumDefinitions() != 3 {
+		t.Errorf("wrong index for shadowing a: %+v, definitions=%d", shadow, global.NumDefinitions())
+	}
+
+	if _, ok := global.Resolve("b"); ok {
+		t.Errorf("b resolvable outside of its block")
+	}
+
+	if symbol, _ := global.Resolve("a"); symbol.Index != 0 {
+		t.Errorf("wrong outer a: %+v", symbol)
+	}
+
+	// 関数の中のブロックの変数は、その関数のローカル変数
+	local := NewEnclosedSymbolTable(block)
+	inner := NewBlockSymbolTable(local)
+	c := inner.Define("c")
+
+	if c != (Symbol{Name: "c", Scope: LocalScope, Index: 0}) || local.NumDefinitions() != 1 {
+		t.Errorf("wrong symbol for c: %+v", c)
+	}
+
+	// ブロックの中からでも外側の関数のローカル変数は自由変数になる
+	nested := NewEnclosedSymbolTable(inner)
+
+	if symbol, _ := nested.Resolve("c"); symbol.Scope != FreeScope {
+		t.Errorf("c not captured as free variable: %+v", symbol)
+	}
+
+	if symbol, _ := nested.Resolve("b"); symbol.Scope != GlobalScope {
+		t.Errorf("wrong symbol for b: %+v", symbol)
+	}
+}
+
+func TestSymbols(t *testing.T) {
+
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	global.Define("b")
+	global.DefineConstant("a")
+
+	expected := []Symbol{
+		{Name: "len", Scope: BuiltinScope, Index: 0},
+		{Name: "b", Scope: GlobalScope, Index: 0},
+		{Name: "a", Scope: GlobalScope, Index: 1, Constant: true},
+	}
+
+	if got := global.Symbols(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("wrong symbols.\nwant=%+v\ngot=%+v", expected, got)
+	}
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("length")
+	local.Define("b")
+
+	if got := local.Complete("le"); !reflect.DeepEqual(got, []string{"len", "length"}) {
+		t.Errorf("wrong completions. got=%v", got)
+	}
+
+	if got := local.Complete("b"); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("wrong completions. got=%v", got)
+	}
+}
+
+func TestExportSymbolTable(t *testing.T) {
+
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	global.Define("x")
+	global.DefineConstant("c")
+	global.Define("x")
+
+	var buf bytes.Buffer
+
+	if err := global.Export(&buf); err != nil {
+		t.Fatalf("export error: %s", err)
+	}
+
+	restored, err := ImportSymbolTable(&buf)
+
+	if err != nil {
+		t.Fatalf("import error: %s", err)
+	}
+
+	if !reflect.DeepEqual(restored.Symbols(), global.Symbols()) {
+		t.Errorf("wrong symbols.\nwant=%+v\ngot=%+v", global.Symbols(), restored.Symbols())
+	}
+
+	// 続きの定義は重ならないインデックスになる
+	if symbol := restored.Define("y"); symbol.Index != 3 {
+		t.Errorf("wrong index for y: %+v", symbol)
+	}
+
+	if err := NewEnclosedSymbolTable(global).Export(&buf); err == nil {
+		t.Errorf("expected an error for an enclosed table")
+	}
+
+	for _, input := range []string{
+		`{`,
+		`{"definitions": 1, "symbols": [{"name": "x", "scope": "GLOBAL", "index": 1}]}`,
+		`{"definitions": 1, "symbols": [{"name": "x", "scope": "LOCAL", "index": 0}]}`,
+	} {
+		if _, err := ImportSymbolTable(strings.NewReader(input)); err == nil {
+			t.Errorf("expected an error for %s", input)
+		}
+	}
+}
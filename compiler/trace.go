@@ -0,0 +1,79 @@
+package compiler
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"example.com/monkey/ast"
+	"example.com/monkey/code"
+)
+
+// コンパイルの途中経過を受け取る (デバッグ用、既定では何もしない)
+
+type TraceKind string
+
+const (
+	// ノードのコンパイルを始めた/終えた
+	TraceEnter TraceKind = "enter"
+	TraceLeave TraceKind = "leave"
+	// 命令を出力した
+	TraceEmit TraceKind = "emit"
+)
+
+type TraceEvent struct {
+	Kind TraceKind
+	// ノードの入れ子の深さ
+	Depth int
+	// enter/leaveのノード
+	Node ast.Node
+	// emitの命令と、関数の中での位置
+	Op       code.Opcode
+	Operands []int
+	Position int
+	Function string
+}
+
+type TraceFunc func(TraceEvent)
+
+func (c *Compiler) SetTrace(fn TraceFunc) {
+	c.trace = fn
+}
+
+// イベントを1行ずつwに書き出すTraceFunc
+func TraceWriter(w io.Writer) TraceFunc {
+
+	return func(e TraceEvent) {
+
+		indent := strings.Repeat("  ", e.Depth)
+
+		switch e.Kind {
+		case TraceEnter, TraceLeave:
+			fmt.Fprintf(w, "%s%s %T %s\n", indent, e.Kind, e.Node, e.Node.String())
+		case TraceEmit:
+			def, _ := code.Lookup(byte(e.Op))
+			fmt.Fprintf(w, "%s%s %s %04d %s %v\n", indent, e.Kind, e.Function, e.Position, def.Name, e.Operands)
+		}
+	}
+}
+
+func (c *Compiler) traceEnter(node ast.Node) {
+	c.trace(TraceEvent{Kind: TraceEnter, Depth: c.traceDepth, Node: node})
+	c.traceDepth++
+}
+
+func (c *Compiler) traceLeave(node ast.Node) {
+	c.traceDepth--
+	c.trace(TraceEvent{Kind: TraceLeave, Depth: c.traceDepth, Node: node})
+}
+
+func (c *Compiler) traceEmit(op code.Opcode, operands []int, pos int) {
+	c.trace(TraceEvent{
+		Kind:     TraceEmit,
+		Depth:    c.traceDepth,
+		Op:       op,
+		Operands: operands,
+		Position: pos,
+		Function: c.scopes[c.scopeIndex].name,
+	})
+}
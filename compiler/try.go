@@ -0,0 +1,88 @@
+package compiler
+
+import (
+	"fmt"
+
+	"example.com/monkey/ast"
+	"example.com/monkey/code"
+)
+
+// try { 本体 } catch (e) { ハンドラー }
+//
+//	OpTry L1
+//	本体
+//	OpEndTry
+//	OpJump L2
+//	L1: (例外の値が積まれている)
+//	OpSetGlobal/OpSetLocal e
+//	ハンドラー
+//	L2:
+//
+// 本体とハンドラーの最後の式の値がtry式の値になる
+func (c *Compiler) compileTry(node *ast.TryExpression) error {
+
+	if c.symbolTable.isConstant(node.Param.Value) {
+		return fmt.Errorf("cannot reassign constant %s", node.Param.Value)
+	}
+
+	// Emit an `OpTry` with a bogus value
+	tryPos := c.emit(code.OpTry, 9999)
+
+	c.scopes[c.scopeIndex].tries++
+
+	err := c.Compile(node.Body)
+
+	c.scopes[c.scopeIndex].tries--
+
+	if err != nil {
+		return err
+	}
+
+	if blockHasValue(node.Body) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+
+	c.emit(code.OpEndTry)
+
+	// Emit an `OpJump` with a bogus value
+	jumpPos := c.emit(code.OpJump, 9999)
+
+	c.changeOperand(tryPos, len(c.currentInstructions()))
+
+	// catchの変数はハンドラーの外からは見えない
+	c.enterBlock()
+	defer c.leaveBlock()
+
+	symbol := c.symbolTable.Define(node.Param.Value)
+
+	c.explainSymbol(node.Param.Token.Line, "define", symbol)
+
+	c.storeSymbol(symbol)
+
+	err = c.Compile(node.Handler)
+
+	if err != nil {
+		return err
+	}
+
+	if blockHasValue(node.Handler) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+
+	return nil
+}
+
+// break、continueでループの中で始めたtryを抜けるときは、
+// 受け取る位置を自分で取り除く
+func (c *Compiler) endTries(l *loop) {
+
+	for i := l.tries; i < c.scopes[c.scopeIndex].tries; i++ {
+		c.emit(code.OpEndTry)
+	}
+}
@@ -0,0 +1,205 @@
+package compiler
+
+import (
+	"fmt"
+
+	"example.com/monkey/code"
+	"example.com/monkey/object"
+)
+
+// コンパイラーのバグをVMが変な落ち方をする前に見つけるための検査
+//
+//   - 命令が途中で切れていない、未定義のopcodeがない
+//   - ジャンプ先が命令の先頭(または末尾)にある
+//   - スタックの深さが負にならず、合流する位置で深さが一致する
+//   - 定数とローカル変数のインデックスが範囲内にある
+
+// トップレベルとすべての関数の命令を検査する
+func Verify(b *Bytecode) error {
+
+	if err := verifyInstructions(b.Instructions, b.Constants, -1); err != nil {
+		return fmt.Errorf("main: %s", err)
+	}
+
+	for i, c := range b.Constants {
+
+		fn, ok := c.(*object.CompiledFunction)
+
+		if !ok {
+			continue
+		}
+
+		if err := verifyInstructions(fn.Instructions, b.Constants, fn.NumLocals); err != nil {
+
+			name := fn.Name
+			if name == "" {
+				name = fmt.Sprintf("constant %d", i)
+			}
+
+			return fmt.Errorf("function %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// numLocalsが負ならトップレベル(ローカル変数はない)
+func verifyInstructions(ins code.Instructions, constants []object.Object, numLocals int) error {
+
+	decoded := map[int]code.Instruction{}
+	order := []int{}
+
+	err := ins.Iterate(func(offset int, op code.Opcode, operands []int) bool {
+
+		decoded[offset] = code.Instruction{Op: op, Operands: operands, Offset: offset}
+		order = append(order, offset)
+
+		return true
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, offset := range order {
+		if err := verifyOperands(decoded[offset], constants, numLocals, len(ins), decoded); err != nil {
+			return fmt.Errorf("%04d: %s", offset, err)
+		}
+	}
+
+	return verifyStack(ins, decoded)
+}
+
+func verifyOperands(
+	in code.Instruction,
+	constants []object.Object,
+	numLocals int,
+	end int,
+	decoded map[int]code.Instruction,
+) error {
+
+	switch in.Op {
+
+	case code.OpConstant, code.OpAddConstant:
+		if in.Operands[0] >= len(constants) {
+			return fmt.Errorf("constant %d out of range (%d constants)", in.Operands[0], len(constants))
+		}
+
+	case code.OpFunction, code.OpClosure:
+		if in.Operands[0] >= len(constants) {
+			return fmt.Errorf("constant %d out of range (%d constants)", in.Operands[0], len(constants))
+		}
+		if _, ok := constants[in.Operands[0]].(*object.CompiledFunction); !ok {
+			return fmt.Errorf("constant %d is not a function: %s", in.Operands[0], constants[in.Operands[0]].Type())
+		}
+
+	case code.OpGetLocal, code.OpSetLocal, code.OpCallLocal:
+		if in.Operands[0] >= numLocals {
+			return fmt.Errorf("local %d out of range (%d locals)", in.Operands[0], numLocals)
+		}
+	}
+
+	if flow := mustLookup(in.Op).Flow; flow == code.FlowJump || flow == code.FlowBranch || flow == code.FlowHandler {
+
+		target := code.JumpTarget(in.Offset, in.Op, in.Operands)
+
+		if _, ok := decoded[target]; !ok && target != end {
+			return fmt.Errorf("jump target %04d is not an instruction boundary", target)
+		}
+	}
+
+	return nil
+}
+
+// 到達できる命令を辿り、それぞれの位置でのスタックの深さを確かめる
+func verifyStack(ins code.Instructions, decoded map[int]code.Instruction) error {
+
+	depths := map[int]int{}
+	work := []int{}
+
+	visit := func(offset, depth int) error {
+
+		if offset >= len(ins) {
+			return nil
+		}
+
+		if d, ok := depths[offset]; ok {
+			if d != depth {
+				return fmt.Errorf("%04d: stack depth mismatch (%d and %d)", offset, d, depth)
+			}
+			return nil
+		}
+
+		depths[offset] = depth
+		work = append(work, offset)
+
+		return nil
+	}
+
+	if err := visit(0, 0); err != nil {
+		return err
+	}
+
+	for len(work) > 0 {
+
+		offset := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		in := decoded[offset]
+		depth := depths[offset]
+
+		def := mustLookup(in.Op)
+
+		pop, push := def.StackEffect(in.Operands)
+
+		if depth < pop {
+			return fmt.Errorf("%04d: %s pops %d values from a stack of %d",
+				offset, opName(in.Op), pop, depth)
+		}
+
+		next := offset + 1
+		for _, w := range def.Operandwidths {
+			next += w
+		}
+
+		switch def.Flow {
+
+		case code.FlowReturn:
+			continue
+
+		case code.FlowJump:
+			if err := visit(code.JumpTarget(offset, in.Op, in.Operands), depth-pop); err != nil {
+				return err
+			}
+			continue
+
+		// ジャンプしたときは取り出すだけ
+		// (OpIterNextは要素が無ければイテレーターを取り除いてジャンプする)
+		case code.FlowBranch:
+			if err := visit(code.JumpTarget(offset, in.Op, in.Operands), depth-pop); err != nil {
+				return err
+			}
+
+		// 例外を受け取る位置では、tryを始めたときのスタックに例外の値が積まれている
+		case code.FlowHandler:
+			if err := visit(code.JumpTarget(offset, in.Op, in.Operands), depth+1); err != nil {
+				return err
+			}
+		}
+
+		if err := visit(next, depth-pop+push); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func mustLookup(op code.Opcode) *code.Definition {
+	def, _ := code.Lookup(byte(op))
+	return def
+}
+
+func opName(op code.Opcode) string {
+	return mustLookup(op).Name
+}
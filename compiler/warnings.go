@@ -0,0 +1,76 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"example.com/monkey/ast"
+)
+
+// letで定義した変数と、定義したシンボルテーブル
+type binding struct {
+	table    *SymbolTable
+	symbol   Symbol
+	line     int
+	function bool
+}
+
+func (c *Compiler) bind(node *ast.LetStatement, symbol Symbol) {
+
+	_, function := node.Value.(*ast.FunctionLiteral)
+
+	c.bindings = append(c.bindings, binding{
+		table:    c.symbolTable,
+		symbol:   symbol,
+		line:     node.Name.Token.Line,
+		function: function,
+	})
+}
+
+// letで定義したのに一度も読まれていない変数と関数
+// _で始まる名前と、エンジンから呼ばれるグローバルのmainは除く
+func (c *Compiler) Warnings() []string {
+
+	warnings := []string{}
+
+	for _, b := range c.bindings {
+
+		name := b.symbol.Name
+
+		if strings.HasPrefix(name, "_") || b.table.IsRead(b.symbol) {
+			continue
+		}
+
+		if name == "main" && b.symbol.Scope == GlobalScope {
+			continue
+		}
+
+		kind := "variable"
+		if b.function {
+			kind = "function"
+		}
+
+		warnings = append(warnings, fmt.Sprintf("line %d: unused %s %s", b.line, kind, name))
+	}
+
+	return append(warnings, c.captureWarnings...)
+}
+
+// 関数は作られたときの変数の値を捕捉するので、
+// 捕捉した側とされた側のどちらで代入しても、もう一方には伝わらない
+func (c *Compiler) checkCapturedAssignment(node *ast.AssignExpression, symbol Symbol) {
+
+	var message string
+
+	switch {
+	case symbol.Scope == FreeScope:
+		message = "assignment to captured variable %s is not visible outside the closure"
+	case c.symbolTable.IsCaptured(symbol):
+		message = "assignment to %s is not visible to closures that captured it"
+	default:
+		return
+	}
+
+	c.captureWarnings = append(c.captureWarnings,
+		fmt.Sprintf("line %d: "+message, node.Token.Line, symbol.Name))
+}
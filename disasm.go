@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"example.com/monkey/code"
+	"example.com/monkey/compiler"
+)
+
+// monkey disasm file
+// コンパイルした命令を定数の値とジャンプ先のラベル付きで表示する
+// .mbc ファイルはそのまま読み込む
+func disasmCommand(args []string) int {
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: monkey disasm file")
+		return 2
+	}
+
+	path := args[0]
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var bytecode *compiler.Bytecode
+
+	if bytes.HasPrefix(data, []byte(code.FileMagic)) {
+
+		bytecode, err = compiler.DecodeBytecode(bytes.NewReader(data))
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			return 1
+		}
+
+	} else {
+
+		var ok bool
+
+		if bytecode, ok = compileFile(path, compiler.DefaultOptions()); !ok {
+			return 1
+		}
+	}
+
+	fmt.Print(compiler.Disassemble(bytecode))
+
+	return 0
+}
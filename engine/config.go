@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"bytes"
+
+	"example.com/monkey/object"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// 設定ファイルの変換
+// yaml_parse(str) / yaml_stringify(value) / toml_parse(str) / toml_stringify(hash)
+// 値はToObject/FromObjectで変換する
+
+func configBuiltins() []hostBuiltin {
+
+	return []hostBuiltin{
+		{
+			"yaml_parse",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				src, errObj := stringArg("yaml_parse", args)
+
+				if errObj != nil {
+					return errObj
+				}
+
+				var v interface{}
+
+				if err := yaml.Unmarshal([]byte(src), &v); err != nil {
+					return newError("yaml_parse: %s", err)
+				}
+
+				return ToObject(v)
+			}},
+		},
+		{
+			"yaml_stringify",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				v, errObj := valueArg("yaml_stringify", args)
+
+				if errObj != nil {
+					return errObj
+				}
+
+				out, err := yaml.Marshal(v)
+
+				if err != nil {
+					return newError("yaml_stringify: %s", err)
+				}
+
+				return &object.String{Value: string(out)}
+			}},
+		},
+		{
+			"toml_parse",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				src, errObj := stringArg("toml_parse", args)
+
+				if errObj != nil {
+					return errObj
+				}
+
+				v := map[string]interface{}{}
+
+				if _, err := toml.Decode(src, &v); err != nil {
+					return newError("toml_parse: %s", err)
+				}
+
+				return ToObject(v)
+			}},
+		},
+		{
+			// TOMLの最上位はテーブルなので、ハッシュしか変換できない
+			"toml_stringify",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				v, errObj := valueArg("toml_stringify", args)
+
+				if errObj != nil {
+					return errObj
+				}
+
+				if _, ok := v.(map[string]interface{}); !ok {
+					return newError("argument to `toml_stringify` must be HASH, got %s",
+						args[0].Type())
+				}
+
+				var out bytes.Buffer
+
+				if err := toml.NewEncoder(&out).Encode(v); err != nil {
+					return newError("toml_stringify: %s", err)
+				}
+
+				return &object.String{Value: out.String()}
+			}},
+		},
+	}
+}
+
+func stringArg(name string, args []object.Object) (string, *object.Error) {
+
+	if len(args) != 1 {
+		return "", newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+
+	str, ok := args[0].(*object.String)
+
+	if !ok {
+		return "", newError("argument to `%s` must be STRING, got %s", name, args[0].Type())
+	}
+
+	return str.Value, nil
+}
+
+func valueArg(name string, args []object.Object) (interface{}, *object.Error) {
+
+	if len(args) != 1 {
+		return nil, newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+
+	v, err := FromObject(args[0])
+
+	if err != nil {
+		return nil, newError("%s: %s", name, err)
+	}
+
+	return v, nil
+}
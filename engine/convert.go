@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"example.com/monkey/object"
+	"example.com/monkey/vm"
+)
+
+// Goの値とMonkeyのオブジェクトの相互変換
+
+// Goの値をオブジェクトに変換する
+// JSONやYAMLの数値はfloat64になるので、整数になるfloatはINTEGERにし、それ以外はFLOATにする
+func ToObject(v interface{}) object.Object {
+
+	switch v := v.(type) {
+
+	case nil:
+		return vm.Null
+
+	case object.Object:
+		return v
+
+	case bool:
+		if v {
+			return vm.True
+		}
+		return vm.False
+
+	case int:
+		return &object.Integer{Value: int64(v)}
+	case int8:
+		return &object.Integer{Value: int64(v)}
+	case int16:
+		return &object.Integer{Value: int64(v)}
+	case int32:
+		return &object.Integer{Value: int64(v)}
+	case int64:
+		return &object.Integer{Value: v}
+	case uint8:
+		return &object.Integer{Value: int64(v)}
+	case uint16:
+		return &object.Integer{Value: int64(v)}
+	case uint32:
+		return &object.Integer{Value: int64(v)}
+
+	case float32:
+		return floatToObject(float64(v))
+	case float64:
+		return floatToObject(v)
+
+	case string:
+		return &object.String{Value: v}
+	case []byte:
+		return &object.String{Value: string(v)}
+
+	case time.Time:
+		return &object.String{Value: v.Format(time.RFC3339)}
+
+	case []interface{}:
+		elements := make([]object.Object, len(v))
+		for i, el := range v {
+			elements[i] = ToObject(el)
+		}
+		return &object.Array{Elements: elements}
+
+	// TOMLのテーブルの配列
+	case []map[string]interface{}:
+		elements := make([]object.Object, len(v))
+		for i, el := range v {
+			elements[i] = ToObject(el)
+		}
+		return &object.Array{Elements: elements}
+
+	// YAMLは文字列以外のキーも使える
+	case map[interface{}]interface{}:
+		pairs := make(map[object.HashKey]object.HashPair, len(v))
+		for key, value := range v {
+			k := ToObject(key)
+			hashable, ok := k.(object.Hashable)
+			if !ok {
+				k = &object.String{Value: k.Inspect()}
+				hashable = k.(object.Hashable)
+			}
+			pairs[hashable.HashKey()] = object.HashPair{Key: k, Value: ToObject(value)}
+		}
+		return &object.Hash{Pairs: pairs}
+
+	case map[string]interface{}:
+		pairs := make(map[object.HashKey]object.HashPair, len(v))
+		for key, value := range v {
+			k := &object.String{Value: key}
+			pairs[k.HashKey()] = object.HashPair{Key: k, Value: ToObject(value)}
+		}
+		return &object.Hash{Pairs: pairs}
+
+	default:
+		return &object.String{Value: fmt.Sprint(v)}
+	}
+}
+
+func floatToObject(f float64) object.Object {
+
+	if f == float64(int64(f)) {
+		return &object.Integer{Value: int64(f)}
+	}
+
+	return &object.Float{Value: f}
+}
+
+// オブジェクトをGoの値に変換する
+// ハッシュのキーは文字列にする(文字列以外のキーはInspectした値)
+func FromObject(obj object.Object) (interface{}, error) {
+
+	switch obj := obj.(type) {
+
+	case *object.Null:
+		return nil, nil
+
+	case *object.Boolean:
+		return obj.Value, nil
+
+	case *object.Integer:
+		return obj.Value, nil
+
+	case *object.Float:
+		return obj.Value, nil
+
+	case *object.String:
+		return obj.Value, nil
+
+	case *object.DateTime:
+		return obj.Value, nil
+
+	case *object.Duration:
+		return obj.Value, nil
+
+	// 精度を落とさないように文字列にする
+	case *object.Decimal:
+		return obj.Inspect(), nil
+
+	case *object.Array:
+		values := make([]interface{}, len(obj.Elements))
+		for i, el := range obj.Elements {
+			v, err := FromObject(el)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return values, nil
+
+	case *object.Hash:
+		values := make(map[string]interface{}, len(obj.Pairs))
+		for _, pair := range obj.Pairs {
+			v, err := FromObject(pair.Value)
+			if err != nil {
+				return nil, err
+			}
+			values[hashKeyString(pair.Key)] = v
+		}
+		return values, nil
+
+	default:
+		return nil, fmt.Errorf("cannot convert %s to a Go value", obj.Type())
+	}
+}
+
+func hashKeyString(key object.Object) string {
+
+	if s, ok := key.(*object.String); ok {
+		return s.Value
+	}
+
+	return key.Inspect()
+}
@@ -0,0 +1,202 @@
+package engine
+
+import (
+	"database/sql"
+
+	"example.com/monkey/object"
+)
+
+// db_open(dsn) / db_query(db, sql, args...) / db_exec(db, sql, args...)
+// ドライバーはホスト側でimportしておき(sql.Register)、その名前をSetDatabaseDriverで指定する
+func (e *Engine) SetDatabaseDriver(name string) {
+	e.dbDriver = name
+}
+
+const DB_OBJ = "DB"
+
+// db_openが返すデータベースへの接続
+type DB struct {
+	db *sql.DB
+}
+
+func (d *DB) Type() object.ObjectType { return DB_OBJ }
+func (d *DB) Inspect() string         { return "<db>" }
+
+func (e *Engine) databaseBuiltins(s *session) []hostBuiltin {
+
+	return []hostBuiltin{
+		{
+			"db_open",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1",
+						len(args))
+				}
+
+				dsn, ok := args[0].(*object.String)
+
+				if !ok {
+					return newError("argument to `db_open` must be STRING, got %s",
+						args[0].Type())
+				}
+
+				if e.dbDriver == "" {
+					return newError("db_open: no database driver configured")
+				}
+
+				db, err := sql.Open(e.dbDriver, dsn.Value)
+
+				if err != nil {
+					return newError("db_open: %s", err)
+				}
+
+				s.closers = append(s.closers, db.Close)
+
+				return &DB{db: db}
+			}},
+		},
+		{
+			// 結果の行をハッシュの配列で返す
+			"db_query",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				db, query, params, errObj := databaseArgs("db_query", args)
+
+				if errObj != nil {
+					return errObj
+				}
+
+				rows, err := db.db.Query(query, params...)
+
+				if err != nil {
+					return newError("db_query: %s", err)
+				}
+
+				defer rows.Close()
+
+				result, err := scanRows(rows)
+
+				if err != nil {
+					return newError("db_query: %s", err)
+				}
+
+				return result
+			}},
+		},
+		{
+			// {"rows_affected": n, "last_insert_id": id} を返す
+			"db_exec",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				db, query, params, errObj := databaseArgs("db_exec", args)
+
+				if errObj != nil {
+					return errObj
+				}
+
+				res, err := db.db.Exec(query, params...)
+
+				if err != nil {
+					return newError("db_exec: %s", err)
+				}
+
+				// ドライバーによっては対応していないので、その場合はnullにする
+				result := map[string]interface{}{
+					"rows_affected":  nil,
+					"last_insert_id": nil,
+				}
+
+				if n, err := res.RowsAffected(); err == nil {
+					result["rows_affected"] = n
+				}
+
+				if id, err := res.LastInsertId(); err == nil {
+					result["last_insert_id"] = id
+				}
+
+				return ToObject(result)
+			}},
+		},
+	}
+}
+
+// (db, sql, args...) の引数を取り出す
+func databaseArgs(
+	name string,
+	args []object.Object,
+) (*DB, string, []interface{}, *object.Error) {
+
+	if len(args) < 2 {
+		return nil, "", nil, newError("wrong number of arguments. got=%d, want at least 2",
+			len(args))
+	}
+
+	db, ok := args[0].(*DB)
+
+	if !ok {
+		return nil, "", nil, newError("first argument to `%s` must be DB, got %s",
+			name, args[0].Type())
+	}
+
+	query, ok := args[1].(*object.String)
+
+	if !ok {
+		return nil, "", nil, newError("second argument to `%s` must be STRING, got %s",
+			name, args[1].Type())
+	}
+
+	params := make([]interface{}, 0, len(args)-2)
+
+	for _, arg := range args[2:] {
+
+		v, err := FromObject(arg)
+
+		if err != nil {
+			return nil, "", nil, newError("%s: %s", name, err)
+		}
+
+		params = append(params, v)
+	}
+
+	return db, query.Value, params, nil
+}
+
+func scanRows(rows *sql.Rows) (object.Object, error) {
+
+	columns, err := rows.Columns()
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := []interface{}{}
+
+	for rows.Next() {
+
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(columns))
+
+		for i, column := range columns {
+			row[column] = values[i]
+		}
+
+		result = append(result, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ToObject(result), nil
+}
@@ -0,0 +1,270 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/evaluator"
+	"example.com/monkey/lexer"
+	"example.com/monkey/object"
+	"example.com/monkey/parser"
+	"example.com/monkey/vm"
+)
+
+// ホストアプリケーションにMonkeyを組み込むためのAPI
+//
+//	e := engine.New()
+//	e.Grant(engine.Database)
+//	e.SetDatabaseDriver("sqlite3")
+//	result, err := e.Run(src)
+
+// スクリプトに与える権限
+// 権限がない組み込み関数はシンボルテーブルに定義されないので、
+// 使おうとするとコンパイルエラーになる
+type Capability int
+
+const (
+	// db_open/db_query/db_exec
+	Database Capability = 1 << iota
+	// exec
+	Process
+	// glob
+	FS
+)
+
+type Engine struct {
+	capabilities Capability
+
+	// database/sqlのドライバー名
+	dbDriver string
+
+	// kv_*の保存先
+	store Store
+
+	// execで実行できるコマンド(空なら制限なし)
+	allowedCommands map[string]bool
+
+	// タイマーかイベントの購読が残っている直前のRun (timers.go)
+	loop *session
+
+	// ホストのイベントの購読者 (events.go)
+	handlers map[string][]Handler
+
+	// 直前のRunの実行の記録
+	report vm.Report
+
+	// 全てのRunの前に定義される標準ライブラリ (prelude.go)
+	prelude *prelude
+
+	// importの解決 (nilならimportはコンパイルエラー)
+	resolver compiler.ModuleResolver
+}
+
+func New() *Engine {
+	return &Engine{}
+}
+
+// 権限を与える
+func (e *Engine) Grant(c Capability) {
+	e.capabilities |= c
+}
+
+// スクリプトのimportでモジュールを読み込めるようにする
+func (e *Engine) SetModuleResolver(r compiler.ModuleResolver) {
+	e.resolver = r
+}
+
+func (e *Engine) has(c Capability) bool {
+	return e.capabilities&c == c
+}
+
+// ホストが提供する組み込み関数
+type hostBuiltin struct {
+	name    string
+	builtin *object.Builtin
+}
+
+// Run1回分の状態
+// 開いたリソースはRunの終わりにまとめて閉じる
+type session struct {
+	ctx     context.Context
+	closers []func() error
+	timers  scheduler
+
+	// スクリプトのイベントの購読者と、それを呼ぶVM (events.go)
+	handlers map[string][]object.Object
+	machine  *vm.VM
+	// 購読した関数の中からemitしている深さと、上限を超えたときのエラー
+	emitDepth    int
+	emitOverflow error
+}
+
+// Runの後に呼ばれるものが残っていない
+func (s *session) idle() bool {
+	return len(s.timers.timers) == 0 && len(s.handlers) == 0
+}
+
+func (s *session) close() {
+
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		s.closers[i]()
+	}
+}
+
+func (e *Engine) hostBuiltins(s *session) []hostBuiltin {
+
+	// 権限が不要なもの
+	builtins := configBuiltins()
+	builtins = append(builtins, pathBuiltins()...)
+	builtins = append(builtins, timerBuiltins(s)...)
+	builtins = append(builtins, e.eventBuiltins(s)...)
+
+	if e.has(Database) {
+		builtins = append(builtins, e.databaseBuiltins(s)...)
+	}
+
+	if e.store != nil {
+		builtins = append(builtins, e.storeBuiltins()...)
+	}
+
+	if e.has(Process) {
+		builtins = append(builtins, e.processBuiltins(s)...)
+	}
+
+	if e.has(FS) {
+		builtins = append(builtins, fsBuiltins()...)
+	}
+
+	return builtins
+}
+
+// ソースをコンパイルして実行し、最後に評価した式の値を返す
+// Runごとに新しいVMを使うので、Run同士で状態は共有しない
+// 前のRunのタイマーが残っていれば捨てる
+func (e *Engine) Run(input string) (object.Object, error) {
+	return e.RunContext(context.Background(), input)
+}
+
+// ctxがキャンセルされると、スクリプトの実行と実行中のexecのプロセスを止める
+func (e *Engine) RunContext(ctx context.Context, input string) (object.Object, error) {
+	return e.run(ctx, input, false, nil)
+}
+
+// callMainならトップレベルを実行した後にmain関数を呼ぶ (main.go)
+func (e *Engine) run(ctx context.Context, input string, callMain bool, argv []string) (object.Object, error) {
+
+	p := parser.New(lexer.New(input))
+
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parser errors: %s", strings.Join(p.Errors(), "; "))
+	}
+
+	macroEnv := object.NewEnvironment()
+	evaluator.DefineMacros(program, macroEnv)
+	expanded, err := evaluator.ExpandMacros(program, macroEnv)
+
+	if err != nil {
+		return nil, fmt.Errorf("macro error: %s", err)
+	}
+
+	e.Stop()
+
+	s := &session{ctx: ctx}
+
+	// タイマーや購読が残っていれば、開いたリソースはそれが無くなるまで閉じない
+	defer func() {
+		if e.loop != s {
+			s.close()
+		}
+	}()
+
+	symbolTable := compiler.NewSymbolTable()
+	constants := []object.Object{}
+
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
+	// preludeの組み込み関数とグローバル変数を引き継ぐ
+	if e.prelude != nil {
+		symbolTable = e.prelude.symbols.Copy()
+		constants = e.prelude.constants
+	}
+
+	builtins := vm.Builtins()
+	names := []string{}
+
+	for _, v := range object.Builtins {
+		names = append(names, v.Name)
+	}
+
+	for _, h := range e.hostBuiltins(s) {
+		symbolTable.DefineBuiltin(len(builtins), h.name)
+		builtins = append(builtins, h.builtin)
+		names = append(names, h.name)
+	}
+
+	comp := compiler.NewWithState(symbolTable, constants)
+
+	if e.resolver != nil {
+		comp.SetModuleResolver(e.resolver)
+	}
+
+	if err := comp.Compile(expanded); err != nil {
+		return nil, err
+	}
+
+	machine := vm.NewWithBuiltins(comp.Bytecode(), builtins)
+
+	machine.SetBuiltinNames(names)
+
+	if e.prelude != nil {
+		machine.PresetGlobals(e.prelude.globals)
+	}
+
+	machine.EnableReport()
+
+	s.machine = machine
+
+	// エラーで止まっても、そこまでの分は記録する
+	defer func() { e.report = machine.Report() }()
+
+	if err := machine.RunContext(ctx); err != nil {
+		return nil, err
+	}
+
+	result := machine.LastPoppedStackElem()
+
+	if callMain {
+
+		returned, err := runMain(symbolTable, machine, argv)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if returned != nil {
+			result = returned
+		}
+	}
+
+	if !s.idle() {
+		e.loop = s
+	}
+
+	return result, nil
+}
+
+// 直前のRunで実行した命令の数や、作ったオブジェクトの数などを返す
+// タイマーやイベントで後から呼ばれた関数の分は含まない
+func (e *Engine) Report() vm.Report {
+	return e.report
+}
+
+func newError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
@@ -0,0 +1,905 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/object"
+)
+
+func TestRun(t *testing.T) {
+
+	e := New()
+
+	result, err := e.Run(`let add = fn(a, b) { a + b }; add(1, 2)`)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testInspect(t, result, "3")
+
+	if _, err := e.Run(`let x = `); err == nil {
+		t.Errorf("expected parser error")
+	}
+}
+
+func TestConvert(t *testing.T) {
+
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{int32(7), "7"},
+		{2.0, "2"},
+		{2.5, "2.5"},
+		{float32(0.25), "0.25"},
+		{[]byte("bytes"), "bytes"},
+		{[]interface{}{int64(1), "a", nil}, "[1, a, null]"},
+		{map[string]interface{}{"k": int64(1)}, "{k: 1}"},
+	}
+
+	for _, tt := range tests {
+
+		obj := ToObject(tt.value)
+
+		testInspect(t, obj, tt.expected)
+	}
+
+	v, err := FromObject(ToObject(map[string]interface{}{
+		"list": []interface{}{int64(1), "two", true, nil},
+	}))
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	list := v.(map[string]interface{})["list"].([]interface{})
+
+	if list[0] != int64(1) || list[1] != "two" || list[2] != true || list[3] != nil {
+		t.Errorf("wrong round trip. got=%#v", list)
+	}
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if v, _ := FromObject(&object.DateTime{Value: at}); v != at {
+		t.Errorf("wrong DATETIME conversion. got=%#v", v)
+	}
+
+	if _, err := FromObject(&object.Builtin{}); err == nil {
+		t.Errorf("expected error for BUILTIN")
+	}
+
+	// 整数にならない数はFLOATのまま戻る
+	ratio := ToObject(0.5)
+
+	if ratio.Type() != object.FLOAT_OBJ {
+		t.Errorf("wrong type for 0.5. got=%s", ratio.Type())
+	}
+
+	if v, _ := FromObject(ratio); v != 0.5 {
+		t.Errorf("wrong FLOAT conversion. got=%#v", v)
+	}
+}
+
+func TestDatabaseBuiltins(t *testing.T) {
+
+	input := `
+	let db = db_open("users");
+	let r = db_exec(db, "INSERT", "alice", 30);
+	db_exec(db, "INSERT", "bob", 25);
+	let rows = db_query(db, "SELECT");
+	[r["rows_affected"], len(rows), rows[1]["name"], rows[1]["age"], rows[0]["id"]]
+	`
+
+	fake := &fakeDatabase{}
+	sql.Register("monkeyfake", fake)
+
+	// 権限がなければ組み込み関数が定義されない
+	e := New()
+	e.SetDatabaseDriver("monkeyfake")
+
+	_, err := e.Run(input)
+
+	if err == nil || err.Error() != "undefined variable db_open" {
+		t.Fatalf("expected undefined variable error. got=%v", err)
+	}
+
+	e.Grant(Database)
+
+	result, err := e.Run(input)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testInspect(t, result, "[1, 2, bob, 25, 1]")
+
+	// Runの終わりに接続が閉じられる
+	if fake.open != 0 {
+		t.Errorf("connections left open: %d", fake.open)
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`db_open(1)`, "argument to `db_open` must be STRING, got INTEGER"},
+		{`db_query("db", "SELECT")`, "first argument to `db_query` must be DB, got STRING"},
+		{`db_exec(db_open("x"), "FAIL")`, "db_exec: exec failed"},
+		{`db_query(db_open("x"), "SELECT", fn() {})`, "db_query: cannot convert CLOSURE to a Go value"},
+	}
+
+	for _, tt := range errorTests {
+
+		result, err := e.Run(tt.input)
+
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		errObj, ok := result.(*object.Error)
+
+		if !ok {
+			t.Errorf("expected error for %q. got=%T (%+v)", tt.input, result, result)
+			continue
+		}
+
+		if errObj.Message != tt.expected {
+			t.Errorf("wrong error message. want=%q, got=%q", tt.expected, errObj.Message)
+		}
+	}
+}
+
+func testInspect(t *testing.T, obj object.Object, expected string) {
+
+	t.Helper()
+
+	if obj == nil {
+		t.Fatalf("object is nil. want=%q", expected)
+	}
+
+	if obj.Inspect() != expected {
+		t.Errorf("wrong value. want=%q, got=%q", expected, obj.Inspect())
+	}
+}
+
+// テスト用のdatabase/sqlのドライバー
+// "INSERT"で(name, age)を追加し、"SELECT"で(id, name, age)をすべて返す
+type fakeDatabase struct {
+	rows [][]driver.Value
+	open int
+}
+
+func (d *fakeDatabase) Open(name string) (driver.Conn, error) {
+	d.open++
+	return &fakeConn{d}, nil
+}
+
+type fakeConn struct {
+	d *fakeDatabase
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{d: c.d, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	c.d.open--
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type fakeStmt struct {
+	d     *fakeDatabase
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+
+	if s.query != "INSERT" {
+		return nil, errors.New("exec failed")
+	}
+
+	id := int64(len(s.d.rows) + 1)
+
+	s.d.rows = append(s.d.rows, []driver.Value{id, args[0], args[1]})
+
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+
+	if !strings.HasPrefix(s.query, "SELECT") {
+		return nil, errors.New("query failed")
+	}
+
+	return &fakeRows{rows: s.d.rows}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+	next int
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"id", "name", "age"}
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[r.next])
+
+	r.next++
+
+	return nil
+}
+
+func TestStoreBuiltins(t *testing.T) {
+
+	e := New()
+
+	if _, err := e.Run(`kv_get("a")`); err == nil {
+		t.Fatalf("expected error without a store")
+	}
+
+	store := NewMemoryStore()
+
+	e.SetStore(store)
+
+	// Runをまたいで値が残る
+	_, err := e.Run(`kv_put("count", 1); kv_put("tags", ["a", "b"]); kv_put("gone", true)`)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	result, err := e.Run(`
+	kv_put("count", kv_get("count") + 1);
+	kv_delete("gone");
+	[kv_get("count"), kv_get("tags")[1], kv_get("gone"), kv_get("missing")]
+	`)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testInspect(t, result, "[2, b, null, null]")
+
+	if v, _, _ := store.Get("count"); v != int64(2) {
+		t.Errorf("store value wrong. got=%#v", v)
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`kv_get(1)`, "argument to `kv_get` must be STRING, got INTEGER"},
+		{`kv_put("a")`, "wrong number of arguments. got=1, want=2"},
+		{`kv_put("f", fn() {})`, "kv_put: cannot convert CLOSURE to a Go value"},
+	}
+
+	for _, tt := range errorTests {
+
+		result, err := e.Run(tt.input)
+
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		errObj, ok := result.(*object.Error)
+
+		if !ok {
+			t.Errorf("expected error for %q. got=%T (%+v)", tt.input, result, result)
+			continue
+		}
+
+		if errObj.Message != tt.expected {
+			t.Errorf("wrong error message. want=%q, got=%q", tt.expected, errObj.Message)
+		}
+	}
+}
+
+// execのテストではテストのバイナリ自体をコマンドとして実行する
+func TestHelperProcess(t *testing.T) {
+
+	if os.Getenv("MONKEY_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	args := os.Args
+
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+
+	switch args[1] {
+	case "echo":
+		fmt.Print(strings.Join(args[2:], " "))
+	case "cat":
+		io.Copy(os.Stdout, os.Stdin)
+	case "fail":
+		fmt.Fprint(os.Stderr, "bad")
+		os.Exit(3)
+	case "sleep":
+		time.Sleep(10 * time.Second)
+	}
+
+	os.Exit(0)
+}
+
+func TestProcessBuiltins(t *testing.T) {
+
+	helper := func(args string, opts string) string {
+		return fmt.Sprintf(`exec("%s", ["-test.run=TestHelperProcess", "--", %s], %s)`,
+			os.Args[0], args, opts)
+	}
+
+	env := `{"env": {"MONKEY_HELPER_PROCESS": "1"}}`
+
+	e := New()
+
+	if _, err := e.Run(helper(`"echo"`, env)); err == nil {
+		t.Fatalf("expected error without the Process capability")
+	}
+
+	e.Grant(Process)
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let r = ` + helper(`"echo", "hello", "monkey"`, env) + `; [r["stdout"], r["stderr"], r["code"]]`,
+			"[hello monkey, , 0]"},
+		{`let r = ` + helper(`"fail"`, env) + `; [r["stdout"], r["stderr"], r["code"]]`,
+			"[, bad, 3]"},
+		{helper(`"cat"`, `{"env": {"MONKEY_HELPER_PROCESS": "1"}, "stdin": "from stdin"}`) + `["stdout"]`,
+			"from stdin"},
+		{helper(`"sleep"`, `{"env": {"MONKEY_HELPER_PROCESS": "1"}, "timeout": 100}`),
+			"ERROR: exec: context deadline exceeded"},
+		{`exec("monkey-no-such-command", [])`, ""},
+		{`exec("echo", [1])`, "ERROR: argument to `exec` must be ARRAY of STRING, got INTEGER"},
+		{`exec("echo", [], 1)`, "ERROR: third argument to `exec` must be HASH, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+
+		result, err := e.Run(tt.input)
+
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", tt.input, err)
+		}
+
+		// 見つからないコマンドのメッセージはOSによって異なる
+		if tt.expected == "" {
+
+			if _, ok := result.(*object.Error); !ok {
+				t.Errorf("expected error for %q. got=%s", tt.input, result.Inspect())
+			}
+
+			continue
+		}
+
+		testInspect(t, result, tt.expected)
+	}
+
+	// Runのcontextがキャンセルされるとプロセスも止まる
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	result, err := e.RunContext(ctx, helper(`"sleep"`, env))
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testInspect(t, result, "ERROR: exec: context deadline exceeded")
+
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("process was not cancelled")
+	}
+
+	// 許可されたコマンド以外は実行できない
+	e.AllowCommands("git")
+
+	result, err = e.Run(helper(`"echo"`, env))
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testInspect(t, result, "ERROR: exec: command not allowed: "+os.Args[0])
+}
+
+func TestConfigBuiltins(t *testing.T) {
+
+	e := New()
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let c = yaml_parse("name: app
+ports:
+  - 80
+  - 443
+debug: true
+ratio: 0.5
+"); [c["name"], c["ports"][1], c["debug"], c["ratio"], c["missing"]]`,
+			"[app, 443, true, 0.5, null]"},
+		{`yaml_parse("ratio: 0.5")["ratio"] * 3.0`, "1.5"},
+		{`yaml_stringify({"ratio": 0.25})`, "ratio: 0.25\n"},
+		{`yaml_parse("1: one")[1]`, "one"},
+		{`yaml_stringify({"b": [1, 2], "a": "x"})`, "a: x\nb:\n    - 1\n    - 2\n"},
+		{`yaml_stringify(yaml_parse("k: v"))`, "k: v\n"},
+		{`let c = toml_parse("title = 't'
+[server]
+port = 8080
+
+[[users]]
+name = 'alice'
+
+[[users]]
+name = 'bob'
+"); [c["title"], c["server"]["port"], c["users"][1]["name"]]`,
+			"[t, 8080, bob]"},
+		{`toml_stringify({"server": {"port": 8080}, "name": "app"})`,
+			"name = \"app\"\n\n[server]\n  port = 8080\n"},
+		{`yaml_parse("a: [1")`, "ERROR: yaml_parse: yaml: line 1: did not find expected ',' or ']'"},
+		{`toml_parse("a = ")`, ""},
+		{`toml_stringify([1])`, "ERROR: argument to `toml_stringify` must be HASH, got ARRAY"},
+		{`yaml_stringify(fn() {})`, "ERROR: yaml_stringify: cannot convert CLOSURE to a Go value"},
+		{`yaml_parse(1)`, "ERROR: argument to `yaml_parse` must be STRING, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+
+		result, err := e.Run(tt.input)
+
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", tt.input, err)
+		}
+
+		// TOMLのエラーメッセージはライブラリに任せる
+		if tt.expected == "" {
+
+			if _, ok := result.(*object.Error); !ok {
+				t.Errorf("expected error for %q. got=%s", tt.input, result.Inspect())
+			}
+
+			continue
+		}
+
+		testInspect(t, result, tt.expected)
+	}
+}
+
+func TestPathBuiltins(t *testing.T) {
+
+	dir := t.TempDir()
+
+	for _, name := range []string{"b.txt", "a.txt", "c.md"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := New()
+
+	if _, err := e.Run(`glob("*")`); err == nil {
+		t.Fatalf("expected error without the FS capability")
+	}
+
+	e.Grant(FS)
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`path_join("a", "b", "c.txt")`, filepath.Join("a", "b", "c.txt")},
+		{`path_join("a", "", "../b")`, "b"},
+		{`path_join()`, ""},
+		{`path_base(path_join("dir", "file.tar.gz"))`, "file.tar.gz"},
+		{`path_ext("file.tar.gz")`, ".gz"},
+		{`path_ext("README")`, ""},
+		{`path_join("a", 1)`, "ERROR: argument to `path_join` must be STRING, got INTEGER"},
+		{`path_base()`, "ERROR: wrong number of arguments. got=0, want=1"},
+		{`glob(path_join("` + dir + `", "*.txt"))`,
+			"[" + filepath.Join(dir, "a.txt") + ", " + filepath.Join(dir, "b.txt") + "]"},
+		{`glob(path_join("` + dir + `", "*.go"))`, "[]"},
+		{`glob("[")`, "ERROR: glob: syntax error in pattern"},
+	}
+
+	for _, tt := range tests {
+
+		result, err := e.Run(tt.input)
+
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", tt.input, err)
+		}
+
+		testInspect(t, result, tt.expected)
+	}
+}
+
+func TestTimers(t *testing.T) {
+
+	store := NewMemoryStore()
+
+	e := New()
+	e.SetStore(store)
+
+	input := `
+	let count = fn(key) {
+		let n = kv_get(key);
+		kv_put(key, if (n == null) { 1 } else { n + 1 });
+	};
+	set_timeout(fn() { count("timeout") }, 100);
+	let id = set_interval(fn() { count("interval") }, 30);
+	set_timeout(fn() { clear_timer(id) }, 100);
+	set_timeout(fn() { set_timeout(fn() { count("nested") }, 0) }, 10);
+	let never = set_timeout(fn() { count("never") }, 10);
+	[clear_timer(never) == true, clear_timer(never) == false]
+	`
+
+	result, err := e.Run(input)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testInspect(t, result, "[true, true]")
+
+	get := func(key string) interface{} {
+		v, _, _ := store.Get(key)
+		return v
+	}
+
+	if err := e.Tick(10 * time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Tickの間に作られたタイマーは次のTickで呼ばれる
+	if get("nested") != nil {
+		t.Errorf("timer created during a tick ran in the same tick")
+	}
+
+	if err := e.Tick(50 * time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if get("nested") != int64(1) || get("interval") != int64(2) || get("timeout") != nil {
+		t.Errorf("wrong state after 60ms. nested=%v interval=%v timeout=%v",
+			get("nested"), get("interval"), get("timeout"))
+	}
+
+	if err := e.Tick(100 * time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if get("timeout") != int64(1) || get("interval") != int64(3) || get("never") != nil {
+		t.Errorf("wrong state after 160ms. timeout=%v interval=%v never=%v",
+			get("timeout"), get("interval"), get("never"))
+	}
+
+	if e.Pending() != 0 {
+		t.Errorf("expected no pending timers. got=%d", e.Pending())
+	}
+
+	// コールバックのエラーはTickのエラーになる
+	if _, err := e.Run(`set_timeout(fn() { 1 + true }, 0)`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = e.Tick(0)
+
+	if err == nil || !strings.Contains(err.Error(), "unsupported types for binary operation") {
+		t.Errorf("expected callback error. got=%v", err)
+	}
+
+	// RunLoopは実際の時間でタイマーが無くなるまで待つ
+	if _, err := e.Run(`set_timeout(fn() { kv_put("loop", true) }, 20)`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := e.RunLoop(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if get("loop") != true {
+		t.Errorf("RunLoop did not run the timer")
+	}
+
+	result, _ = e.Run(`set_interval(1, 10)`)
+
+	testInspect(t, result, "ERROR: first argument to `set_interval` must be FUNCTION, got INTEGER")
+}
+
+func TestEvents(t *testing.T) {
+
+	e := New()
+
+	var logged []interface{}
+
+	e.On("log", func(payload interface{}) {
+		logged = append(logged, payload)
+	})
+
+	input := `
+	on("click", fn(p) { emit("log", p["x"] * 2) });
+	on("click", fn(p) { emit("clicked") });
+	on("clicked", fn(p) { emit("log", "clicked") });
+	emit("log", "ready")
+	`
+
+	result, err := e.Run(input)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// ホストの購読者1つに送った
+	testInspect(t, result, "1")
+
+	n, err := e.Emit("click", map[string]interface{}{"x": 21})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n != 2 {
+		t.Errorf("wrong number of handlers. want=2, got=%d", n)
+	}
+
+	if fmt.Sprint(logged) != "[ready 42 clicked]" {
+		t.Errorf("wrong events. got=%v", logged)
+	}
+
+	if n, _ := e.Emit("unknown", nil); n != 0 {
+		t.Errorf("expected no handlers for unknown event. got=%d", n)
+	}
+
+	// スクリプトの購読者のエラーはEmitのエラーになる
+	if _, err := e.Run(`on("bad", fn(p) { p + 1 })`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, err := e.Emit("bad", "x"); err == nil {
+		t.Errorf("expected error from handler")
+	}
+
+	e.Stop()
+
+	if n, _ := e.Emit("bad", "x"); n != 0 {
+		t.Errorf("expected handlers to be dropped after Stop")
+	}
+
+	result, _ = e.Run(`on(1, fn() {})`)
+
+	testInspect(t, result, "ERROR: first argument to `on` must be STRING, got INTEGER")
+
+	// 購読した関数の中で同じイベントを発行し続けても上限で止まる
+	e = New()
+
+	result, err = e.Run(`on("ping", fn(p) { emit("ping") }); emit("ping")`)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testInspect(t, result, "ERROR: emit: event ping: emit nested too deeply: 64 levels")
+
+	// 深さは元に戻るので、ホストから発行しても同じところで止まる
+	if _, err := e.Emit("ping", nil); err == nil || err.Error() != "event ping: emit nested too deeply: 64 levels" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func TestReport(t *testing.T) {
+
+	e := New()
+
+	if _, err := e.Run(`path_base("a/b"); len("abc"); len([1])`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	report := e.Report()
+
+	// ホストの組み込み関数も名前で数える
+	if report.BuiltinCalls["len"] != 2 || report.BuiltinCalls["path_base"] != 1 {
+		t.Errorf("wrong builtin calls. got=%v", report.BuiltinCalls)
+	}
+
+	if report.Instructions == 0 {
+		t.Errorf("no instructions recorded")
+	}
+
+	// エラーで止まったRunも記録される
+	if _, err := e.Run(`len(1, 2, 3); 1 + "a"`); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	if e.Report().BuiltinCalls["len"] != 1 {
+		t.Errorf("wrong builtin calls after error. got=%v", e.Report().BuiltinCalls)
+	}
+}
+
+func TestPrelude(t *testing.T) {
+
+	e := New()
+
+	if err := e.SetPrelude(`
+	let square = fn(x) { x * x };
+	let sum = fn(xs) { if (len(xs) == 0) { 0 } else { first(xs) + sum(rest(xs)) } };
+	let greeting = "hello";
+	`); err != nil {
+		t.Fatalf("unexpected prelude error: %s", err)
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`square(4)`, "16"},
+		{`sum([1, 2, 3]) + square(2)`, "10"},
+		{`let name = "monkey"; "${greeting} ${name}"`, "hello monkey"},
+		// スクリプトの定数はpreludeの定数の後ろに追加される
+		{`let f = fn(x) { x + 100 }; f(square(3))`, "109"},
+		{`path_base(greeting)`, "hello"},
+	}
+
+	for _, tt := range tests {
+
+		result, err := e.Run(tt.input)
+
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", tt.input, err)
+		}
+
+		testInspect(t, result, tt.expected)
+	}
+
+	// preludeのグローバル変数は定義し直せない
+	if _, err := e.Run(`let square = 1;`); err == nil || err.Error() != "cannot reassign constant square" {
+		t.Errorf("expected constant error. got=%v", err)
+	}
+
+	// 関数の中で隠すのはよい
+	result, err := e.Run(`let f = fn() { let greeting = "hi"; greeting }; f()`)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testInspect(t, result, "hi")
+
+	if err := e.SetPrelude(`let x = ;`); err == nil {
+		t.Errorf("expected prelude parser error")
+	}
+
+	if err := e.SetPrelude(`1 + "a"`); err == nil {
+		t.Errorf("expected prelude runtime error")
+	}
+
+	if err := e.SetPrelude(`path_base("a")`); err == nil {
+		t.Errorf("host builtins should not be available in the prelude")
+	}
+}
+
+func TestCallMain(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		argv     []string
+		expected string
+	}{
+		{`let main = fn(argv) { len(argv) }`, []string{"a", "b"}, "2"},
+		{`let main = fn(argv) { argv }`, []string{"x", "y"}, "[x, y]"},
+		{`let prefix = "hi "; let main = fn() { prefix + "there" }`, nil, "hi there"},
+		// mainが無ければトップレベルの値
+		{`1 + 2`, []string{"ignored"}, "3"},
+		{`if (false) { let main = fn() { 1 } }; 5`, nil, "5"},
+		// monkey runでもマクロを展開する
+		{`let unless = macro(c, a, b) { quote(if (!(unquote(c))) { unquote(a) } else { unquote(b) }) };
+		let main = fn(argv) { unless(len(argv) > 1, "one", "many") }`, []string{"a"}, "one"},
+	}
+
+	for _, tt := range tests {
+
+		result, err := New().CallMain(tt.input, tt.argv)
+
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", tt.input, err)
+		}
+
+		testInspect(t, result, tt.expected)
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`let main = 1`, "main must be a function, got INTEGER"},
+		{`let main = fn(a, b) { a }`, "main must take 0 or 1 parameters, got 2"},
+	}
+
+	for _, tt := range errorTests {
+
+		_, err := New().CallMain(tt.input, nil)
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+
+	// Runではmainを呼ばない
+	result, err := New().Run(`let main = fn() { 1 }; 2`)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testInspect(t, result, "2")
+}
+
+func TestModules(t *testing.T) {
+
+	e := New()
+
+	if _, err := e.Run(`import "paths"`); err == nil {
+		t.Errorf("expected an error without a module resolver")
+	}
+
+	e.SetModuleResolver(compiler.MapResolver{
+		// ホストの組み込み関数はモジュールからも使える
+		"paths": `let base = fn(p) { path_base(p) };`,
+	})
+
+	result, err := e.Run(`let paths = import "paths"; paths["base"]("/tmp/a.monkey")`)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if result.Inspect() != "a.monkey" {
+		t.Errorf("wrong result. got=%s", result.Inspect())
+	}
+}
+
+func TestRunContextCancelsScript(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := New().RunContext(ctx, `while (true) { 1 }`)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
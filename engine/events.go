@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"fmt"
+
+	"example.com/monkey/object"
+)
+
+// イベント
+// スクリプトは on(event, fn) で購読し、emit(event, payload) で発行する
+// ホストは Engine.On で購読し、Engine.Emit でスクリプトにイベントを送る
+// 購読したスクリプトは実行が終わった後もVMを保持しておく(timers.goと同じ)
+//
+//	e.On("log", func(payload interface{}) { ... })
+//	e.Run(`on("click", fn(p) { emit("log", p["x"]) })`)
+//	e.Emit("click", map[string]interface{}{"x": 1})
+
+// ホストの購読者が受け取る値はFromObjectで変換したもの
+type Handler func(payload interface{})
+
+// 購読した関数の中からemitできる深さの上限
+// 同じイベントを発行し続けるとGoのスタックを使い切ってしまうので止める
+const maxEmitDepth = 64
+
+// ホストでイベントを購読する
+func (e *Engine) On(event string, fn Handler) {
+
+	if e.handlers == nil {
+		e.handlers = map[string][]Handler{}
+	}
+
+	e.handlers[event] = append(e.handlers[event], fn)
+}
+
+// スクリプトにイベントを送り、購読している関数を登録順に呼ぶ
+// 呼んだ関数の数を返す
+func (e *Engine) Emit(event string, payload interface{}) (int, error) {
+
+	if e.loop == nil {
+		return 0, nil
+	}
+
+	return e.loop.emitToScript(event, ToObject(payload))
+}
+
+func (s *session) emitToScript(event string, payload object.Object) (int, error) {
+
+	if s.emitDepth >= maxEmitDepth {
+		s.emitOverflow = fmt.Errorf("event %s: emit nested too deeply: %d levels", event, maxEmitDepth)
+		return 0, s.emitOverflow
+	}
+
+	s.emitDepth++
+
+	defer func() {
+		s.emitDepth--
+
+		if s.emitDepth == 0 {
+			s.emitOverflow = nil
+		}
+	}()
+
+	handlers := s.handlers[event]
+
+	for _, fn := range handlers {
+
+		result, err := s.machine.Call(fn, payload)
+
+		if err == nil {
+
+			if errObj, ok := result.(*object.Error); ok {
+				err = fmt.Errorf("%s", errObj.Message)
+			}
+		}
+
+		// 上限を超えたときは途中の段のイベント名を重ねずに返す
+		if err != nil && s.emitOverflow != nil {
+			return 0, s.emitOverflow
+		}
+
+		if err != nil {
+			return 0, fmt.Errorf("event %s: %s", event, err)
+		}
+	}
+
+	return len(handlers), nil
+}
+
+func (e *Engine) eventBuiltins(s *session) []hostBuiltin {
+
+	return []hostBuiltin{
+		{
+			"on",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				if len(args) != 2 {
+					return newError("wrong number of arguments. got=%d, want=2", len(args))
+				}
+
+				event, ok := args[0].(*object.String)
+
+				if !ok {
+					return newError("first argument to `on` must be STRING, got %s", args[0].Type())
+				}
+
+				switch args[1].(type) {
+				case *object.Closure, *object.Builtin:
+				default:
+					return newError("second argument to `on` must be FUNCTION, got %s", args[1].Type())
+				}
+
+				if s.handlers == nil {
+					s.handlers = map[string][]object.Object{}
+				}
+
+				s.handlers[event.Value] = append(s.handlers[event.Value], args[1])
+
+				return nil
+			}},
+		},
+		{
+			// ホストとスクリプトの購読者に送り、呼んだ数を返す
+			"emit",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				if len(args) != 1 && len(args) != 2 {
+					return newError("wrong number of arguments. got=%d, want=1 or 2", len(args))
+				}
+
+				event, ok := args[0].(*object.String)
+
+				if !ok {
+					return newError("first argument to `emit` must be STRING, got %s", args[0].Type())
+				}
+
+				var payload object.Object = &object.Null{}
+
+				if len(args) == 2 {
+					payload = args[1]
+				}
+
+				hostHandlers := e.handlers[event.Value]
+
+				if len(hostHandlers) > 0 {
+
+					v, err := FromObject(payload)
+
+					if err != nil {
+						return newError("emit: %s", err)
+					}
+
+					for _, fn := range hostHandlers {
+						fn(v)
+					}
+				}
+
+				n, err := s.emitToScript(event.Value, payload)
+
+				if err != nil {
+					return newError("emit: %s", err)
+				}
+
+				return &object.Integer{Value: int64(len(hostHandlers) + n)}
+			}},
+		},
+	}
+}
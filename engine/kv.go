@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"sync"
+
+	"example.com/monkey/object"
+)
+
+// kv_get(key) / kv_put(key, value) / kv_delete(key)
+// ファイルの読み書きを許さなくても、スクリプトが小さな状態を保存できるようにする
+
+// 値はToObject/FromObjectで変換できるGoの値
+type Store interface {
+	Get(key string) (value interface{}, ok bool, err error)
+	Put(key string, value interface{}) error
+	Delete(key string) error
+}
+
+// ストアを設定するとkv_*が使えるようになる
+func (e *Engine) SetStore(s Store) {
+	e.store = s
+}
+
+// メモリ上のStore
+type MemoryStore struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: map[string]interface{}{}}
+}
+
+func (m *MemoryStore) Get(key string) (interface{}, bool, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.values[key]
+
+	return v, ok, nil
+}
+
+func (m *MemoryStore) Put(key string, value interface{}) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[key] = value
+
+	return nil
+}
+
+func (m *MemoryStore) Delete(key string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.values, key)
+
+	return nil
+}
+
+func (e *Engine) storeBuiltins() []hostBuiltin {
+
+	store := e.store
+
+	return []hostBuiltin{
+		{
+			// キーがなければnull
+			"kv_get",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				key, errObj := storeKey("kv_get", args, 1)
+
+				if errObj != nil {
+					return errObj
+				}
+
+				v, ok, err := store.Get(key)
+
+				if err != nil {
+					return newError("kv_get: %s", err)
+				}
+
+				if !ok {
+					return nil
+				}
+
+				return ToObject(v)
+			}},
+		},
+		{
+			"kv_put",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				key, errObj := storeKey("kv_put", args, 2)
+
+				if errObj != nil {
+					return errObj
+				}
+
+				v, err := FromObject(args[1])
+
+				if err != nil {
+					return newError("kv_put: %s", err)
+				}
+
+				if err := store.Put(key, v); err != nil {
+					return newError("kv_put: %s", err)
+				}
+
+				return nil
+			}},
+		},
+		{
+			"kv_delete",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				key, errObj := storeKey("kv_delete", args, 1)
+
+				if errObj != nil {
+					return errObj
+				}
+
+				if err := store.Delete(key); err != nil {
+					return newError("kv_delete: %s", err)
+				}
+
+				return nil
+			}},
+		},
+	}
+}
+
+// 引数の数を確認し、1つ目の引数をキーとして取り出す
+func storeKey(name string, args []object.Object, want int) (string, *object.Error) {
+
+	if len(args) != want {
+		return "", newError("wrong number of arguments. got=%d, want=%d",
+			len(args), want)
+	}
+
+	key, ok := args[0].(*object.String)
+
+	if !ok {
+		return "", newError("argument to `%s` must be STRING, got %s",
+			name, args[0].Type())
+	}
+
+	return key.Value, nil
+}
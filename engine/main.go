@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/object"
+	"example.com/monkey/vm"
+)
+
+// Runと同じようにソースを実行した後、グローバルのmain関数が定義されていれば
+// argvを文字列の配列にして渡して呼び、その戻り値を返す(monkey runと同じ)
+// mainが無ければトップレベルで最後に評価した式の値を返す
+// mainは引数を0個か1個とる関数でなければならない
+func (e *Engine) CallMain(input string, argv []string) (object.Object, error) {
+	return e.run(context.Background(), input, true, argv)
+}
+
+// mainが定義されていなければnilを返す
+func runMain(symbolTable *compiler.SymbolTable, machine *vm.VM, argv []string) (object.Object, error) {
+
+	symbol, ok := symbolTable.Resolve("main")
+
+	if !ok || symbol.Scope != compiler.GlobalScope {
+		return nil, nil
+	}
+
+	// 実行されなかったletで定義されている
+	value := machine.Global(symbol.Index)
+
+	if value == nil {
+		return nil, nil
+	}
+
+	main, ok := value.(*object.Closure)
+
+	if !ok {
+		return nil, fmt.Errorf("main must be a function, got %s", value.Type())
+	}
+
+	switch main.Fn.NumParameters {
+
+	case 0:
+		return machine.Call(main)
+
+	case 1:
+		args := make([]object.Object, len(argv))
+
+		for i, arg := range argv {
+			args[i] = &object.String{Value: arg}
+		}
+
+		return machine.Call(main, &object.Array{Elements: args})
+
+	default:
+		return nil, fmt.Errorf("main must take 0 or 1 parameters, got %d", main.Fn.NumParameters)
+	}
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"path/filepath"
+
+	"example.com/monkey/object"
+)
+
+// パスの操作
+// path_join(elem...) / path_base(path) / path_ext(path) は文字列を扱うだけなので権限は不要
+// glob(pattern) はファイルシステムを読むのでFS権限が必要
+// 区切り文字はOSに合わせる(filepath)
+
+func pathBuiltins() []hostBuiltin {
+
+	return []hostBuiltin{
+		{
+			"path_join",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				elems := make([]string, len(args))
+
+				for i, arg := range args {
+
+					str, ok := arg.(*object.String)
+
+					if !ok {
+						return newError("argument to `path_join` must be STRING, got %s", arg.Type())
+					}
+
+					elems[i] = str.Value
+				}
+
+				return &object.String{Value: filepath.Join(elems...)}
+			}},
+		},
+		{
+			"path_base",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				path, errObj := stringArg("path_base", args)
+
+				if errObj != nil {
+					return errObj
+				}
+
+				return &object.String{Value: filepath.Base(path)}
+			}},
+		},
+		{
+			// 拡張子は"."を含む。なければ""
+			"path_ext",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				path, errObj := stringArg("path_ext", args)
+
+				if errObj != nil {
+					return errObj
+				}
+
+				return &object.String{Value: filepath.Ext(path)}
+			}},
+		},
+	}
+}
+
+func fsBuiltins() []hostBuiltin {
+
+	return []hostBuiltin{
+		{
+			// 一致したパスを辞書順の配列で返す。一致しなければ空配列
+			"glob",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				pattern, errObj := stringArg("glob", args)
+
+				if errObj != nil {
+					return errObj
+				}
+
+				matches, err := filepath.Glob(pattern)
+
+				if err != nil {
+					return newError("glob: %s", err)
+				}
+
+				elements := make([]object.Object, len(matches))
+
+				for i, m := range matches {
+					elements[i] = &object.String{Value: m}
+				}
+
+				return &object.Array{Elements: elements}
+			}},
+		},
+	}
+}
@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/lexer"
+	"example.com/monkey/object"
+	"example.com/monkey/parser"
+	"example.com/monkey/vm"
+)
+
+// 全てのRunで使える、Monkeyで書いた標準ライブラリ
+type prelude struct {
+	// preludeのグローバル変数(const扱い)と組み込み関数
+	symbols *compiler.SymbolTable
+	// preludeの関数が参照する定数。Runの定数はこの後ろに追加される
+	constants []object.Object
+	// 実行した後のグローバル変数の値
+	globals []object.Object
+}
+
+// srcを一度だけコンパイル・実行し、定義したグローバル変数を以降の全てのRunに見せる
+// Runごとにはグローバル変数の値を写すだけで、preludeを実行し直さない
+// preludeのグローバル変数はconstになり、スクリプトから定義し直せない
+// preludeで使える組み込み関数はobject.Builtinsのものだけ
+func (e *Engine) SetPrelude(src string) error {
+
+	p := parser.New(lexer.New(src))
+
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+		return fmt.Errorf("prelude parser errors: %s", strings.Join(p.Errors(), "; "))
+	}
+
+	symbolTable := compiler.NewSymbolTable()
+
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+
+	if err := comp.Compile(program); err != nil {
+		return fmt.Errorf("prelude: %s", err)
+	}
+
+	bytecode := comp.Bytecode()
+
+	machine := vm.New(bytecode)
+
+	if err := machine.Run(); err != nil {
+		return fmt.Errorf("prelude: %s", err)
+	}
+
+	symbolTable.Freeze()
+
+	globals := make([]object.Object, symbolTable.NumDefinitions())
+	copy(globals, machine.Globals())
+
+	constants := bytecode.Constants
+
+	e.prelude = &prelude{
+		symbols: symbolTable,
+		// Runのコンパイラーが定数を追加したときに、共有している配列に書き込まないよう容量を切り詰める
+		constants: constants[:len(constants):len(constants)],
+		globals:   globals,
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+
+	"example.com/monkey/object"
+)
+
+// exec(cmd, args, opts) -> {"stdout": ..., "stderr": ..., "code": ...}
+// optsは省略できる
+//
+//	"timeout": ミリ秒
+//	"dir":     作業ディレクトリ
+//	"env":     追加する環境変数のハッシュ
+//	"stdin":   標準入力に渡す文字列
+
+// execで実行できるコマンドを制限する
+func (e *Engine) AllowCommands(names ...string) {
+
+	if e.allowedCommands == nil {
+		e.allowedCommands = map[string]bool{}
+	}
+
+	for _, name := range names {
+		e.allowedCommands[name] = true
+	}
+}
+
+func (e *Engine) processBuiltins(s *session) []hostBuiltin {
+
+	return []hostBuiltin{
+		{
+			"exec",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				if len(args) != 2 && len(args) != 3 {
+					return newError("wrong number of arguments. got=%d, want=2 or 3",
+						len(args))
+				}
+
+				name, ok := args[0].(*object.String)
+
+				if !ok {
+					return newError("first argument to `exec` must be STRING, got %s",
+						args[0].Type())
+				}
+
+				if e.allowedCommands != nil && !e.allowedCommands[name.Value] {
+					return newError("exec: command not allowed: %s", name.Value)
+				}
+
+				cmdArgs, errObj := stringArray("exec", args[1])
+
+				if errObj != nil {
+					return errObj
+				}
+
+				opts := &object.Hash{}
+
+				if len(args) == 3 {
+
+					opts, ok = args[2].(*object.Hash)
+
+					if !ok {
+						return newError("third argument to `exec` must be HASH, got %s",
+							args[2].Type())
+					}
+				}
+
+				return runCommand(s.ctx, name.Value, cmdArgs, opts)
+			}},
+		},
+	}
+}
+
+func runCommand(
+	ctx context.Context,
+	name string,
+	args []string,
+	opts *object.Hash,
+) object.Object {
+
+	if timeout, ok := hashGet(opts, "timeout").(*object.Integer); ok {
+
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout.Value)*time.Millisecond)
+
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+
+	var stdout, stderr bytes.Buffer
+
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if dir, ok := hashGet(opts, "dir").(*object.String); ok {
+		cmd.Dir = dir.Value
+	}
+
+	if stdin, ok := hashGet(opts, "stdin").(*object.String); ok {
+		cmd.Stdin = bytes.NewBufferString(stdin.Value)
+	}
+
+	if env, ok := hashGet(opts, "env").(*object.Hash); ok {
+
+		cmd.Env = os.Environ()
+
+		for _, pair := range env.Pairs {
+			cmd.Env = append(cmd.Env, hashKeyString(pair.Key)+"="+hashKeyString(pair.Value))
+		}
+	}
+
+	err := cmd.Run()
+
+	// タイムアウトやキャンセルで止めた場合
+	if ctx.Err() != nil {
+		return newError("exec: %s", ctx.Err())
+	}
+
+	code := 0
+
+	if err != nil {
+
+		var exitErr *exec.ExitError
+
+		if !errors.As(err, &exitErr) {
+			return newError("exec: %s", err)
+		}
+
+		// 0以外の終了コードはエラーにせず、codeで返す
+		code = exitErr.ExitCode()
+	}
+
+	return ToObject(map[string]interface{}{
+		"stdout": stdout.String(),
+		"stderr": stderr.String(),
+		"code":   code,
+	})
+}
+
+// 文字列の配列をGoのスライスにする
+func stringArray(name string, obj object.Object) ([]string, *object.Error) {
+
+	array, ok := obj.(*object.Array)
+
+	if !ok {
+		return nil, newError("argument to `%s` must be ARRAY, got %s", name, obj.Type())
+	}
+
+	values := make([]string, len(array.Elements))
+
+	for i, el := range array.Elements {
+
+		str, ok := el.(*object.String)
+
+		if !ok {
+			return nil, newError("argument to `%s` must be ARRAY of STRING, got %s",
+				name, el.Type())
+		}
+
+		values[i] = str.Value
+	}
+
+	return values, nil
+}
+
+// 文字列のキーで値を取り出す(なければnil)
+func hashGet(hash *object.Hash, key string) object.Object {
+
+	pair, ok := hash.Pairs[(&object.String{Value: key}).HashKey()]
+
+	if !ok {
+		return nil
+	}
+
+	return pair.Value
+}
@@ -0,0 +1,259 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"example.com/monkey/object"
+	"example.com/monkey/vm"
+)
+
+// タイマー
+// set_timeout(fn, ms) / set_interval(fn, ms) / clear_timer(id)
+// スクリプトの実行が終わった後も、タイマーが残っていればそのVMを保持しておき、
+// ホストがTick(またはRunLoop)を呼ぶたびに時間になったコールバックを呼ぶ
+//
+//	e.Run(src)
+//	for e.Pending() > 0 {
+//		e.Tick(16 * time.Millisecond)
+//	}
+
+type timer struct {
+	id int
+	// Runの開始からの時間
+	due      time.Duration
+	interval time.Duration
+	fn       object.Object
+	// 作られたTickの回数(そのTickの間は呼ばない)
+	tick int
+}
+
+type scheduler struct {
+	now    time.Duration
+	ticks  int
+	nextID int
+	timers []*timer
+}
+
+func (sc *scheduler) add(fn object.Object, delay time.Duration, interval time.Duration) int {
+
+	sc.nextID++
+
+	sc.timers = append(sc.timers, &timer{
+		id:       sc.nextID,
+		due:      sc.now + delay,
+		interval: interval,
+		fn:       fn,
+		tick:     sc.ticks,
+	})
+
+	return sc.nextID
+}
+
+func (sc *scheduler) remove(id int) bool {
+
+	for i, t := range sc.timers {
+
+		if t.id == id {
+			sc.timers = append(sc.timers[:i], sc.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// 時間になったタイマーのうち最も早いもの(同じなら先に作ったもの)
+func (sc *scheduler) due() *timer {
+
+	sort.SliceStable(sc.timers, func(i, j int) bool {
+		return sc.timers[i].due < sc.timers[j].due
+	})
+
+	for _, t := range sc.timers {
+
+		if t.due > sc.now {
+			return nil
+		}
+
+		// このTickの間に作られたタイマーは次のTickまで待つ
+		if t.tick < sc.ticks {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// 次のタイマーの時間までの長さ
+func (sc *scheduler) untilNext() time.Duration {
+
+	next := sc.timers[0].due
+
+	for _, t := range sc.timers[1:] {
+		if t.due < next {
+			next = t.due
+		}
+	}
+
+	return next - sc.now
+}
+
+// 残っているタイマーの数
+func (e *Engine) Pending() int {
+
+	if e.loop == nil {
+		return 0
+	}
+
+	return len(e.loop.timers.timers)
+}
+
+// 時間をdだけ進めて、時間になったコールバックを呼ぶ
+// コールバックがエラーになると、残りのタイマーは呼ばずにエラーを返す
+func (e *Engine) Tick(d time.Duration) error {
+
+	if e.loop == nil {
+		return nil
+	}
+
+	sc := &e.loop.timers
+	sc.now += d
+	sc.ticks++
+
+	for t := sc.due(); t != nil; t = sc.due() {
+
+		if t.interval > 0 {
+			t.due += t.interval
+		} else {
+			sc.remove(t.id)
+		}
+
+		result, err := e.loop.machine.Call(t.fn)
+
+		if err == nil {
+
+			if errObj, ok := result.(*object.Error); ok {
+				err = fmt.Errorf("%s", errObj.Message)
+			}
+		}
+
+		if err != nil {
+			e.Stop()
+			return fmt.Errorf("timer %d: %s", t.id, err)
+		}
+	}
+
+	if e.loop.idle() {
+		e.Stop()
+	}
+
+	return nil
+}
+
+// タイマーが無くなるまで実際の時間に合わせてTickを呼ぶ
+func (e *Engine) RunLoop(ctx context.Context) error {
+
+	last := time.Now()
+
+	for e.Pending() > 0 {
+
+		wait := e.loop.timers.untilNext()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		now := time.Now()
+
+		if err := e.Tick(now.Sub(last)); err != nil {
+			return err
+		}
+
+		last = now
+	}
+
+	return nil
+}
+
+// 残っているタイマーとイベントの購読を捨てて、スクリプトが開いたリソースを閉じる
+func (e *Engine) Stop() {
+
+	if e.loop != nil {
+		e.loop.close()
+		e.loop = nil
+	}
+}
+
+func timerBuiltins(s *session) []hostBuiltin {
+
+	add := func(name string, repeat bool) *object.Builtin {
+
+		return &object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2", len(args))
+			}
+
+			switch args[0].(type) {
+			case *object.Closure, *object.Builtin:
+			default:
+				return newError("first argument to `%s` must be FUNCTION, got %s",
+					name, args[0].Type())
+			}
+
+			ms, ok := args[1].(*object.Integer)
+
+			if !ok || ms.Value < 0 {
+				return newError("second argument to `%s` must be a non-negative INTEGER, got %s",
+					name, args[1].Inspect())
+			}
+
+			delay := time.Duration(ms.Value) * time.Millisecond
+
+			if !repeat {
+				return &object.Integer{Value: int64(s.timers.add(args[0], delay, 0))}
+			}
+
+			// 0msの繰り返しはTickの間に何度も呼ばれないように1msにする
+			if delay == 0 {
+				delay = time.Millisecond
+			}
+
+			return &object.Integer{Value: int64(s.timers.add(args[0], delay, delay))}
+		}}
+	}
+
+	return []hostBuiltin{
+		{"set_timeout", add("set_timeout", false)},
+		{"set_interval", add("set_interval", true)},
+		{
+			// 取り消せたらtrue
+			"clear_timer",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+
+				id, ok := args[0].(*object.Integer)
+
+				if !ok {
+					return newError("argument to `clear_timer` must be INTEGER, got %s",
+						args[0].Type())
+				}
+
+				// VMは真偽値を同一性で比べるので、VMと同じ値を返す
+				if s.timers.remove(int(id.Value)) {
+					return vm.True
+				}
+
+				return vm.False
+			}},
+		},
+	}
+}
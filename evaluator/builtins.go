@@ -12,4 +12,15 @@ var builtins = map[string]*object.Builtin{
 	"rest":  object.GetBuiltinByName("rest"),
 	"push":  object.GetBuiltinByName("push"),
 	"puts":  object.GetBuiltinByName("puts"),
+
+	"now":         object.GetBuiltinByName("now"),
+	"datetime":    object.GetBuiltinByName("datetime"),
+	"duration":    object.GetBuiltinByName("duration"),
+	"date_add":    object.GetBuiltinByName("date_add"),
+	"date_diff":   object.GetBuiltinByName("date_diff"),
+	"date_format": object.GetBuiltinByName("date_format"),
+
+	"dot":       object.GetBuiltinByName("dot"),
+	"matmul":    object.GetBuiltinByName("matmul"),
+	"transpose": object.GetBuiltinByName("transpose"),
 }
@@ -0,0 +1,185 @@
+package evaluator
+
+import (
+	"fmt"
+
+	"example.com/monkey/ast"
+	"example.com/monkey/object"
+)
+
+// トップレベルの let name = macro(...){...}; をenvに登録し、
+// プログラムからは取り除く
+func DefineMacros(program *ast.Program, env *object.Environment) {
+
+	definitions := []int{}
+
+	for i, statement := range program.Statements {
+
+		if isMacroDefinition(statement) {
+			addMacro(statement, env)
+			definitions = append(definitions, i)
+		}
+	}
+
+	// 後ろから取り除くことでインデックスがずれないようにする
+	for i := len(definitions) - 1; i >= 0; i = i - 1 {
+
+		definitionIndex := definitions[i]
+
+		program.Statements = append(
+			program.Statements[:definitionIndex],
+			program.Statements[definitionIndex+1:]...,
+		)
+	}
+}
+
+func isMacroDefinition(node ast.Statement) bool {
+
+	letStatement, ok := node.(*ast.LetStatement)
+
+	if !ok {
+		return false
+	}
+
+	_, ok = letStatement.Value.(*ast.MacroLiteral)
+
+	return ok
+}
+
+func addMacro(stmt ast.Statement, env *object.Environment) {
+
+	letStatement, _ := stmt.(*ast.LetStatement)
+
+	macroLiteral, _ := letStatement.Value.(*ast.MacroLiteral)
+
+	macro := &object.Macro{
+		Parameters: macroLiteral.Parameters,
+		Env:        env,
+		Body:       macroLiteral.Body,
+	}
+
+	env.Set(letStatement.Name.Value, macro)
+}
+
+// マクロの呼び出しを、マクロを評価した結果のASTに置き換える
+// コンパイルの前に実行する
+// マクロがquoteしたAST以外を返したときや、引数の数が合わないときはエラーを返す
+func ExpandMacros(program ast.Node, env *object.Environment) (ast.Node, error) {
+
+	var err error
+
+	expanded := ast.Modify(program, func(node ast.Node) ast.Node {
+
+		if err != nil {
+			return node
+		}
+
+		callExpression, ok := node.(*ast.CallExpression)
+
+		if !ok {
+			return node
+		}
+
+		macro, ok := isMacroCall(callExpression, env)
+
+		if !ok {
+			return node
+		}
+
+		name := callExpression.Function.String()
+
+		if len(callExpression.Arguments) != len(macro.Parameters) {
+			err = fmt.Errorf("wrong number of arguments to macro %s: want=%d, got=%d",
+				name, len(macro.Parameters), len(callExpression.Arguments))
+			return node
+		}
+
+		// 引数は評価せずにASTのまま渡す
+		args := quoteArgs(callExpression)
+
+		evalEnv := extendMacroEnv(macro, args)
+
+		evaluated := Eval(macro.Body, evalEnv)
+
+		if isError(evaluated) {
+			err = fmt.Errorf("macro %s: %s", name, evaluated.(*object.Error).Message)
+			return node
+		}
+
+		quote, ok := evaluated.(*object.Quote)
+
+		if !ok {
+			err = fmt.Errorf("macro %s must return a quoted AST node, got %s", name, typeName(evaluated))
+			return node
+		}
+
+		return quote.Node
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return expanded, nil
+}
+
+// 本体が空のマクロはnilを返す
+func typeName(obj object.Object) object.ObjectType {
+
+	if obj == nil {
+		return object.NULL_OBJ
+	}
+
+	return obj.Type()
+}
+
+func isMacroCall(
+	exp *ast.CallExpression,
+	env *object.Environment,
+) (*object.Macro, bool) {
+
+	identifier, ok := exp.Function.(*ast.Identifier)
+
+	if !ok {
+		return nil, false
+	}
+
+	obj, ok := env.Get(identifier.Value)
+
+	if !ok {
+		return nil, false
+	}
+
+	macro, ok := obj.(*object.Macro)
+
+	if !ok {
+		return nil, false
+	}
+
+	return macro, true
+}
+
+func quoteArgs(exp *ast.CallExpression) []*object.Quote {
+
+	args := []*object.Quote{}
+
+	for _, a := range exp.Arguments {
+		args = append(args, &object.Quote{Node: a})
+	}
+
+	return args
+}
+
+func extendMacroEnv(
+	macro *object.Macro,
+	args []*object.Quote,
+) *object.Environment {
+
+	extended := object.NewEnclosedEnvironment(macro.Env)
+
+	for paramIdx, param := range macro.Parameters {
+		extended.Set(param.Value, args[paramIdx])
+	}
+
+	return extended
+}
@@ -0,0 +1,92 @@
+package evaluator
+
+import (
+	"fmt"
+
+	"example.com/monkey/ast"
+	"example.com/monkey/object"
+	"example.com/monkey/token"
+)
+
+// 引数のASTを評価せずにそのまま返す
+// ただし中にあるunquote(...)だけは評価して、その結果のASTに置き換える
+func quote(node ast.Node, env *object.Environment) object.Object {
+
+	node = evalUnquoteCalls(node, env)
+
+	return &object.Quote{Node: node}
+}
+
+func evalUnquoteCalls(quoted ast.Node, env *object.Environment) ast.Node {
+
+	return ast.Modify(quoted, func(node ast.Node) ast.Node {
+
+		if !isUnquoteCall(node) {
+			return node
+		}
+
+		call, ok := node.(*ast.CallExpression)
+
+		if !ok {
+			return node
+		}
+
+		if len(call.Arguments) != 1 {
+			return node
+		}
+
+		unquoted := Eval(call.Arguments[0], env)
+
+		return convertObjectToASTNode(unquoted)
+	})
+}
+
+func isUnquoteCall(node ast.Node) bool {
+
+	callExpression, ok := node.(*ast.CallExpression)
+
+	if !ok {
+		return false
+	}
+
+	return callExpression.Function.TokenLiteral() == "unquote"
+}
+
+// 評価結果のオブジェクトをASTのノードに戻す
+func convertObjectToASTNode(obj object.Object) ast.Node {
+
+	switch obj := obj.(type) {
+
+	case *object.Integer:
+		t := token.Token{
+			Type:    token.INT,
+			Literal: fmt.Sprintf("%d", obj.Value),
+		}
+		return &ast.IntegerLiteral{Token: t, Value: obj.Value}
+
+	case *object.String:
+		t := token.Token{
+			Type:    token.STRING,
+			Literal: obj.Value,
+		}
+		return &ast.StringLiteral{Token: t, Value: obj.Value}
+
+	case *object.Boolean:
+		var t token.Token
+		if obj.Value {
+			t = token.Token{Type: token.TRUE, Literal: "true"}
+		} else {
+			t = token.Token{Type: token.FALSE, Literal: "false"}
+		}
+		return &ast.Boolean{Token: t, Value: obj.Value}
+
+	case *object.Null:
+		return &ast.NullLiteral{Token: token.Token{Type: token.NULL, Literal: "null"}}
+
+	case *object.Quote:
+		return obj.Node
+
+	default:
+		return nil
+	}
+}
@@ -1,3 +1,8 @@
 module example.com/monkey
 
 go 1.16
+
+require (
+	github.com/BurntSushi/toml v1.3.2
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,645 @@
+package gogen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strconv"
+	"strings"
+
+	"example.com/monkey/ast"
+	"example.com/monkey/object"
+)
+
+// Monkeyのプログラムから、同じ動きをするGoのソースコード(package main)を出力する
+// よく使うスクリプトを事前にGoのバイナリにしておくためのもの
+//
+// 式の値はすべて一時変数に入れてから使うので、評価の順番はVMと同じになる
+// 実行時の演算は rt パッケージの関数を呼ぶ
+// 対応していない構文(マクロ、import、try/throw、スライスなど)はエラーにする
+
+type generator struct {
+	out    bytes.Buffer
+	indent int
+	// 一時変数と変数の名前の通し番号
+	count int
+	// Monkeyの変数名からGoの変数名へ。内側のスコープが最後
+	scopes []map[string]string
+	// constで定義したGoの変数
+	constants map[string]bool
+	// 関数名のGoの変数(代入できない)
+	functions map[string]bool
+	loops     int
+}
+
+func Generate(program *ast.Program) (string, error) {
+
+	g := &generator{constants: map[string]bool{}, functions: map[string]bool{}}
+
+	g.line("// Code generated by monkey transpile. DO NOT EDIT.")
+	g.line("")
+	g.line("package main")
+	g.line("")
+	g.line("import (")
+	g.line(`"fmt"`)
+	g.line(`"os"`)
+	g.line("")
+	g.line(`"example.com/monkey/gogen/rt"`)
+	g.line(`"example.com/monkey/object"`)
+	g.line(")")
+	g.line("")
+	g.line("var _ = rt.NULL")
+	g.line("")
+	g.line("func main() {")
+	g.line("if _, err := rt.Run(program); err != nil {")
+	g.line("fmt.Fprintln(os.Stderr, err)")
+	g.line("os.Exit(1)")
+	g.line("}")
+	g.line("}")
+	g.line("")
+	g.line("func program() object.Object {")
+	g.line("var result object.Object = rt.NULL")
+	g.line("_ = result")
+
+	g.pushScope()
+
+	for _, s := range program.Statements {
+
+		value, err := g.statement(s)
+
+		if err != nil {
+			return "", err
+		}
+
+		if value != "" {
+			g.line("result = %s", value)
+		}
+	}
+
+	g.line("return result")
+	g.line("}")
+
+	src, err := format.Source(g.out.Bytes())
+
+	if err != nil {
+		return "", fmt.Errorf("generated invalid Go source: %s", err)
+	}
+
+	return string(src), nil
+}
+
+func (g *generator) line(format string, a ...interface{}) {
+	fmt.Fprintf(&g.out, format+"\n", a...)
+}
+
+func (g *generator) temp() string {
+	g.count++
+	return fmt.Sprintf("t%d", g.count)
+}
+
+func (g *generator) pushScope() {
+	g.scopes = append(g.scopes, map[string]string{})
+}
+
+func (g *generator) popScope() {
+	g.scopes = g.scopes[:len(g.scopes)-1]
+}
+
+// Goの予約語や組み込みと重ならないように名前を変える
+func (g *generator) declare(name string) string {
+
+	g.count++
+
+	goName := fmt.Sprintf("v_%s_%d", name, g.count)
+
+	g.scopes[len(g.scopes)-1][name] = goName
+
+	return goName
+}
+
+func (g *generator) lookup(name string) (string, bool) {
+
+	for i := len(g.scopes) - 1; i >= 0; i-- {
+		if goName, ok := g.scopes[i][name]; ok {
+			return goName, true
+		}
+	}
+
+	return "", false
+}
+
+// 文を出力し、式文ならその値を返す
+func (g *generator) statement(s ast.Statement) (string, error) {
+
+	switch s := s.(type) {
+
+	case *ast.ExpressionStatement:
+		return g.expression(s.Expression)
+
+	case *ast.LetStatement:
+		return "", g.let(s.Name.Value, s.Value, false)
+
+	case *ast.ConstStatement:
+		return "", g.let(s.Name.Value, s.Value, true)
+
+	case *ast.ReturnStatement:
+
+		value, err := g.expression(s.ReturnValue)
+
+		if err != nil {
+			return "", err
+		}
+
+		g.line("return %s", value)
+
+	case *ast.BreakStatement:
+
+		if g.loops == 0 {
+			return "", fmt.Errorf("break outside of a loop")
+		}
+
+		g.line("break")
+
+	case *ast.ContinueStatement:
+
+		if g.loops == 0 {
+			return "", fmt.Errorf("continue outside of a loop")
+		}
+
+		g.line("continue")
+
+	default:
+		return "", fmt.Errorf("cannot transpile %T", s)
+	}
+
+	return "", nil
+}
+
+func (g *generator) let(name string, value ast.Expression, constant bool) error {
+
+	// 右辺からも新しい変数が見える(コンパイラーと同じ)
+	goName := g.declare(name)
+
+	g.line("var %s object.Object", goName)
+	g.line("_ = %s", goName)
+
+	v, err := g.expression(value)
+
+	if err != nil {
+		return err
+	}
+
+	g.line("%s = %s", goName, v)
+
+	if constant {
+		g.constants[goName] = true
+	}
+
+	return nil
+}
+
+// ブロックを出力し、最後の式文の値(なければnull)を返す
+func (g *generator) block(b *ast.BlockStatement) (string, error) {
+
+	g.pushScope()
+	defer g.popScope()
+
+	value := "rt.NULL"
+
+	for i, s := range b.Statements {
+
+		v, err := g.statement(s)
+
+		if err != nil {
+			return "", err
+		}
+
+		if i == len(b.Statements)-1 && v != "" {
+			value = v
+		} else if v != "" {
+			g.line("_ = %s", v)
+		}
+	}
+
+	return value, nil
+}
+
+// 後の式を評価しても変わらない値にする
+// 変数は後の代入で変わることがあるので一時変数にコピーする
+func (g *generator) value(e ast.Expression) (string, error) {
+
+	v, err := g.expression(e)
+
+	if err != nil || !strings.HasPrefix(v, "v_") {
+		return v, err
+	}
+
+	t := g.temp()
+	g.line("%s := %s", t, v)
+
+	return t, nil
+}
+
+func (g *generator) values(exps []ast.Expression) ([]string, error) {
+
+	values := []string{}
+
+	for _, e := range exps {
+
+		v, err := g.value(e)
+
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+// 式を評価する文を出力し、その値を表すGoの式を返す
+func (g *generator) expression(e ast.Expression) (string, error) {
+
+	switch e := e.(type) {
+
+	case *ast.IntegerLiteral:
+		return fmt.Sprintf("rt.Int(%d)", e.Value), nil
+
+	case *ast.StringLiteral:
+		return fmt.Sprintf("rt.Str(%s)", strconv.Quote(e.Value)), nil
+
+	case *ast.Boolean:
+		if e.Value {
+			return "rt.TRUE", nil
+		}
+		return "rt.FALSE", nil
+
+	case *ast.NullLiteral:
+		return "rt.NULL", nil
+
+	case *ast.Identifier:
+
+		if goName, ok := g.lookup(e.Value); ok {
+			return goName, nil
+		}
+
+		if object.GetBuiltinByName(e.Value) != nil {
+			return fmt.Sprintf("rt.Builtin(%q)", e.Value), nil
+		}
+
+		return "", fmt.Errorf("undefined variable %s", e.Value)
+
+	case *ast.PrefixExpression:
+
+		right, err := g.expression(e.Right)
+
+		if err != nil {
+			return "", err
+		}
+
+		return g.assign(fmt.Sprintf("rt.Prefix(%q, %s)", e.Operator, right)), nil
+
+	case *ast.InfixExpression:
+		return g.infix(e)
+
+	case *ast.IfExpression:
+		return g.ifExpression(e)
+
+	case *ast.FunctionLiteral:
+		return g.function(e)
+
+	case *ast.CallExpression:
+
+		fn, err := g.value(e.Function)
+
+		if err != nil {
+			return "", err
+		}
+
+		args, err := g.values(e.Arguments)
+
+		if err != nil {
+			return "", err
+		}
+
+		return g.assign(fmt.Sprintf("rt.Call(%s)", strings.Join(append([]string{fn}, args...), ", "))), nil
+
+	case *ast.ArrayLiteral:
+
+		elements, err := g.values(e.Elements)
+
+		if err != nil {
+			return "", err
+		}
+
+		return g.assign(fmt.Sprintf("rt.Array(%s)", strings.Join(elements, ", "))), nil
+
+	case *ast.HashLiteral:
+
+		// コンパイラーと同じ順番で評価する
+		keys := []ast.Expression{}
+		for k := range e.Pairs {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		exps := []ast.Expression{}
+		for _, k := range keys {
+			exps = append(exps, k, e.Pairs[k])
+		}
+
+		values, err := g.values(exps)
+
+		if err != nil {
+			return "", err
+		}
+
+		return g.assign(fmt.Sprintf("rt.Hash(%s)", strings.Join(values, ", "))), nil
+
+	case *ast.IndexExpression:
+
+		values, err := g.values([]ast.Expression{e.Left, e.Index})
+
+		if err != nil {
+			return "", err
+		}
+
+		return g.assign(fmt.Sprintf("rt.Index(%s, %s)", values[0], values[1])), nil
+
+	case *ast.RangeExpression:
+
+		values, err := g.values([]ast.Expression{e.Start, e.End})
+
+		if err != nil {
+			return "", err
+		}
+
+		return g.assign(fmt.Sprintf("rt.Range(%s, %s)", values[0], values[1])), nil
+
+	case *ast.InterpolatedString:
+
+		parts, err := g.values(e.Parts)
+
+		if err != nil {
+			return "", err
+		}
+
+		return g.assign(fmt.Sprintf("rt.Concat(%s)", strings.Join(parts, ", "))), nil
+
+	case *ast.AssignExpression:
+		return g.assignExpression(e)
+
+	case *ast.WhileExpression:
+		return g.while(e)
+
+	case *ast.ForInExpression:
+		return g.forIn(e)
+	}
+
+	return "", fmt.Errorf("cannot transpile %T", e)
+}
+
+// 式の値を一時変数に入れる
+func (g *generator) assign(expression string) string {
+
+	t := g.temp()
+
+	g.line("%s := %s", t, expression)
+
+	return t
+}
+
+func (g *generator) infix(e *ast.InfixExpression) (string, error) {
+
+	if e.Operator == "&&" || e.Operator == "||" {
+
+		left, err := g.expression(e.Left)
+
+		if err != nil {
+			return "", err
+		}
+
+		t := g.temp()
+
+		// 左辺で結果が決まれば右辺は評価しない
+		g.line("%s := rt.Bool(rt.Truthy(%s))", t, left)
+
+		if e.Operator == "&&" {
+			g.line("if rt.Truthy(%s) {", t)
+		} else {
+			g.line("if !rt.Truthy(%s) {", t)
+		}
+
+		right, err := g.expression(e.Right)
+
+		if err != nil {
+			return "", err
+		}
+
+		g.line("%s = rt.Bool(rt.Truthy(%s))", t, right)
+		g.line("}")
+
+		return t, nil
+	}
+
+	// <、<= はVMと同じく右辺から評価する
+	operands := []ast.Expression{e.Left, e.Right}
+
+	lessThan := e.Operator == "<" || e.Operator == "<="
+
+	if lessThan {
+		operands = []ast.Expression{e.Right, e.Left}
+	}
+
+	values, err := g.values(operands)
+
+	if err != nil {
+		return "", err
+	}
+
+	if lessThan {
+		values[0], values[1] = values[1], values[0]
+	}
+
+	return g.assign(fmt.Sprintf("rt.Infix(%q, %s, %s)", e.Operator, values[0], values[1])), nil
+}
+
+func (g *generator) ifExpression(e *ast.IfExpression) (string, error) {
+
+	condition, err := g.expression(e.Condition)
+
+	if err != nil {
+		return "", err
+	}
+
+	t := g.temp()
+
+	g.line("var %s object.Object = rt.NULL", t)
+	g.line("if rt.Truthy(%s) {", condition)
+
+	value, err := g.block(e.Consequence)
+
+	if err != nil {
+		return "", err
+	}
+
+	g.line("%s = %s", t, value)
+
+	if e.Alternative != nil {
+
+		g.line("} else {")
+
+		value, err := g.block(e.Alternative)
+
+		if err != nil {
+			return "", err
+		}
+
+		g.line("%s = %s", t, value)
+	}
+
+	g.line("}")
+
+	return t, nil
+}
+
+func (g *generator) function(e *ast.FunctionLiteral) (string, error) {
+
+	t := g.temp()
+
+	g.line("%s := &rt.Func{Name: %q, Arity: %d}", t, e.Name, len(e.Parameters))
+	g.line("%s.Fn = func(args []object.Object) object.Object {", t)
+
+	g.pushScope()
+
+	// 関数の中では自分の名前は自分自身
+	if e.Name != "" {
+		g.scopes[len(g.scopes)-1][e.Name] = t
+		g.functions[t] = true
+	}
+
+	for i, p := range e.Parameters {
+		goName := g.declare(p.Value)
+		g.line("%s := args[%d]", goName, i)
+		g.line("_ = %s", goName)
+	}
+
+	// ループの中の関数でbreakは使えない
+	loops := g.loops
+	g.loops = 0
+
+	value, err := g.block(e.Body)
+
+	g.loops = loops
+
+	g.popScope()
+
+	if err != nil {
+		return "", err
+	}
+
+	g.line("return %s", value)
+	g.line("}")
+
+	return t, nil
+}
+
+func (g *generator) assignExpression(e *ast.AssignExpression) (string, error) {
+
+	goName, ok := g.lookup(e.Name.Value)
+
+	switch {
+	case !ok:
+		return "", fmt.Errorf("undefined variable %s", e.Name.Value)
+	case g.constants[goName]:
+		return "", fmt.Errorf("cannot reassign constant %s", e.Name.Value)
+	case g.functions[goName]:
+		return "", fmt.Errorf("cannot assign to function %s", e.Name.Value)
+	}
+
+	value, err := g.expression(e.Value)
+
+	if err != nil {
+		return "", err
+	}
+
+	g.line("%s = %s", goName, value)
+
+	return goName, nil
+}
+
+func (g *generator) while(e *ast.WhileExpression) (string, error) {
+
+	g.line("for {")
+
+	condition, err := g.expression(e.Condition)
+
+	if err != nil {
+		return "", err
+	}
+
+	g.line("if !rt.Truthy(%s) {", condition)
+	g.line("break")
+	g.line("}")
+
+	if err := g.loopBody(e.Body); err != nil {
+		return "", err
+	}
+
+	g.line("}")
+
+	return "rt.NULL", nil
+}
+
+func (g *generator) forIn(e *ast.ForInExpression) (string, error) {
+
+	iterable, err := g.expression(e.Iterable)
+
+	if err != nil {
+		return "", err
+	}
+
+	it := g.temp()
+
+	g.line("%s := rt.Iterate(%s)", it, iterable)
+	g.line("for {")
+
+	g.pushScope()
+	defer g.popScope()
+
+	goName := g.declare(e.Variable.Value)
+
+	g.line("%s, ok := %s.Next()", goName, it)
+	g.line("_ = %s", goName)
+	g.line("if !ok {")
+	g.line("break")
+	g.line("}")
+
+	if err := g.loopBody(e.Body); err != nil {
+		return "", err
+	}
+
+	g.line("}")
+
+	return "rt.NULL", nil
+}
+
+func (g *generator) loopBody(body *ast.BlockStatement) error {
+
+	g.loops++
+	defer func() { g.loops-- }()
+
+	value, err := g.block(body)
+
+	if err != nil {
+		return err
+	}
+
+	g.line("_ = %s", value)
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package gogen
+
+import (
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example.com/monkey/ast"
+	"example.com/monkey/lexer"
+	monkeyparser "example.com/monkey/parser"
+)
+
+func parse(t *testing.T, input string) *ast.Program {
+
+	p := monkeyparser.New(lexer.New(input))
+
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	return program
+}
+
+func TestGenerate(t *testing.T) {
+
+	src, err := Generate(parse(t, `
+let add = fn(a, b) { a + b };
+let x = 1;
+x = add(x, 2);
+if (x > 2) { puts(x) } else { puts("small") };
+`))
+
+	if err != nil {
+		t.Fatalf("generate error: %s", err)
+	}
+
+	if _, err := parser.ParseFile(token.NewFileSet(), "main.go", src, 0); err != nil {
+		t.Fatalf("generated source does not parse: %s\n%s", err, src)
+	}
+
+	if !strings.Contains(src, "package main") || !strings.Contains(src, "rt.Call(") {
+		t.Errorf("unexpected source:\n%s", src)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`y`, "undefined variable y"},
+		{`const a = 1; a = 2;`, "cannot reassign constant a"},
+		{`let s = [1, 2, 3][0:1];`, "cannot transpile *ast.SliceExpression"},
+		{`break;`, "break outside of a loop"},
+	}
+
+	for _, tt := range tests {
+
+		_, err := Generate(parse(t, tt.input))
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+// 出力したGoのプログラムを実際に動かして、putsの出力を比べる
+func TestGeneratedProgramRuns(t *testing.T) {
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+		fails    bool
+	}{
+		{
+			`
+let fib = fn(n) { if (n < 2) { return n; }; fib(n - 1) + fib(n - 2) };
+puts(fib(15), 17 % 5, 2 <= 2, "ab" < "b", [1, 2, 3][-1], "日本語"[1]);
+`,
+			"610\n2\ntrue\ntrue\n3\n本\n",
+			false,
+		},
+		{
+			`
+let counter = fn() { let n = 0; fn() { n = n + 1; n } };
+let c = counter();
+c(); c();
+puts(c());
+let total = 0;
+for (x in 1..5) { if (x == 3) { continue; }; total = total + x; };
+let i = 0;
+while (true) { i = i + 1; if (i > 3) { break; } };
+puts(total, i);
+let h = {"a": 1, "b": [1, 2]};
+puts(h["b"][1], len(push(h["b"], 3)), "x=${total}");
+puts(true && false, null || 1, !null);
+`,
+			"3\n7\n4\n2\n3\nx=7\nfalse\ntrue\ntrue\n",
+			false,
+		},
+		{
+			`puts(1); let f = fn(a) { a }; f(1, 2);`,
+			"1\nwrong number of arguments: want=1, got=2\n",
+			true,
+		},
+	}
+
+	dir, err := ioutil.TempDir(".", "gen")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	for _, tt := range tests {
+
+		src, err := Generate(parse(t, tt.input))
+
+		if err != nil {
+			t.Fatalf("generate error: %s", err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := exec.Command("go", "run", "./"+dir).CombinedOutput()
+
+		if (err != nil) != tt.fails {
+			t.Errorf("unexpected result %v:\n%s\n%s", err, out, src)
+			continue
+		}
+
+		got := string(out)
+
+		if tt.fails {
+			got = strings.Replace(got, "exit status 1\n", "", 1)
+		}
+
+		if got != tt.expected {
+			t.Errorf("wrong output.\nwant=%q\ngot=%q", tt.expected, got)
+		}
+	}
+}
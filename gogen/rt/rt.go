@@ -0,0 +1,367 @@
+package rt
+
+import (
+	"fmt"
+	"strings"
+
+	"example.com/monkey/object"
+)
+
+// gogenが出力したGoのソースコードから使う実行時の関数
+// 演算の結果はVMと同じになるようにしている
+// 実行時エラーはpanicで伝え、Runで受け取る
+
+var (
+	TRUE  = &object.Boolean{Value: true}
+	FALSE = &object.Boolean{Value: false}
+	NULL  = &object.Null{}
+)
+
+// 実行時エラー
+type Error struct {
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func Fail(format string, a ...interface{}) {
+	panic(&Error{Message: fmt.Sprintf(format, a...)})
+}
+
+// プログラムを実行し、実行時エラーをerrorにして返す
+func Run(program func() object.Object) (result object.Object, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+
+	return program(), nil
+}
+
+// Monkeyの関数をGoの関数にしたもの
+type Func struct {
+	Name  string
+	Arity int
+	Fn    func(args []object.Object) object.Object
+}
+
+func (f *Func) Type() object.ObjectType { return object.FUNCTION_OBJ }
+func (f *Func) Inspect() string         { return fmt.Sprintf("fn<%s>", f.Name) }
+
+func Int(v int64) object.Object  { return &object.Integer{Value: v} }
+func Str(v string) object.Object { return &object.String{Value: v} }
+
+func Bool(v bool) object.Object {
+	if v {
+		return TRUE
+	}
+	return FALSE
+}
+
+func Truthy(obj object.Object) bool {
+
+	switch obj := obj.(type) {
+	case *object.Boolean:
+		return obj.Value
+	case *object.Null, nil:
+		return false
+	default:
+		return true
+	}
+}
+
+func Builtin(name string) object.Object {
+
+	builtin := object.GetBuiltinByName(name)
+
+	if builtin == nil {
+		Fail("undefined builtin %s", name)
+	}
+
+	return builtin
+}
+
+func Call(fn object.Object, args ...object.Object) object.Object {
+
+	switch fn := fn.(type) {
+
+	case *Func:
+		if len(args) != fn.Arity {
+			Fail("wrong number of arguments: want=%d, got=%d", fn.Arity, len(args))
+		}
+		return fn.Fn(args)
+
+	case *object.Builtin:
+		if result := fn.Fn(args...); result != nil {
+			return result
+		}
+		return NULL
+
+	default:
+		Fail("calling non-function and non-built-in")
+		return nil
+	}
+}
+
+func Prefix(operator string, right object.Object) object.Object {
+
+	switch operator {
+
+	case "!":
+		return Bool(!Truthy(right))
+
+	case "-":
+		integer, ok := right.(*object.Integer)
+		if !ok {
+			Fail("unsupported type for negation: %s", right.Type())
+		}
+		return Int(-integer.Value)
+	}
+
+	Fail("unknown operator: %s", operator)
+	return nil
+}
+
+func Infix(operator string, left, right object.Object) object.Object {
+
+	l, lok := left.(*object.Integer)
+	r, rok := right.(*object.Integer)
+
+	if lok && rok {
+		return integerInfix(operator, l.Value, r.Value)
+	}
+
+	switch operator {
+
+	case "+":
+		ls, lok := left.(*object.String)
+		rs, rok := right.(*object.String)
+		if !lok || !rok {
+			Fail("unsupported types for binary operation: %s %s", left.Type(), right.Type())
+		}
+		return Str(ls.Value + rs.Value)
+
+	case "-", "*", "/", "%":
+		Fail("unsupported types for binary operation: %s %s", left.Type(), right.Type())
+
+	// 文字列は辞書順で比べる
+	case "<", ">", "<=", ">=":
+		ls, lok := left.(*object.String)
+		rs, rok := right.(*object.String)
+		if lok && rok {
+			return stringComparison(operator, ls.Value, rs.Value)
+		}
+
+	case "==":
+		return Bool(equal(left, right))
+
+	case "!=":
+		return Bool(!equal(left, right))
+	}
+
+	Fail("unknown operator: %s (%s %s)", operator, left.Type(), right.Type())
+	return nil
+}
+
+func integerInfix(operator string, l, r int64) object.Object {
+
+	switch operator {
+	case "+":
+		return Int(l + r)
+	case "-":
+		return Int(l - r)
+	case "*":
+		return Int(l * r)
+	case "/":
+		if r == 0 {
+			Fail("division by zero")
+		}
+		return Int(l / r)
+	case "%":
+		if r == 0 {
+			Fail("division by zero")
+		}
+		return Int(l % r)
+	case ">":
+		return Bool(l > r)
+	case "<":
+		return Bool(l < r)
+	case ">=":
+		return Bool(l >= r)
+	case "<=":
+		return Bool(l <= r)
+	case "==":
+		return Bool(l == r)
+	case "!=":
+		return Bool(l != r)
+	}
+
+	Fail("unknown operator: %s", operator)
+	return nil
+}
+
+func stringComparison(operator string, l, r string) object.Object {
+
+	switch operator {
+	case ">":
+		return Bool(l > r)
+	case "<":
+		return Bool(l < r)
+	case ">=":
+		return Bool(l >= r)
+	}
+
+	return Bool(l <= r)
+}
+
+// 整数以外は同じオブジェクトかどうか(真偽値、null、文字列は値で比べる)
+func equal(left, right object.Object) bool {
+
+	switch l := left.(type) {
+	case *object.String:
+		r, ok := right.(*object.String)
+		return ok && l.Value == r.Value
+	case *object.Boolean:
+		r, ok := right.(*object.Boolean)
+		return ok && l.Value == r.Value
+	case *object.Null:
+		_, ok := right.(*object.Null)
+		return ok
+	}
+
+	return left == right
+}
+
+func Array(elements ...object.Object) object.Object {
+	return &object.Array{Elements: elements}
+}
+
+// キーと値を交互に並べる
+func Hash(keysAndValues ...object.Object) object.Object {
+
+	pairs := map[object.HashKey]object.HashPair{}
+
+	for i := 0; i < len(keysAndValues); i += 2 {
+
+		key, ok := keysAndValues[i].(object.Hashable)
+
+		if !ok {
+			Fail("unusable as hash key: %s", keysAndValues[i].Type())
+		}
+
+		pairs[key.HashKey()] = object.HashPair{Key: keysAndValues[i], Value: keysAndValues[i+1]}
+	}
+
+	return &object.Hash{Pairs: pairs}
+}
+
+func Index(left, index object.Object) object.Object {
+
+	switch left := left.(type) {
+
+	case *object.Array:
+		i, ok := index.(*object.Integer)
+		if !ok {
+			Fail("index operator not supported: %s", left.Type())
+		}
+		n := i.Value
+		// VMと同じく、負のインデックスは末尾から数える
+		if n < 0 {
+			n += int64(len(left.Elements))
+		}
+		if n < 0 || n >= int64(len(left.Elements)) {
+			return NULL
+		}
+		return left.Elements[n]
+
+	case *object.String:
+		i, ok := index.(*object.Integer)
+		if !ok {
+			Fail("index operator not supported: %s", left.Type())
+		}
+		runes := []rune(left.Value)
+		n := i.Value
+		if n < 0 {
+			n += int64(len(runes))
+		}
+		if n < 0 || n >= int64(len(runes)) {
+			return NULL
+		}
+		return Str(string(runes[n]))
+
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			Fail("unusable as hash key: %s", index.Type())
+		}
+		pair, ok := left.Pairs[key.HashKey()]
+		if !ok {
+			return NULL
+		}
+		return pair.Value
+	}
+
+	Fail("index operator not supported: %s", left.Type())
+	return nil
+}
+
+func Range(start, end object.Object) object.Object {
+
+	s, ok := start.(*object.Integer)
+	e, ok2 := end.(*object.Integer)
+
+	if !ok || !ok2 {
+		Fail("range bounds must be INTEGER, got %s..%s", start.Type(), end.Type())
+	}
+
+	return &object.Range{Start: s.Value, End: e.Value}
+}
+
+// for-inのイテレーター
+func Iterate(iterable object.Object) *object.Iterator {
+
+	switch iterable := iterable.(type) {
+
+	case *object.Array:
+		return &object.Iterator{Elements: iterable.Elements}
+
+	case *object.Range:
+		return &object.Iterator{Range: iterable}
+
+	case *object.String:
+		elements := []object.Object{}
+		for _, r := range iterable.Value {
+			elements = append(elements, Str(string(r)))
+		}
+		return &object.Iterator{Elements: elements}
+
+	case *object.Hash:
+		// VMと同じ順に並べる
+		return &object.Iterator{Elements: iterable.Keys()}
+	}
+
+	Fail("not iterable: %s", iterable.Type())
+	return nil
+}
+
+// 文字列の補間 "a${x}b"
+func Concat(parts ...object.Object) object.Object {
+
+	var out strings.Builder
+
+	for _, p := range parts {
+		if s, ok := p.(*object.String); ok {
+			out.WriteString(s.Value)
+		} else {
+			out.WriteString(p.Inspect())
+		}
+	}
+
+	return Str(out.String())
+}
@@ -1,6 +1,10 @@
 package lexer
 
-import "example.com/monkey/token"
+import (
+	"strings"
+
+	"example.com/monkey/token"
+)
 
 type Lexer struct {
 	input string
@@ -13,14 +17,34 @@ type Lexer struct {
 	// 現在の位置の文字
 	// current char under examination
 	ch byte
+	// 現在の位置の行番号(1始まり)
+	line int
+	// 現在の行の先頭の位置
+	lineStart int
+	// 読み飛ばしたコメント
+	comments []Comment
+	// 最後に返したトークンの行番号
+	lastLine int
+}
+
+// ソースコード中のコメント
+type Comment struct {
+	Token token.Token
+	// 同じ行でコードの後ろに書かれたコメント
+	Trailing bool
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	l := &Lexer{input: input, line: 1}
 	l.readChar()
 	return l
 }
 
+// 現在の位置の列番号(1始まり)
+func (l *Lexer) column() int {
+	return l.position - l.lineStart + 1
+}
+
 func newToken(tokenType token.TokenType, ch byte) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
@@ -28,6 +52,11 @@ func newToken(tokenType token.TokenType, ch byte) token.Token {
 // 次に読み取る位置から一文字読み取り、chにセットする
 // 現在位置もその読み取った位置にずらす
 func (l *Lexer) readChar() {
+	// 改行を読み進めたら次の行
+	if l.ch == '\n' {
+		l.line++
+		l.lineStart = l.readPosition
+	}
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -37,6 +66,14 @@ func (l *Lexer) readChar() {
 	l.readPosition += 1
 }
 
+// n文字先を読み取るが、現在位置はずらさない
+func (l *Lexer) peekCharAt(n int) byte {
+	if l.position+n >= len(l.input) {
+		return 0
+	}
+	return l.input[l.position+n]
+}
+
 // 次に予定している読み取り位置から読み取るが、
 // 現在位置はずらさない
 func (l *Lexer) peekChar() byte {
@@ -54,6 +91,10 @@ func (l *Lexer) NextToken() token.Token {
 	// つまり、次に意味のある文字が来るまでスキップする
 	l.skipWhitespace()
 
+	// トークンの開始位置
+	line, column := l.line, l.column()
+	l.lastLine = line
+
 	switch l.ch {
 	case '=':
 		// すぐ後ろの文字が=の場合、==(EQ)というトークンにする
@@ -82,14 +123,41 @@ func (l *Lexer) NextToken() token.Token {
 		} else {
 			tok = newToken(token.BANG, l.ch)
 		}
+	case '&':
+		// &単体の演算子はない
+		if l.peekChar() == '&' {
+			l.readChar()
+			tok = token.Token{Type: token.AND, Literal: "&&"}
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
+	case '|':
+		if l.peekChar() == '|' {
+			l.readChar()
+			tok = token.Token{Type: token.OR, Literal: "||"}
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case '/':
 		tok = newToken(token.SLASH, l.ch)
 	case '*':
 		tok = newToken(token.ASTERISK, l.ch)
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		if l.peekChar() == '=' {
+			l.readChar()
+			tok = token.Token{Type: token.LT_EQ, Literal: "<="}
+		} else {
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		if l.peekChar() == '=' {
+			l.readChar()
+			tok = token.Token{Type: token.GT_EQ, Literal: ">="}
+		} else {
+			tok = newToken(token.GT, l.ch)
+		}
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case '(':
@@ -108,9 +176,22 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.RBRACKET, l.ch)
 	case ':':
 		tok = newToken(token.COLON, l.ch)
+	case '.':
+		// .単体の演算子はない
+		if l.peekChar() == '.' {
+			l.readChar()
+			tok = token.Token{Type: token.DOTDOT, Literal: ".."}
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case '"':
-		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		literal, interpolated := l.readString()
+		tok.Literal = literal
+		if interpolated {
+			tok.Type = token.INTERP_STRING
+		} else {
+			tok.Type = token.STRING
+		}
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
@@ -119,11 +200,12 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Literal = l.readIdentifier()
 			// 予約語なのかユーザー定義の識別子なのか
 			tok.Type = token.LookupIdent(tok.Literal)
+			tok.Line, tok.Column = line, column
 			return tok
 
 		} else if isDigit(l.ch) { // 数字の場合
-			tok.Type = token.INT
-			tok.Literal = l.readNumber()
+			tok.Literal, tok.Type = l.readNumber()
+			tok.Line, tok.Column = line, column
 			return tok
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
@@ -132,24 +214,85 @@ func (l *Lexer) NextToken() token.Token {
 
 	l.readChar()
 
+	tok.Line, tok.Column = line, column
+
 	return tok
 }
 
-func (l *Lexer) readString() string {
+// 文字列の中身と、${...}を含むか否かを返す
+func (l *Lexer) readString() (string, bool) {
 
 	position := l.position + 1
 
+	interpolated := false
+
+	// $${ で${をそのまま書いている
+	escaped := false
+
+	// ${...}の中にいる場合の{}の深さ
+	depth := 0
+
 	// TODO 文字列が閉じられることなくEOFに達したらエラーにする
 	// TODO "をエスケープできるようにする
 	for {
 		l.readChar()
 
-		if l.ch == '"' || l.ch == 0 {
+		if l.ch == 0 {
 			break
 		}
+
+		if depth == 0 {
+
+			if l.ch == '"' {
+				break
+			}
+
+			if l.ch == '$' && l.peekChar() == '$' && l.peekCharAt(2) == '{' {
+				escaped = true
+				l.readChar()
+				l.readChar()
+				continue
+			}
+
+			if l.ch == '$' && l.peekChar() == '{' {
+				interpolated = true
+				depth = 1
+				l.readChar()
+			}
+
+			continue
+		}
+
+		// ${...}の中は式なので、"で文字列を終わらせない
+		switch l.ch {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '"':
+			l.skipNestedString()
+		}
 	}
 
-	return l.input[position:l.position]
+	literal := l.input[position:l.position]
+
+	// ${...}を含む場合はパーサーで$${を戻す
+	if escaped && !interpolated {
+		literal = strings.ReplaceAll(literal, "$${", "${")
+	}
+
+	return literal, interpolated
+}
+
+// ${...}の中に書かれた文字列を読み飛ばす
+func (l *Lexer) skipNestedString() {
+	for {
+		l.readChar()
+
+		if l.ch == '"' || l.ch == 0 {
+			break
+		}
+	}
 }
 
 // 連続する文字を返す（文字出ない位置に遭遇するまで）
@@ -169,17 +312,57 @@ func isLetter(ch byte) bool {
 
 // スペース、タブ、LF、CRは飛ばす
 func (l *Lexer) skipWhitespace() {
-	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
+	for {
+		for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
+			l.readChar()
+		}
+
+		if l.ch != '/' || l.peekChar() != '/' {
+			return
+		}
+
+		l.comments = append(l.comments, l.readComment())
+	}
+}
+
+// 行末までをコメントとして読み取る
+func (l *Lexer) readComment() Comment {
+
+	tok := token.Token{Type: token.COMMENT, Line: l.line, Column: l.column()}
+
+	trailing := l.lastLine == l.line
+
+	position := l.position
+
+	for l.ch != '\n' && l.ch != 0 {
 		l.readChar()
 	}
+
+	tok.Literal = strings.TrimRight(l.input[position:l.position], "\r")
+
+	return Comment{Token: tok, Trailing: trailing}
 }
 
-func (l *Lexer) readNumber() string {
+// これまでに読み飛ばしたコメントを出現順に返す
+func (l *Lexer) Comments() []Comment {
+	return l.comments
+}
+
+// 小数点の後に数字が続けば浮動小数点数
+// 0..5 のような範囲は整数のまま
+func (l *Lexer) readNumber() (string, token.TokenType) {
 	position := l.position
 	for isDigit(l.ch) {
 		l.readChar()
 	}
-	return l.input[position:l.position]
+	if l.ch != '.' || !isDigit(l.peekChar()) {
+		return l.input[position:l.position], token.INT
+	}
+	l.readChar()
+	for isDigit(l.ch) {
+		l.readChar()
+	}
+	return l.input[position:l.position], token.FLOAT
 }
 
 // 0～9は「数字」
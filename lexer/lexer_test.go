@@ -152,3 +152,245 @@ func TestNextToken(t *testing.T) {
 		}
 	}
 }
+
+func TestInterpolatedString(t *testing.T) {
+
+	input := `"Hello ${name}!" "${ {"a": "}"}["a"] }" "plain"`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INTERP_STRING, "Hello ${name}!"},
+		{token.INTERP_STRING, `${ {"a": "}"}["a"] }`},
+		{token.STRING, "plain"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestTokenPositions(t *testing.T) {
+
+	input := "let x = 5;\n  x + \"a\nb\";\nfn"
+
+	tests := []struct {
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{"let", 1, 1},
+		{"x", 1, 5},
+		{"=", 1, 7},
+		{"5", 1, 9},
+		{";", 1, 10},
+		{"x", 2, 3},
+		{"+", 2, 5},
+		{"a\nb", 2, 7},
+		{";", 3, 3},
+		{"fn", 4, 1},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+
+		tok := l.NextToken()
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.Line != tt.expectedLine || tok.Column != tt.expectedColumn {
+			t.Errorf("tests[%d] - position wrong. expected=%d:%d, got=%d:%d",
+				i, tt.expectedLine, tt.expectedColumn, tok.Line, tok.Column)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+
+	input := "// header\nlet x = 10 / 2; // half\r\n  // indented\nx"
+
+	expectedTokens := []string{"let", "x", "=", "10", "/", "2", ";", "x", ""}
+
+	l := New(input)
+
+	for i, want := range expectedTokens {
+
+		tok := l.NextToken()
+
+		if tok.Literal != want {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, want, tok.Literal)
+		}
+	}
+
+	expectedComments := []struct {
+		literal  string
+		line     int
+		column   int
+		trailing bool
+	}{
+		{"// header", 1, 1, false},
+		{"// half", 2, 17, true},
+		{"// indented", 3, 3, false},
+	}
+
+	comments := l.Comments()
+
+	if len(comments) != len(expectedComments) {
+		t.Fatalf("wrong number of comments. want=%d, got=%d",
+			len(expectedComments), len(comments))
+	}
+
+	for i, tt := range expectedComments {
+
+		c := comments[i]
+
+		if c.Token.Type != token.COMMENT {
+			t.Errorf("comments[%d] - type wrong. got=%q", i, c.Token.Type)
+		}
+
+		if c.Token.Literal != tt.literal {
+			t.Errorf("comments[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.literal, c.Token.Literal)
+		}
+
+		if c.Token.Line != tt.line || c.Token.Column != tt.column {
+			t.Errorf("comments[%d] - position wrong. expected=%d:%d, got=%d:%d",
+				i, tt.line, tt.column, c.Token.Line, c.Token.Column)
+		}
+
+		if c.Trailing != tt.trailing {
+			t.Errorf("comments[%d] - trailing wrong. expected=%t, got=%t",
+				i, tt.trailing, c.Trailing)
+		}
+	}
+}
+
+func TestEscapedInterpolation(t *testing.T) {
+
+	tests := []struct {
+		input           string
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{`"$${name}"`, token.STRING, "${name}"},
+		{`"cost: $$5"`, token.STRING, "cost: $$5"},
+		// 補間を含む場合はパーサーで$${を処理する
+		{`"${a} $${b}"`, token.INTERP_STRING, "${a} $${b}"},
+	}
+
+	for i, tt := range tests {
+
+		tok := New(tt.input).NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Errorf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Errorf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestRangeTokens(t *testing.T) {
+
+	input := `1..10 a..b . 1.5 0..2.5`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INT, "1"},
+		{token.DOTDOT, ".."},
+		{token.INT, "10"},
+		{token.IDENT, "a"},
+		{token.DOTDOT, ".."},
+		{token.IDENT, "b"},
+		{token.ILLEGAL, "."},
+		{token.FLOAT, "1.5"},
+		{token.INT, "0"},
+		{token.DOTDOT, ".."},
+		{token.FLOAT, "2.5"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestLogicalTokens(t *testing.T) {
+
+	input := `a && b || c & | % <= >= < >`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.AND, "&&"},
+		{token.IDENT, "b"},
+		{token.OR, "||"},
+		{token.IDENT, "c"},
+		{token.ILLEGAL, "&"},
+		{token.ILLEGAL, "|"},
+		{token.PERCENT, "%"},
+		{token.LT_EQ, "<="},
+		{token.GT_EQ, ">="},
+		{token.LT, "<"},
+		{token.GT, ">"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
@@ -8,7 +8,33 @@ import (
 	"example.com/monkey/repl"
 )
 
+// サブコマンドとその処理の対応付け
+// 処理の戻り値は終了コード
+var commands = map[string]func(args []string) int{
+	"build":     buildCommand,
+	"check":     checkCommand,
+	"disasm":    disasmCommand,
+	"run":       runCommand,
+	"serve":     serveCommand,
+	"test":      testCommand,
+	"transpile": transpileCommand,
+	"wasm":      wasmCommand,
+}
+
 func main() {
+
+	if len(os.Args) > 1 {
+
+		command, ok := commands[os.Args[1]]
+
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+			os.Exit(2)
+		}
+
+		os.Exit(command(os.Args[2:]))
+	}
+
 	user, err := user.Current()
 	if err != nil {
 		panic(err)
@@ -1,6 +1,9 @@
 package object
 
-import "fmt"
+import (
+	"fmt"
+	"unicode/utf8"
+)
 
 var Builtins = []struct {
 	Name    string
@@ -18,8 +21,11 @@ var Builtins = []struct {
 			switch arg := args[0].(type) {
 			case *Array:
 				return &Integer{Value: int64(len(arg.Elements))}
+			// インデックスやスライスと同じく、バイトではなく文字の数
 			case *String:
-				return &Integer{Value: int64(len(arg.Value))}
+				return &Integer{Value: int64(utf8.RuneCountInString(arg.Value))}
+			case *Range:
+				return &Integer{Value: arg.Len()}
 			default:
 				return newError("argument to `len` not supported, got %s",
 					args[0].Type())
@@ -154,6 +160,54 @@ var Builtins = []struct {
 			},
 		},
 	},
+	{
+		// テンプレートの式を評価するにはVMが必要なので、
+		// 実際の処理はvmパッケージで差し替える
+		"render",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				return newError("render is only available in the VM")
+			},
+		},
+	},
+	// 日時と期間(time.go)
+	{"now", &Builtin{Fn: nowBuiltin}},
+	{"datetime", &Builtin{Fn: datetimeBuiltin}},
+	{"duration", &Builtin{Fn: durationBuiltin}},
+	{"date_add", &Builtin{Fn: dateAddBuiltin}},
+	{"date_diff", &Builtin{Fn: dateDiffBuiltin}},
+	{"date_format", &Builtin{Fn: dateFormatBuiltin}},
+	// 10進数(decimal.go)
+	{"decimal", &Builtin{Fn: decimalBuiltin}},
+	// 数値計算(numeric.go)
+	{"dot", &Builtin{Fn: dotBuiltin}},
+	{"matmul", &Builtin{Fn: matmulBuiltin}},
+	{"transpose", &Builtin{Fn: transposeBuiltin}},
+	{
+		// 関数を呼び出すにはVMが必要なので、
+		// 実際の処理はvmパッケージで差し替える
+		"pmap",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				return newError("pmap is only available in the VM")
+			},
+		},
+	},
+	// チャンネル(channel.go)
+	{"channel", &Builtin{Fn: channelBuiltin}},
+	{"send", &Builtin{Fn: sendBuiltin}},
+	{"recv", &Builtin{Fn: recvBuiltin}},
+	{"close", &Builtin{Fn: closeBuiltin}},
+	{
+		// next(g) または next(g, v)
+		// pmapと同じく、実際の処理はvmパッケージで差し替える
+		"next",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				return newError("next is only available in the VM")
+			},
+		},
+	},
 }
 
 func newError(format string, a ...interface{}) *Error {
@@ -0,0 +1,126 @@
+package object
+
+import "fmt"
+
+// タスク(spawn)の間で値を受け渡すチャンネル
+// GoのチャンネルをそのままMonkeyの値として扱う
+
+const CHANNEL_OBJ = "CHANNEL"
+
+// channel(capacity)で指定できる容量の上限
+// 領域は作るときに確保するので、大きすぎる値で止まらないようにする
+const MaxChannelCapacity = 1 << 16
+
+type Channel struct {
+	Value chan Object
+}
+
+func (c *Channel) Type() ObjectType { return CHANNEL_OBJ }
+func (c *Channel) Inspect() string  { return fmt.Sprintf("channel(%d)", cap(c.Value)) }
+
+// channel() または channel(capacity)
+// 容量を省略するとバッファなし(送る側と受け取る側が揃うまで待つ)
+func channelBuiltin(args ...Object) Object {
+
+	if len(args) > 1 {
+		return newError("wrong number of arguments. got=%d, want=0 or 1", len(args))
+	}
+
+	capacity := int64(0)
+
+	if len(args) == 1 {
+
+		n, ok := args[0].(*Integer)
+
+		if !ok || n.Value < 0 {
+			return newError("argument to `channel` must be a non-negative INTEGER, got %s",
+				args[0].Inspect())
+		}
+
+		if n.Value > MaxChannelCapacity {
+			return newError("channel capacity must be at most %d, got %d", MaxChannelCapacity, n.Value)
+		}
+
+		capacity = n.Value
+	}
+
+	return &Channel{Value: make(chan Object, capacity)}
+}
+
+func channelArgument(name string, args []Object, want int) (*Channel, *Error) {
+
+	if len(args) != want {
+		return nil, newError("wrong number of arguments. got=%d, want=%d", len(args), want)
+	}
+
+	ch, ok := args[0].(*Channel)
+
+	if !ok {
+		return nil, newError("first argument to `%s` must be CHANNEL, got %s", name, args[0].Type())
+	}
+
+	return ch, nil
+}
+
+// send(ch, value)
+// 受け取られるまで(バッファがあれば空きができるまで)待つ
+// VMでは待っている間もキャンセルで止まるものに差し替える (vm/channel.go)
+func sendBuiltin(args ...Object) (result Object) {
+
+	ch, err := channelArgument("send", args, 2)
+
+	if err != nil {
+		return err
+	}
+
+	// 閉じたチャンネルに送るとGoはpanicするので、エラーにする
+	defer func() {
+		if recover() != nil {
+			result = newError("send on closed channel")
+		}
+	}()
+
+	ch.Value <- args[1]
+
+	return nil
+}
+
+// recv(ch)
+// 値が届くまで待つ。閉じていて値が残っていなければnullを返す
+// VMでは待っている間もキャンセルで止まるものに差し替える (vm/channel.go)
+func recvBuiltin(args ...Object) Object {
+
+	ch, err := channelArgument("recv", args, 1)
+
+	if err != nil {
+		return err
+	}
+
+	value, ok := <-ch.Value
+
+	if !ok {
+		return nil
+	}
+
+	return value
+}
+
+// close(ch)
+func closeBuiltin(args ...Object) (result Object) {
+
+	ch, err := channelArgument("close", args, 1)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if recover() != nil {
+			result = newError("close of closed channel")
+		}
+	}()
+
+	close(ch.Value)
+
+	return nil
+}
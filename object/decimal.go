@@ -0,0 +1,125 @@
+package object
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// 10進数の正確な計算(金額など)
+// 値は有理数で持つので +,-,*,/ で誤差が出ない
+// 表示するときだけ、割り切れない値を DecimalDigits 桁で丸める
+
+const DECIMAL_OBJ = "DECIMAL"
+
+// 割り切れない値を表示するときの小数点以下の桁数
+const DecimalDigits = 20
+
+type Decimal struct {
+	Value *big.Rat
+}
+
+func (d *Decimal) Type() ObjectType { return DECIMAL_OBJ }
+func (d *Decimal) Inspect() string  { return FormatDecimal(d.Value) }
+
+// "12.34" "-0.5" "1e3" のような文字列を解析する
+func ParseDecimal(s string) (*big.Rat, error) {
+
+	// big.Ratは"1/3"も受け付けるが、10進数の表記だけにする
+	if strings.Contains(s, "/") {
+		return nil, fmt.Errorf("invalid decimal %q", s)
+	}
+
+	r, ok := new(big.Rat).SetString(s)
+
+	if !ok {
+		return nil, fmt.Errorf("invalid decimal %q", s)
+	}
+
+	return r, nil
+}
+
+// 有限小数ならそのまま、そうでなければ DecimalDigits 桁に丸めて表示する
+// 末尾の0は付けない
+func FormatDecimal(r *big.Rat) string {
+
+	if r.IsInt() {
+		return r.Num().String()
+	}
+
+	digits := DecimalDigits
+
+	if n, ok := finiteDigits(r.Denom()); ok {
+		digits = n
+	}
+
+	s := r.FloatString(digits)
+
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(s, "0")
+		s = strings.TrimSuffix(s, ".")
+	}
+
+	return s
+}
+
+// 分母が2と5だけでできていれば、小数点以下の桁数を返す
+func finiteDigits(denom *big.Int) (int, bool) {
+
+	d := new(big.Int).Set(denom)
+	two, five := big.NewInt(2), big.NewInt(5)
+	m := new(big.Int)
+
+	twos, fives := 0, 0
+
+	for m.Mod(d, two).Sign() == 0 {
+		d.Quo(d, two)
+		twos++
+	}
+
+	for m.Mod(d, five).Sign() == 0 {
+		d.Quo(d, five)
+		fives++
+	}
+
+	if d.Cmp(big.NewInt(1)) != 0 {
+		return 0, false
+	}
+
+	if twos > fives {
+		return twos, true
+	}
+
+	return fives, true
+}
+
+// decimal("19.99") / decimal(10)
+func decimalBuiltin(args ...Object) Object {
+
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+
+	switch arg := args[0].(type) {
+
+	case *Integer:
+		return &Decimal{Value: new(big.Rat).SetInt64(arg.Value)}
+
+	case *Decimal:
+		return arg
+
+	case *String:
+
+		r, err := ParseDecimal(arg.Value)
+
+		if err != nil {
+			return newError("decimal: %s", err)
+		}
+
+		return &Decimal{Value: r}
+
+	default:
+		return newError("argument to `decimal` must be STRING or INTEGER, got %s",
+			args[0].Type())
+	}
+}
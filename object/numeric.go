@@ -0,0 +1,199 @@
+package object
+
+// 配列を使った数値計算
+// dot(a, b) / matmul(a, b) / transpose(m)
+// ベクトルはINTEGERの配列、行列はINTEGERの配列の配列
+// Monkeyでループを書くと遅いのでGoで計算する
+
+func toVector(name string, obj Object) ([]int64, *Error) {
+
+	arr, ok := obj.(*Array)
+
+	if !ok {
+		return nil, newError("argument to `%s` must be ARRAY, got %s", name, obj.Type())
+	}
+
+	v := make([]int64, len(arr.Elements))
+
+	for i, el := range arr.Elements {
+
+		n, ok := el.(*Integer)
+
+		if !ok {
+			return nil, newError("argument to `%s` must be ARRAY of INTEGER, got %s",
+				name, el.Type())
+		}
+
+		v[i] = n.Value
+	}
+
+	return v, nil
+}
+
+// 各行の長さが揃っていなければエラー
+func toMatrix(name string, obj Object) ([][]int64, *Error) {
+
+	arr, ok := obj.(*Array)
+
+	if !ok {
+		return nil, newError("argument to `%s` must be ARRAY, got %s", name, obj.Type())
+	}
+
+	m := make([][]int64, len(arr.Elements))
+
+	for i, el := range arr.Elements {
+
+		row, err := toVector(name, el)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 && len(row) != len(m[0]) {
+			return nil, newError("%s: rows must have the same length", name)
+		}
+
+		m[i] = row
+	}
+
+	return m, nil
+}
+
+func fromVector(v []int64) *Array {
+
+	elements := make([]Object, len(v))
+
+	for i, n := range v {
+		elements[i] = &Integer{Value: n}
+	}
+
+	return &Array{Elements: elements}
+}
+
+func fromMatrix(m [][]int64) *Array {
+
+	rows := make([]Object, len(m))
+
+	for i, row := range m {
+		rows[i] = fromVector(row)
+	}
+
+	return &Array{Elements: rows}
+}
+
+func dotBuiltin(args ...Object) Object {
+
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2", len(args))
+	}
+
+	a, err := toVector("dot", args[0])
+
+	if err != nil {
+		return err
+	}
+
+	b, err := toVector("dot", args[1])
+
+	if err != nil {
+		return err
+	}
+
+	if len(a) != len(b) {
+		return newError("dot: vectors must have the same length, got %d and %d",
+			len(a), len(b))
+	}
+
+	var sum int64
+
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+
+	return &Integer{Value: sum}
+}
+
+func matmulBuiltin(args ...Object) Object {
+
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2", len(args))
+	}
+
+	a, err := toMatrix("matmul", args[0])
+
+	if err != nil {
+		return err
+	}
+
+	b, err := toMatrix("matmul", args[1])
+
+	if err != nil {
+		return err
+	}
+
+	// aの列数とbの行数が一致していること
+	inner := 0
+	if len(a) > 0 {
+		inner = len(a[0])
+	}
+
+	if inner != len(b) {
+		return newError("matmul: cannot multiply %dx%d and %dx%d matrices",
+			len(a), inner, len(b), columns(b))
+	}
+
+	cols := columns(b)
+	result := make([][]int64, len(a))
+
+	for i := range a {
+
+		result[i] = make([]int64, cols)
+
+		for k := 0; k < inner; k++ {
+
+			x := a[i][k]
+
+			for j := 0; j < cols; j++ {
+				result[i][j] += x * b[k][j]
+			}
+		}
+	}
+
+	return fromMatrix(result)
+}
+
+func transposeBuiltin(args ...Object) Object {
+
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+
+	m, err := toMatrix("transpose", args[0])
+
+	if err != nil {
+		return err
+	}
+
+	cols := columns(m)
+	result := make([][]int64, cols)
+
+	for j := 0; j < cols; j++ {
+
+		result[j] = make([]int64, len(m))
+
+		for i := range m {
+			result[j][i] = m[i][j]
+		}
+	}
+
+	return fromMatrix(result)
+}
+
+func columns(m [][]int64) int {
+
+	if len(m) == 0 {
+		return 0
+	}
+
+	return len(m[0])
+}
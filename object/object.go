@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"sort"
+	"strconv"
 	"strings"
 
 	"example.com/monkey/ast"
@@ -14,6 +16,7 @@ type ObjectType string
 
 const (
 	INTEGER_OBJ      = "INTEGER"
+	FLOAT_OBJ        = "FLOAT"
 	BOOLEAN_OBJ      = "BOOLEAN"
 	NULL_OBJ         = "NULL"
 	RETURN_VALUE_OBJ = "RETURN_VALUE"
@@ -27,6 +30,15 @@ const (
 	COMPILED_FUNCION_OBJ = "COMPILED_FUNCTION_OBJ"
 
 	CLOSURE_OBJ = "CLOSURE"
+
+	ITERATOR_OBJ = "ITERATOR"
+
+	GENERATOR_OBJ = "GENERATOR"
+
+	RANGE_OBJ = "RANGE"
+
+	QUOTE_OBJ = "QUOTE"
+	MACRO_OBJ = "MACRO"
 )
 
 type Object interface {
@@ -41,6 +53,24 @@ type Integer struct {
 func (i *Integer) Inspect() string  { return fmt.Sprintf("%d", i.Value) }
 func (i *Integer) Type() ObjectType { return INTEGER_OBJ }
 
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+
+// 整数と見分けが付くように、小数部が無くても 2.0 のように表示する
+func (f *Float) Inspect() string {
+
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+
+	return s
+}
+
 type Boolean struct {
 	Value bool
 }
@@ -181,6 +211,41 @@ func (h *Hash) Inspect() string {
 	return out.String()
 }
 
+// キーを決まった順に並べて返す (for-inの順番)
+// 型ごとにまとめ(BOOLEAN、INTEGER、STRINGの順)、同じ型の中では値の小さい順
+func (h *Hash) Keys() []Object {
+
+	keys := make([]Object, 0, len(h.Pairs))
+
+	for _, pair := range h.Pairs {
+		keys = append(keys, pair.Key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keyLess(keys[i], keys[j])
+	})
+
+	return keys
+}
+
+func keyLess(a, b Object) bool {
+
+	if a.Type() != b.Type() {
+		return a.Type() < b.Type()
+	}
+
+	switch a := a.(type) {
+	case *Boolean:
+		return !a.Value && b.(*Boolean).Value
+	case *Integer:
+		return a.Value < b.(*Integer).Value
+	case *String:
+		return a.Value < b.(*String).Value
+	}
+
+	return false
+}
+
 // オブジェクトがハッシュキーとして使用できるか否かを判断するため
 type Hashable interface {
 	HashKey() HashKey
@@ -191,6 +256,12 @@ type CompiledFunction struct {
 	// Local bindingの数
 	NumLocals     int
 	NumParameters int
+	// 本体にyieldがあれば、呼び出すと本体を実行せずにGeneratorを返す
+	Generator bool
+	// 関数の名前(無名関数は"")と、命令とソースコードの行の対応
+	// 実行時エラーの位置を表示するのに使う
+	Name  string
+	Lines code.LineTable
 }
 
 func (cf *CompiledFunction) Type() ObjectType {
@@ -213,3 +284,127 @@ func (c *Closure) Type() ObjectType {
 func (c *Closure) Inspect() string {
 	return fmt.Sprintf("Closure[%p]", c)
 }
+
+// 整数の範囲 Start..End (Endは含まない)
+type Range struct {
+	Start int64
+	End   int64
+}
+
+func (r *Range) Type() ObjectType { return RANGE_OBJ }
+func (r *Range) Inspect() string  { return fmt.Sprintf("%d..%d", r.Start, r.End) }
+
+// 範囲に含まれる整数の数
+func (r *Range) Len() int64 {
+
+	if r.End <= r.Start {
+		return 0
+	}
+
+	return r.End - r.Start
+}
+
+// for-inループの状態を保持する
+// ループの間、VMのスタック上に置かれる
+type Iterator struct {
+	Elements []Object
+	// 範囲の場合は要素を作らずに1つずつ数を返す
+	Range *Range
+	// generatorの場合はVMが再開して値を受け取る(Nextは使わない)
+	Generator *Generator
+	// 次に返す要素の位置
+	// 範囲は32ビット環境でもintの上限を超えられるのでint64にする
+	Index int64
+}
+
+func (it *Iterator) Type() ObjectType { return ITERATOR_OBJ }
+func (it *Iterator) Inspect() string {
+
+	if it.Range != nil {
+		return fmt.Sprintf("Iterator[%d/%d]", it.Index, it.Range.Len())
+	}
+
+	if it.Generator != nil {
+		return "Iterator[generator]"
+	}
+
+	return fmt.Sprintf("Iterator[%d/%d]", it.Index, len(it.Elements))
+}
+
+// yieldがある関数を呼び出したときに返す、止めた関数の実行
+// next(g)で次のyieldまで実行する
+type Generator struct {
+	Fn   *Closure
+	Args []Object
+	// 止めた位置のフレームとスタック(vmパッケージが使う)
+	State interface{}
+	// 関数から戻ったら、それ以上値を返さない
+	Done bool
+}
+
+func (g *Generator) Type() ObjectType { return GENERATOR_OBJ }
+func (g *Generator) Inspect() string {
+
+	if g.Done {
+		return "generator(done)"
+	}
+
+	return "generator"
+}
+
+// 次の要素を返す。要素が残っていなければfalseを返す
+func (it *Iterator) Next() (Object, bool) {
+
+	if it.Range != nil {
+
+		if it.Index >= it.Range.Len() {
+			return nil, false
+		}
+
+		n := it.Range.Start + it.Index
+		it.Index++
+
+		return &Integer{Value: n}, true
+	}
+
+	if it.Index >= int64(len(it.Elements)) {
+		return nil, false
+	}
+
+	el := it.Elements[it.Index]
+	it.Index++
+
+	return el, true
+}
+
+// quote(...)で評価されずにそのまま残されたAST
+type Quote struct {
+	Node ast.Node
+}
+
+func (q *Quote) Type() ObjectType { return QUOTE_OBJ }
+func (q *Quote) Inspect() string {
+	return "QUOTE(" + q.Node.String() + ")"
+}
+
+type Macro struct {
+	Parameters []*ast.Identifier
+	Body       *ast.BlockStatement
+	Env        *Environment
+}
+
+func (m *Macro) Type() ObjectType { return MACRO_OBJ }
+func (m *Macro) Inspect() string {
+	var out bytes.Buffer
+	params := []string{}
+	for _, p := range m.Parameters {
+		params = append(params, p.String())
+	}
+	out.WriteString("macro")
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(") {\n")
+	out.WriteString(m.Body.String())
+	out.WriteString("\n}")
+	return out.String()
+}
@@ -1,6 +1,10 @@
 package object
 
-import "testing"
+import (
+	"math"
+	"strings"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 
@@ -60,3 +64,107 @@ func TestIntegerHashKey(t *testing.T) {
 		t.Errorf("integers with twoerent content have same hash keys")
 	}
 }
+
+func TestHashKeys(t *testing.T) {
+
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+
+	for _, key := range []Object{
+		&String{Value: "b"}, &Integer{Value: 10}, &Boolean{Value: true},
+		&Integer{Value: -1}, &String{Value: "a"}, &Integer{Value: 9}, &Boolean{Value: false},
+	} {
+		hash.Pairs[key.(Hashable).HashKey()] = HashPair{Key: key, Value: key}
+	}
+
+	got := []string{}
+	for _, key := range hash.Keys() {
+		got = append(got, key.Inspect())
+	}
+
+	expected := "false true -1 9 10 a b"
+
+	if strings.Join(got, " ") != expected {
+		t.Errorf("wrong order. want=%q, got=%q", expected, strings.Join(got, " "))
+	}
+}
+
+func TestDuration(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"PT1H30M", "PT1H30M"},
+		{"P1DT0.5S", "P1DT0.5S"},
+		{"-P2W", "-P14D"},
+		{"PT90M", "PT1H30M"},
+		{"1h2m3s", "PT1H2M3S"},
+		{"PT0S", "PT0S"},
+	}
+
+	for _, tt := range tests {
+
+		d, err := ParseDuration(tt.input)
+
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", tt.input, err)
+		}
+
+		if got := FormatDuration(d); got != tt.expected {
+			t.Errorf("wrong duration for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+
+	for _, input := range []string{"", "P", "PT", "P1Y", "P1M", "1 hour"} {
+
+		if _, err := ParseDuration(input); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestInt64Overflow(t *testing.T) {
+
+	const max, min = int64(math.MaxInt64), int64(math.MinInt64)
+
+	tests := []struct {
+		name     string
+		fn       func(a, b int64) (int64, bool)
+		a, b     int64
+		expected int64
+		overflow bool
+	}{
+		{"add", AddInt64, 1, 2, 3, false},
+		{"add", AddInt64, max, 1, min, true},
+		{"add", AddInt64, min, -1, max, true},
+		{"add", AddInt64, max, min, -1, false},
+		{"sub", SubInt64, min, 1, max, true},
+		{"sub", SubInt64, 0, min, min, true},
+		{"sub", SubInt64, -1, max, min, false},
+		{"mul", MulInt64, 3, -4, -12, false},
+		{"mul", MulInt64, max, 2, -2, true},
+		{"mul", MulInt64, -1, min, min, true},
+		{"mul", MulInt64, min, -1, min, true},
+		{"mul", MulInt64, 0, min, 0, false},
+		{"div", DivInt64, min, -1, min, true},
+		{"div", DivInt64, min, 1, min, false},
+	}
+
+	for _, tt := range tests {
+
+		result, overflow := tt.fn(tt.a, tt.b)
+
+		if result != tt.expected || overflow != tt.overflow {
+			t.Errorf("%s(%d, %d): want=(%d, %t), got=(%d, %t)",
+				tt.name, tt.a, tt.b, tt.expected, tt.overflow, result, overflow)
+		}
+	}
+
+	if _, overflow := NegInt64(min); !overflow {
+		t.Errorf("-MinInt64 should overflow")
+	}
+
+	if v, overflow := NegInt64(max); v != -max || overflow {
+		t.Errorf("-MaxInt64 should not overflow")
+	}
+}
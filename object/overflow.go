@@ -0,0 +1,32 @@
+package object
+
+import "math"
+
+// INTEGER(int64)の演算の結果と、int64の範囲を超えたかどうか
+// 超えた場合の結果はGoと同じく折り返した値
+// VMのIntegerOverflowの設定と、コンパイラーの定数畳み込みで使う
+
+func AddInt64(a, b int64) (int64, bool) {
+	sum := a + b
+	return sum, (a >= 0) == (b >= 0) && (sum >= 0) != (a >= 0)
+}
+
+func SubInt64(a, b int64) (int64, bool) {
+	diff := a - b
+	return diff, (a >= 0) != (b >= 0) && (diff >= 0) != (a >= 0)
+}
+
+func MulInt64(a, b int64) (int64, bool) {
+	product := a * b
+	// -1 * MinInt64 は割り算で戻しても同じ値になるので別に確かめる
+	return product, a != 0 && (product/a != b || a == -1 && b == math.MinInt64)
+}
+
+// bは0でないこと
+func DivInt64(a, b int64) (int64, bool) {
+	return a / b, a == math.MinInt64 && b == -1
+}
+
+func NegInt64(a int64) (int64, bool) {
+	return -a, a == math.MinInt64
+}
@@ -0,0 +1,310 @@
+package object
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 日時と期間
+// datetime("2024-01-02T03:04:05Z") / duration("PT1H30M") で作り、
+// date_add / date_diff / date_format で操作する
+
+const (
+	DATETIME_OBJ = "DATETIME"
+	DURATION_OBJ = "DURATION"
+)
+
+type DateTime struct {
+	Value time.Time
+}
+
+func (dt *DateTime) Type() ObjectType { return DATETIME_OBJ }
+func (dt *DateTime) Inspect() string  { return dt.Value.Format(time.RFC3339Nano) }
+
+type Duration struct {
+	Value time.Duration
+}
+
+func (d *Duration) Type() ObjectType { return DURATION_OBJ }
+func (d *Duration) Inspect() string  { return FormatDuration(d.Value) }
+
+// datetimeで受け付ける形式(先に一致したもの)
+// タイムゾーンがなければUTCとみなす
+var dateTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// ISO-8601の日時を解析する
+func ParseDateTime(s string) (time.Time, error) {
+
+	for _, layout := range dateTimeLayouts {
+
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid datetime %q", s)
+}
+
+// 年と月は長さが一定でないので扱わない
+var isoDuration = regexp.MustCompile(
+	`^(-)?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// ISO-8601の期間(P1DT2H30M など)を解析する
+// Goの形式(1h30m など)も受け付ける
+func ParseDuration(s string) (time.Duration, error) {
+
+	m := isoDuration.FindStringSubmatch(s)
+
+	if m == nil || strings.HasSuffix(s, "P") || strings.HasSuffix(s, "T") {
+
+		if d, err := time.ParseDuration(s); err == nil {
+			return d, nil
+		}
+
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute}
+
+	var d time.Duration
+
+	for i, unit := range units {
+
+		if m[i+2] == "" {
+			continue
+		}
+
+		n, err := strconv.ParseInt(m[i+2], 10, 64)
+
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+
+		d += time.Duration(n) * unit
+	}
+
+	if m[6] != "" {
+
+		sec, err := strconv.ParseFloat(m[6], 64)
+
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+
+		d += time.Duration(math.Round(sec * float64(time.Second)))
+	}
+
+	if m[1] == "-" {
+		d = -d
+	}
+
+	return d, nil
+}
+
+// 期間をISO-8601の形式にする (例: P1DT2H30M, PT1.5S, PT0S)
+func FormatDuration(d time.Duration) string {
+
+	var out strings.Builder
+
+	if d < 0 {
+		out.WriteString("-")
+		d = -d
+	}
+
+	out.WriteString("P")
+
+	if days := d / (24 * time.Hour); days > 0 {
+		fmt.Fprintf(&out, "%dD", days)
+		d -= days * 24 * time.Hour
+	}
+
+	if d == 0 {
+
+		if out.Len() <= 2 {
+			out.WriteString("T0S")
+		}
+
+		return out.String()
+	}
+
+	out.WriteString("T")
+
+	if h := d / time.Hour; h > 0 {
+		fmt.Fprintf(&out, "%dH", h)
+		d -= h * time.Hour
+	}
+
+	if m := d / time.Minute; m > 0 {
+		fmt.Fprintf(&out, "%dM", m)
+		d -= m * time.Minute
+	}
+
+	if d > 0 {
+		sec := strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+		out.WriteString(sec + "S")
+	}
+
+	return out.String()
+}
+
+func nowBuiltin(args ...Object) Object {
+
+	if len(args) != 0 {
+		return newError("wrong number of arguments. got=%d, want=0", len(args))
+	}
+
+	return &DateTime{Value: time.Now().UTC()}
+}
+
+func datetimeBuiltin(args ...Object) Object {
+
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+
+	str, ok := args[0].(*String)
+
+	if !ok {
+		return newError("argument to `datetime` must be STRING, got %s", args[0].Type())
+	}
+
+	t, err := ParseDateTime(str.Value)
+
+	if err != nil {
+		return newError("datetime: %s", err)
+	}
+
+	return &DateTime{Value: t}
+}
+
+// 整数はミリ秒とみなす
+func durationBuiltin(args ...Object) Object {
+
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+
+	switch arg := args[0].(type) {
+
+	case *Integer:
+		return &Duration{Value: time.Duration(arg.Value) * time.Millisecond}
+
+	case *String:
+
+		d, err := ParseDuration(arg.Value)
+
+		if err != nil {
+			return newError("duration: %s", err)
+		}
+
+		return &Duration{Value: d}
+
+	default:
+		return newError("argument to `duration` must be STRING or INTEGER, got %s",
+			args[0].Type())
+	}
+}
+
+// date_add(datetime, duration) / date_add(duration, duration)
+func dateAddBuiltin(args ...Object) Object {
+
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2", len(args))
+	}
+
+	d, ok := args[1].(*Duration)
+
+	if !ok {
+		return newError("second argument to `date_add` must be DURATION, got %s",
+			args[1].Type())
+	}
+
+	switch base := args[0].(type) {
+
+	case *DateTime:
+		return &DateTime{Value: base.Value.Add(d.Value)}
+
+	case *Duration:
+		return &Duration{Value: base.Value + d.Value}
+
+	default:
+		return newError("first argument to `date_add` must be DATETIME or DURATION, got %s",
+			args[0].Type())
+	}
+}
+
+// date_diff(a, b) は a - b の期間を返す
+func dateDiffBuiltin(args ...Object) Object {
+
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2", len(args))
+	}
+
+	a, ok := args[0].(*DateTime)
+	b, ok2 := args[1].(*DateTime)
+
+	if !ok || !ok2 {
+		return newError("arguments to `date_diff` must be DATETIME, got %s and %s",
+			args[0].Type(), args[1].Type())
+	}
+
+	return &Duration{Value: a.Value.Sub(b.Value)}
+}
+
+// date_format(datetime, layout?) レイアウトはGoの形式、省略するとRFC3339
+// date_format(duration, "ms") でミリ秒の整数を返す
+func dateFormatBuiltin(args ...Object) Object {
+
+	if len(args) != 1 && len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=1 or 2", len(args))
+	}
+
+	layout := ""
+
+	if len(args) == 2 {
+
+		str, ok := args[1].(*String)
+
+		if !ok {
+			return newError("second argument to `date_format` must be STRING, got %s",
+				args[1].Type())
+		}
+
+		layout = str.Value
+	}
+
+	switch arg := args[0].(type) {
+
+	case *DateTime:
+
+		if layout == "" {
+			layout = time.RFC3339
+		}
+
+		return &String{Value: arg.Value.Format(layout)}
+
+	case *Duration:
+
+		switch layout {
+		case "":
+			return &String{Value: FormatDuration(arg.Value)}
+		case "ms":
+			return &Integer{Value: arg.Value.Milliseconds()}
+		default:
+			return newError("unknown duration format %q", layout)
+		}
+
+	default:
+		return newError("first argument to `date_format` must be DATETIME or DURATION, got %s",
+			args[0].Type())
+	}
+}
@@ -3,6 +3,7 @@ package parser
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"example.com/monkey/ast"
 	"example.com/monkey/lexer"
@@ -13,8 +14,12 @@ import (
 const (
 	_int = iota
 	LOWEST
+	ASSIGNMENT  // x = 5
+	OR          // ||
+	AND         // &&
 	EQUALS      // ==
 	LESSGREATER // > or <
+	RANGE       // 1..10
 	SUM         // +
 	PRODUCT     // *
 	PREFIX      // -X or !X
@@ -24,14 +29,21 @@ const (
 
 // トークンとその優先順位の対応付け
 var precedences = map[token.TokenType]int{
+	token.ASSIGN:   ASSIGNMENT,
+	token.OR:       OR,
+	token.AND:      AND,
 	token.EQ:       EQUALS,
 	token.NOT_EQ:   EQUALS,
 	token.LT:       LESSGREATER,
 	token.GT:       LESSGREATER,
+	token.LT_EQ:    LESSGREATER,
+	token.GT_EQ:    LESSGREATER,
+	token.DOTDOT:   RANGE,
 	token.PLUS:     SUM,
 	token.MINUS:    SUM,
 	token.SLASH:    PRODUCT,
 	token.ASTERISK: PRODUCT,
+	token.PERCENT:  PRODUCT,
 	token.LPAREN:   CALL,
 	token.LBRACKET: INDEX,
 }
@@ -61,6 +73,19 @@ type Parser struct {
 	prefixParseFns map[token.TokenType]prefixParseFn
 	// トークンの種類と中置演算子用の解析関数との対応付け
 	infixParseFns map[token.TokenType]infixParseFn
+	// 式のネストの深さと上限
+	depth    int
+	maxDepth int
+	tooDeep  bool
+}
+
+// 式のネストの深さの既定の上限
+const DefaultMaxDepth = 512
+
+// SetMaxDepth は式のネストの深さの上限を設定する
+// 上限を超えるとスタックオーバーフローの代わりに構文エラーになる
+func (p *Parser) SetMaxDepth(n int) {
+	p.maxDepth = n
 }
 
 type (
@@ -82,7 +107,7 @@ func (p *Parser) registerInfix(tokenType token.TokenType, fn infixParseFn) {
 }
 
 func New(l *lexer.Lexer) *Parser {
-	p := &Parser{l: l, errors: []string{}}
+	p := &Parser{l: l, errors: []string{}, maxDepth: DefaultMaxDepth}
 
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	// このトークンの種類に出会ったらこの関数を呼び出す
@@ -90,11 +115,15 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	// 整数リテラル
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	// Boolean
 	p.registerPrefix(token.TRUE, p.parseBoolean)
 	p.registerPrefix(token.FALSE, p.parseBoolean)
+	// null
+	p.registerPrefix(token.NULL, p.parseNullLiteral)
 	// 文字列
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
+	p.registerPrefix(token.INTERP_STRING, p.parseInterpolatedString)
 
 	// prefix operators
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
@@ -104,6 +133,21 @@ func New(l *lexer.Lexer) *Parser {
 
 	p.registerPrefix(token.IF, p.parseIfExpression)
 
+	p.registerPrefix(token.FOR, p.parseForInExpression)
+	p.registerPrefix(token.WHILE, p.parseWhileExpression)
+
+	p.registerPrefix(token.IMPORT, p.parseImportExpression)
+
+	p.registerPrefix(token.TRY, p.parseTryExpression)
+	p.registerPrefix(token.SPAWN, p.parseSpawnExpression)
+	p.registerPrefix(token.YIELD, p.parseYieldExpression)
+
+	// マクロ
+	// quote, unquoteは予約語だが、呼び出し式の関数名として識別子と同じように扱う
+	p.registerPrefix(token.MACRO, p.parseMacroLiteral)
+	p.registerPrefix(token.QUOTE, p.parseIdentifier)
+	p.registerPrefix(token.UNQUOTE, p.parseIdentifier)
+
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
 
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
@@ -116,10 +160,18 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.MINUS, p.parseInfixExpression)
 	p.registerInfix(token.SLASH, p.parseInfixExpression)
 	p.registerInfix(token.ASTERISK, p.parseInfixExpression)
+	p.registerInfix(token.PERCENT, p.parseInfixExpression)
+	p.registerInfix(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.GT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.EQ, p.parseInfixExpression)
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
+	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.AND, p.parseInfixExpression)
+	p.registerInfix(token.OR, p.parseInfixExpression)
+	// 範囲
+	p.registerInfix(token.DOTDOT, p.parseRangeExpression)
 
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 
@@ -137,6 +189,10 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 
 	hash.Pairs = make(map[ast.Expression]ast.Expression)
 
+	// リテラルのキーの重複を検出する
+	// Pairsのキーはノードのポインターなので、同じ値でも別のキーとして残ってしまう
+	seen := map[string]bool{}
+
 	for !p.peekTokenIs(token.RBRACE) {
 
 		p.nextToken()
@@ -151,8 +207,19 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 
 		value := p.parseExpression(LOWEST)
 
+		if k, ok := literalKey(key); ok {
+
+			if seen[k] {
+				p.errors = append(p.errors, fmt.Sprintf("duplicate key %s in hash literal", k))
+				return nil
+			}
+
+			seen[k] = true
+		}
+
 		hash.Pairs[key] = value
 
+		// 末尾のカンマ {"a": 1, } はループの条件で}を確認するので許容される
 		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
 			return nil
 		}
@@ -165,13 +232,67 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 	return hash
 }
 
+// 値が解析時に決まるキーを比較用の文字列にする
+// 文字列の"1"と整数の1が同じにならないように、文字列は""で囲む
+func literalKey(exp ast.Expression) (string, bool) {
+
+	switch exp := exp.(type) {
+
+	case *ast.StringLiteral:
+		return strconv.Quote(exp.Value), true
+
+	case *ast.IntegerLiteral:
+		return strconv.FormatInt(exp.Value, 10), true
+
+	case *ast.Boolean:
+		return strconv.FormatBool(exp.Value), true
+
+	default:
+		return "", false
+	}
+}
+
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 
-	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
+	tok := p.curToken
 
 	p.nextToken()
 
-	exp.Index = p.parseExpression(LOWEST)
+	// arr[:2]
+	if p.curTokenIs(token.COLON) {
+		return p.parseSliceExpression(tok, left, nil)
+	}
+
+	index := p.parseExpression(LOWEST)
+
+	// arr[1:3], arr[2:]
+	if p.peekTokenIs(token.COLON) {
+		p.nextToken()
+		return p.parseSliceExpression(tok, left, index)
+	}
+
+	exp := &ast.IndexExpression{Token: tok, Left: left, Index: index}
+
+	if !p.expectPeek(token.RBRACKET) {
+		return nil
+	}
+
+	return exp
+}
+
+// 現在位置のトークンは:
+func (p *Parser) parseSliceExpression(
+	tok token.Token,
+	left ast.Expression,
+	low ast.Expression,
+) ast.Expression {
+
+	exp := &ast.SliceExpression{Token: tok, Left: left, Low: low}
+
+	if !p.peekTokenIs(token.RBRACKET) {
+		p.nextToken()
+		exp.High = p.parseExpression(LOWEST)
+	}
 
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
@@ -204,6 +325,10 @@ func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 
 	for p.peekTokenIs(token.COMMA) {
 		p.nextToken()
+		// 末尾のカンマは許容する [1, 2, ]
+		if p.peekTokenIs(end) {
+			break
+		}
 		p.nextToken()
 		list = append(list, p.parseExpression(LOWEST))
 	}
@@ -219,6 +344,148 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 	return &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
 }
 
+func (p *Parser) parseInterpolatedString() ast.Expression {
+
+	str := &ast.InterpolatedString{Token: p.curToken}
+
+	for _, seg := range splitInterpolation(p.curToken.Literal) {
+
+		if !seg.isExpression {
+
+			if seg.text != "" {
+				str.Parts = append(str.Parts, &ast.StringLiteral{
+					Token: token.Token{Type: token.STRING, Literal: seg.text},
+					Value: seg.text,
+				})
+			}
+
+			continue
+		}
+
+		exp := p.parseEmbeddedExpression(seg.text)
+
+		if exp == nil {
+			return nil
+		}
+
+		str.Parts = append(str.Parts, exp)
+	}
+
+	return str
+}
+
+// テンプレートを文字列補間と同じ書き方で解析する
+// "Hello ${name}!" の""の中身だけを渡す
+func ParseTemplate(input string) (*ast.InterpolatedString, []string) {
+
+	p := New(lexer.New(""))
+
+	p.curToken = token.Token{Type: token.INTERP_STRING, Literal: input}
+
+	str, _ := p.parseInterpolatedString().(*ast.InterpolatedString)
+
+	return str, p.errors
+}
+
+// ${...}の中身を別のパーサーで1つの式として解析する
+func (p *Parser) parseEmbeddedExpression(input string) ast.Expression {
+
+	sub := New(lexer.New(input))
+	sub.depth = p.depth
+	sub.maxDepth = p.maxDepth
+
+	if sub.curTokenIs(token.EOF) {
+		p.errors = append(p.errors, "empty expression in string interpolation")
+		return nil
+	}
+
+	exp := sub.parseExpression(LOWEST)
+
+	if !sub.peekTokenIs(token.EOF) {
+		msg := fmt.Sprintf("unexpected %s in string interpolation %q",
+			sub.peekToken.Type,
+			input)
+		sub.errors = append(sub.errors, msg)
+	}
+
+	if len(sub.errors) != 0 {
+		p.errors = append(p.errors, sub.errors...)
+		return nil
+	}
+
+	return exp
+}
+
+type interpolationSegment struct {
+	text         string
+	isExpression bool
+}
+
+// "a${x}b" を "a", x, "b" に分割する
+func splitInterpolation(literal string) []interpolationSegment {
+
+	segments := []interpolationSegment{}
+
+	start := 0
+
+	for i := 0; i < len(literal); i++ {
+
+		// $${ は${そのもの
+		if strings.HasPrefix(literal[i:], "$${") {
+			segments = append(segments, interpolationSegment{text: literal[start : i+1]})
+			start = i + 2
+			i = i + 2
+			continue
+		}
+
+		if literal[i] != '$' || i+1 >= len(literal) || literal[i+1] != '{' {
+			continue
+		}
+
+		segments = append(segments, interpolationSegment{text: literal[start:i]})
+
+		// 対応する}を探す
+		depth := 0
+		j := i + 1
+
+		for ; j < len(literal); j++ {
+
+			switch literal[j] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+			case '"':
+				// 式の中の文字列は読み飛ばす
+				for j++; j < len(literal) && literal[j] != '"'; j++ {
+				}
+			}
+
+			if depth == 0 {
+				break
+			}
+		}
+
+		if j >= len(literal) {
+			j = len(literal)
+		}
+
+		segments = append(segments, interpolationSegment{
+			text:         literal[i+2 : j],
+			isExpression: true,
+		})
+
+		start = j + 1
+		i = j
+	}
+
+	if start < len(literal) {
+		segments = append(segments, interpolationSegment{text: literal[start:]})
+	}
+
+	return segments
+}
+
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
@@ -275,6 +542,25 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 	return lit
 }
 
+func (p *Parser) parseMacroLiteral() ast.Expression {
+
+	lit := &ast.MacroLiteral{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	lit.Parameters = p.parseFunctionParameters()
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	lit.Body = p.parseBlockStatement()
+
+	return lit
+}
+
 func (p *Parser) parseFunctionParameters() []*ast.Identifier {
 
 	identifiers := []*ast.Identifier{}
@@ -292,6 +578,10 @@ func (p *Parser) parseFunctionParameters() []*ast.Identifier {
 
 	for p.peekTokenIs(token.COMMA) {
 		p.nextToken()
+		// 末尾のカンマは許容する fn(a, b, )
+		if p.peekTokenIs(token.RPAREN) {
+			break
+		}
 		p.nextToken()
 		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 		identifiers = append(identifiers, ident)
@@ -329,6 +619,193 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	return expression
 }
 
+func (p *Parser) parseForInExpression() ast.Expression {
+
+	expression := &ast.ForInExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	// ループ変数
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+
+	expression.Variable = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if !p.expectPeek(token.IN) {
+		return nil
+	}
+
+	p.nextToken()
+
+	expression.Iterable = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	expression.Body = p.parseBlockStatement()
+
+	return expression
+}
+
+// 右結合にするため、右辺は一段低い優先順位で解析する (a = b = 1 は a = (b = 1))
+func (p *Parser) parseAssignExpression(left ast.Expression) ast.Expression {
+
+	name, ok := left.(*ast.Identifier)
+
+	if !ok {
+		msg := fmt.Sprintf("invalid assignment target %s", left.String())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	expression := &ast.AssignExpression{Token: p.curToken, Name: name}
+
+	p.nextToken()
+
+	expression.Value = p.parseExpression(ASSIGNMENT - 1)
+
+	return expression
+}
+
+func (p *Parser) parseWhileExpression() ast.Expression {
+
+	expression := &ast.WhileExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	p.nextToken()
+
+	expression.Condition = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	expression.Body = p.parseBlockStatement()
+
+	return expression
+}
+
+// import "path" と import("path") のどちらの書き方も受け付ける
+func (p *Parser) parseImportExpression() ast.Expression {
+
+	expression := &ast.ImportExpression{Token: p.curToken}
+
+	parenthesized := p.peekTokenIs(token.LPAREN)
+
+	if parenthesized {
+		p.nextToken()
+	}
+
+	// モジュールはコンパイル時に解決するので、パスは文字列リテラルに限る
+	if !p.peekTokenIs(token.STRING) {
+		msg := fmt.Sprintf("import path must be a string literal, got %s",
+			p.peekToken.Type)
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	p.nextToken()
+
+	expression.Path = p.curToken.Literal
+
+	if parenthesized && !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	return expression
+}
+
+func (p *Parser) parseTryExpression() ast.Expression {
+
+	expression := &ast.TryExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	expression.Body = p.parseBlockStatement()
+
+	if !p.expectPeek(token.CATCH) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+
+	expression.Param = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	expression.Handler = p.parseBlockStatement()
+
+	return expression
+}
+
+// spawn fn() { ... } または spawn f
+// 引数の無い関数を式として読む。呼び出しはVMが行う
+func (p *Parser) parseSpawnExpression() ast.Expression {
+
+	expression := &ast.SpawnExpression{Token: p.curToken}
+
+	p.nextToken()
+
+	expression.Function = p.parseExpression(PREFIX)
+
+	if expression.Function == nil {
+		return nil
+	}
+
+	return expression
+}
+
+// yield expr
+// 式が続かなければ(; か } か ) か , が続けば)値を省いたものとする
+func (p *Parser) parseYieldExpression() ast.Expression {
+
+	expression := &ast.YieldExpression{Token: p.curToken}
+
+	switch p.peekToken.Type {
+	case token.SEMICOLON, token.RBRACE, token.RPAREN, token.COMMA, token.RBRACKET, token.EOF:
+		return expression
+	}
+
+	p.nextToken()
+
+	expression.Value = p.parseExpression(LOWEST)
+
+	if expression.Value == nil {
+		return nil
+	}
+
+	return expression
+}
+
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	block := &ast.BlockStatement{Token: p.curToken}
 	block.Statements = []ast.Statement{}
@@ -362,6 +839,10 @@ func (p *Parser) parseBoolean() ast.Expression {
 	return &ast.Boolean{Token: p.curToken, Value: p.curTokenIs(token.TRUE)}
 }
 
+func (p *Parser) parseNullLiteral() ast.Expression {
+	return &ast.NullLiteral{Token: p.curToken}
+}
+
 // infix operators
 func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 
@@ -384,6 +865,24 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return expression
 }
 
+// 1..10
+func (p *Parser) parseRangeExpression(left ast.Expression) ast.Expression {
+
+	exp := &ast.RangeExpression{Token: p.curToken, Start: left}
+
+	precedence := p.curPrecedence()
+
+	p.nextToken()
+
+	exp.End = p.parseExpression(precedence)
+
+	if exp.End == nil {
+		return nil
+	}
+
+	return exp
+}
+
 // prefix operators (prefix expressions)
 func (p *Parser) parsePrefixExpression() ast.Expression {
 
@@ -412,6 +911,9 @@ func (p *Parser) Errors() []string {
 }
 
 func (p *Parser) peekError(t token.TokenType) {
+	if p.tooDeep {
+		return
+	}
 	msg := fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type)
 	p.errors = append(p.errors, msg)
 }
@@ -437,6 +939,13 @@ func (p *Parser) ParseProgram() *ast.Program {
 		// トークン順列上の現在位置を進める
 		p.nextToken()
 	}
+
+	// EOFまで読み終えたので、lexerが読み飛ばしたコメントはすべて揃っている
+	for _, c := range p.l.Comments() {
+		program.Comments = append(program.Comments,
+			&ast.Comment{Token: c.Token, Trailing: c.Trailing})
+	}
+
 	return program
 }
 
@@ -447,8 +956,14 @@ func (p *Parser) parseStatement() ast.Statement {
 	// 現在位置のトークンがletの場合、LET文の取り出し（LET文であるかの検証）を開始する
 	case token.LET:
 		return p.parseLetStatement()
+	case token.CONST:
+		return p.parseConstStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.THROW:
+		return p.parseThrowStatement()
+	case token.BREAK, token.CONTINUE:
+		return p.parseLoopControlStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
@@ -497,6 +1012,38 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	return stmt
 }
 
+func (p *Parser) parseLoopControlStatement() ast.Statement {
+
+	var stmt ast.Statement
+
+	if p.curTokenIs(token.BREAK) {
+		stmt = &ast.BreakStatement{Token: p.curToken}
+	} else {
+		stmt = &ast.ContinueStatement{Token: p.curToken}
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement {
+
+	stmt := &ast.ThrowStatement{Token: p.curToken}
+
+	p.nextToken()
+
+	stmt.Value = p.parseExpression(LOWEST)
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseLetStatement() *ast.LetStatement {
 
 	stmt := &ast.LetStatement{Token: p.curToken}
@@ -529,6 +1076,18 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	return stmt
 }
 
+// const文はletと同じ形なので、let文として解析してから詰め替える
+func (p *Parser) parseConstStatement() ast.Statement {
+
+	stmt := p.parseLetStatement()
+
+	if stmt == nil {
+		return nil
+	}
+
+	return &ast.ConstStatement{Token: stmt.Token, Name: stmt.Name, Value: stmt.Value}
+}
+
 // 現在位置のトークンの種類を確認する
 func (p *Parser) curTokenIs(t token.TokenType) bool {
 	return p.curToken.Type == t
@@ -570,7 +1129,40 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	return lit
 }
 
+func (p *Parser) parseFloatLiteral() ast.Expression {
+
+	lit := &ast.FloatLiteral{Token: p.curToken}
+
+	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
+
+	if err != nil {
+		msg := fmt.Sprintf("could not parse %q as float", p.curToken.Literal)
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	lit.Value = value
+
+	return lit
+}
+
+// 深すぎるネストはエラーを１つだけ記録して残りの入力を読み飛ばす
+// （後続のエラーが連鎖しないようにする）
+func (p *Parser) nestingTooDeepError() {
+	if !p.tooDeep {
+		msg := fmt.Sprintf("expression nested too deeply (max depth %d)", p.maxDepth)
+		p.errors = append(p.errors, msg)
+		p.tooDeep = true
+	}
+	for !p.curTokenIs(token.EOF) {
+		p.nextToken()
+	}
+}
+
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
+	if p.tooDeep {
+		return
+	}
 	msg := fmt.Sprintf("no prefix parse function for %s found", t)
 	p.errors = append(p.errors, msg)
 }
@@ -580,6 +1172,14 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 	//defer untrace(trace("parseExpression"))
 	//trace2(fmt.Sprintf("curToken=%+v", p.curToken))
 
+	p.depth++
+	defer func() { p.depth-- }()
+
+	if p.depth > p.maxDepth {
+		p.nestingTooDeepError()
+		return nil
+	}
+
 	prefix := p.prefixParseFns[p.curToken.Type]
 
 	if prefix == nil {
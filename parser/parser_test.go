@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"example.com/monkey/ast"
@@ -190,6 +191,38 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestFloatLiteralExpression(t *testing.T) {
+	input := "3.25;"
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program has not enough statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statement[0] is not *ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	literal, ok := stmt.Expression.(*ast.FloatLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+	}
+
+	if literal.Value != 3.25 {
+		t.Errorf("literal.Value not %g. got=%g", 3.25, literal.Value)
+	}
+
+	if literal.TokenLiteral() != "3.25" {
+		t.Errorf("literal.TokenLiteral not %s. got=%s", "3.25", literal.TokenLiteral())
+	}
+}
+
 // prefix operators or "prefix expressions"
 func TestParsingPrefixExpression(t *testing.T) {
 	prefixTests := []struct {
@@ -362,6 +395,9 @@ func TestParsingInfixExpression(t *testing.T) {
 		{"5 - 5;", 5, "-", 5},
 		{"5 * 5;", 5, "*", 5},
 		{"5 / 5;", 5, "/", 5},
+		{"5 % 5;", 5, "%", 5},
+		{"5 <= 5;", 5, "<=", 5},
+		{"5 >= 5;", 5, ">=", 5},
 		{"5 > 5;", 5, ">", 5},
 		{"5 < 5;", 5, "<", 5},
 		{"5 == 5;", 5, "==", 5},
@@ -401,6 +437,10 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"-a*b",
 			"((-a) * b)",
 		},
+		{
+			"a + b % c * d",
+			"(a + ((b % c) * d))",
+		},
 		{
 			"!-a",
 			"(!(-a))",
@@ -501,6 +541,14 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"add(a * b[2], b[1], 2 * [1, 2][1])",
 			"add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))",
 		},
+		{
+			"a || b && c == d",
+			"(a || (b && (c == d)))",
+		},
+		{
+			"a && b || !c",
+			"((a && b) || (!c))",
+		},
 	}
 
 	for _, tt := range tests {
@@ -1160,3 +1208,850 @@ func TestParsingHashLiteralsWithExpressions(t *testing.T) {
 		testFunc(value)
 	}
 }
+
+func TestTrailingCommas(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1, 2, 3,]", "[1, 2, 3]"},
+		{"[\n1,\n2,\n]", "[1, 2]"},
+		{"add(1, 2,)", "add(1, 2)"},
+		{"fn(x, y,){ x }", "fn(x,y)x"},
+		{`{"a": 1, "b": 2,}`, ""},
+	}
+
+	for _, tt := range tests {
+
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statements. got=%d",
+				len(program.Statements))
+		}
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+
+		if hash, ok := stmt.Expression.(*ast.HashLiteral); ok {
+
+			if len(hash.Pairs) != 2 {
+				t.Errorf("hash.Pairs has wrong length. got=%d", len(hash.Pairs))
+			}
+
+			continue
+		}
+
+		if stmt.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, stmt.String())
+		}
+	}
+}
+
+func TestTrailingCommaErrors(t *testing.T) {
+
+	tests := []string{
+		"[1, , 2]",
+		"add(,)",
+	}
+
+	for _, input := range tests {
+
+		l := lexer.New(input)
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q", input)
+		}
+	}
+}
+
+func TestForInExpression(t *testing.T) {
+
+	input := `for (x in [1, 2]) { x }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	exp, ok := stmt.Expression.(*ast.ForInExpression)
+
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.ForInExpression. got=%T",
+			stmt.Expression)
+	}
+
+	if !testIdentifier(t, exp.Variable, "x") {
+		return
+	}
+
+	if exp.Iterable.String() != "[1, 2]" {
+		t.Errorf("exp.Iterable.String() wrong. got=%q", exp.Iterable.String())
+	}
+
+	if len(exp.Body.Statements) != 1 {
+		t.Fatalf("body is not 1 statements. got=%d", len(exp.Body.Statements))
+	}
+
+	body, ok := exp.Body.Statements[0].(*ast.ExpressionStatement)
+
+	if !ok {
+		t.Fatalf("body stmt is not ast.ExpressionStatement. got=%T",
+			exp.Body.Statements[0])
+	}
+
+	testIdentifier(t, body.Expression, "x")
+}
+
+func TestParsingSliceExpression(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"myArray[1:3]", "(myArray[1:3])"},
+		{"myArray[:2]", "(myArray[:2])"},
+		{"myArray[2:]", "(myArray[2:])"},
+		{"myArray[:]", "(myArray[:])"},
+		{"myArray[1 + 1:len(myArray)]", "(myArray[(1 + 1):len(myArray)])"},
+	}
+
+	for _, tt := range tests {
+
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+
+		sliceExp, ok := stmt.Expression.(*ast.SliceExpression)
+
+		if !ok {
+			t.Fatalf("exp not *ast.SliceExpression. got=%T", stmt.Expression)
+		}
+
+		if !testIdentifier(t, sliceExp.Left, "myArray") {
+			return
+		}
+
+		if sliceExp.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, sliceExp.String())
+		}
+	}
+}
+
+func TestInterpolatedStringExpression(t *testing.T) {
+
+	tests := []struct {
+		input         string
+		expectedParts []string
+	}{
+		{`"Hello ${name}!"`, []string{"Hello ", "name", "!"}},
+		{`"${a + b}"`, []string{"(a + b)"}},
+		{`"${x}${y}"`, []string{"x", "y"}},
+		{`"${ {"k": "}"}["k"] }"`, []string{`({k:}}[k])`}},
+	}
+
+	for _, tt := range tests {
+
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+
+		str, ok := stmt.Expression.(*ast.InterpolatedString)
+
+		if !ok {
+			t.Fatalf("exp not *ast.InterpolatedString. got=%T", stmt.Expression)
+		}
+
+		if len(str.Parts) != len(tt.expectedParts) {
+			t.Fatalf("wrong number of parts. want=%d, got=%d",
+				len(tt.expectedParts), len(str.Parts))
+		}
+
+		for i, part := range tt.expectedParts {
+			if str.Parts[i].String() != part {
+				t.Errorf("parts[%d] wrong. want=%q, got=%q",
+					i, part, str.Parts[i].String())
+			}
+		}
+	}
+}
+
+func TestInterpolatedStringErrors(t *testing.T) {
+
+	tests := []string{
+		`"${}"`,
+		`"${1 +}"`,
+		`"${a b}"`,
+	}
+
+	for _, input := range tests {
+
+		l := lexer.New(input)
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q", input)
+		}
+	}
+}
+
+func TestImportExpression(t *testing.T) {
+
+	tests := []struct {
+		input        string
+		expectedPath string
+	}{
+		{`import "lib/math.monkey"`, "lib/math.monkey"},
+		{`import("lib/math.monkey");`, "lib/math.monkey"},
+		{`let m = import("util.monkey");`, "util.monkey"},
+	}
+
+	for _, tt := range tests {
+
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statements. got=%d",
+				len(program.Statements))
+		}
+
+		var exp ast.Expression
+
+		switch stmt := program.Statements[0].(type) {
+		case *ast.ExpressionStatement:
+			exp = stmt.Expression
+		case *ast.LetStatement:
+			exp = stmt.Value
+		}
+
+		imp, ok := exp.(*ast.ImportExpression)
+
+		if !ok {
+			t.Fatalf("exp not *ast.ImportExpression. got=%T", exp)
+		}
+
+		if imp.Path != tt.expectedPath {
+			t.Errorf("imp.Path wrong. want=%q, got=%q", tt.expectedPath, imp.Path)
+		}
+	}
+}
+
+func TestImportExpressionErrors(t *testing.T) {
+
+	tests := []string{
+		`import x`,
+		`import(1)`,
+		`import("a.monkey"`,
+	}
+
+	for _, input := range tests {
+
+		l := lexer.New(input)
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q", input)
+		}
+	}
+}
+
+func TestTryExpression(t *testing.T) {
+
+	input := `try { risky(); } catch (e) { e }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+
+	exp, ok := stmt.Expression.(*ast.TryExpression)
+
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.TryExpression. got=%T", stmt.Expression)
+	}
+
+	if exp.Body.String() != "risky()" {
+		t.Errorf("exp.Body wrong. got=%q", exp.Body.String())
+	}
+
+	if !testIdentifier(t, exp.Param, "e") {
+		return
+	}
+
+	if exp.Handler.String() != "e" {
+		t.Errorf("exp.Handler wrong. got=%q", exp.Handler.String())
+	}
+}
+
+func TestThrowStatement(t *testing.T) {
+
+	input := `throw "boom"; throw 1 + 2`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	expected := []string{`throw boom;`, `throw (1 + 2);`}
+
+	if len(program.Statements) != len(expected) {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d",
+			len(expected), len(program.Statements))
+	}
+
+	for i, want := range expected {
+
+		stmt, ok := program.Statements[i].(*ast.ThrowStatement)
+
+		if !ok {
+			t.Fatalf("stmt is not *ast.ThrowStatement. got=%T", program.Statements[i])
+		}
+
+		if stmt.String() != want {
+			t.Errorf("stmt.String() wrong. want=%q, got=%q", want, stmt.String())
+		}
+	}
+}
+
+func TestSpawnExpression(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`spawn fn() { 1 }`, "spawn fn()1"},
+		{`spawn worker`, "spawn worker"},
+		{`let ch = spawn fn() { x + 1 };`, "let ch = spawn fn()(x + 1);"},
+	}
+
+	for _, tt := range tests {
+
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+}
+
+func TestYieldExpression(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`yield 1 + 2`, "yield (1 + 2)"},
+		{`yield;`, "yield"},
+		{`let x = yield y;`, "let x = yield y;"},
+		{`[yield, yield 1]`, "[yield, yield 1]"},
+		{`fn() { yield }`, "fn()yield"},
+	}
+
+	for _, tt := range tests {
+
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+}
+
+func TestTryExpressionErrors(t *testing.T) {
+
+	tests := []string{
+		`try { 1 }`,
+		`try { 1 } catch { 2 }`,
+		`try { 1 } catch (1) { 2 }`,
+	}
+
+	for _, input := range tests {
+
+		l := lexer.New(input)
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q", input)
+		}
+	}
+}
+
+func TestMacroLiteralParsing(t *testing.T) {
+
+	input := `macro(x, y) { x + y; }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+
+	if !ok {
+		t.Fatalf("statement is not ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	macro, ok := stmt.Expression.(*ast.MacroLiteral)
+
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.MacroLiteral. got=%T", stmt.Expression)
+	}
+
+	if len(macro.Parameters) != 2 {
+		t.Fatalf("macro literal parameters wrong. want 2, got=%d",
+			len(macro.Parameters))
+	}
+
+	testLiteralExpression(t, macro.Parameters[0], "x")
+	testLiteralExpression(t, macro.Parameters[1], "y")
+
+	if len(macro.Body.Statements) != 1 {
+		t.Fatalf("macro.Body.Statements has not 1 statements. got=%d",
+			len(macro.Body.Statements))
+	}
+
+	bodyStmt, ok := macro.Body.Statements[0].(*ast.ExpressionStatement)
+
+	if !ok {
+		t.Fatalf("macro body stmt is not ast.ExpressionStatement. got=%T",
+			macro.Body.Statements[0])
+	}
+
+	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
+}
+
+func TestProgramComments(t *testing.T) {
+
+	input := `// double it
+let double = fn(x) {
+	x * 2 // the body
+};
+double(2)`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d",
+			len(program.Statements))
+	}
+
+	expected := []struct {
+		text     string
+		line     int
+		trailing bool
+	}{
+		{"double it", 1, false},
+		{"the body", 3, true},
+	}
+
+	if len(program.Comments) != len(expected) {
+		t.Fatalf("program.Comments does not contain %d comments. got=%d",
+			len(expected), len(program.Comments))
+	}
+
+	for i, tt := range expected {
+
+		c := program.Comments[i]
+
+		if c.Text() != tt.text {
+			t.Errorf("comments[%d] text wrong. want=%q, got=%q", i, tt.text, c.Text())
+		}
+
+		if c.Token.Line != tt.line {
+			t.Errorf("comments[%d] line wrong. want=%d, got=%d", i, tt.line, c.Token.Line)
+		}
+
+		if c.Trailing != tt.trailing {
+			t.Errorf("comments[%d] trailing wrong. want=%t, got=%t",
+				i, tt.trailing, c.Trailing)
+		}
+	}
+
+	// コメントは文の文字列表現には含まれない
+	if program.String() != "let double = fn<double>(x)(x * 2);double(2)" {
+		t.Errorf("program.String() wrong. got=%q", program.String())
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+
+	exp, errors := ParseTemplate(`port: ${cfg["port"]}, hosts: ${len(hosts)}`)
+
+	if len(errors) != 0 {
+		t.Fatalf("unexpected errors: %v", errors)
+	}
+
+	expected := []string{"port: ", "(cfg[port])", ", hosts: ", "len(hosts)"}
+
+	if len(exp.Parts) != len(expected) {
+		t.Fatalf("wrong number of parts. want=%d, got=%d", len(expected), len(exp.Parts))
+	}
+
+	for i, want := range expected {
+
+		if exp.Parts[i].String() != want {
+			t.Errorf("parts[%d] wrong. want=%q, got=%q", i, want, exp.Parts[i].String())
+		}
+	}
+
+	_, errors = ParseTemplate(`${}`)
+
+	if len(errors) == 0 {
+		t.Errorf("expected errors for empty expression")
+	}
+}
+
+func TestParsingHashLiteralsDuplicateKeys(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"a": 1, "a": 2}`, `duplicate key "a" in hash literal`},
+		{`{1: "x", 2: "y", 1: "z"}`, `duplicate key 1 in hash literal`},
+		{`{true: 1, false: 2, true: 3}`, `duplicate key true in hash literal`},
+		{`fn() { {"k": 1, "k": 1} }`, `duplicate key "k" in hash literal`},
+	}
+
+	for _, tt := range tests {
+
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+
+		if len(errors) == 0 {
+			t.Errorf("expected parser errors for %q", tt.input)
+			continue
+		}
+
+		if errors[0] != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.expected, errors[0])
+		}
+	}
+
+	// 値が同じでも型が違うキーや、式のキーは重複とみなさない
+	valid := []string{
+		`{"1": 1, 1: 2}`,
+		`{"true": 1, true: 2}`,
+		`{"a" + "b": 1, "a" + "b": 2}`,
+	}
+
+	for _, input := range valid {
+
+		l := lexer.New(input)
+		p := New(l)
+		p.ParseProgram()
+		checkParserErrors(t, p)
+	}
+}
+
+func TestConstStatements(t *testing.T) {
+
+	tests := []struct {
+		input              string
+		expectedIdentifier string
+		expectedValue      interface{}
+	}{
+		{"const x = 5;", "x", 5},
+		{"const y = true", "y", true},
+		{"const foobar = y;", "foobar", "y"},
+	}
+
+	for _, tt := range tests {
+
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statements. got=%d", len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.ConstStatement)
+
+		if !ok {
+			t.Fatalf("stmt not *ast.ConstStatement. got=%T", program.Statements[0])
+		}
+
+		if stmt.Name.Value != tt.expectedIdentifier {
+			t.Errorf("stmt.Name.Value not '%s'. got=%s", tt.expectedIdentifier, stmt.Name.Value)
+		}
+
+		if !testLiteralExpression(t, stmt.Value, tt.expectedValue) {
+			return
+		}
+	}
+
+	for _, input := range []string{"const = 5;", "const x 5;", "const 1 = 5;"} {
+
+		p := New(lexer.New(input))
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q", input)
+		}
+	}
+}
+
+func TestNullLiteral(t *testing.T) {
+
+	input := `null; [null, 1]`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+
+	null, ok := stmt.Expression.(*ast.NullLiteral)
+
+	if !ok {
+		t.Fatalf("exp not *ast.NullLiteral. got=%T", stmt.Expression)
+	}
+
+	if null.TokenLiteral() != "null" {
+		t.Errorf("null.TokenLiteral not %q. got=%q", "null", null.TokenLiteral())
+	}
+
+	if program.Statements[1].String() != "[null, 1]" {
+		t.Errorf("wrong string. got=%q", program.Statements[1].String())
+	}
+}
+
+func TestRangeExpression(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1..10", "(1..10)"},
+		{"0..n + 1", "(0..(n + 1))"},
+		{"a * 2..b - 1", "((a * 2)..(b - 1))"},
+		{"0..len(arr)", "(0..len(arr))"},
+		{"1..3 == r", "((1..3) == r)"},
+		{"arr[1..3]", "(arr[(1..3)])"},
+		{"for (i in 0..n) { i }", "for (i in (0..n)) i"},
+	}
+
+	for _, tt := range tests {
+
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+
+	p := New(lexer.New("1.."))
+	p.ParseProgram()
+
+	if len(p.Errors()) == 0 {
+		t.Errorf("expected parser errors for %q", "1..")
+	}
+}
+
+func TestNestingDepthLimit(t *testing.T) {
+
+	tests := []struct {
+		input string
+		depth int
+	}{
+		{strings.Repeat("(", 10000) + "1" + strings.Repeat(")", 10000), 0},
+		{strings.Repeat("-", 10000) + "1", 0},
+		{strings.Repeat("[", 10000) + strings.Repeat("]", 10000), 0},
+		{strings.Repeat("if (true) { ", 100) + "1" + strings.Repeat(" }", 100), 50},
+		{"\"${" + strings.Repeat("(", 100) + "1" + strings.Repeat(")", 100) + "}\"", 50},
+	}
+
+	for _, tt := range tests {
+
+		p := New(lexer.New(tt.input))
+		if tt.depth != 0 {
+			p.SetMaxDepth(tt.depth)
+		}
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) != 1 {
+			t.Fatalf("expected 1 error, got %d: %v", len(errors), errors)
+		}
+		if !strings.HasPrefix(errors[0], "expression nested too deeply") {
+			t.Errorf("wrong error. got=%q", errors[0])
+		}
+	}
+
+	// 上限以内なら解析できる
+	input := strings.Repeat("(", 100) + "1" + strings.Repeat(")", 100)
+	p := New(lexer.New(input))
+	p.ParseProgram()
+	checkParserErrors(t, p)
+}
+
+func TestWhileExpression(t *testing.T) {
+
+	input := `while (x < 10) { x }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	exp, ok := stmt.Expression.(*ast.WhileExpression)
+
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.WhileExpression. got=%T",
+			stmt.Expression)
+	}
+
+	if !testInfixExpression(t, exp.Condition, "x", "<", 10) {
+		return
+	}
+
+	if len(exp.Body.Statements) != 1 {
+		t.Fatalf("body is not 1 statements. got=%d", len(exp.Body.Statements))
+	}
+
+	if exp.String() != "while ((x < 10)) x" {
+		t.Errorf("exp.String() wrong. got=%q", exp.String())
+	}
+}
+
+func TestBreakAndContinueStatements(t *testing.T) {
+
+	input := `while (true) { break; continue }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+
+	exp, ok := stmt.Expression.(*ast.WhileExpression)
+
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.WhileExpression. got=%T", stmt.Expression)
+	}
+
+	if len(exp.Body.Statements) != 2 {
+		t.Fatalf("body is not 2 statements. got=%d", len(exp.Body.Statements))
+	}
+
+	if _, ok := exp.Body.Statements[0].(*ast.BreakStatement); !ok {
+		t.Errorf("body.Statements[0] is not ast.BreakStatement. got=%T", exp.Body.Statements[0])
+	}
+
+	if _, ok := exp.Body.Statements[1].(*ast.ContinueStatement); !ok {
+		t.Errorf("body.Statements[1] is not ast.ContinueStatement. got=%T", exp.Body.Statements[1])
+	}
+
+	if program.String() != "while (true) break;continue;" {
+		t.Errorf("program.String() wrong. got=%q", program.String())
+	}
+}
+
+func TestAssignExpression(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 5", "(x = 5)"},
+		{"x = y = 1 + 2", "(x = (y = (1 + 2)))"},
+		{"x = a || b", "(x = (a || b))"},
+		{"f(x = 1)", "f((x = 1))"},
+	}
+
+	for _, tt := range tests {
+
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+
+	p := New(lexer.New("1 = 2"))
+	p.ParseProgram()
+
+	if len(p.Errors()) == 0 || p.Errors()[0] != "invalid assignment target 1" {
+		t.Errorf("expected invalid assignment target error. got=%v", p.Errors())
+	}
+}
@@ -0,0 +1,233 @@
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/object"
+)
+
+const INSPECT_PROMPT = "inspect>"
+
+// 1ページに表示する要素の数
+const inspectPageSize = 10
+
+// 長い文字列は途中までにする
+const inspectMaxString = 60
+
+const inspectHelp = `  <index/key>  open element    ..  back    n/p  next/previous page    q  quit
+`
+
+// :inspect name
+// グローバル変数の配列やハッシュを1階層ずつ開いて見る
+type inspector struct {
+	out io.Writer
+	// 開いている値と、そこまでの経路
+	values []object.Object
+	path   []string
+	page   int
+}
+
+func inspect(
+	name string,
+	symbolTable *compiler.SymbolTable,
+	globals []object.Object,
+	scanner *bufio.Scanner,
+	out io.Writer,
+) {
+
+	symbol, ok := symbolTable.Resolve(name)
+
+	if !ok || symbol.Scope != compiler.GlobalScope || globals[symbol.Index] == nil {
+		fmt.Fprintf(out, "no global named %s\n", name)
+		return
+	}
+
+	in := &inspector{out: out, values: []object.Object{globals[symbol.Index]}, path: []string{name}}
+
+	in.show()
+
+	for {
+		fmt.Fprintf(out, INSPECT_PROMPT)
+
+		if !scanner.Scan() {
+			return
+		}
+
+		if !in.handle(strings.TrimSpace(scanner.Text())) {
+			return
+		}
+	}
+}
+
+// 入力を処理する。終了するときはfalseを返す
+func (in *inspector) handle(command string) bool {
+
+	switch command {
+	case "q":
+		return false
+	case "":
+	case "?":
+		io.WriteString(in.out, inspectHelp)
+		return true
+	case "..":
+		if len(in.values) > 1 {
+			in.values = in.values[:len(in.values)-1]
+			in.path = in.path[:len(in.path)-1]
+			in.page = 0
+		}
+	case "n":
+		if (in.page+1)*inspectPageSize < inspectSize(in.current()) {
+			in.page++
+		}
+	case "p":
+		if in.page > 0 {
+			in.page--
+		}
+	default:
+		child, step, ok := in.child(command)
+
+		if !ok {
+			fmt.Fprintf(in.out, "no element %s in %s\n", command, strings.Join(in.path, ""))
+			return true
+		}
+
+		in.values = append(in.values, child)
+		in.path = append(in.path, step)
+		in.page = 0
+	}
+
+	in.show()
+
+	return true
+}
+
+func (in *inspector) current() object.Object {
+	return in.values[len(in.values)-1]
+}
+
+// 開いている値の要素を、配列ならインデックス、ハッシュならキーの表示で探す
+func (in *inspector) child(selector string) (object.Object, string, bool) {
+
+	switch obj := in.current().(type) {
+
+	case *object.Array:
+
+		i, err := strconv.Atoi(selector)
+
+		if err != nil || i < 0 || i >= len(obj.Elements) {
+			return nil, "", false
+		}
+
+		return obj.Elements[i], fmt.Sprintf("[%d]", i), true
+
+	case *object.Hash:
+
+		for _, pair := range obj.Pairs {
+			if pair.Key.Inspect() != selector {
+				continue
+			}
+
+			if _, ok := pair.Key.(*object.String); ok {
+				return pair.Value, fmt.Sprintf("[%q]", selector), true
+			}
+
+			return pair.Value, fmt.Sprintf("[%s]", selector), true
+		}
+	}
+
+	return nil, "", false
+}
+
+func (in *inspector) show() {
+
+	obj := in.current()
+
+	fmt.Fprintf(in.out, "%s: %s\n", strings.Join(in.path, ""), summarize(obj))
+
+	start := in.page * inspectPageSize
+
+	switch obj := obj.(type) {
+
+	case *object.Array:
+
+		for i := start; i < len(obj.Elements) && i < start+inspectPageSize; i++ {
+			fmt.Fprintf(in.out, "  [%d] %s\n", i, summarize(obj.Elements[i]))
+		}
+
+	case *object.Hash:
+
+		pairs := sortedPairs(obj)
+
+		for i := start; i < len(pairs) && i < start+inspectPageSize; i++ {
+			fmt.Fprintf(in.out, "  %s: %s\n", pairs[i].Key.Inspect(), summarize(pairs[i].Value))
+		}
+
+	default:
+		return
+	}
+
+	if size := inspectSize(obj); size > inspectPageSize {
+		pages := (size + inspectPageSize - 1) / inspectPageSize
+		fmt.Fprintf(in.out, "  (page %d/%d)\n", in.page+1, pages)
+	}
+}
+
+// 型と大きさ。中身は配列とハッシュを開いたときに表示する
+func summarize(obj object.Object) string {
+
+	switch obj := obj.(type) {
+
+	case *object.Array:
+		return fmt.Sprintf("ARRAY (%d elements)", len(obj.Elements))
+
+	case *object.Hash:
+		return fmt.Sprintf("HASH (%d pairs)", len(obj.Pairs))
+
+	case *object.String:
+
+		value := obj.Value
+
+		if len(value) > inspectMaxString {
+			value = value[:inspectMaxString] + "..."
+		}
+
+		return fmt.Sprintf("STRING (%d bytes) %q", len(obj.Value), value)
+
+	default:
+		return fmt.Sprintf("%s %s", obj.Type(), obj.Inspect())
+	}
+}
+
+func inspectSize(obj object.Object) int {
+
+	switch obj := obj.(type) {
+	case *object.Array:
+		return len(obj.Elements)
+	case *object.Hash:
+		return len(obj.Pairs)
+	default:
+		return 0
+	}
+}
+
+// ハッシュの表示順を固定する
+func sortedPairs(hash *object.Hash) []object.HashPair {
+
+	pairs := make([]object.HashPair, 0, len(hash.Pairs))
+
+	for _, pair := range hash.Pairs {
+		pairs = append(pairs, pair)
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key.Inspect() < pairs[j].Key.Inspect()
+	})
+
+	return pairs
+}
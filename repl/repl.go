@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"strings"
 
 	"example.com/monkey/compiler"
+	"example.com/monkey/evaluator"
 	"example.com/monkey/lexer"
 	"example.com/monkey/object"
 	"example.com/monkey/parser"
@@ -21,15 +23,23 @@ func Start(in io.Reader, out io.Writer) {
 	// インタープリターの場合は必要
 	// env := object.NewEnvironment()
 
-	constants := []object.Object{}
 	globals := make([]object.Object, vm.GlobalsSize)
 	symbolTable := compiler.NewSymbolTable()
 
+	// マクロは入力をまたいで使えるように環境を保持しておく
+	macroEnv := object.NewEnvironment()
+
 	for i, v := range object.Builtins {
 
 		symbolTable.DefineBuiltin(i, v.Name)
 	}
 
+	// 定義と定数は入力をまたいでコンパイラーが持ち続ける
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+
+	// スタックとフレームの領域は入力をまたいで使い回す
+	var machine *vm.VM
+
 	for {
 		fmt.Fprintf(out, PROMPT)
 		scanned := scanner.Scan()
@@ -37,6 +47,13 @@ func Start(in io.Reader, out io.Writer) {
 			return
 		}
 		line := scanner.Text()
+
+		// :inspect name でグローバル変数の中身を開いて見る (inspect.go)
+		if name := strings.TrimPrefix(line, ":inspect "); name != line {
+			inspect(strings.TrimSpace(name), symbolTable, globals, scanner, out)
+			continue
+		}
+
 		l := lexer.New(line)
 		p := parser.New(l)
 		program := p.ParseProgram()
@@ -53,19 +70,33 @@ func Start(in io.Reader, out io.Writer) {
 		}
 		*/
 
-		comp := compiler.NewWithState(symbolTable, constants)
+		evaluator.DefineMacros(program, macroEnv)
+		expanded, err := evaluator.ExpandMacros(program, macroEnv)
 
-		err := comp.Compile(program)
+		if err != nil {
+			fmt.Fprintf(out, "Woops! Macro expansion failed:\n %s\n", err)
+			continue
+		}
+
+		// 失敗した入力の定義は取り消す
+		snapshot := comp.Snapshot()
+		comp.Reset()
+
+		err = comp.Compile(expanded)
 
 		if err != nil {
+			comp.Restore(snapshot)
 			fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n", err)
 			continue
 		}
 
 		code := comp.Bytecode()
-		constants = code.Constants
 
-		machine := vm.NewWithGlobalsStore(code, globals)
+		if machine == nil {
+			machine = vm.NewWithGlobalsStore(code, globals)
+		} else {
+			machine.Reset(code)
+		}
 
 		err = machine.Run()
 
@@ -75,7 +106,13 @@ func Start(in io.Reader, out io.Writer) {
 		}
 
 		// スタックの先頭要素を表示
+		// マクロの定義だけの入力などでは、何も積まれていない
 		lastPopped := machine.LastPoppedStackElem()
+
+		if lastPopped == nil {
+			continue
+		}
+
 		io.WriteString(out, lastPopped.Inspect())
 		io.WriteString(out, "\n")
 	}
@@ -0,0 +1,66 @@
+package repl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// 1行ずつ入力し、各行の出力を返す
+func runLines(t *testing.T, lines ...string) []string {
+
+	t.Helper()
+
+	var out bytes.Buffer
+
+	Start(strings.NewReader(strings.Join(lines, "\n")+"\n"), &out)
+
+	outputs := strings.Split(out.String(), PROMPT)
+
+	// 最初のプロンプトの前と、入力が終わった後のプロンプトの分
+	return outputs[1 : len(outputs)-1]
+}
+
+func TestStart(t *testing.T) {
+
+	tests := []struct {
+		lines    []string
+		expected []string
+	}{
+		{[]string{"1 + 2", `"a" + "b"`}, []string{"3\n", "ab\n"}},
+		// 入力をまたいで代入した関数は展開しない
+		{
+			[]string{"let f = fn(x) { x };", "f(1)", "f = fn(x) { 0 };", "f(1)"},
+			[]string{"", "1\n", "", "0\n"},
+		},
+	}
+
+	for _, tt := range tests {
+
+		outputs := runLines(t, tt.lines...)
+
+		if len(outputs) != len(tt.expected) {
+			t.Fatalf("wrong number of outputs for %q. got=%q", tt.lines, outputs)
+		}
+
+		for i, want := range tt.expected {
+			// 値を返さない行は確認しない
+			if want == "" {
+				continue
+			}
+
+			if outputs[i] != want {
+				t.Errorf("wrong output for %q. want=%q, got=%q", tt.lines[i], want, outputs[i])
+			}
+		}
+	}
+}
+
+func TestStartMacroOnlyLine(t *testing.T) {
+
+	outputs := runLines(t, "let m = macro(x) { quote(unquote(x) * 2) };", "m(5)")
+
+	if len(outputs) != 2 || outputs[0] != "" || outputs[1] != "10\n" {
+		t.Errorf("wrong outputs. got=%q", outputs)
+	}
+}
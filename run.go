@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/engine"
+	"example.com/monkey/object"
+)
+
+// monkey run file [args...]
+// ファイルを実行し、グローバルのmain関数があればargsを文字列の配列にして渡して呼ぶ
+// タイマーが残っていれば、無くなるまで待ってから終わる
+func runCommand(args []string) int {
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: monkey run file [args...]")
+		return 2
+	}
+
+	path := args[0]
+
+	src, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// 自分で実行するスクリプトなので、ファイルとコマンドの実行を許す
+	e := engine.New()
+	e.Grant(engine.Process | engine.FS)
+	e.SetModuleResolver(compiler.FileResolver{Dir: filepath.Dir(path)})
+
+	result, err := e.CallMain(string(src), args[1:])
+
+	if err == nil {
+		if errObj, ok := result.(*object.Error); ok {
+			err = fmt.Errorf("%s", errObj.Message)
+		}
+	}
+
+	if err == nil {
+		err = e.RunLoop(context.Background())
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		status int
+	}{
+		{`let main = fn(argv) { argv }`, 0},
+		{`let main = fn() { 1 + "a" }`, 1},
+		// マクロを展開してから実行する
+		{`let unless = macro(c, a, b) { quote(if (!(unquote(c))) { unquote(a) } else { unquote(b) }) };
+		let main = fn(argv) { unless(len(argv) == 1, 1 + "a", argv) }`, 0},
+	}
+
+	for _, tt := range tests {
+
+		path := filepath.Join(t.TempDir(), "main.monkey")
+
+		writeFile(t, path, tt.input)
+
+		if status := runCommand([]string{path, "x"}); status != tt.status {
+			t.Errorf("wrong exit status for %q. want=%d, got=%d", tt.input, tt.status, status)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/lexer"
+	"example.com/monkey/object"
+	"example.com/monkey/parser"
+	"example.com/monkey/vm"
+)
+
+// 1リクエストで受け付けるソースと返す出力の上限
+const (
+	maxSourceSize = 64 * 1024
+	maxOutputSize = 64 * 1024
+)
+
+// monkey serve [--addr :8080] [--fuel n] [--memory bytes] [--timeout d]
+// POST /run でソースを受け取り、実行結果をJSONで返す
+func serveCommand(args []string) int {
+
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+
+	addr := fs.String("addr", ":8080", "address to listen on")
+	fuel := fs.Int("fuel", 1000000, "maximum number of instructions per run")
+	memory := fs.Int("memory", 16*1024*1024, "maximum bytes allocated per run")
+	timeout := fs.Duration("timeout", 5*time.Second, "maximum wall-clock time per run")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	server := &playground{fuel: *fuel, memoryLimit: *memory, timeout: *timeout}
+
+	mux := http.NewServeMux()
+	mux.Handle("/run", server)
+
+	fmt.Fprintf(os.Stderr, "listening on %s\n", *addr)
+
+	if err := http.ListenAndServe(*addr, mux); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+type playground struct {
+	fuel        int
+	memoryLimit int
+	// recvで待ち続けるなど、燃料を使わずに止まっている場合も打ち切る
+	timeout time.Duration
+}
+
+type runRequest struct {
+	Source string `json:"source"`
+}
+
+type runResponse struct {
+	Output    string   `json:"output"`
+	Result    string   `json:"result,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+	ElapsedMs float64  `json:"elapsed_ms"`
+}
+
+func (pg *playground) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req runRequest
+
+	body := http.MaxBytesReader(w, r.Body, maxSourceSize)
+
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(r.Context(), pg.timeout)
+	defer cancel()
+
+	res := pg.run(ctx, req.Source)
+
+	res.ElapsedMs = float64(time.Since(start).Microseconds()) / 1000
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// ソースを新しいVMで実行する
+// リクエスト同士で状態は共有しない
+func (pg *playground) run(ctx context.Context, source string) (res runResponse) {
+
+	output := &limitedBuffer{limit: maxOutputSize}
+
+	// VMの中でpanicしてもサーバーは止めない
+	defer func() {
+		if r := recover(); r != nil {
+			res.Output = output.String()
+			res.Errors = append(res.Errors, fmt.Sprintf("internal error: %v", r))
+		}
+	}()
+
+	p := parser.New(lexer.New(source))
+
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+
+		for _, msg := range p.Errors() {
+			res.Errors = append(res.Errors, "parser error: "+msg)
+		}
+
+		return res
+	}
+
+	// マクロの展開は燃料で制限できないので、playgroundでは行わない
+	symbolTable := compiler.NewSymbolTable()
+
+	builtins := vm.Builtins()
+
+	for i, v := range object.Builtins {
+
+		symbolTable.DefineBuiltin(i, v.Name)
+
+		if v.Name == "puts" {
+			builtins[i] = putsTo(output)
+		}
+	}
+
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+
+	if err := comp.Compile(program); err != nil {
+		res.Errors = append(res.Errors, "compiler error: "+err.Error())
+		return res
+	}
+
+	machine := vm.NewWithBuiltins(comp.Bytecode(), builtins)
+	machine.SetFuel(pg.fuel)
+	machine.SetMemoryLimit(pg.memoryLimit)
+
+	err := machine.RunContext(ctx)
+
+	res.Output = output.String()
+
+	if err != nil {
+		res.Errors = append(res.Errors, "runtime error: "+err.Error())
+		return res
+	}
+
+	if last := machine.LastPoppedStackElem(); last != nil {
+		res.Result = last.Inspect()
+	}
+
+	return res
+}
+
+// 標準出力の代わりにbufに書き出すputs
+func putsTo(buf *limitedBuffer) *object.Builtin {
+
+	return &object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+		for _, arg := range args {
+			buf.WriteString(arg.Inspect() + "\n")
+		}
+
+		return nil
+	}}
+}
+
+// 上限を超えた分は捨てるバッファ
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) WriteString(s string) {
+
+	if b.Len()+len(s) > b.limit {
+
+		n := b.limit - b.Len()
+
+		// マルチバイト文字の途中で切らない
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+
+		s = s[:n]
+		b.truncated = true
+	}
+
+	b.Buffer.WriteString(s)
+}
+
+func (b *limitedBuffer) String() string {
+
+	if b.truncated {
+		return b.Buffer.String() + "\n... output truncated"
+	}
+
+	return b.Buffer.String()
+}
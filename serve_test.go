@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/monkey/object"
+)
+
+func postRun(t *testing.T, pg *playground, source string) runResponse {
+
+	t.Helper()
+
+	body, _ := json.Marshal(runRequest{Source: source})
+
+	w := httptest.NewRecorder()
+
+	pg.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(string(body))))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status. want=%d, got=%d", http.StatusOK, w.Code)
+	}
+
+	var res runResponse
+
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatalf("invalid response: %s", err)
+	}
+
+	return res
+}
+
+func TestServe(t *testing.T) {
+
+	pg := &playground{fuel: 1000000, memoryLimit: 16 * 1024 * 1024, timeout: 5 * time.Second}
+
+	res := postRun(t, pg, `puts("hello"); 1 + 2`)
+
+	if res.Output != "hello\n" || res.Result != "3" || len(res.Errors) != 0 {
+		t.Errorf("wrong response. got=%+v", res)
+	}
+
+	// 燃料を使い切ると止まる
+	res = postRun(t, &playground{fuel: 1000, timeout: 5 * time.Second}, `puts("start"); while (true) { 1 }`)
+
+	if res.Output != "start\n" || len(res.Errors) != 1 || !strings.Contains(res.Errors[0], "out of fuel") {
+		t.Errorf("wrong response for fuel exhaustion. got=%+v", res)
+	}
+
+	// 燃料を使わずに待ち続けても時間で止まる
+	res = postRun(t, &playground{fuel: 1000, timeout: 50 * time.Millisecond}, `puts("start"); recv(channel())`)
+
+	if res.Output != "start\n" || len(res.Errors) != 1 || !strings.Contains(res.Errors[0], "context deadline exceeded") {
+		t.Errorf("wrong response for a blocking script. got=%+v", res)
+	}
+
+	// 出力は上限で切る。1行7バイトなので、最後の行は文字の途中で上限になる
+	res = postRun(t, pg, `for (i in 0..10000) { puts("ああ") }`)
+
+	if !strings.HasSuffix(res.Output, "\n... output truncated") {
+		t.Errorf("output not truncated. got suffix=%q", res.Output[len(res.Output)-40:])
+	}
+
+	if strings.Contains(res.Output, "�") || len(res.Output) > maxOutputSize+len("\n... output truncated") {
+		t.Errorf("output cut in the middle of a character. got suffix=%q", res.Output[len(res.Output)-40:])
+	}
+
+	// 組み込み関数の中のpanicはエラーとして返し、サーバーは止めない
+	var lenBuiltin *object.Builtin
+
+	for _, def := range object.Builtins {
+		if def.Name == "len" {
+			lenBuiltin = def.Builtin
+		}
+	}
+
+	fn := lenBuiltin.Fn
+	lenBuiltin.Fn = func(args ...object.Object) object.Object { panic("boom") }
+	defer func() { lenBuiltin.Fn = fn }()
+
+	res = postRun(t, pg, `puts("before"); len([])`)
+
+	if res.Output != "before\n" || len(res.Errors) != 1 || res.Errors[0] != "internal error: boom" {
+		t.Errorf("wrong response for panic. got=%+v", res)
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"example.com/monkey/ast"
+	"example.com/monkey/compiler"
+	"example.com/monkey/evaluator"
+	"example.com/monkey/lexer"
+	"example.com/monkey/object"
+	"example.com/monkey/parser"
+	"example.com/monkey/vm"
+)
+
+// テストファイルとテスト関数の命名規則
+const (
+	testFileSuffix     = "_test.monkey"
+	testFunctionPrefix = "test_"
+)
+
+// monkey test [-v] [dir|file]...
+// *_test.monkey の中の test_ で始まる関数を1つずつ実行する
+func testCommand(args []string) int {
+	return runTests(os.Stdout, os.Stderr, args)
+}
+
+// 結果をstdoutに、テストを始められなかったときのエラーをstderrに書き出す
+func runTests(stdout, stderr io.Writer, args []string) int {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	verbose := fs.Bool("v", false, "print passing tests as well")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	paths := fs.Args()
+
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	files, err := discoverTestFiles(paths)
+
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if len(files) == 0 {
+		fmt.Fprintln(stderr, "no test files found")
+		return 1
+	}
+
+	status := 0
+
+	for _, file := range files {
+
+		if !runTestFile(stdout, file, *verbose) {
+			status = 1
+		}
+	}
+
+	return status
+}
+
+func discoverTestFiles(paths []string) ([]string, error) {
+
+	files := []string{}
+
+	for _, path := range paths {
+
+		err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+
+			if err != nil {
+				return err
+			}
+
+			// 直接指定されたファイルは名前に関係なく対象にする
+			if p == path && !info.IsDir() {
+				files = append(files, p)
+				return nil
+			}
+
+			if !info.IsDir() && strings.HasSuffix(p, testFileSuffix) {
+				files = append(files, p)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// ファイル内のテストをすべて実行し、すべて成功したかを返す
+func runTestFile(out io.Writer, path string, verbose bool) bool {
+
+	src, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		fmt.Fprintf(out, "FAIL\t%s\n\t%s\n", path, err)
+		return false
+	}
+
+	p := parser.New(lexer.New(string(src)))
+
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+
+		fmt.Fprintf(out, "FAIL\t%s\n", path)
+
+		for _, msg := range p.Errors() {
+			fmt.Fprintf(out, "\tparser error: %s\n", msg)
+		}
+
+		return false
+	}
+
+	// テスト関数を取り出す前にマクロを展開しておく
+	macroEnv := object.NewEnvironment()
+	evaluator.DefineMacros(program, macroEnv)
+	expanded, err := evaluator.ExpandMacros(program, macroEnv)
+
+	if err != nil {
+		fmt.Fprintf(out, "FAIL\t%s\n\tmacro error: %s\n", path, err)
+		return false
+	}
+
+	program = expanded.(*ast.Program)
+
+	passed := true
+
+	start := time.Now()
+
+	for _, name := range testFunctionNames(program) {
+
+		testStart := time.Now()
+
+		failures := runTest(program, name)
+
+		elapsed := time.Since(testStart)
+
+		if len(failures) == 0 {
+
+			if verbose {
+				fmt.Fprintf(out, "--- PASS: %s (%s)\n", name, elapsed)
+			}
+
+			continue
+		}
+
+		passed = false
+
+		fmt.Fprintf(out, "--- FAIL: %s (%s)\n", name, elapsed)
+
+		for _, failure := range failures {
+			fmt.Fprintf(out, "    %s\n", strings.ReplaceAll(failure, "\n", "\n    "))
+		}
+	}
+
+	if passed {
+		fmt.Fprintf(out, "ok\t%s\t%s\n", path, time.Since(start))
+	} else {
+		fmt.Fprintf(out, "FAIL\t%s\t%s\n", path, time.Since(start))
+	}
+
+	return passed
+}
+
+// トップレベルで let test_xxx = fn(){ ... } と定義された引数の無い関数
+func testFunctionNames(program *ast.Program) []string {
+
+	names := []string{}
+
+	for _, s := range program.Statements {
+
+		let, ok := s.(*ast.LetStatement)
+
+		if !ok || !strings.HasPrefix(let.Name.Value, testFunctionPrefix) {
+			continue
+		}
+
+		fn, ok := let.Value.(*ast.FunctionLiteral)
+
+		if !ok || len(fn.Parameters) != 0 {
+			continue
+		}
+
+		names = append(names, let.Name.Value)
+	}
+
+	return names
+}
+
+// トップレベルの文を実行した後にテスト関数を呼び出す
+// テストごとに新しいVMで実行するので、テスト同士は影響しない
+func runTest(program *ast.Program, name string) []string {
+
+	failures := []string{}
+
+	symbolTable := compiler.NewSymbolTable()
+
+	builtins := vm.Builtins()
+
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
+	for _, a := range assertionBuiltins(&failures) {
+		symbolTable.DefineBuiltin(len(builtins), a.name)
+		builtins = append(builtins, a.builtin)
+	}
+
+	call := &ast.ExpressionStatement{
+		Expression: &ast.CallExpression{
+			Function: &ast.Identifier{Value: name},
+		},
+	}
+
+	statements := make([]ast.Statement, 0, len(program.Statements)+1)
+	statements = append(statements, program.Statements...)
+	statements = append(statements, call)
+
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+
+	err := comp.Compile(&ast.Program{Statements: statements})
+
+	if err != nil {
+		return append(failures, fmt.Sprintf("compiler error: %s", err))
+	}
+
+	machine := vm.NewWithBuiltins(comp.Bytecode(), builtins)
+
+	err = machine.Run()
+
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("runtime error: %s", err))
+	}
+
+	return failures
+}
+
+type assertion struct {
+	name    string
+	builtin *object.Builtin
+}
+
+// テストの中だけで使える組み込み関数
+// 失敗はfailuresに記録し、テストはそのまま続行する
+func assertionBuiltins(failures *[]string) []assertion {
+
+	fail := func(format string, a ...interface{}) object.Object {
+		msg := fmt.Sprintf(format, a...)
+		*failures = append(*failures, msg)
+		return &object.Error{Message: msg}
+	}
+
+	return []assertion{
+		{
+			// assert(condition) / assert(condition, message)
+			"assert",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				if len(args) != 1 && len(args) != 2 {
+					return fail("assert: wrong number of arguments. got=%d, want=1 or 2",
+						len(args))
+				}
+
+				if isTruthy(args[0]) {
+					return nil
+				}
+
+				if len(args) == 2 {
+					return fail("assert failed: %s", args[1].Inspect())
+				}
+
+				return fail("assert failed: got %s", args[0].Inspect())
+			}},
+		},
+		{
+			// assert_eq(actual, expected)
+			"assert_eq",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				if len(args) != 2 {
+					return fail("assert_eq: wrong number of arguments. got=%d, want=2",
+						len(args))
+				}
+
+				got, want := args[0], args[1]
+
+				path, equal := findDifference("", got, want)
+
+				if equal {
+					return nil
+				}
+
+				msg := fmt.Sprintf("assert_eq failed\n    got:  %s\n    want: %s",
+					describe(got),
+					describe(want))
+
+				// 配列やハッシュの場合は最初に異なる位置も示す
+				if path != "" {
+					msg += fmt.Sprintf("\n    first difference at %s", path)
+				}
+
+				return fail("%s", msg)
+			}},
+		},
+		{
+			// fail(message)
+			"fail",
+			&object.Builtin{Fn: func(args ...object.Object) object.Object {
+
+				parts := []string{}
+
+				for _, arg := range args {
+					parts = append(parts, arg.Inspect())
+				}
+
+				return fail("fail: %s", strings.Join(parts, " "))
+			}},
+		},
+	}
+}
+
+func describe(obj object.Object) string {
+
+	if obj.Type() == object.STRING_OBJ {
+		return fmt.Sprintf("%q (%s)", obj.Inspect(), obj.Type())
+	}
+
+	return fmt.Sprintf("%s (%s)", obj.Inspect(), obj.Type())
+}
+
+// 2つの値を比較し、異なる場合はその位置(配列のインデックスやハッシュのキー)を返す
+func findDifference(path string, got, want object.Object) (string, bool) {
+
+	if got.Type() != want.Type() {
+		return path, false
+	}
+
+	switch got := got.(type) {
+
+	case *object.Integer:
+		return path, got.Value == want.(*object.Integer).Value
+
+	case *object.String:
+		return path, got.Value == want.(*object.String).Value
+
+	case *object.Boolean:
+		return path, got.Value == want.(*object.Boolean).Value
+
+	case *object.Float:
+		return path, got.Value == want.(*object.Float).Value
+
+	// 1.0と1.00も等しい
+	case *object.Decimal:
+		return path, got.Value.Cmp(want.(*object.Decimal).Value) == 0
+
+	// タイムゾーンが違っても同じ時刻なら等しい
+	case *object.DateTime:
+		return path, got.Value.Equal(want.(*object.DateTime).Value)
+
+	case *object.Duration:
+		return path, got.Value == want.(*object.Duration).Value
+
+	case *object.Null:
+		return path, true
+
+	case *object.Array:
+
+		wantElements := want.(*object.Array).Elements
+
+		for i := 0; i < len(got.Elements) && i < len(wantElements); i++ {
+
+			p, equal := findDifference(fmt.Sprintf("%s[%d]", path, i),
+				got.Elements[i],
+				wantElements[i])
+
+			if !equal {
+				return p, false
+			}
+		}
+
+		if len(got.Elements) != len(wantElements) {
+			return fmt.Sprintf("%s (length %d != %d)", path, len(got.Elements), len(wantElements)), false
+		}
+
+		return path, true
+
+	case *object.Hash:
+
+		wantPairs := want.(*object.Hash).Pairs
+
+		for key, pair := range got.Pairs {
+
+			keyPath := fmt.Sprintf("%s[%s]", path, pair.Key.Inspect())
+
+			wantPair, ok := wantPairs[key]
+
+			if !ok {
+				return keyPath + " (unexpected key)", false
+			}
+
+			p, equal := findDifference(keyPath, pair.Value, wantPair.Value)
+
+			if !equal {
+				return p, false
+			}
+		}
+
+		for key, pair := range wantPairs {
+
+			if _, ok := got.Pairs[key]; !ok {
+				return fmt.Sprintf("%s[%s] (missing key)", path, pair.Key.Inspect()), false
+			}
+		}
+
+		return path, true
+
+	default:
+		return path, got == want
+	}
+}
+
+func isTruthy(obj object.Object) bool {
+
+	switch obj := obj.(type) {
+
+	case *object.Boolean:
+		return obj.Value
+
+	case *object.Null:
+		return false
+
+	default:
+		return true
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTestCommand(t *testing.T) {
+
+	dir := t.TempDir()
+
+	writeFile(t, filepath.Join(dir, "math_test.monkey"), `
+	let double = fn(x) { x * 2 };
+	let test_double = fn() { assert_eq(double(2), 4) };
+	let test_list = fn() { assert_eq([1, double(1)], [1, 3]) };
+	let test_assert = fn() { assert(1 > 2, "one is not greater") };
+	let helper = fn() { fail("not a test") };
+	`)
+
+	writeFile(t, filepath.Join(dir, "sub", "ok_test.monkey"), `
+	let test_ok = fn() { assert(true) };
+	`)
+
+	// *_test.monkeyでないファイルは読まない
+	writeFile(t, filepath.Join(dir, "lib.monkey"), `let = ;`)
+
+	var stdout, stderr bytes.Buffer
+
+	if status := runTests(&stdout, &stderr, []string{"-v", dir}); status != 1 {
+		t.Errorf("wrong exit status. want=1, got=%d", status)
+	}
+
+	out := stdout.String()
+
+	for _, want := range []string{
+		"--- PASS: test_double",
+		"--- FAIL: test_list",
+		"    assert_eq failed\n        got:  [1, 2] (ARRAY)\n        want: [1, 3] (ARRAY)\n        first difference at [1]\n",
+		"--- FAIL: test_assert",
+		"    assert failed: one is not greater\n",
+		"FAIL\t" + filepath.Join(dir, "math_test.monkey"),
+		"--- PASS: test_ok",
+		"ok\t" + filepath.Join(dir, "sub", "ok_test.monkey"),
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q. got=\n%s", want, out)
+		}
+	}
+
+	if strings.Contains(out, "helper") || strings.Contains(out, "lib.monkey") {
+		t.Errorf("ran something other than test functions. got=\n%s", out)
+	}
+
+	// ファイル名順に実行する
+	if strings.Index(out, "math_test.monkey") > strings.Index(out, "ok_test.monkey") {
+		t.Errorf("test files not run in order. got=\n%s", out)
+	}
+
+	// すべて成功すれば0
+	stdout.Reset()
+
+	if status := runTests(&stdout, &stderr, []string{filepath.Join(dir, "sub")}); status != 0 {
+		t.Errorf("wrong exit status. want=0, got=%d\n%s", status, stdout.String())
+	}
+
+	if strings.Contains(stdout.String(), "--- PASS") {
+		t.Errorf("passing tests printed without -v. got=\n%s", stdout.String())
+	}
+
+	// テストファイルが無ければ失敗
+	stderr.Reset()
+
+	if status := runTests(&stdout, &stderr, []string{t.TempDir()}); status != 1 ||
+		stderr.String() != "no test files found\n" {
+		t.Errorf("wrong result for no test files. status=%d, stderr=%q", status, stderr.String())
+	}
+}
+
+func TestAssertEq(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		passed bool
+	}{
+		{`assert_eq(1.5, 1.5)`, true},
+		{`assert_eq([0.5, {"a": 2.0}], [0.5, {"a": 2.0}])`, true},
+		{`assert_eq(1.5, 2.5)`, false},
+		{`assert_eq(1.0, 1)`, false},
+		{`assert_eq(decimal("1.10"), decimal("1.1"))`, true},
+		{`assert_eq(decimal("1.1"), decimal("1.2"))`, false},
+		{`assert_eq(datetime("2024-01-02T03:04:05Z"), datetime("2024-01-02T12:04:05+09:00"))`, true},
+		{`assert_eq(datetime("2024-01-02T03:04:05Z"), datetime("2024-01-02T03:04:06Z"))`, false},
+		{`assert_eq(duration("1s"), duration(1000))`, true},
+		{`assert_eq(duration("1s"), duration("2s"))`, false},
+	}
+
+	for _, tt := range tests {
+
+		dir := t.TempDir()
+
+		writeFile(t, filepath.Join(dir, "eq_test.monkey"), "let test_eq = fn() { "+tt.input+" };")
+
+		var stdout, stderr bytes.Buffer
+
+		if passed := runTests(&stdout, &stderr, []string{dir}) == 0; passed != tt.passed {
+			t.Errorf("wrong result for %s. want passed=%t, got=\n%s%s", tt.input, tt.passed,
+				stdout.String(), stderr.String())
+		}
+	}
+}
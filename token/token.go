@@ -7,6 +7,9 @@ type Token struct {
 	Type TokenType
 	// トークンの文字列表現
 	Literal string
+	// ソースコード上の位置(1始まり)
+	Line   int
+	Column int
 }
 
 const (
@@ -18,7 +21,13 @@ const (
 	// 識別子(変数の名前、関数の名前）、定数（リテラル）
 	IDENT  = "IDENT" //add, foobar, x, y, ...
 	INT    = "INT"   // 1343456
+	FLOAT  = "FLOAT" // 3.14
 	STRING = "STRING"
+	// ${...}を含む文字列 "Hello ${name}!"
+	INTERP_STRING = "INTERP_STRING"
+	// 行コメント // ...
+	// パーサーには渡さず、Lexer.Comments()で取り出す
+	COMMENT = "COMMENT"
 
 	// 配列のインデックスアクセス
 	LBRACKET = "["
@@ -26,6 +35,9 @@ const (
 
 	COLON = ":"
 
+	// 範囲 1..10
+	DOTDOT = ".."
+
 	// 演算子（オペレーター）
 	ASSIGN   = "="
 	PLUS     = "+"
@@ -33,10 +45,16 @@ const (
 	BANG     = "!"
 	ASTERISK = "*"
 	SLASH    = "/"
+	PERCENT  = "%"
 	LT       = "<"
+	LT_EQ    = "<="
+	GT_EQ    = ">="
 	GT       = ">"
 	EQ       = "=="
 	NOT_EQ   = "!="
+	// 論理演算子(右辺は必要なときだけ評価する)
+	AND = "&&"
+	OR  = "||"
 
 	// 区切り文字（デリミタ）
 	COMMA     = ","
@@ -49,22 +67,54 @@ const (
 	// キーワード（プログラム言語の予約語）
 	FUNCTION = "FUNCTION"
 	LET      = "LET"
+	CONST    = "CONST"
 	TRUE     = "TRUE"
 	FALSE    = "FALSE"
+	NULL     = "NULL"
 	IF       = "IF"
 	ELSE     = "ELSE"
 	RETURN   = "RETURN"
+	FOR      = "FOR"
+	WHILE    = "WHILE"
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
+	IN       = "IN"
+	IMPORT   = "IMPORT"
+	TRY      = "TRY"
+	CATCH    = "CATCH"
+	THROW    = "THROW"
+	SPAWN    = "SPAWN"
+	YIELD    = "YIELD"
+	MACRO    = "MACRO"
+	QUOTE    = "QUOTE"
+	UNQUOTE  = "UNQUOTE"
 )
 
 // キーワード(予約語)とトークンの種類の対応付け
 var keywords = map[string]TokenType{
-	"fn":     FUNCTION,
-	"let":    LET,
-	"true":   TRUE,
-	"false":  FALSE,
-	"if":     IF,
-	"else":   ELSE,
-	"return": RETURN,
+	"fn":       FUNCTION,
+	"let":      LET,
+	"const":    CONST,
+	"true":     TRUE,
+	"false":    FALSE,
+	"null":     NULL,
+	"if":       IF,
+	"else":     ELSE,
+	"return":   RETURN,
+	"for":      FOR,
+	"while":    WHILE,
+	"break":    BREAK,
+	"continue": CONTINUE,
+	"in":       IN,
+	"import":   IMPORT,
+	"try":      TRY,
+	"catch":    CATCH,
+	"throw":    THROW,
+	"spawn":    SPAWN,
+	"yield":    YIELD,
+	"macro":    MACRO,
+	"quote":    QUOTE,
+	"unquote":  UNQUOTE,
 }
 
 // 識別子(連続する文字)が言語のキーワード(予約語)なのか、
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"example.com/monkey/gogen"
+	"example.com/monkey/lexer"
+	"example.com/monkey/parser"
+)
+
+// monkey transpile file
+// 同じ動きをするGoのソースを標準出力に書く。go build でバイナリにできる
+func transpileCommand(args []string) int {
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: monkey transpile file")
+		return 2
+	}
+
+	src, err := ioutil.ReadFile(args[0])
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	p := parser.New(lexer.New(string(src)))
+
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+
+		for _, msg := range p.Errors() {
+			fmt.Fprintf(os.Stderr, "%s: parser error: %s\n", args[0], msg)
+		}
+
+		return 1
+	}
+
+	out, err := gogen.Generate(program)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err)
+		return 1
+	}
+
+	fmt.Print(out)
+
+	return 0
+}
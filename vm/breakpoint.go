@@ -0,0 +1,126 @@
+package vm
+
+import (
+	"fmt"
+
+	"example.com/monkey/code"
+	"example.com/monkey/object"
+)
+
+// ブレークポイント
+// 指定した位置の命令を実行する前に、Runを止めてハンドラーを呼ぶ
+// ハンドラーの中ではStepStateと、VMのLocals/Globalsなどで状態を調べられる
+// (VMを引数にするとVMがヒープに逃げるので、ハンドラーのクロージャで参照する)
+// ハンドラーがnilを返せば、その命令から実行を続ける。エラーを返せばRunはそのエラーで終わる
+//
+//	machine.OnBreakpoint(func(state *vm.StepState) error {
+//		fmt.Println(state.Function, state.Line, machine.Locals())
+//		return nil
+//	})
+//	machine.SetBreakpoint(fnIndex, 3)
+
+type BreakpointHandler func(state *StepState) error
+
+// トップレベルのプログラムを指すfnIndex
+const MainFunction = -1
+
+func (vm *VM) OnBreakpoint(handler BreakpointHandler) {
+	vm.breakpointHandler = handler
+}
+
+// fnIndexの関数(定数プールのインデックス。トップレベルはMainFunction)の、
+// lineの行に入るところにブレークポイントを置く
+// 行の情報はコンパイラーがデバッグ情報を出力したときだけある
+func (vm *VM) SetBreakpoint(fnIndex int, line int) error {
+
+	fn, err := vm.breakpointFunction(fnIndex)
+
+	if err != nil {
+		return err
+	}
+
+	if len(fn.Lines) == 0 {
+		return fmt.Errorf("no line information for function %d", fnIndex)
+	}
+
+	found := false
+
+	for i, e := range fn.Lines {
+
+		if e.Line != line || (i > 0 && fn.Lines[i-1].Line == line) {
+			continue
+		}
+
+		vm.addBreakpoint(fn, e.Offset)
+		found = true
+	}
+
+	if !found {
+		return fmt.Errorf("no instructions on line %d in function %d", line, fnIndex)
+	}
+
+	return nil
+}
+
+// fnIndexの関数の、offsetの位置の命令にブレークポイントを置く
+func (vm *VM) SetBreakpointAt(fnIndex int, offset int) error {
+
+	fn, err := vm.breakpointFunction(fnIndex)
+
+	if err != nil {
+		return err
+	}
+
+	found := false
+
+	fn.Instructions.Iterate(func(at int, _ code.Opcode, _ []int) bool {
+		found = at == offset
+		return at < offset
+	})
+
+	if !found {
+		return fmt.Errorf("offset %d is not an instruction in function %d", offset, fnIndex)
+	}
+
+	vm.addBreakpoint(fn, offset)
+
+	return nil
+}
+
+func (vm *VM) ClearBreakpoints() {
+	vm.breakpoints = nil
+	vm.updateDebugging()
+}
+
+func (vm *VM) breakpointFunction(fnIndex int) (*object.CompiledFunction, error) {
+
+	if fnIndex == MainFunction {
+		return vm.frames[0].cl.Fn, nil
+	}
+
+	if fnIndex < 0 || fnIndex >= len(vm.constants) {
+		return nil, fmt.Errorf("constant %d out of range (%d constants)", fnIndex, len(vm.constants))
+	}
+
+	fn, ok := vm.constants[fnIndex].(*object.CompiledFunction)
+
+	if !ok {
+		return nil, fmt.Errorf("constant %d is not a function: %s", fnIndex, vm.constants[fnIndex].Type())
+	}
+
+	return fn, nil
+}
+
+func (vm *VM) addBreakpoint(fn *object.CompiledFunction, offset int) {
+
+	if vm.breakpoints == nil {
+		vm.breakpoints = map[*object.CompiledFunction]map[int]bool{}
+	}
+
+	if vm.breakpoints[fn] == nil {
+		vm.breakpoints[fn] = map[int]bool{}
+	}
+
+	vm.breakpoints[fn][offset] = true
+	vm.updateDebugging()
+}
@@ -0,0 +1,104 @@
+package vm
+
+import "example.com/monkey/object"
+
+// send(ch, value) と recv(ch)
+// object.Builtinsのものと同じだが、待っている間もVMのcontextを見て、
+// キャンセルされたり期限を過ぎたりしたら止まる
+// (spawnしたタスクは、spawnしたVMのRunが終わるときにキャンセルされる)
+
+// 呼び出し元のVMが必要なので、callBuiltinでこのポインタを見て処理を切り替える
+// 関数として渡されて直接呼ばれたときは、object.Builtinsのものと同じく待ち続ける
+var (
+	sendBuiltin = &object.Builtin{}
+	recvBuiltin = &object.Builtin{}
+)
+
+func init() {
+
+	for i, def := range object.Builtins {
+
+		switch def.Name {
+		case "send":
+			sendBuiltin.Fn = def.Builtin.Fn
+			builtins[i] = sendBuiltin
+		case "recv":
+			recvBuiltin.Fn = def.Builtin.Fn
+			builtins[i] = recvBuiltin
+		}
+	}
+}
+
+func channelArgument(name string, args []object.Object, want int) (*object.Channel, *object.Error) {
+
+	if len(args) != want {
+		return nil, newError("wrong number of arguments. got=%d, want=%d", len(args), want)
+	}
+
+	ch, ok := args[0].(*object.Channel)
+
+	if !ok {
+		return nil, newError("first argument to `%s` must be CHANNEL, got %s", name, args[0].Type())
+	}
+
+	return ch, nil
+}
+
+func (vm *VM) executeSend(args []object.Object) (result object.Object, err error) {
+
+	ch, errObj := channelArgument("send", args, 2)
+
+	if errObj != nil {
+		return errObj, nil
+	}
+
+	// 閉じたチャンネルに送るとGoはpanicするので、エラーにする
+	defer func() {
+		if recover() != nil {
+			result, err = newError("send on closed channel"), nil
+		}
+	}()
+
+	select {
+	case ch.Value <- args[1]:
+		return nil, nil
+	case <-vm.done():
+		return nil, vm.cancelled()
+	}
+}
+
+func (vm *VM) executeRecv(args []object.Object) (object.Object, error) {
+
+	ch, errObj := channelArgument("recv", args, 1)
+
+	if errObj != nil {
+		return errObj, nil
+	}
+
+	select {
+	case value, ok := <-ch.Value:
+
+		if !ok {
+			return nil, nil
+		}
+
+		return value, nil
+
+	case <-vm.done():
+		return nil, vm.cancelled()
+	}
+}
+
+// contextが無ければnil(待ち続ける)
+func (vm *VM) done() <-chan struct{} {
+
+	if vm.ctx == nil {
+		return nil
+	}
+
+	return vm.ctx.Done()
+}
+
+func (vm *VM) cancelled() error {
+	return uncatchable(vm.ctx.Err())
+}
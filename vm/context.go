@@ -0,0 +1,42 @@
+package vm
+
+import "context"
+
+// RunContextでctxを確かめる間隔(命令の数)
+const ContextCheckInterval = 1024
+
+// Runと同じだが、ContextCheckInterval個の命令ごとにctxを確かめ、
+// キャンセルされたり期限を過ぎたりしていればctx.Err()のエラーで止まる
+// 止まったときのエラーはRuntimeErrorなので、errors.Isでcontext.Canceledなどと比べる
+func (vm *VM) RunContext(ctx context.Context) error {
+
+	// キャンセルされることのないctxなら確かめない
+	if ctx.Done() == nil {
+		return vm.Run()
+	}
+
+	vm.ctx = ctx
+	vm.ctxCountdown = 0
+
+	defer func() { vm.ctx = nil }()
+
+	return vm.Run()
+}
+
+// 命令を1つ実行するごとに呼ぶ
+func (vm *VM) checkContext() error {
+
+	vm.ctxCountdown--
+
+	if vm.ctxCountdown > 0 {
+		return nil
+	}
+
+	vm.ctxCountdown = ContextCheckInterval
+
+	if err := vm.ctx.Err(); err != nil {
+		return uncatchable(err)
+	}
+
+	return nil
+}
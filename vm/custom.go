@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"fmt"
+
+	"example.com/monkey/code"
+	"example.com/monkey/object"
+)
+
+// code.RegisterOpcodeで追加した命令の処理
+// argsはスタックから取り出した値(積まれた順)で、返した値を順に積む
+// 返す値の数は命令の定義と同じでなければならない
+type OpcodeHandler func(operands []int, args []object.Object) ([]object.Object, error)
+
+// 定義と同じくプログラムの開始時に登録する
+var customHandlers = map[code.Opcode]OpcodeHandler{}
+
+// 追加した命令の処理を登録する
+func HandleOpcode(op code.Opcode, handler OpcodeHandler) error {
+
+	if !code.IsCustom(op) {
+		return fmt.Errorf("opcode %d is not a custom opcode", op)
+	}
+
+	if _, err := code.Lookup(byte(op)); err != nil {
+		return err
+	}
+
+	customHandlers[op] = handler
+
+	return nil
+}
+
+// ipは命令の位置。読んだオペランドの分だけフレームのipを進める
+func (vm *VM) executeCustom(op code.Opcode, ins code.Instructions, ip int) error {
+
+	def, err := code.Lookup(byte(op))
+
+	if err != nil {
+		return err
+	}
+
+	handler, ok := customHandlers[op]
+
+	if !ok {
+		return fmt.Errorf("no handler for opcode %s", def.Name)
+	}
+
+	operands, read := code.ReadOperands(def, ins[ip+1:])
+	vm.currentFrame().ip += read
+
+	pops, pushes := def.StackEffect(operands)
+
+	if vm.sp < pops {
+		return fmt.Errorf("%s pops %d values from a stack of %d", def.Name, pops, vm.sp)
+	}
+
+	args := make([]object.Object, pops)
+	copy(args, vm.stack[vm.sp-pops:vm.sp])
+	vm.sp -= pops
+
+	results, err := handler(operands, args)
+
+	if err != nil {
+		return err
+	}
+
+	if len(results) != pushes {
+		return fmt.Errorf("%s returned %d values (want %d)", def.Name, len(results), pushes)
+	}
+
+	for _, r := range results {
+		if err := vm.push(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package vm
+
+import (
+	"example.com/monkey/code"
+	"example.com/monkey/object"
+)
+
+// デバッガー向けに1命令ずつ実行する
+//
+//	machine := vm.New(bytecode)
+//	for {
+//		state, err := machine.Step()
+//		if err != nil || state.Done {
+//			break
+//		}
+//		fmt.Println(state.Function, state.IP, state.Op, machine.Locals())
+//	}
+//
+// StepとRunは混ぜて使える。途中までStepで進めてから、残りをRunで実行してもよい
+
+// Stepで1命令を実行した後の状態
+type StepState struct {
+	// 実行中の関数の名前。トップレベルならIsMain
+	Function string
+	IsMain   bool
+	// 呼び出しの深さ。トップレベルは1
+	Depth int
+	// 次に実行する命令の位置と命令。Doneなら意味を持たない
+	IP int
+	Op code.Opcode
+	// 次に実行する命令のソースコード上の行。分からなければ0
+	Line int
+	// スタックに積まれている値のコピー(底から順に)
+	Stack []object.Object
+	// プログラムの最後まで実行した
+	Done bool
+}
+
+// 命令を1つだけ実行する
+// エラーになった場合は、Runと同じくその位置を付けたRuntimeErrorを返す
+func (vm *VM) Step() (*StepState, error) {
+
+	if err := vm.check(); err != nil {
+		return nil, err
+	}
+
+	vm.stepping = true
+	vm.stepped = false
+	vm.updateDebugging()
+
+	err := vm.run()
+
+	vm.stepping = false
+	vm.updateDebugging()
+	vm.profileStop()
+
+	if err != nil {
+		return nil, vm.runtimeError(err)
+	}
+
+	return vm.stepState(), nil
+}
+
+func (vm *VM) updateDebugging() {
+	vm.debugging = vm.stepping || vm.breakpoints != nil || vm.trace != nil || vm.profile != nil ||
+		vm.hooks != nil && vm.hooks.OnInstruction != nil
+}
+
+// 命令を実行する前に呼ぶ。trueを返したらそこでrunを終える
+// Stepのときは2つ目の命令の前で止める。ブレークポイントはStep中には使わない
+// トレースはブレークポイントのハンドラーが続けることにした命令だけ書き出す
+func (vm *VM) beforeInstruction() (bool, error) {
+
+	if vm.stepping {
+
+		if vm.stepped {
+			return true, nil
+		}
+
+		vm.stepped = true
+	}
+
+	frame := vm.currentFrame()
+
+	if !vm.stepping && vm.breakpoints[frame.cl.Fn][frame.ip+1] && vm.breakpointHandler != nil {
+
+		if err := vm.breakpointHandler(vm.stepState()); err != nil {
+			return false, uncatchable(err)
+		}
+	}
+
+	if vm.trace != nil {
+		vm.traceInstruction()
+	}
+
+	if vm.profile != nil {
+		vm.profileInstruction()
+	}
+
+	if vm.hooks != nil && vm.hooks.OnInstruction != nil {
+		vm.hooks.OnInstruction(vm.stepState())
+	}
+
+	return false, nil
+}
+
+func (vm *VM) stepState() *StepState {
+
+	frame := vm.currentFrame()
+	fn := frame.cl.Fn
+	next := frame.ip + 1
+
+	state := &StepState{
+		Function: fn.Name,
+		IsMain:   vm.framesIndex == 1,
+		Depth:    vm.framesIndex,
+		IP:       next,
+		Stack:    append([]object.Object{}, vm.stack[:vm.sp]...),
+		Done:     next >= len(fn.Instructions),
+	}
+
+	if !state.Done {
+		state.Op = code.Opcode(fn.Instructions[next])
+		state.Line = fn.Lines.Line(next)
+	}
+
+	return state
+}
+
+// 実行中の関数の引数とローカル変数(インデックス順)
+// トップレベルではnil
+func (vm *VM) Locals() []object.Object {
+
+	if vm.framesIndex == 1 {
+		return nil
+	}
+
+	frame := vm.currentFrame()
+	numLocals := frame.cl.Fn.NumLocals
+
+	return append([]object.Object{}, vm.stack[frame.basePointer:frame.basePointer+numLocals]...)
+}
+
+// 実行中のクロージャの自由変数
+func (vm *VM) Free() []object.Object {
+	return append([]object.Object{}, vm.currentFrame().cl.Free...)
+}
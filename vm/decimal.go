@@ -0,0 +1,99 @@
+package vm
+
+import (
+	"fmt"
+	"math/big"
+
+	"example.com/monkey/code"
+	"example.com/monkey/object"
+)
+
+// DECIMALとDECIMAL、またはDECIMALとINTEGERの演算
+// INTEGERはDECIMALに変換してから計算する
+func isDecimalOperation(left, right object.Object) bool {
+
+	lt, rt := left.Type(), right.Type()
+
+	if lt != object.DECIMAL_OBJ && rt != object.DECIMAL_OBJ {
+		return false
+	}
+
+	return (lt == object.DECIMAL_OBJ || lt == object.INTEGER_OBJ) &&
+		(rt == object.DECIMAL_OBJ || rt == object.INTEGER_OBJ)
+}
+
+func toRat(obj object.Object) *big.Rat {
+
+	switch obj := obj.(type) {
+	case *object.Decimal:
+		return obj.Value
+	case *object.Integer:
+		return new(big.Rat).SetInt64(obj.Value)
+	}
+
+	return nil
+}
+
+func (vm *VM) executeBinaryDecimalOperation(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+
+	leftValue := toRat(left)
+	rightValue := toRat(right)
+
+	result := new(big.Rat)
+
+	switch op {
+
+	case code.OpAdd:
+		result.Add(leftValue, rightValue)
+
+	case code.OpSub:
+		result.Sub(leftValue, rightValue)
+
+	case code.OpMul:
+		result.Mul(leftValue, rightValue)
+
+	case code.OpDiv:
+		if rightValue.Sign() == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result.Quo(leftValue, rightValue)
+
+	default:
+		return fmt.Errorf("unknown decimal operator: %d", op)
+	}
+
+	return vm.push(&object.Decimal{Value: result})
+}
+
+func (vm *VM) executeDecimalComparison(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+
+	cmp := toRat(left).Cmp(toRat(right))
+
+	switch op {
+
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(cmp == 0))
+
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(cmp != 0))
+
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(cmp > 0))
+
+	case code.OpGreaterEqual:
+		return vm.push(nativeBoolToBooleanObject(cmp >= 0))
+
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+func negateDecimal(d *object.Decimal) *object.Decimal {
+	return &object.Decimal{Value: new(big.Rat).Neg(d.Value)}
+}
@@ -0,0 +1,50 @@
+package vm
+
+import "fmt"
+
+// 実行時エラーと、エラーになった命令のソースコード上の位置
+type RuntimeError struct {
+	Err error
+	// 分からなければ0
+	Line int
+	// エラーになった関数の名前。トップレベルならIsMain
+	Function string
+	IsMain   bool
+}
+
+func (e *RuntimeError) Error() string {
+
+	switch {
+	case e.Line == 0:
+		return e.Err.Error()
+	case e.IsMain:
+		return fmt.Sprintf("runtime error at line %d: %s", e.Line, e.Err)
+	case e.Function == "":
+		return fmt.Sprintf("runtime error at line %d in anonymous fn: %s", e.Line, e.Err)
+	default:
+		return fmt.Sprintf("runtime error at line %d in fn %s: %s", e.Line, e.Function, e.Err)
+	}
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// 実行中のフレームの位置をエラーに付ける
+// 関数を呼び出した先(pmapなど)で位置が付いていればそのまま返す
+func (vm *VM) runtimeError(err error) error {
+
+	if _, ok := err.(*RuntimeError); ok {
+		return err
+	}
+
+	frame := vm.currentFrame()
+	fn := frame.cl.Fn
+
+	return &RuntimeError{
+		Err:      err,
+		Line:     fn.Lines.Line(frame.ip),
+		Function: fn.Name,
+		IsMain:   vm.framesIndex == 1,
+	}
+}
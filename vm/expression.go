@@ -0,0 +1,96 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"example.com/monkey/ast"
+	"example.com/monkey/compiler"
+	"example.com/monkey/object"
+)
+
+// varsを変数として参照できるようにして式を評価する
+func EvalExpression(exp ast.Expression, vars map[string]object.Object) (object.Object, error) {
+
+	bytecode, globals, err := compileExpression(exp, vars, nil, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	vm := NewWithGlobalsStore(bytecode, globals)
+
+	// テンプレートの中の式なので、行の位置は付けない
+	if err := vm.Run(); err != nil {
+		return nil, errors.Unwrap(err)
+	}
+
+	return vm.LastPoppedStackElem(), nil
+}
+
+// EvalExpressionと同じだが、このVMの燃料とメモリの上限を引き継いだVMで評価する (render)
+func (vm *VM) evalExpression(exp ast.Expression, vars map[string]object.Object) (object.Object, error) {
+
+	// テンプレートの中でrenderを呼ぶ入れ子も呼び出しの深さと同じ上限で止める
+	if vm.forkDepth >= vm.options.MaxFrames {
+		return nil, uncatchable(fmt.Errorf("render nested too deeply: %d levels", vm.forkDepth))
+	}
+
+	// dataに入れた関数の定数を参照できるよう、このVMの定数の後ろに追加する
+	// 組み込み関数はこのVMの表のインデックスで参照する(Sandboxでは許可したものだけ)
+	bytecode, globals, err := compileExpression(exp, vars, vm.builtinNames, vm.constants)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fork := vm.fork(globals)
+	fork.constants = bytecode.Constants
+	fork.frames[0] = NewFrame(&object.Closure{Fn: &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+	}}, 0)
+	fork.framesIndex = 1
+	fork.checked = false
+
+	err = fork.Run()
+
+	vm.join(fork)
+
+	if rerr, ok := err.(*RuntimeError); ok {
+		return nil, rerr.Err
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fork.LastPoppedStackElem(), nil
+}
+
+// 式をコンパイルし、変数の値を入れたグローバル変数の領域と一緒に返す
+func compileExpression(exp ast.Expression, vars map[string]object.Object, builtins []string, constants []object.Object) (*compiler.Bytecode, []object.Object, error) {
+
+	// グローバル変数のインデックスが毎回同じになるように名前順に並べる
+	names := make([]string, 0, len(vars))
+
+	for name := range vars {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	bytecode, err := compiler.CompileExpressionWithState(exp, names, builtins, constants)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	globals := make([]object.Object, len(names))
+
+	for i, name := range names {
+		globals[i] = vars[name]
+	}
+
+	return bytecode, globals, nil
+}
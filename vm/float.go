@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+
+	"example.com/monkey/code"
+	"example.com/monkey/object"
+)
+
+// FLOATとFLOAT、またはFLOATとINTEGERの演算
+// INTEGERはFLOATに変換してから計算する
+func isFloatOperation(left, right object.Object) bool {
+
+	lt, rt := left.Type(), right.Type()
+
+	if lt != object.FLOAT_OBJ && rt != object.FLOAT_OBJ {
+		return false
+	}
+
+	return (lt == object.FLOAT_OBJ || lt == object.INTEGER_OBJ) &&
+		(rt == object.FLOAT_OBJ || rt == object.INTEGER_OBJ)
+}
+
+func toFloat(obj object.Object) float64 {
+
+	switch obj := obj.(type) {
+	case *object.Float:
+		return obj.Value
+	case *object.Integer:
+		return float64(obj.Value)
+	}
+
+	return 0
+}
+
+func (vm *VM) executeBinaryFloatOperation(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	var result float64
+
+	switch op {
+
+	case code.OpAdd:
+		result = leftValue + rightValue
+
+	case code.OpSub:
+		result = leftValue - rightValue
+
+	case code.OpMul:
+		result = leftValue * rightValue
+
+	// 整数、DECIMALと同じく、0で割ったらInfではなくエラーにする
+	case code.OpDiv:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result = leftValue / rightValue
+
+	case code.OpMod:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result = math.Mod(leftValue, rightValue)
+
+	default:
+		return fmt.Errorf("unknown float operator: %d", op)
+	}
+
+	return vm.push(&object.Float{Value: result})
+}
+
+func (vm *VM) executeFloatComparison(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	switch op {
+
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue == rightValue))
+
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
+
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+
+	case code.OpGreaterEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
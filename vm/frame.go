@@ -17,6 +17,23 @@ func NewFrame(cl *object.Closure, basePointer int) *Frame {
 		basePointer: basePointer}
 }
 
+// 呼び出しのたびにフレームを作らず、次の深さに残っている戻ったフレームを使い回す
+// 戻ったフレームはpopFrameの直後にしか参照しないので、上書きしてもよい
+func (vm *VM) nextFrame(cl *object.Closure, basePointer int) *Frame {
+
+	if vm.framesIndex < len(vm.frames) {
+
+		if f := vm.frames[vm.framesIndex]; f != nil {
+			f.cl = cl
+			f.ip = -1
+			f.basePointer = basePointer
+			return f
+		}
+	}
+
+	return NewFrame(cl, basePointer)
+}
+
 func (f *Frame) Instructions() code.Instructions {
 	return f.cl.Fn.Instructions
 }
@@ -0,0 +1,213 @@
+package vm
+
+import (
+	"errors"
+
+	"example.com/monkey/object"
+)
+
+// generator
+//
+// yieldがある関数を呼び出すと、本体を実行せずにGeneratorを返す
+// 最初にnext(g)を呼んだときに、定数とグローバル変数を共有したVMを作って本体を実行し、
+// OpYieldでそのVMのフレームとスタックを残したまま止める
+// 次のnext(g, v)ではvをyield式の値として積み、止めた位置から続ける
+// 関数から戻ると終わり、それ以降のnextはnullを返す(戻り値は使わない)
+//
+// for-inでも受け取れる。yieldした値を順に返し、関数から戻るとループが終わる
+//
+// generatorのVMは作ったVMのグローバル変数を使うので、作ったVMと同じgoroutineでしか再開できない
+// pmapのワーカーやspawnしたタスクで再開するとエラーにする(始めていなければ複製を渡す。pmap.go)
+
+// 止めた関数を実行するVM
+type generatorState struct {
+	vm      *VM
+	running bool
+	// 再開できるVMの印。nilなら最初に再開したVMのもの
+	owner *thread
+}
+
+// OpYieldで実行を止めたことを表す(エラーではない)
+var errYield = errors.New("yield outside generator")
+
+// 呼び出し元のVMが必要なので、callBuiltinでこのポインタを見て処理を切り替える
+var nextBuiltin = &object.Builtin{Fn: func(args ...object.Object) object.Object {
+	return newError("next is only available in the VM")
+}}
+
+func init() {
+
+	for i, def := range object.Builtins {
+
+		if def.Name == "next" {
+			builtins[i] = nextBuiltin
+		}
+	}
+}
+
+// スタックの関数と引数をGeneratorに置き換える
+func (vm *VM) newGenerator(cl *object.Closure, numArgs int) error {
+
+	args := make([]object.Object, numArgs)
+	copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+
+	vm.sp = vm.sp - numArgs - 1
+
+	g := &object.Generator{Fn: cl, Args: args, State: &generatorState{owner: vm.currentThread()}}
+
+	if err := vm.allocate(g); err != nil {
+		return err
+	}
+
+	return vm.push(g)
+}
+
+func (vm *VM) executeNext(args []object.Object) (object.Object, error) {
+
+	if len(args) != 1 && len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=1 or 2", len(args)), nil
+	}
+
+	g, ok := args[0].(*object.Generator)
+
+	if !ok {
+		return newError("first argument to `next` must be GENERATOR, got %s", args[0].Type()), nil
+	}
+
+	var sent object.Object = Null
+
+	if len(args) == 2 {
+		sent = args[1]
+	}
+
+	value, ok, err := vm.resume(g, sent)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return Null, nil
+	}
+
+	return value, nil
+}
+
+// 次のyieldまで実行し、yieldした値を返す。関数から戻っていればfalse
+func (vm *VM) resume(g *object.Generator, sent object.Object) (object.Object, bool, error) {
+
+	state, _ := g.State.(*generatorState)
+
+	if state == nil {
+		state = &generatorState{}
+		g.State = state
+	}
+
+	if state.owner == nil {
+		state.owner = vm.currentThread()
+	}
+
+	// 他のgoroutineで動いているかもしれないので、他の値を見る前に確かめる
+	if state.owner != vm.currentThread() {
+		return nil, false, errors.New("generator belongs to another pmap worker or task")
+	}
+
+	if g.Done {
+		return nil, false, nil
+	}
+
+	if state.vm == nil {
+
+		state.vm = vm.fork(vm.globals)
+
+		if err := state.vm.start(g); err != nil {
+			g.Done = true
+			state.vm = nil
+			return nil, false, err
+		}
+	} else {
+
+		if state.running {
+			return nil, false, errors.New("generator is already running")
+		}
+
+		// yield式の値
+		if err := state.vm.push(sent); err != nil {
+			return nil, false, err
+		}
+	}
+
+	fork := state.vm
+
+	// 燃料とメモリは呼び出し元のVMの残りを使う
+	fork.fuel = vm.fuel
+	fork.allocated = vm.allocated
+	fork.budget = vm.budget
+	fork.tasks = vm.tasks
+
+	state.running = true
+	err := fork.run()
+	state.running = false
+
+	vm.fuel = fork.fuel
+	vm.allocated = fork.allocated
+	// generatorの中でspawnしたタスクは呼び出し元のRunが終わるときに止める
+	vm.tasks = fork.tasks
+	vm.mergeStats(fork)
+
+	if fork.stats != nil {
+		fork.EnableReport()
+	}
+
+	if err == errYield {
+		return fork.pop(), true, nil
+	}
+
+	// 終わったらフレームとスタックを手放す
+	g.Done = true
+	state.vm = nil
+
+	if err != nil {
+		// 止めた関数の中の位置を残す
+		return nil, false, fork.runtimeError(err)
+	}
+
+	return nil, false, nil
+}
+
+// 空のメインフレームの上でgeneratorの関数のフレームを作る
+func (vm *VM) start(g *object.Generator) error {
+
+	vm.sp = 0
+	vm.frames[0] = NewFrame(&object.Closure{Fn: &object.CompiledFunction{}}, 0)
+	vm.framesIndex = 1
+
+	if err := vm.push(g.Fn); err != nil {
+		return err
+	}
+
+	for _, arg := range g.Args {
+
+		if err := vm.push(arg); err != nil {
+			return err
+		}
+	}
+
+	return vm.enterClosure(g.Fn, len(g.Args))
+}
+
+// 同じgoroutineで順に動くVM(呼び出し元と、generatorやCallで作ったVM)の印
+// pmapのワーカーとspawnしたタスクは別の印を持つ
+// (大きさが0の値はアドレスが同じになることがあるので、1バイト持たせる)
+type thread struct {
+	_ byte
+}
+
+func (vm *VM) currentThread() *thread {
+
+	if vm.thread == nil {
+		vm.thread = &thread{}
+	}
+
+	return vm.thread
+}
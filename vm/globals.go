@@ -0,0 +1,36 @@
+package vm
+
+import "example.com/monkey/object"
+
+// 実行後のグローバル変数の領域
+// NewWithGlobalsStoreに渡した領域が足りずに伸ばした場合は、伸ばした後の領域を返す
+func (vm *VM) Globals() []object.Object {
+	return vm.globals
+}
+
+// グローバル変数の領域にn個の変数が入るようにする
+// オペランドは2バイトなので、GlobalsSizeを超えて伸ばすことはない
+func (vm *VM) ensureGlobals(n int) {
+
+	if n <= len(vm.globals) {
+		return
+	}
+
+	size := 2 * len(vm.globals)
+
+	if size < 16 {
+		size = 16
+	}
+
+	if size < n {
+		size = n
+	}
+
+	if size > GlobalsSize && n <= GlobalsSize {
+		size = GlobalsSize
+	}
+
+	grown := make([]object.Object, size)
+	copy(grown, vm.globals)
+	vm.globals = grown
+}
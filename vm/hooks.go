@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"example.com/monkey/code"
+	"example.com/monkey/object"
+)
+
+// 実行を外から観察するための関数
+// 実行ループを変えずに、プロファイラー、トレーサー、カバレッジなどを作れる
+// NewWithOptionsのOptions.Hooksで設定する。使わない関数はnilにしておく
+//
+//	covered := map[int]bool{}
+//	machine := vm.NewWithOptions(bytecode, vm.Options{Hooks: &vm.Hooks{
+//		OnInstruction: func(state *vm.StepState) {
+//			if state.IsMain {
+//				covered[state.Line] = true
+//			}
+//		},
+//	}})
+//
+// 呼び出しごとにスタックをコピーしたStepStateを作るので、有効にすると実行は遅くなる
+// 値を書き換えたり実行を止めたりはできない(止めるならブレークポイントを使う)
+// pmap、spawn、generatorの中の実行は別のVMで行うので含まない
+type Hooks struct {
+	// 関数を呼び出して、最初の命令を実行する前。stateは呼び出された関数
+	OnCall func(state *StepState)
+	// 関数から戻った後。stateは戻った先で、valueは戻り値
+	// 例外でフレームを捨てたときは呼ばない
+	OnReturn func(state *StepState, value object.Object)
+	// 命令を実行する前。stateのIPとOpがこれから実行する命令
+	OnInstruction func(state *StepState)
+	// 命令がエラーになったとき。tryで受け取る例外も含む
+	// stateのIPとOpはエラーになった命令。errには位置を付けない
+	OnError func(state *StepState, err error)
+}
+
+func (vm *VM) hookCall() {
+
+	if vm.hooks.OnCall != nil {
+		vm.hooks.OnCall(vm.stepState())
+	}
+}
+
+func (vm *VM) hookReturn(value object.Object) {
+
+	if vm.hooks.OnReturn != nil {
+		vm.hooks.OnReturn(vm.stepState(), value)
+	}
+}
+
+func (vm *VM) hookError(err error) {
+
+	if vm.hooks.OnError == nil {
+		return
+	}
+
+	state := vm.stepState()
+
+	// stepStateは次の命令を指すので、実行していた命令に戻す
+	frame := vm.currentFrame()
+	fn := frame.cl.Fn
+
+	state.IP = frame.ip
+	state.Done = false
+
+	if frame.ip >= 0 && frame.ip < len(fn.Instructions) {
+		state.Op = code.Opcode(fn.Instructions[frame.ip])
+		state.Line = fn.Lines.Line(frame.ip)
+	}
+
+	vm.hooks.OnError(state, err)
+}
@@ -0,0 +1,210 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"example.com/monkey/object"
+)
+
+// 信頼できないスクリプトを実行するときの制限
+// どちらも0なら無制限
+
+// 実行できる命令数(燃料)の上限を設定する
+func (vm *VM) SetFuel(n int) {
+	vm.fuel = n
+	vm.configuredFuel = n
+	vm.limitFuel = n > 0
+	vm.maxInstructions = 0
+	vm.budget = nil
+}
+
+// 実行できる命令数の上限を設定する。超えたら "instruction budget exceeded" のエラーで止まる
+// 燃料と同じ仕組みなので、SetFuelとは一緒に使えない(後から呼んだ方が有効になる)
+// ループが無限に続くかもしれない信頼できないスクリプトを実行するときに使う
+func (vm *VM) SetMaxInstructions(n int) {
+	vm.SetFuel(n)
+	vm.maxInstructions = n
+}
+
+// 文字列・配列・ハッシュ・クロージャに割り当てられる合計バイト数の上限を設定する
+// GCで回収された分は差し引かないので、実行中の累計で判定する
+func (vm *VM) SetMemoryLimit(bytes int) {
+	vm.memoryLimit = bytes
+}
+
+// 呼び出しの深さが上限に達したときのエラー
+// 外側から呼び出した関数の名前を並べる。長ければ先頭の何段かだけ
+func (vm *VM) callDepthError() error {
+
+	const shown = 5
+
+	names := []string{}
+
+	for _, frame := range vm.frames[1:vm.framesIndex] {
+
+		if len(names) == shown {
+			names = append(names, "...")
+			break
+		}
+
+		name := frame.cl.Fn.Name
+
+		if name == "" {
+			name = "anonymous fn"
+		}
+
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		names = append(names, "main")
+	}
+
+	return uncatchable(fmt.Errorf("recursion limit of %d exceeded in %s",
+		vm.options.MaxFrames, strings.Join(names, " -> ")))
+}
+
+// 命令を1つ実行するごとに呼ぶ
+func (vm *VM) consumeFuel() error {
+
+	if vm.fuel == 0 && vm.budget != nil {
+		vm.fuel = vm.budget.draw()
+	}
+
+	if vm.fuel == 0 {
+		return vm.fuelError()
+	}
+
+	vm.fuel--
+
+	return nil
+}
+
+func (vm *VM) fuelError() error {
+
+	if vm.maxInstructions > 0 {
+		return uncatchable(fmt.Errorf("instruction budget exceeded: %d instructions", vm.maxInstructions))
+	}
+
+	return uncatchable(fmt.Errorf("out of fuel"))
+}
+
+// VMが作ったオブジェクトの大きさを記録し、上限を超えたらエラーにする
+func (vm *VM) allocate(obj object.Object) error {
+
+	vm.recordAllocation(obj)
+
+	return vm.charge(objectSize(obj))
+}
+
+// バイト数を記録し、上限を超えたらエラーにする
+func (vm *VM) charge(size int) error {
+
+	if vm.memoryLimit == 0 {
+		return nil
+	}
+
+	if vm.budget != nil {
+		vm.allocated = int(atomic.AddInt64(&vm.budget.allocated, int64(size)))
+	} else {
+		vm.allocated += size
+	}
+
+	if vm.allocated > vm.memoryLimit {
+		return uncatchable(fmt.Errorf("memory limit exceeded: %d bytes", vm.memoryLimit))
+	}
+
+	return nil
+}
+
+// おおよそのバイト数
+// 要素自体はそれぞれ作られたときに数えているので、ここでは参照の分だけ数える
+func objectSize(obj object.Object) int {
+
+	const word = 8
+
+	switch obj := obj.(type) {
+
+	case *object.String:
+		return 2*word + len(obj.Value)
+
+	case *object.Array:
+		return 3*word + word*len(obj.Elements)
+
+	case *object.Hash:
+		return word + 6*word*len(obj.Pairs)
+
+	case *object.Closure:
+		return 4*word + word*len(obj.Free)
+
+	// バッファの分も数える
+	case *object.Channel:
+		return 12*word + 2*word*cap(obj.Value)
+
+	default:
+		return 2 * word
+	}
+}
+
+// pmapやspawnで並列に動くVMと呼び出し元で共有する燃料とメモリ
+// それぞれのVMが残りを全部使えないように、燃料はここから少しずつ取り出す
+type budget struct {
+	// 32ビット環境でもatomicに扱えるよう先頭に置く
+	fuel      int64
+	allocated int64
+}
+
+// 一度に取り出す燃料
+const fuelChunk = 1024
+
+// 共有の燃料とメモリに切り替える。手元の燃料は共有の方に移す
+func (vm *VM) shareBudget() *budget {
+
+	if vm.budget == nil {
+		vm.budget = &budget{fuel: int64(vm.fuel), allocated: int64(vm.allocated)}
+		vm.fuel = 0
+	}
+
+	return vm.budget
+}
+
+// 取り出して使わなかった燃料を共有の方に返す
+func (vm *VM) returnFuel() {
+
+	if vm.budget != nil && vm.fuel > 0 {
+		atomic.AddInt64(&vm.budget.fuel, int64(vm.fuel))
+		vm.fuel = 0
+	}
+}
+
+// 残りが無ければ0
+func (b *budget) draw() int {
+
+	for {
+		remaining := atomic.LoadInt64(&b.fuel)
+
+		if remaining <= 0 {
+			return 0
+		}
+
+		n := remaining
+
+		if n > fuelChunk {
+			n = fuelChunk
+		}
+
+		if atomic.CompareAndSwapInt64(&b.fuel, remaining, remaining-n) {
+			return int(n)
+		}
+	}
+}
+
+// forkしたVMのスタックとフレームの領域のバイト数
+func (vm *VM) forkSize() int {
+
+	const word = 8
+
+	return 2*word*vm.options.StackSize + word*MaxFrames
+}
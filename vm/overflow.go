@@ -0,0 +1,59 @@
+package vm
+
+import (
+	"fmt"
+
+	"example.com/monkey/code"
+	"example.com/monkey/object"
+)
+
+// 整数の演算がint64の範囲を超えたときの扱い (Options.IntegerOverflow)
+type OverflowMode int
+
+const (
+	// 範囲を超えた値は折り返す(Goのint64と同じ)
+	OverflowWrap OverflowMode = iota
+	// "integer overflow" の実行時エラーにする。tryで受け取れる
+	OverflowError
+	// 多倍長のDECIMALにして計算を続ける
+	// DECIMAL同士の / は割り切れなければ分数のまま計算する
+	OverflowPromote
+)
+
+// 整数同士の演算が範囲を超えたとき、設定に従って結果を積むかエラーを返す
+func (vm *VM) integerOverflow(op code.Opcode, left, right object.Object) error {
+
+	if vm.options.IntegerOverflow == OverflowPromote {
+		return vm.executeBinaryDecimalOperation(op, left, right)
+	}
+
+	return fmt.Errorf("integer overflow: %s %s %s",
+		overflowOperand(left), overflowOperators[op], overflowOperand(right))
+}
+
+// 範囲を超えることがある演算と、エラーに表示するソース上の演算子
+var overflowOperators = map[code.Opcode]string{
+	code.OpAdd: "+",
+	code.OpSub: "-",
+	code.OpMul: "*",
+	code.OpDiv: "/",
+}
+
+// 負の数は演算子と続かないように括弧で囲む
+func overflowOperand(obj object.Object) string {
+
+	if i, ok := obj.(*object.Integer); ok && i.Value < 0 {
+		return "(" + i.Inspect() + ")"
+	}
+
+	return obj.Inspect()
+}
+
+func (vm *VM) negationOverflow(operand *object.Integer) error {
+
+	if vm.options.IntegerOverflow == OverflowPromote {
+		return vm.push(negateDecimal(&object.Decimal{Value: toRat(operand)}))
+	}
+
+	return fmt.Errorf("integer overflow: -%s", overflowOperand(operand))
+}
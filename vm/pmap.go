@@ -0,0 +1,389 @@
+package vm
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"example.com/monkey/object"
+)
+
+// pmap(arr, fn, workers?)
+// arrの各要素にfnを適用した配列を返す(順序はarrと同じ)
+// 呼び出し元のVMから定数を共有し、その時点のグローバル変数を複製した
+// VMをworkers個(省略時はGOMAXPROCS)作って並列に実行する
+// 関数の中でグローバル変数や自由変数に代入できるので、複製はVMごとに作る
+// グローバル変数や要素から辿れるクロージャも複製する (stateCopier)
+// (代入しても呼び出し元や他のVMには反映されない)
+//
+// 燃料とメモリは呼び出し元と全部のVMで共有する (budget)
+// VMのスタックとフレームの領域もメモリの上限に数える
+
+// 呼び出し元のVMが必要なので、callBuiltinでこのポインタを見て処理を切り替える
+var pmapBuiltin = &object.Builtin{Fn: func(args ...object.Object) object.Object {
+	return newError("pmap is only available in the VM")
+}}
+
+func init() {
+
+	for i, def := range object.Builtins {
+
+		if def.Name == "pmap" {
+			builtins[i] = pmapBuiltin
+		}
+	}
+}
+
+func (vm *VM) executeParallelMap(args []object.Object) (object.Object, error) {
+
+	if len(args) != 2 && len(args) != 3 {
+		return newError("wrong number of arguments. got=%d, want=2 or 3", len(args)), nil
+	}
+
+	arr, ok := args[0].(*object.Array)
+
+	if !ok {
+		return newError("first argument to `pmap` must be ARRAY, got %s", args[0].Type()), nil
+	}
+
+	switch args[1].(type) {
+	case *object.Closure, *object.Builtin:
+	default:
+		return newError("second argument to `pmap` must be FUNCTION, got %s", args[1].Type()), nil
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+
+	if len(args) == 3 {
+
+		n, ok := args[2].(*object.Integer)
+
+		if !ok || n.Value < 1 {
+			return newError("third argument to `pmap` must be a positive INTEGER, got %s",
+				args[2].Inspect()), nil
+		}
+
+		// 32ビット環境でintに変換したときに桁あふれしないよう、先に要素数で抑える
+		workers = len(arr.Elements)
+
+		if n.Value < int64(workers) {
+			workers = int(n.Value)
+		}
+	}
+
+	if workers > len(arr.Elements) {
+		workers = len(arr.Elements)
+	}
+
+	// pmapの中のpmapも呼び出しの深さと同じ上限で止める
+	if vm.forkDepth >= vm.options.MaxFrames {
+		return nil, uncatchable(fmt.Errorf("pmap nested too deeply: %d levels", vm.forkDepth))
+	}
+
+	vm.shareBudget()
+
+	for w := 0; w < workers; w++ {
+
+		if err := vm.charge(vm.forkSize()); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]object.Object, len(arr.Elements))
+	errs := make([]error, len(arr.Elements))
+	forks := make([]*VM, workers)
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+
+		copier := newStateCopier()
+
+		forks[w] = vm.fork(copier.copyAll(vm.globals))
+		forks[w].thread = &thread{}
+		wg.Add(1)
+
+		go func(fork *VM, copier *stateCopier, fn object.Object) {
+
+			defer wg.Done()
+
+			for i := range jobs {
+				results[i], errs[i] = fork.call(fn, copier.copy(arr.Elements[i]))
+			}
+		}(forks[w], copier, copier.copy(args[1]))
+	}
+
+	for i := range arr.Elements {
+		jobs <- i
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	for _, fork := range forks {
+		vm.join(fork)
+	}
+
+	for _, err := range errs {
+
+		// 関数の中でのエラーはその位置を残す
+		if rerr, ok := err.(*RuntimeError); ok {
+			wrapped := *rerr
+			wrapped.Err = fmt.Errorf("pmap: %w", rerr.Err)
+			return nil, &wrapped
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("pmap: %w", err)
+		}
+	}
+
+	return &object.Array{Elements: results}, nil
+}
+
+// 別のgoroutineで動くVMに渡す値を複製する
+// OpSetFreeで書き換えられる自由変数を持つクロージャと、まだ始めていないgeneratorを複製し、
+// それを辿れる配列とハッシュも作り直す。それ以外の値は書き換えられないので共有する
+// 始めたgeneratorは元のVMでしか再開できないので複製しない (generator.go)
+//
+// 同じ値は同じ複製にする(循環していても止まる)
+type stateCopier struct {
+	copies map[object.Object]object.Object
+	needs  map[object.Object]bool
+}
+
+func newStateCopier() *stateCopier {
+	return &stateCopier{
+		copies: map[object.Object]object.Object{},
+		needs:  map[object.Object]bool{},
+	}
+}
+
+func (c *stateCopier) copyAll(objs []object.Object) []object.Object {
+
+	copied := make([]object.Object, len(objs))
+
+	for i, obj := range objs {
+		copied[i] = c.copy(obj)
+	}
+
+	return copied
+}
+
+func (c *stateCopier) copy(obj object.Object) object.Object {
+
+	if !c.needsCopy(obj) {
+		return obj
+	}
+
+	if copied, ok := c.copies[obj]; ok {
+		return copied
+	}
+
+	// 循環して戻ってきたときのために、中身を複製する前に登録しておく
+	switch obj := obj.(type) {
+
+	case *object.Closure:
+
+		copied := &object.Closure{Fn: obj.Fn}
+		c.copies[obj] = copied
+		copied.Free = c.copyAll(obj.Free)
+
+		return copied
+
+	case *object.Generator:
+
+		// 最初に再開したVMのものになる
+		copied := &object.Generator{}
+		c.copies[obj] = copied
+		copied.Fn = c.copy(obj.Fn).(*object.Closure)
+		copied.Args = c.copyAll(obj.Args)
+
+		return copied
+
+	case *object.Array:
+
+		copied := &object.Array{}
+		c.copies[obj] = copied
+		copied.Elements = c.copyAll(obj.Elements)
+
+		return copied
+
+	case *object.Hash:
+
+		copied := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair, len(obj.Pairs))}
+		c.copies[obj] = copied
+
+		for key, pair := range obj.Pairs {
+			copied.Pairs[key] = object.HashPair{Key: pair.Key, Value: c.copy(pair.Value)}
+		}
+
+		return copied
+	}
+
+	return obj
+}
+
+// 複製が必要な値を含むか
+// 循環はかならず自由変数を持つクロージャを通るので、辿っている途中の値はfalseとしておく
+func (c *stateCopier) needsCopy(obj object.Object) bool {
+
+	switch obj := obj.(type) {
+
+	case *object.Closure:
+		return len(obj.Free) > 0
+
+	case *object.Generator:
+		state, _ := obj.State.(*generatorState)
+		return !obj.Done && (state == nil || state.vm == nil)
+
+	case *object.Array:
+
+		if needs, ok := c.needs[obj]; ok {
+			return needs
+		}
+
+		c.needs[obj] = false
+
+		for _, element := range obj.Elements {
+
+			if c.needsCopy(element) {
+				c.needs[obj] = true
+				return true
+			}
+		}
+
+		return false
+
+	case *object.Hash:
+
+		if needs, ok := c.needs[obj]; ok {
+			return needs
+		}
+
+		c.needs[obj] = false
+
+		for _, pair := range obj.Pairs {
+
+			if c.needsCopy(pair.Value) {
+				c.needs[obj] = true
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return false
+}
+
+// 定数と組み込み関数と制限を引き継いだVMを作る
+// 共有の燃料を使っている場合は、必要になったときにそこから取り出す
+func (vm *VM) fork(globals []object.Object) *VM {
+
+	fork := &VM{
+		constants:       vm.constants,
+		stack:           make([]object.Object, vm.options.StackSize),
+		globals:         globals,
+		frames:          make([]*Frame, MaxFrames),
+		builtins:        vm.builtins,
+		builtinNames:    vm.builtinNames,
+		fuel:            vm.fuel,
+		maxInstructions: vm.maxInstructions,
+		ctx:             vm.ctx,
+		limitFuel:       vm.limitFuel,
+		memoryLimit:     vm.memoryLimit,
+		allocated:       vm.allocated,
+		budget:          vm.budget,
+		forkDepth:       vm.forkDepth + 1,
+		// 定数は元のVMで確かめてある
+		checked: true,
+		thread:  vm.currentThread(),
+		options: vm.options,
+	}
+
+	if vm.budget != nil {
+		fork.fuel = 0
+	}
+
+	if vm.stats != nil {
+		fork.EnableReport()
+	}
+
+	return fork
+}
+
+// forkしたVMで使った燃料とメモリを反映する
+func (vm *VM) join(fork *VM) {
+
+	if vm.budget != nil {
+		fork.returnFuel()
+	} else {
+		vm.fuel = fork.fuel
+		vm.allocated = fork.allocated
+	}
+
+	vm.mergeStats(fork)
+}
+
+// 関数を呼び出して戻り値を返す
+// 空のメインフレームの上で呼ぶので、関数から戻るとRunが終わる
+func (vm *VM) call(fn object.Object, args ...object.Object) (object.Object, error) {
+
+	if builtin, ok := fn.(*object.Builtin); ok {
+
+		if result := builtin.Fn(args...); result != nil {
+			return result, nil
+		}
+
+		return Null, nil
+	}
+
+	cl := fn.(*object.Closure)
+
+	vm.sp = 0
+	vm.frames[0] = NewFrame(&object.Closure{Fn: &object.CompiledFunction{}}, 0)
+	vm.framesIndex = 1
+
+	if err := vm.push(cl); err != nil {
+		return nil, err
+	}
+
+	for _, arg := range args {
+
+		if err := vm.push(arg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := vm.callClosure(cl, len(args)); err != nil {
+		return nil, err
+	}
+
+	if err := vm.Run(); err != nil {
+		return nil, err
+	}
+
+	return vm.StackTop(), nil
+}
+
+// 実行が終わったVMの関数を呼び出して戻り値を返す
+// ホストからコールバックを呼ぶときに使う
+// 呼び出し中に使った燃料とメモリはこのVMから差し引く
+func (vm *VM) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+
+	switch fn.(type) {
+	case *object.Closure, *object.Builtin:
+	default:
+		return nil, fmt.Errorf("calling non-closure and non-built-in")
+	}
+
+	fork := vm.fork(vm.globals)
+
+	result, err := fork.call(fn, args...)
+
+	vm.join(fork)
+
+	return result, err
+}
@@ -0,0 +1,200 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"example.com/monkey/code"
+	"example.com/monkey/object"
+)
+
+// 命令ごと・関数ごとの実行回数と時間
+// 命令の時間は、その命令を始めてから次の命令を始めるまで
+// (呼び出しは呼び出し先の最初の命令まで)を測る
+// 命令ごとに時刻を取るので、有効にすると実行はかなり遅くなる
+// pmapのワーカーで実行した分は含まない
+
+type Profile struct {
+	// 時間の長い順
+	Opcodes   []ProfileEntry
+	Functions []ProfileEntry
+}
+
+type ProfileEntry struct {
+	Name  string
+	Count int
+	Time  time.Duration
+}
+
+type profileCounter struct {
+	count int
+	time  time.Duration
+}
+
+type profiler struct {
+	opcodes   [256]profileCounter
+	functions map[*object.CompiledFunction]*profileCounter
+	names     map[*object.CompiledFunction]string
+
+	// 測っている途中の命令
+	running bool
+	op      code.Opcode
+	fn      *object.CompiledFunction
+	start   time.Time
+}
+
+// 以降の実行を測るようにする
+func (vm *VM) EnableProfile() {
+	vm.profile = &profiler{
+		functions: map[*object.CompiledFunction]*profileCounter{},
+		names:     map[*object.CompiledFunction]string{},
+	}
+	vm.updateDebugging()
+}
+
+// ここまでの記録を返す。EnableProfileしていなければ空
+func (vm *VM) Profile() Profile {
+
+	profile := Profile{Opcodes: []ProfileEntry{}, Functions: []ProfileEntry{}}
+
+	p := vm.profile
+
+	if p == nil {
+		return profile
+	}
+
+	for op, c := range p.opcodes {
+
+		if c.count == 0 {
+			continue
+		}
+
+		def, _ := code.Lookup(byte(op))
+
+		profile.Opcodes = append(profile.Opcodes, ProfileEntry{def.Name, c.count, c.time})
+	}
+
+	for fn, c := range p.functions {
+		profile.Functions = append(profile.Functions, ProfileEntry{p.names[fn], c.count, c.time})
+	}
+
+	sortProfileEntries(profile.Opcodes)
+	sortProfileEntries(profile.Functions)
+
+	return profile
+}
+
+// 時間の長い順。同じなら回数の多い順、名前の順
+func sortProfileEntries(entries []ProfileEntry) {
+
+	sort.Slice(entries, func(i, j int) bool {
+
+		a, b := entries[i], entries[j]
+
+		if a.Time != b.Time {
+			return a.Time > b.Time
+		}
+
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+
+		return a.Name < b.Name
+	})
+}
+
+// 命令ごとと関数ごとの表
+func (p Profile) String() string {
+
+	var out bytes.Buffer
+
+	write := func(title string, entries []ProfileEntry) {
+
+		var total time.Duration
+		for _, e := range entries {
+			total += e.Time
+		}
+
+		fmt.Fprintf(&out, "%-24s %10s %12s %7s\n", title, "count", "time", "%")
+
+		for _, e := range entries {
+
+			percent := 0.0
+			if total > 0 {
+				percent = 100 * float64(e.Time) / float64(total)
+			}
+
+			fmt.Fprintf(&out, "%-24s %10d %12s %6.1f%%\n", e.Name, e.Count, e.Time, percent)
+		}
+	}
+
+	write("opcode", p.Opcodes)
+	out.WriteString("\n")
+	write("function", p.Functions)
+
+	return out.String()
+}
+
+// 前の命令の時間を記録し、これから実行する命令を測り始める
+func (vm *VM) profileInstruction() {
+
+	now := time.Now()
+
+	vm.profileRecord(now)
+
+	frame := vm.currentFrame()
+	fn := frame.cl.Fn
+
+	p := vm.profile
+	p.running = true
+	p.op = code.Opcode(fn.Instructions[frame.ip+1])
+	p.fn = fn
+	p.start = now
+
+	if _, ok := p.functions[fn]; !ok {
+		p.functions[fn] = &profileCounter{}
+		p.names[fn] = vm.profileName(fn)
+	}
+}
+
+// RunやStepが終わったときに、最後の命令の時間を記録する
+func (vm *VM) profileStop() {
+
+	if vm.profile != nil {
+		vm.profileRecord(time.Now())
+	}
+}
+
+func (vm *VM) profileRecord(now time.Time) {
+
+	p := vm.profile
+
+	if !p.running {
+		return
+	}
+
+	elapsed := now.Sub(p.start)
+
+	p.opcodes[p.op].count++
+	p.opcodes[p.op].time += elapsed
+
+	c := p.functions[p.fn]
+	c.count++
+	c.time += elapsed
+
+	p.running = false
+}
+
+func (vm *VM) profileName(fn *object.CompiledFunction) string {
+
+	switch {
+	case fn == vm.frames[0].cl.Fn:
+		return "main"
+	case fn.Name == "":
+		return "anonymous fn"
+	default:
+		return fn.Name
+	}
+}
@@ -0,0 +1,85 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"example.com/monkey/object"
+	"example.com/monkey/parser"
+)
+
+// render(template, data)
+// templateの${...}をdataのキーを変数として評価した結果に置き換える
+// 式は呼び出し元のVMの燃料とメモリの上限を引き継いだVMで実行する
+
+// 呼び出し元のVMが必要なので、callBuiltinでこのポインタを見て処理を切り替える
+var renderBuiltin = &object.Builtin{Fn: func(args ...object.Object) object.Object {
+	return newError("render is only available in the VM")
+}}
+
+func init() {
+
+	for i, def := range object.Builtins {
+
+		if def.Name == "render" {
+			builtins[i] = renderBuiltin
+		}
+	}
+}
+
+func (vm *VM) executeRender(args []object.Object) (object.Object, error) {
+
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2", len(args)), nil
+	}
+
+	template, ok := args[0].(*object.String)
+
+	if !ok {
+		return newError("first argument to `render` must be STRING, got %s",
+			args[0].Type()), nil
+	}
+
+	data, ok := args[1].(*object.Hash)
+
+	if !ok {
+		return newError("second argument to `render` must be HASH, got %s",
+			args[1].Type()), nil
+	}
+
+	exp, parseErrors := parser.ParseTemplate(template.Value)
+
+	if len(parseErrors) != 0 {
+		return newError("render: %s", strings.Join(parseErrors, "; ")), nil
+	}
+
+	// 文字列のキーだけを変数にする
+	vars := map[string]object.Object{}
+
+	for _, pair := range data.Pairs {
+
+		if key, ok := pair.Key.(*object.String); ok {
+			vars[key.Value] = pair.Value
+		}
+	}
+
+	result, err := vm.evalExpression(exp, vars)
+
+	// 燃料やメモリを使い切ったときは呼び出し元も止める
+	var fatal *uncatchableError
+
+	if errors.As(err, &fatal) {
+		return nil, fatal
+	}
+
+	if err != nil {
+		return newError("render: %s", err), nil
+	}
+
+	return result, nil
+}
+
+func newError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
@@ -0,0 +1,145 @@
+package vm
+
+import (
+	"fmt"
+
+	"example.com/monkey/object"
+)
+
+// 実行にかかったコストの記録
+// 複数の利用者のスクリプトを動かすホストが、課金や制限に使う
+type Report struct {
+	// 実行した命令の数
+	Instructions int
+	// スタックの要素数とフレーム数の最大値
+	PeakStack  int
+	PeakFrames int
+	// 作ったオブジェクトの数(文字列・配列・ハッシュ・クロージャ・組み込み関数の戻り値など)
+	Allocations map[object.ObjectType]int
+	// 組み込み関数ごとの呼び出し回数
+	BuiltinCalls map[string]int
+}
+
+type stats struct {
+	instructions int
+	peakStack    int
+	peakFrames   int
+	allocations  map[object.ObjectType]int
+	builtinCalls map[*object.Builtin]int
+}
+
+// 以降の実行を記録するようにする
+// 記録のためのmapが割り当て上限の計算に影響しないよう、必要なときだけ有効にする
+func (vm *VM) EnableReport() {
+	vm.stats = &stats{
+		allocations:  map[object.ObjectType]int{},
+		builtinCalls: map[*object.Builtin]int{},
+	}
+}
+
+// 組み込み関数の名前をbuiltinsと同じ順に設定する(Reportの表示用)
+// 設定しなければobject.Builtinsの名前を使う
+func (vm *VM) SetBuiltinNames(names []string) {
+	vm.builtinNames = names
+}
+
+// ここまでの実行の記録を返す。EnableReportしていなければ空
+func (vm *VM) Report() Report {
+
+	report := Report{
+		Allocations:  map[object.ObjectType]int{},
+		BuiltinCalls: map[string]int{},
+	}
+
+	if vm.stats == nil {
+		return report
+	}
+
+	// 最後の命令で積んだ分は命令ごとの記録に入らない
+	vm.recordStack()
+
+	report.Instructions = vm.stats.instructions
+	report.PeakStack = vm.stats.peakStack
+	report.PeakFrames = vm.stats.peakFrames
+
+	for t, n := range vm.stats.allocations {
+		report.Allocations[t] = n
+	}
+
+	for i, b := range vm.builtins {
+
+		if n := vm.stats.builtinCalls[b.(*object.Builtin)]; n > 0 {
+			report.BuiltinCalls[vm.builtinName(i)] = n
+		}
+	}
+
+	return report
+}
+
+func (vm *VM) builtinName(index int) string {
+
+	if index < len(vm.builtinNames) {
+		return vm.builtinNames[index]
+	}
+
+	if index < len(object.Builtins) {
+		return object.Builtins[index].Name
+	}
+
+	return fmt.Sprintf("builtin#%d", index)
+}
+
+func (vm *VM) recordAllocation(obj object.Object) {
+
+	if vm.stats != nil {
+		vm.stats.allocations[obj.Type()]++
+	}
+}
+
+func (vm *VM) recordBuiltinCall(b *object.Builtin) {
+
+	if vm.stats != nil {
+		vm.stats.builtinCalls[b]++
+	}
+}
+
+func (vm *VM) recordStack() {
+
+	if vm.stats == nil {
+		return
+	}
+
+	if vm.sp > vm.stats.peakStack {
+		vm.stats.peakStack = vm.sp
+	}
+
+	if vm.framesIndex > vm.stats.peakFrames {
+		vm.stats.peakFrames = vm.framesIndex
+	}
+}
+
+// forkしたVMの記録を足し合わせる(最大値は大きい方)
+func (vm *VM) mergeStats(fork *VM) {
+
+	if vm.stats == nil || fork.stats == nil {
+		return
+	}
+
+	vm.stats.instructions += fork.stats.instructions
+
+	if fork.stats.peakStack > vm.stats.peakStack {
+		vm.stats.peakStack = fork.stats.peakStack
+	}
+
+	if fork.stats.peakFrames > vm.stats.peakFrames {
+		vm.stats.peakFrames = fork.stats.peakFrames
+	}
+
+	for t, n := range fork.stats.allocations {
+		vm.stats.allocations[t] += n
+	}
+
+	for b, n := range fork.stats.builtinCalls {
+		vm.stats.builtinCalls[b] += n
+	}
+}
@@ -0,0 +1,109 @@
+package vm
+
+import (
+	"fmt"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/object"
+)
+
+// 信頼できないスクリプトを、許可した組み込み関数だけで実行する
+//
+//	sandbox, err := vm.NewSandbox("len", "push", "first")
+//	comp := sandbox.Compiler()
+//	err = comp.Compile(program) // putsなどを使うとコンパイルエラー
+//	machine := sandbox.VM(comp.Bytecode())
+//	machine.SetMaxInstructions(100000)
+//	err = machine.Run()
+//
+// 許可していない組み込み関数はシンボルテーブルに定義しないので、使おうとすると
+// undefined variable のコンパイルエラーになる。VMの組み込み関数の表も許可したものだけにする
+// spawnはコンパイルエラーにし、VMでも実行しない
+//
+// 命令数やメモリの上限は、作ったVMに別に設定する
+// pmapとrenderは別のVMで実行するが、上限は呼び出し元のVMと共有する
+// (pmapのワーカーのスタックもメモリに数える)
+// 上限で止まらないのは組み込み関数そのものの処理(Goのコード)なので、
+// 時間のかかるものや待ち続けるものやホストの資源を使うもの(recv, send, putsなど)は許可しないこと
+type Sandbox struct {
+	names    []string
+	builtins []*object.Builtin
+}
+
+// allowedはobject.Builtinsの名前。並べた順にインデックスを振る
+func NewSandbox(allowed ...string) (*Sandbox, error) {
+
+	// pmapとnextはVMが差し替えたものを使う
+	resolved := Builtins()
+
+	s := &Sandbox{}
+
+	for _, name := range allowed {
+
+		index := -1
+
+		for i, def := range object.Builtins {
+			if def.Name == name {
+				index = i
+				break
+			}
+		}
+
+		if index < 0 {
+			return nil, fmt.Errorf("unknown built-in function: %s", name)
+		}
+
+		for _, n := range s.names {
+			if n == name {
+				return nil, fmt.Errorf("built-in function %s is allowed twice", name)
+			}
+		}
+
+		s.names = append(s.names, name)
+		s.builtins = append(s.builtins, resolved[index])
+	}
+
+	return s, nil
+}
+
+// 許可した組み込み関数だけを定義したシンボルテーブル
+// REPLのように入力をまたいで定義を持ち続けるときは、これをcompiler.NewWithStateに渡す
+func (s *Sandbox) SymbolTable() *compiler.SymbolTable {
+
+	symbolTable := compiler.NewSymbolTable()
+
+	for i, name := range s.names {
+		symbolTable.DefineBuiltin(i, name)
+	}
+
+	return symbolTable
+}
+
+func (s *Sandbox) Compiler() *compiler.Compiler {
+
+	comp := compiler.NewWithState(s.SymbolTable(), []object.Object{})
+
+	opts := compiler.DefaultOptions()
+	opts.DisallowSpawn = true
+	comp.SetOptions(opts)
+
+	return comp
+}
+
+// このSandboxのCompilerでコンパイルしたBytecodeを実行するVM
+func (s *Sandbox) VM(bytecode *compiler.Bytecode) *VM {
+
+	vm := NewWithBuiltins(bytecode, s.builtins)
+
+	vm.SetBuiltinNames(s.names)
+
+	// SymbolTableで別に作ったコンパイラーでコンパイルしても、spawnは実行しない
+	vm.options.DisableSpawn = true
+
+	return vm
+}
+
+// 許可した組み込み関数の名前
+func (s *Sandbox) Builtins() []string {
+	return append([]string{}, s.names...)
+}
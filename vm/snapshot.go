@@ -0,0 +1,757 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/big"
+	"time"
+
+	"example.com/monkey/object"
+)
+
+// 実行中のVMの状態を書き出して、後で(別のプロセスでも)続きから実行する
+//
+//	machine := vm.New(bytecode)
+//	machine.Step() // 途中まで進める
+//	machine.Snapshot(&buf)
+//
+//	resumed := vm.New(bytecode) // 同じBytecodeから作る
+//	resumed.Restore(&buf)
+//	resumed.Run() // 続きから実行する
+//
+// 書き出すのはグローバル変数、スタック、フレーム(関数とip)、tryのハンドラー
+// 値は参照をたどって一度ずつ書き出すので、同じ配列を指していた変数は戻しても同じ配列を指す
+// 定数と命令列は書き出さないので、同じBytecodeから作ったVMにしか戻せない
+// 燃料やメモリの上限などの設定は含めない
+// チャンネルとgeneratorは他のgoroutineや止めた関数の実行を持つので書き出せない
+//
+// 形式:
+//
+//	magic "MNKS", バージョン(1バイト)
+//	定数の数、トップレベルの命令列と定数のハッシュ(別のプログラムに戻さないため)
+//	値の数、各値の種類と中身(配列などの要素は含めない)、配列などの要素(値の番号)
+//	グローバル変数、スタック、フレーム、ハンドラー
+//
+// 値の番号は1から。0はnil(まだ代入していないグローバル変数など)
+
+const SnapshotMagic = "MNKS"
+
+// 形式を変えたら上げる
+const SnapshotVersion = 1
+
+var ErrNotSnapshot = errors.New("not a monkey vm snapshot")
+
+const (
+	snapshotNull byte = iota + 1
+	snapshotTrue
+	snapshotFalse
+	snapshotInteger
+	snapshotFloat
+	snapshotString
+	snapshotDecimal
+	snapshotDateTime
+	snapshotDuration
+	snapshotError
+	snapshotRange
+	snapshotBuiltin
+	snapshotArray
+	snapshotHash
+	snapshotClosure
+	// トップレベルのクロージャ(定数にない)
+	snapshotMain
+	snapshotIterator
+)
+
+type snapshotWriter struct {
+	vm  *VM
+	w   bytes.Buffer
+	buf [binary.MaxVarintLen64]byte
+
+	ids     map[object.Object]int
+	objects []object.Object
+
+	constants map[*object.CompiledFunction]int
+	builtins  map[object.Object]int
+}
+
+// VMの状態をwに書き出す
+// Stepやブレークポイントで止めている間か、Runが終わった後に呼ぶ
+func (vm *VM) Snapshot(w io.Writer) error {
+
+	s := &snapshotWriter{
+		vm:        vm,
+		ids:       map[object.Object]int{},
+		constants: map[*object.CompiledFunction]int{},
+		builtins:  map[object.Object]int{},
+	}
+
+	for i, c := range vm.constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			s.constants[fn] = i
+		}
+	}
+
+	for i, b := range vm.builtins {
+		s.builtins[b] = i
+	}
+
+	roots := [][]object.Object{vm.globals, vm.stack[:vm.sp]}
+
+	for _, frame := range vm.frames[:vm.framesIndex] {
+		roots = append(roots, []object.Object{frame.cl})
+	}
+
+	for _, objs := range roots {
+		for _, o := range objs {
+			if err := s.collect(o); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.w.WriteString(SnapshotMagic)
+	s.w.WriteByte(SnapshotVersion)
+
+	s.uint(len(vm.constants))
+	s.uint64(vm.programHash())
+
+	s.uint(len(s.objects))
+
+	for _, o := range s.objects {
+		s.value(o)
+	}
+
+	for _, o := range s.objects {
+		s.elements(o)
+	}
+
+	s.refs(vm.globals)
+	s.refs(vm.stack[:vm.sp])
+
+	s.uint(vm.framesIndex)
+
+	for _, frame := range vm.frames[:vm.framesIndex] {
+		s.ref(frame.cl)
+		s.uint(frame.ip + 1)
+		s.uint(frame.basePointer)
+	}
+
+	s.uint(len(vm.handlers))
+
+	for _, h := range vm.handlers {
+		s.uint(h.framesIndex)
+		s.uint(h.sp)
+		s.uint(h.ip)
+	}
+
+	_, err := w.Write(s.w.Bytes())
+
+	return err
+}
+
+// 値と、そこから参照している値に番号を付ける
+func (s *snapshotWriter) collect(o object.Object) error {
+
+	if o == nil {
+		return nil
+	}
+
+	if _, ok := s.ids[o]; ok {
+		return nil
+	}
+
+	s.objects = append(s.objects, o)
+	s.ids[o] = len(s.objects)
+
+	switch o := o.(type) {
+
+	case *object.Null, *object.Boolean, *object.Integer, *object.Float, *object.String,
+		*object.Decimal, *object.DateTime, *object.Duration, *object.Error, *object.Range:
+
+	case *object.Builtin:
+		if _, ok := s.builtins[o]; !ok {
+			return fmt.Errorf("cannot snapshot unknown built-in function")
+		}
+
+	case *object.Array:
+		for _, el := range o.Elements {
+			if err := s.collect(el); err != nil {
+				return err
+			}
+		}
+
+	case *object.Hash:
+		for _, key := range o.Keys() {
+			if err := s.collect(key); err != nil {
+				return err
+			}
+			if err := s.collect(o.Pairs[key.(object.Hashable).HashKey()].Value); err != nil {
+				return err
+			}
+		}
+
+	case *object.Closure:
+		if _, ok := s.constants[o.Fn]; !ok && o != s.vm.frames[0].cl {
+			return fmt.Errorf("cannot snapshot function that is not a constant")
+		}
+		for _, free := range o.Free {
+			if err := s.collect(free); err != nil {
+				return err
+			}
+		}
+
+	case *object.Iterator:
+		if o.Generator != nil {
+			return fmt.Errorf("cannot snapshot %s", object.GENERATOR_OBJ)
+		}
+		if o.Range != nil {
+			if err := s.collect(o.Range); err != nil {
+				return err
+			}
+		}
+		for _, el := range o.Elements {
+			if err := s.collect(el); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("cannot snapshot %s", o.Type())
+	}
+
+	return nil
+}
+
+// 値の種類と、他の値を参照しない中身
+func (s *snapshotWriter) value(o object.Object) {
+
+	switch o := o.(type) {
+
+	case *object.Null:
+		s.w.WriteByte(snapshotNull)
+
+	case *object.Boolean:
+		if o.Value {
+			s.w.WriteByte(snapshotTrue)
+		} else {
+			s.w.WriteByte(snapshotFalse)
+		}
+
+	case *object.Integer:
+		s.w.WriteByte(snapshotInteger)
+		s.int(o.Value)
+
+	case *object.Float:
+		s.w.WriteByte(snapshotFloat)
+		s.uint64(math.Float64bits(o.Value))
+
+	case *object.String:
+		s.w.WriteByte(snapshotString)
+		s.string(o.Value)
+
+	case *object.Decimal:
+		s.w.WriteByte(snapshotDecimal)
+		s.string(o.Value.RatString())
+
+	case *object.DateTime:
+		s.w.WriteByte(snapshotDateTime)
+		data, _ := o.Value.MarshalBinary()
+		s.string(string(data))
+
+	case *object.Duration:
+		s.w.WriteByte(snapshotDuration)
+		s.int(int64(o.Value))
+
+	case *object.Error:
+		s.w.WriteByte(snapshotError)
+		s.string(o.Message)
+
+	case *object.Range:
+		s.w.WriteByte(snapshotRange)
+		s.int(o.Start)
+		s.int(o.End)
+
+	case *object.Builtin:
+		s.w.WriteByte(snapshotBuiltin)
+		s.uint(s.builtins[o])
+
+	case *object.Array:
+		s.w.WriteByte(snapshotArray)
+
+	case *object.Hash:
+		s.w.WriteByte(snapshotHash)
+
+	case *object.Closure:
+		if o == s.vm.frames[0].cl {
+			s.w.WriteByte(snapshotMain)
+			return
+		}
+		s.w.WriteByte(snapshotClosure)
+		s.uint(s.constants[o.Fn])
+
+	case *object.Iterator:
+		s.w.WriteByte(snapshotIterator)
+		s.int(o.Index)
+	}
+}
+
+// 配列などが参照している値の番号
+func (s *snapshotWriter) elements(o object.Object) {
+
+	switch o := o.(type) {
+
+	case *object.Array:
+		s.refs(o.Elements)
+
+	case *object.Hash:
+		keys := o.Keys()
+		s.uint(len(keys))
+		for _, key := range keys {
+			s.ref(key)
+			s.ref(o.Pairs[key.(object.Hashable).HashKey()].Value)
+		}
+
+	case *object.Closure:
+		s.refs(o.Free)
+
+	case *object.Iterator:
+		if o.Range != nil {
+			s.ref(o.Range)
+		} else {
+			s.ref(nil)
+		}
+		s.refs(o.Elements)
+	}
+}
+
+func (s *snapshotWriter) ref(o object.Object) {
+
+	if o == nil {
+		s.uint(0)
+		return
+	}
+
+	s.uint(s.ids[o])
+}
+
+func (s *snapshotWriter) refs(objs []object.Object) {
+
+	s.uint(len(objs))
+
+	for _, o := range objs {
+		s.ref(o)
+	}
+}
+
+func (s *snapshotWriter) string(str string) {
+	s.uint(len(str))
+	s.w.WriteString(str)
+}
+
+func (s *snapshotWriter) uint(n int) {
+	s.uint64(uint64(n))
+}
+
+func (s *snapshotWriter) uint64(n uint64) {
+	size := binary.PutUvarint(s.buf[:], n)
+	s.w.Write(s.buf[:size])
+}
+
+func (s *snapshotWriter) int(n int64) {
+	size := binary.PutVarint(s.buf[:], n)
+	s.w.Write(s.buf[:size])
+}
+
+// トップレベルの命令列と定数のハッシュ
+func (vm *VM) programHash() uint64 {
+
+	h := fnv.New64a()
+	h.Write(vm.frames[0].cl.Fn.Instructions)
+
+	for _, c := range vm.constants {
+
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			h.Write(fn.Instructions)
+		} else {
+			io.WriteString(h, c.Inspect())
+		}
+
+		h.Write([]byte{0})
+	}
+
+	return h.Sum64()
+}
+
+type snapshotReader struct {
+	vm *VM
+	// 残りのバイト数で長さを確かめるので、全体を読んでから解析する
+	r *bytes.Reader
+	// 最初に起きたエラー。以降の読み込みは何もしない
+	err error
+
+	objects []object.Object
+}
+
+// Snapshotで書き出した状態に戻す。続きはRunかStepで実行する
+// 同じBytecodeから作ったVMで呼ぶ。読み込みに失敗したときはVMの状態を変えない
+func (vm *VM) Restore(r io.Reader) error {
+
+	data, err := io.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+
+	s := &snapshotReader{vm: vm, r: bytes.NewReader(data)}
+
+	magic := make([]byte, len(SnapshotMagic)+1)
+
+	if _, err := io.ReadFull(s.r, magic); err != nil || string(magic[:len(SnapshotMagic)]) != SnapshotMagic {
+		return ErrNotSnapshot
+	}
+
+	if version := magic[len(SnapshotMagic)]; version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d, want %d", version, SnapshotVersion)
+	}
+
+	if s.uint() != len(vm.constants) || s.uint64() != vm.programHash() {
+		if s.err == nil {
+			return fmt.Errorf("snapshot was taken from a different program")
+		}
+	}
+
+	n := s.count()
+
+	for i := 0; i < n && s.err == nil; i++ {
+		s.objects = append(s.objects, s.value())
+	}
+
+	for _, o := range s.objects {
+		s.elements(o)
+	}
+
+	globals := s.refs()
+	stack := s.refs()
+
+	var frames []*Frame
+
+	n = s.count()
+
+	if n > vm.options.MaxFrames {
+		s.fail(fmt.Errorf("too many frames: %d", n))
+	}
+
+	for i := 0; i < n && s.err == nil; i++ {
+
+		cl, ok := s.ref().(*object.Closure)
+		ip := s.uint() - 1
+		basePointer := s.uint()
+
+		if s.err != nil {
+			break
+		}
+
+		if !ok || ip >= len(cl.Fn.Instructions) || basePointer > len(stack) {
+			s.fail(fmt.Errorf("invalid frame %d", i))
+			break
+		}
+
+		frames = append(frames, &Frame{cl: cl, ip: ip, basePointer: basePointer})
+	}
+
+	var handlers []handler
+
+	n = s.count()
+
+	for i := 0; i < n && s.err == nil; i++ {
+
+		h := handler{framesIndex: s.uint(), sp: s.uint(), ip: s.uint()}
+
+		if h.framesIndex > len(frames) || h.sp > len(stack) {
+			s.fail(fmt.Errorf("invalid handler %d", i))
+		}
+
+		handlers = append(handlers, h)
+	}
+
+	if s.err == nil && (len(frames) == 0 || frames[0].cl != vm.frames[0].cl) {
+		s.fail(fmt.Errorf("snapshot has no main frame"))
+	}
+
+	if s.err != nil {
+		return fmt.Errorf("snapshot: %s", s.err)
+	}
+
+	if err := vm.ensureStack(len(stack)); err != nil {
+		return err
+	}
+
+	// NewWithGlobalsStoreで渡された領域はそのまま使う
+	vm.ensureGlobals(len(globals))
+	count := copy(vm.globals, globals)
+
+	for i := count; i < len(vm.globals); i++ {
+		vm.globals[i] = nil
+	}
+
+	vm.sp = copy(vm.stack, stack)
+
+	for i := vm.sp; i < len(vm.stack); i++ {
+		vm.stack[i] = nil
+	}
+
+	if len(frames) > len(vm.frames) {
+		vm.frames = make([]*Frame, len(frames))
+	}
+
+	vm.framesIndex = copy(vm.frames, frames)
+	vm.handlers = handlers
+
+	return nil
+}
+
+func (s *snapshotReader) value() object.Object {
+
+	kind := s.byte()
+
+	if s.err != nil {
+		return nil
+	}
+
+	switch kind {
+
+	case snapshotNull:
+		return Null
+
+	case snapshotTrue:
+		return True
+
+	case snapshotFalse:
+		return False
+
+	case snapshotInteger:
+		return newInteger(s.int())
+
+	case snapshotFloat:
+		return &object.Float{Value: math.Float64frombits(s.uint64())}
+
+	case snapshotString:
+		return &object.String{Value: s.string()}
+
+	case snapshotDecimal:
+		r, ok := new(big.Rat).SetString(s.string())
+		if !ok {
+			s.fail(fmt.Errorf("invalid decimal"))
+		}
+		return &object.Decimal{Value: r}
+
+	case snapshotDateTime:
+		var t time.Time
+		s.fail(t.UnmarshalBinary([]byte(s.string())))
+		return &object.DateTime{Value: t}
+
+	case snapshotDuration:
+		return &object.Duration{Value: time.Duration(s.int())}
+
+	case snapshotError:
+		return &object.Error{Message: s.string()}
+
+	case snapshotRange:
+		return &object.Range{Start: s.int(), End: s.int()}
+
+	case snapshotBuiltin:
+		i := s.uint()
+		if i >= len(s.vm.builtins) {
+			s.fail(fmt.Errorf("unknown built-in function %d", i))
+			return nil
+		}
+		return s.vm.builtins[i]
+
+	case snapshotArray:
+		return &object.Array{}
+
+	case snapshotHash:
+		return &object.Hash{Pairs: map[object.HashKey]object.HashPair{}}
+
+	case snapshotClosure:
+		i := s.uint()
+		if i >= len(s.vm.constants) {
+			s.fail(fmt.Errorf("unknown constant %d", i))
+			return nil
+		}
+		fn, ok := s.vm.constants[i].(*object.CompiledFunction)
+		if !ok {
+			s.fail(fmt.Errorf("constant %d is not a function", i))
+			return nil
+		}
+		return &object.Closure{Fn: fn}
+
+	case snapshotMain:
+		return s.vm.frames[0].cl
+
+	case snapshotIterator:
+		return &object.Iterator{Index: s.int()}
+	}
+
+	s.fail(fmt.Errorf("unknown value kind %d", kind))
+
+	return nil
+}
+
+func (s *snapshotReader) elements(o object.Object) {
+
+	switch o := o.(type) {
+
+	case *object.Array:
+		o.Elements = s.refs()
+
+	case *object.Hash:
+		n := s.count()
+		for i := 0; i < n && s.err == nil; i++ {
+			key, ok := s.ref().(object.Hashable)
+			value := s.ref()
+			if !ok {
+				s.fail(fmt.Errorf("unusable as hash key"))
+				return
+			}
+			o.Pairs[key.HashKey()] = object.HashPair{Key: key.(object.Object), Value: value}
+		}
+
+	case *object.Closure:
+		// トップレベルのクロージャは自由変数を持たない
+		if o == s.vm.frames[0].cl {
+			s.refs()
+			return
+		}
+		o.Free = s.refs()
+
+	case *object.Iterator:
+		o.Range, _ = s.ref().(*object.Range)
+		o.Elements = s.refs()
+	}
+}
+
+func (s *snapshotReader) ref() object.Object {
+
+	id := s.uint()
+
+	if s.err != nil || id == 0 {
+		return nil
+	}
+
+	if id > len(s.objects) {
+		s.fail(fmt.Errorf("invalid reference %d", id))
+		return nil
+	}
+
+	return s.objects[id-1]
+}
+
+// 長さが壊れていても大きな領域を先に確保しないように、読めた分だけ使う
+func (s *snapshotReader) refs() []object.Object {
+
+	n := s.count()
+
+	objs := []object.Object{}
+
+	for i := 0; i < n && s.err == nil; i++ {
+		objs = append(objs, s.ref())
+	}
+
+	return objs
+}
+
+func (s *snapshotReader) string() string {
+
+	n := s.count()
+
+	if s.err != nil {
+		return ""
+	}
+
+	var buf bytes.Buffer
+
+	if _, err := io.CopyN(&buf, s.r, int64(n)); err != nil {
+		s.fail(err)
+	}
+
+	return buf.String()
+}
+
+func (s *snapshotReader) byte() byte {
+
+	if s.err != nil {
+		return 0
+	}
+
+	b, err := s.r.ReadByte()
+
+	s.fail(err)
+
+	return b
+}
+
+// 要素の数や文字列の長さ。どの要素も1バイト以上あるので、残りのバイト数を超えることはない
+func (s *snapshotReader) count() int {
+
+	n := s.uint()
+
+	if s.err == nil && n > s.r.Len() {
+		s.fail(fmt.Errorf("length %d exceeds the remaining %d bytes", n, s.r.Len()))
+	}
+
+	return n
+}
+
+func (s *snapshotReader) uint() int {
+
+	n := s.uint64()
+
+	if s.err == nil && n > math.MaxInt32 {
+		s.fail(fmt.Errorf("length out of range: %d", n))
+	}
+
+	return int(n)
+}
+
+func (s *snapshotReader) uint64() uint64 {
+
+	if s.err != nil {
+		return 0
+	}
+
+	n, err := binary.ReadUvarint(s.r)
+
+	s.fail(err)
+
+	return n
+}
+
+func (s *snapshotReader) int() int64 {
+
+	if s.err != nil {
+		return 0
+	}
+
+	n, err := binary.ReadVarint(s.r)
+
+	s.fail(err)
+
+	return n
+}
+
+func (s *snapshotReader) fail(err error) {
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if s.err == nil && err != nil {
+		s.err = err
+	}
+}
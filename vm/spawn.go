@@ -0,0 +1,122 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"example.com/monkey/object"
+)
+
+// spawn fn() { ... }
+// 引数の無い関数をgoroutineの上で別のVMで実行する
+// 定数は共有し、グローバル変数はpmapと同じくその時点の複製を使う
+// 戻り値(エラーならERRORオブジェクト)は容量1のチャンネルに送ってから閉じるので、
+// recvで受け取って終わるのを待てる
+//
+// 燃料とメモリはpmapと同じく呼び出し元と共有する (budget)
+// タスクはspawnしたVMのRunが終わるときにキャンセルする(send/recvで待っているときも止まる)
+// 呼び出し元のcontextがキャンセルされたときも止まる
+// クロージャはpmapと同じく複製したものを使う (stateCopier)
+func (vm *VM) executeSpawn() error {
+
+	if vm.options.DisableSpawn {
+		return fmt.Errorf("spawn is disabled")
+	}
+
+	fn := vm.pop()
+
+	switch fn := fn.(type) {
+	case *object.Closure:
+
+		if fn.Fn.NumParameters != 0 {
+			return fmt.Errorf("spawned function must take no arguments, got %d",
+				fn.Fn.NumParameters)
+		}
+
+	case *object.Builtin:
+	default:
+		return fmt.Errorf("cannot spawn %s", fn.Type())
+	}
+
+	if vm.forkDepth >= vm.options.MaxFrames {
+		return uncatchable(fmt.Errorf("spawn nested too deeply: %d levels", vm.forkDepth))
+	}
+
+	vm.shareBudget()
+
+	if err := vm.charge(vm.forkSize()); err != nil {
+		return err
+	}
+
+	copier := newStateCopier()
+
+	fork := vm.fork(copier.copyAll(vm.globals))
+	fork.thread = &thread{}
+	fn = copier.copy(fn)
+	fork.ctx = vm.taskContext()
+	fork.ctxCountdown = 0
+
+	ch := &object.Channel{Value: make(chan object.Object, 1)}
+
+	go func() {
+
+		defer close(ch.Value)
+
+		ch.Value <- fork.runTask(fn)
+	}()
+
+	return vm.push(ch)
+}
+
+// タスクの戻り値。エラーやpanicはERRORオブジェクトにする
+// (panicでプロセスごと止めないよう、goroutineの中で受け止める)
+func (vm *VM) runTask(fn object.Object) (result object.Object) {
+
+	defer func() {
+
+		if r := recover(); r != nil {
+			result = &object.Error{Message: fmt.Sprintf("task panicked: %v", r)}
+		}
+
+		vm.returnFuel()
+	}()
+
+	result, err := vm.call(fn)
+
+	if err != nil {
+		return &object.Error{Message: err.Error()}
+	}
+
+	return result
+}
+
+type taskGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// タスクを実行するVMのcontext。呼び出し元のcontextがあればそれから作る
+func (vm *VM) taskContext() context.Context {
+
+	if vm.tasks == nil {
+
+		parent := vm.ctx
+
+		if parent == nil {
+			parent = context.Background()
+		}
+
+		ctx, cancel := context.WithCancel(parent)
+		vm.tasks = &taskGroup{ctx: ctx, cancel: cancel}
+	}
+
+	return vm.tasks.ctx
+}
+
+func (vm *VM) stopTasks() {
+
+	if vm.tasks != nil {
+		vm.tasks.cancel()
+		vm.tasks = nil
+	}
+}
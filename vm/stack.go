@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/object"
+)
+
+// VMを作るときの設定
+type Options struct {
+	// スタックの要素数の初期値。0以下ならStackSize
+	StackSize int
+	// スタックが足りなくなったときに伸ばせる要素数の上限
+	// StackSize以下なら伸ばさず、足りなくなった時点で stack overflow にする
+	MaxStackSize int
+	// グローバル変数の領域の初期の大きさ。足りなくなればGlobalsSizeまで伸ばす
+	// 0なら最初の代入のときに確保する
+	GlobalsSize int
+	// 呼び出しの深さの上限。0以下ならMaxFrames
+	MaxFrames int
+	// nilでなければ、実行する命令を1行ずつ書き出す (SetTrace)
+	Trace io.Writer
+	// 呼び出しや命令ごとに呼ぶ関数 (hooks.go)
+	Hooks *Hooks
+	// 整数の演算がint64の範囲を超えたときの扱い。0ならOverflowWrap (overflow.go)
+	IntegerOverflow OverflowMode
+	// trueならspawnをエラーにする (spawn.go)
+	DisableSpawn bool
+}
+
+// Newで使う設定。スタックは伸ばさない
+func DefaultOptions() Options {
+	return Options{StackSize: StackSize, MaxFrames: MaxFrames}
+}
+
+func NewWithOptions(bytecode *compiler.Bytecode, opts Options) *VM {
+
+	if opts.StackSize <= 0 {
+		opts.StackSize = StackSize
+	}
+
+	if opts.MaxStackSize < opts.StackSize {
+		opts.MaxStackSize = opts.StackSize
+	}
+
+	if opts.MaxFrames <= 0 {
+		opts.MaxFrames = MaxFrames
+	}
+
+	vm := New(bytecode)
+
+	if opts.StackSize != StackSize {
+		vm.stack = make([]object.Object, opts.StackSize)
+	}
+
+	if opts.GlobalsSize > 0 {
+		vm.ensureGlobals(opts.GlobalsSize)
+	}
+
+	if opts.Trace != nil {
+		vm.SetTrace(opts.Trace)
+	}
+
+	if opts.Hooks != nil {
+		vm.hooks = opts.Hooks
+		vm.updateDebugging()
+	}
+
+	vm.options = opts
+
+	return vm
+}
+
+// スタックにn個の要素が入るようにする
+// 上限までは倍々に伸ばし、それを超えるなら stack overflow
+func (vm *VM) ensureStack(n int) error {
+
+	if n <= len(vm.stack) {
+		return nil
+	}
+
+	if n > vm.options.MaxStackSize {
+		return uncatchable(fmt.Errorf("stack overflow"))
+	}
+
+	size := 2 * len(vm.stack)
+
+	if size < n {
+		size = n
+	}
+
+	if size > vm.options.MaxStackSize {
+		size = vm.options.MaxStackSize
+	}
+
+	grown := make([]object.Object, size)
+	copy(grown, vm.stack[:vm.sp])
+	vm.stack = grown
+
+	return nil
+}
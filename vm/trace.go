@@ -0,0 +1,59 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"example.com/monkey/code"
+)
+
+// 実行する命令を1行ずつ書き出す (デバッグ用)
+//
+//	main 0006 OpGetGlobal 0 top=-
+//	  add 0000 OpGetLocal 0 top=<nil>
+//
+// 呼び出しの深さで字下げし、関数の名前、命令の位置、命令、実行する前のスタックの先頭を並べる
+
+// wに書き出すようにする。nilなら書き出さない
+func (vm *VM) SetTrace(w io.Writer) {
+	vm.trace = w
+	vm.updateDebugging()
+}
+
+func (vm *VM) traceInstruction() {
+
+	frame := vm.currentFrame()
+	ip := frame.ip + 1
+	ins := frame.Instructions()
+
+	def, _ := code.Lookup(ins[ip])
+	operands, _ := code.ReadOperands(def, ins[ip+1:])
+
+	line := def.Name
+	for _, o := range operands {
+		line += fmt.Sprintf(" %d", o)
+	}
+
+	name := frame.cl.Fn.Name
+
+	switch {
+	case vm.framesIndex == 1:
+		name = "main"
+	case name == "":
+		name = "anonymous fn"
+	}
+
+	top := "-"
+
+	if vm.sp > 0 {
+		if obj := vm.stack[vm.sp-1]; obj != nil {
+			top = obj.Inspect()
+		} else {
+			top = "<nil>"
+		}
+	}
+
+	fmt.Fprintf(vm.trace, "%s%s %04d %s top=%s\n",
+		strings.Repeat("  ", vm.framesIndex-1), name, ip, line, top)
+}
@@ -0,0 +1,111 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"example.com/monkey/object"
+)
+
+// 例外処理 (try/catch)
+//
+// OpTryで例外を受け取る位置を積み、本体で起きたエラーはそこまでフレームとスタックを戻して続ける
+// throwした値はそのまま、型の合わない演算などの実行時エラーはERRORオブジェクトとして受け取る
+// 燃料やメモリの上限、キャンセルなど、ホストが決めた制限のエラーは受け取れない
+
+// 例外を受け取る位置
+type handler struct {
+	// OpTryを実行したときのフレームの数とスタックの位置
+	framesIndex int
+	sp          int
+	// ハンドラーの最初の命令の位置
+	ip int
+}
+
+// throwされた値
+type thrownError struct {
+	value object.Object
+}
+
+func (e *thrownError) Error() string {
+	return fmt.Sprintf("uncaught exception: %s", e.value.Inspect())
+}
+
+// catchで受け取れないエラー
+type uncatchableError struct {
+	err error
+}
+
+func (e *uncatchableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *uncatchableError) Unwrap() error {
+	return e.err
+}
+
+func uncatchable(err error) error {
+	return &uncatchableError{err: err}
+}
+
+// エラーを受け取るハンドラーがあるあいだ、命令を実行し直す
+func (vm *VM) run() error {
+
+	for {
+
+		err := vm.execute()
+
+		if err != nil && err != errYield && vm.hooks != nil {
+			vm.hookError(err)
+		}
+
+		// yieldで止めたときはハンドラーを探さない (generator.go)
+		if err == nil || err == errYield || !vm.catch(err) {
+			return err
+		}
+	}
+}
+
+// 一番内側のハンドラーまでフレームとスタックを戻し、例外の値を積む
+// 受け取れなければfalse
+func (vm *VM) catch(err error) bool {
+
+	if len(vm.handlers) == 0 {
+		return false
+	}
+
+	var fatal *uncatchableError
+
+	if errors.As(err, &fatal) {
+		return false
+	}
+
+	var exception object.Object
+
+	var thrown *thrownError
+
+	if errors.As(err, &thrown) {
+		exception = thrown.value
+	} else {
+		exception = &object.Error{Message: err.Error()}
+	}
+
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+	vm.framesIndex = h.framesIndex
+	vm.sp = h.sp
+
+	// 次の命令を読む前にipを1つ進めるので、その前の位置にしておく
+	vm.currentFrame().ip = h.ip - 1
+
+	return vm.push(exception) == nil
+}
+
+// 関数から戻ったら、その関数の中で積んだハンドラーを捨てる
+func (vm *VM) dropHandlers() {
+
+	for len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].framesIndex > vm.framesIndex {
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	}
+}
@@ -1,7 +1,9 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"io"
 
 	"example.com/monkey/code"
 	"example.com/monkey/compiler"
@@ -9,12 +11,15 @@ import (
 )
 
 // スタックが持てる要素の上限数
+// NewWithOptionsで変えたり、足りなくなったときに伸ばしたりできる (stack.go)
 const StackSize = 2048
 
 // VMが持てるグローバルバインディングの上限
+// グローバル変数の領域は使った分だけ伸ばす (globals.go)
 const GlobalsSize = 65536
 
-// 最大フレーム数
+// 呼び出しの深さの上限の既定値 (Options.MaxFrames)
+// 最初にこの数のフレームを用意し、上限が大きければ伸ばす
 const MaxFrames = 1024
 
 var True = &object.Boolean{Value: true}
@@ -22,6 +27,63 @@ var False = &object.Boolean{Value: false}
 
 var Null = &object.Null{}
 
+// 演算の結果によく出る小さな整数は、True/Falseと同じく作っておいたものを使い回す
+// 整数の値は変えないので共有してよい
+const (
+	MinCachedInteger = -128
+	MaxCachedInteger = 1024
+)
+
+var integers = func() []*object.Integer {
+
+	cache := make([]*object.Integer, MaxCachedInteger-MinCachedInteger+1)
+
+	for i := range cache {
+		cache[i] = &object.Integer{Value: int64(i + MinCachedInteger)}
+	}
+
+	return cache
+}()
+
+// 範囲内なら共有の整数、そうでなければ新しい整数を返す
+func newInteger(value int64) *object.Integer {
+
+	if value >= MinCachedInteger && value <= MaxCachedInteger {
+		return integers[value-MinCachedInteger]
+	}
+
+	return &object.Integer{Value: value}
+}
+
+// 組み込み関数の解決表
+// OpGetBuiltinのオペランド(インデックス)で直接参照できるように、
+// object.Builtinsから組み込み関数だけを取り出しておく
+var builtins = resolveBuiltins()
+
+func resolveBuiltins() []object.Object {
+
+	resolved := make([]object.Object, len(object.Builtins))
+
+	for i, def := range object.Builtins {
+		resolved[i] = def.Builtin
+	}
+
+	return resolved
+}
+
+// 組み込み関数の解決表のコピーを返す
+// 一部を差し替えてNewWithBuiltinsに渡すときに使う
+func Builtins() []*object.Builtin {
+
+	copied := make([]*object.Builtin, len(builtins))
+
+	for i, b := range builtins {
+		copied[i] = b.(*object.Builtin)
+	}
+
+	return copied
+}
+
 type VM struct {
 	constants []object.Object
 	stack     []object.Object
@@ -32,6 +94,73 @@ type VM struct {
 
 	frames      []*Frame
 	framesIndex int
+
+	// OpGetBuiltinで参照する組み込み関数の表
+	builtins []object.Object
+
+	// 自由変数を持たない関数のクロージャ(constant indexごと)
+	// OpFunctionのたびにクロージャを作らないように使い回す
+	functions []*object.Closure
+	// 最初の1つはfunctionsを割り当てずにここに置く
+	// (関数を1つ呼ぶだけのプログラムで表を作らないため)
+	function      *object.Closure
+	functionIndex int
+
+	// 実行の制限 (limits.go)
+	fuel      int
+	limitFuel bool
+	// SetFuelで設定した燃料 (Resetで元に戻す)
+	configuredFuel int
+	// SetMaxInstructionsで設定した上限 (エラーの表示用)
+	maxInstructions int
+
+	// RunContextで実行しているときのctxと、次に確かめるまでの命令数 (context.go)
+	ctx          context.Context
+	ctxCountdown int
+	memoryLimit  int
+	allocated    int
+	// pmapやspawnで作ったVMと共有する燃料とメモリ。nilなら自分の分だけで数える
+	budget *budget
+	// pmapやspawnの入れ子の深さ
+	forkDepth int
+	// spawnしたタスク。Runが終わるときに止める (spawn.go)
+	tasks *taskGroup
+	// 同じgoroutineで順に動くVMで共有する印 (generator.go)
+	thread *thread
+
+	// 命令列が壊れていないことを確かめたか
+	checked bool
+
+	// スタックの大きさ (stack.go)
+	options Options
+
+	// Stepで1命令だけ実行しているか (debug.go)
+	stepping bool
+	stepped  bool
+
+	// ブレークポイントの位置と、止まったときに呼ぶ関数 (breakpoint.go)
+	breakpoints       map[*object.CompiledFunction]map[int]bool
+	breakpointHandler BreakpointHandler
+
+	// 実行する命令を書き出す先 (trace.go)
+	trace io.Writer
+
+	// 命令ごとの回数と時間 (profile.go)
+	profile *profiler
+
+	// 呼び出しや命令ごとに呼ぶ関数 (hooks.go)
+	hooks *Hooks
+
+	// 例外を受け取る位置。内側のtryが最後 (try.go)
+	handlers []handler
+
+	// Step、ブレークポイント、トレース、プロファイルのどれかを使っていれば、
+	// 命令ごとにbeforeInstructionを呼ぶ
+	debugging bool
+
+	// EnableReportされている場合のみ記録する (report.go)
+	stats        *stats
+	builtinNames []string
 }
 
 func (vm *VM) currentFrame() *Frame {
@@ -40,8 +169,15 @@ func (vm *VM) currentFrame() *Frame {
 
 func (vm *VM) pushFrame(f *Frame) {
 
-	vm.frames[vm.framesIndex] = f
+	if vm.framesIndex == len(vm.frames) {
+		vm.frames = append(vm.frames, f)
+	} else {
+		vm.frames[vm.framesIndex] = f
+	}
+
 	vm.framesIndex++
+
+	vm.recordStack()
 }
 
 func (vm *VM) popFrame() *Frame {
@@ -54,6 +190,7 @@ func New(bytecode *compiler.Bytecode) *VM {
 
 	mainFn := &object.CompiledFunction{
 		Instructions: bytecode.Instructions,
+		Lines:        bytecode.Lines,
 	}
 
 	mainClosure := &object.Closure{Fn: mainFn}
@@ -68,12 +205,15 @@ func New(bytecode *compiler.Bytecode) *VM {
 		constants:   bytecode.Constants,
 		stack:       make([]object.Object, StackSize),
 		sp:          0,
-		globals:     make([]object.Object, GlobalsSize),
 		frames:      frames,
 		framesIndex: 1,
+		builtins:    builtins,
+		options:     Options{StackSize: StackSize, MaxStackSize: StackSize, MaxFrames: MaxFrames},
 	}
 }
 
+// sをグローバル変数の領域として使う
+// 実行中に足りなくなると別の領域に伸ばすので、実行後の値はGlobalsで取り出す
 func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
 
 	vm := New(bytecode)
@@ -83,6 +223,98 @@ func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
 	return vm
 }
 
+// ジャンプ命令のジャンプ先とオペランドの幅
+// 64KBを超える関数では4バイトのジャンプ先を持つ命令になる
+func jumpTarget(op code.Opcode, ins code.Instructions, ip int) (int, int) {
+
+	switch op {
+	case code.OpJumpWide, code.OpJumpNotTruthyWide, code.OpIterNextWide:
+		return int(readUint32(ins, ip+1)), 4
+	// 次の命令からの符号付きの差
+	case code.OpJumpRel, code.OpJumpNotTruthyRel:
+		return ip + 3 + int(int16(readUint16(ins, ip+1))), 2
+	default:
+		return int(readUint16(ins, ip+1)), 2
+	}
+}
+
+// オペランドを読む。code.ReadUint16/ReadUint32と同じだが、命令ごとにスライスを作らない
+func readUint16(ins code.Instructions, i int) uint16 {
+	return uint16(ins[i])<<8 | uint16(ins[i+1])
+}
+
+func readUint32(ins code.Instructions, i int) uint32 {
+	return uint32(ins[i])<<24 | uint32(ins[i+1])<<16 | uint32(ins[i+2])<<8 | uint32(ins[i+3])
+}
+
+// インデックスの位置のグローバル変数の値を返す
+func (vm *VM) Global(index int) object.Object {
+
+	if index >= len(vm.globals) {
+		return nil
+	}
+
+	return vm.globals[index]
+}
+
+// 先に実行したプログラム(engineのpreludeなど)のグローバル変数を引き継ぐ
+// globalsの要素を写すだけなので、元のスライスは変更されない
+func (vm *VM) PresetGlobals(globals []object.Object) {
+	vm.ensureGlobals(len(globals))
+	copy(vm.globals, globals)
+}
+
+// object.Builtins以外の組み込み関数を使うVMを作る
+// builtinsはコンパイラーのシンボルテーブルに定義したインデックスの順に並べる
+func NewWithBuiltins(bytecode *compiler.Bytecode, builtins []*object.Builtin) *VM {
+
+	vm := New(bytecode)
+
+	vm.builtins = make([]object.Object, len(builtins))
+
+	for i, b := range builtins {
+		vm.builtins[i] = b
+	}
+
+	return vm
+}
+
+// 同じVMで別のBytecodeを最初から実行できるようにする
+// REPLのように入力ごとに実行するときに、スタックとフレームの領域を作り直さずに使い回す
+// グローバル変数の領域、組み込み関数、制限やデバッグの設定はそのまま引き継ぐ
+func (vm *VM) Reset(bytecode *compiler.Bytecode) {
+
+	vm.constants = bytecode.Constants
+	vm.functions = nil
+	vm.function = nil
+	vm.checked = false
+
+	// 前の実行の値を残さない
+	for i := range vm.stack {
+		vm.stack[i] = nil
+	}
+
+	vm.sp = 0
+
+	mainFn := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		Lines:        bytecode.Lines,
+	}
+
+	vm.frames[0] = NewFrame(&object.Closure{Fn: mainFn}, 0)
+	vm.framesIndex = 1
+
+	// エラーで止まった場合は、tryのハンドラーが残っている
+	vm.handlers = vm.handlers[:0]
+
+	if vm.limitFuel {
+		vm.fuel = vm.configuredFuel
+	}
+
+	vm.allocated = 0
+	vm.budget = nil
+}
+
 func (vm *VM) StackTop() object.Object {
 
 	if vm.sp == 0 {
@@ -92,29 +324,130 @@ func (vm *VM) StackTop() object.Object {
 	return vm.stack[vm.sp-1]
 }
 
+// エラーになった場合は、その位置を付けたRuntimeErrorを返す
 func (vm *VM) Run() error {
 
+	if err := vm.check(); err != nil {
+		return err
+	}
+
+	err := vm.run()
+
+	vm.stopTasks()
+	vm.profileStop()
+
+	if err != nil {
+		return vm.runtimeError(err)
+	}
+
+	return nil
+}
+
+// 最初の実行のときだけ命令列を確かめる
+func (vm *VM) check() error {
+
+	if vm.checked {
+		return nil
+	}
+
+	if err := vm.checkInstructions(); err != nil {
+		return err
+	}
+
+	vm.checked = true
+
+	return nil
+}
+
+// 実行中に命令を読むときは範囲を確かめないので、
+// 途中で切れた命令や未定義のopcodeは実行する前に見つける
+func (vm *VM) checkInstructions() error {
+
+	if err := code.CheckInstructions(vm.frames[0].Instructions()); err != nil {
+		return fmt.Errorf("malformed bytecode: main: %s", err)
+	}
+
+	for i, c := range vm.constants {
+
+		fn, ok := c.(*object.CompiledFunction)
+
+		if !ok {
+			continue
+		}
+
+		if err := code.CheckInstructions(fn.Instructions); err != nil {
+			return fmt.Errorf("malformed bytecode: constant %d: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (vm *VM) execute() error {
+
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
 
-	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+	// 命令ごとにフレームを1回だけ取り出し、各命令ではそれを使う
+	// フレームが変わるのは呼び出しと戻りの命令だけで、次の命令で取り出し直す
+	var frame *Frame
+
+	for {
+
+		frame = vm.frames[vm.framesIndex-1]
+
+		if frame.ip >= len(frame.cl.Fn.Instructions)-1 {
+			break
+		}
+
+		if vm.debugging {
+
+			stop, err := vm.beforeInstruction()
+
+			if err != nil {
+				return err
+			}
+
+			if stop {
+				return nil
+			}
+		}
+
+		if vm.stats != nil {
+			vm.stats.instructions++
+			vm.recordStack()
+		}
+
+		if vm.limitFuel {
 
-		vm.currentFrame().ip++
+			if err := vm.consumeFuel(); err != nil {
+				return err
+			}
+		}
+
+		if vm.ctx != nil {
+
+			if err := vm.checkContext(); err != nil {
+				return err
+			}
+		}
 
-		ip = vm.currentFrame().ip
-		ins = vm.currentFrame().Instructions()
+		frame.ip++
+
+		ip = frame.ip
+		ins = frame.cl.Fn.Instructions
 		op = code.Opcode(ins[ip])
 
 		switch op {
 
 		case code.OpClosure:
 
-			constIndex := code.ReadUint16(ins[ip+1:])
+			constIndex := readUint16(ins, ip+1)
 
-			numFree := code.ReadUint8(ins[ip+3:])
+			numFree := ins[ip+3]
 
-			vm.currentFrame().ip += 3
+			frame.ip += 3
 
 			err := vm.pushClosure(int(constIndex), int(numFree))
 
@@ -122,9 +455,21 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		case code.OpFunction:
+
+			constIndex := readUint16(ins, ip+1)
+
+			frame.ip += 2
+
+			err := vm.pushFunction(int(constIndex))
+
+			if err != nil {
+				return err
+			}
+
 		case code.OpCurrentClosure:
 
-			currentClosure := vm.currentFrame().cl
+			currentClosure := frame.cl
 
 			err := vm.push(currentClosure)
 
@@ -134,11 +479,11 @@ func (vm *VM) Run() error {
 
 		case code.OpGetFree:
 
-			freeIndex := code.ReadUint8(ins[ip+1:])
+			freeIndex := ins[ip+1]
 
-			vm.currentFrame().ip += 1
+			frame.ip += 1
 
-			currentClosure := vm.currentFrame().cl
+			currentClosure := frame.cl
 
 			err := vm.push(currentClosure.Free[freeIndex])
 
@@ -146,11 +491,20 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		case code.OpSetFree:
+
+			freeIndex := ins[ip+1]
+
+			frame.ip += 1
+
+			// 書き換わるのはこのクロージャが持つ値だけで、取り込んだ元の変数は変わらない
+			frame.cl.Free[freeIndex] = vm.pop()
+
 		case code.OpCall:
 
-			numArgs := code.ReadUint8(ins[ip+1:])
+			numArgs := ins[ip+1]
 
-			vm.currentFrame().ip += 1
+			frame.ip += 1
 
 			err := vm.executeCall(int(numArgs))
 
@@ -172,6 +526,25 @@ func (vm *VM) Run() error {
 				vm.sp = frame.basePointer + fn.NumLocals
 			*/
 
+		case code.OpCallLocal:
+
+			localIndex := ins[ip+1]
+			numArgs := ins[ip+2]
+
+			frame.ip += 2
+
+			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+
+			if err != nil {
+				return err
+			}
+
+			err = vm.executeCall(int(numArgs))
+
+			if err != nil {
+				return err
+			}
+
 		case code.OpReturnValue:
 
 			returnValue := vm.pop()
@@ -181,6 +554,10 @@ func (vm *VM) Run() error {
 			// 実行された関数自体も無くすため-1している
 			vm.sp = frame.basePointer - 1
 
+			if len(vm.handlers) > 0 {
+				vm.dropHandlers()
+			}
+
 			// pop the called compiled function
 			//vm.pop()
 
@@ -190,6 +567,10 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+			if vm.hooks != nil {
+				vm.hookReturn(returnValue)
+			}
+
 		case code.OpReturn:
 
 			frame := vm.popFrame()
@@ -197,6 +578,10 @@ func (vm *VM) Run() error {
 			// 実行された関数自体も無くすため-1している
 			vm.sp = frame.basePointer - 1
 
+			if len(vm.handlers) > 0 {
+				vm.dropHandlers()
+			}
+
 			// pop the called function
 			//vm.pop()
 
@@ -206,6 +591,10 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+			if vm.hooks != nil {
+				vm.hookReturn(Null)
+			}
+
 		case code.OpConstant:
 			//log.Println("OpConstant")
 			// 性能観点でcode.ReadOperandsは使用しない
@@ -217,9 +606,9 @@ func (vm *VM) Run() error {
 			//log.Printf("length of the rest of the instructions: %d\n", len(b)) // 2 bytes
 			// バイト配列の16進数表記、配列の長さは可変長でもよいみたい
 			//log.Printf("hex of the above: %s\n", fmt.Sprintf("%x", b))
-			constIndex := code.ReadUint16(ins[ip+1:])
+			constIndex := readUint16(ins, ip+1)
 			//log.Printf("constIndex: %d\n", constIndex)
-			vm.currentFrame().ip += 2
+			frame.ip += 2
 
 			// 定数プールから実際の値を仮想マシンにプッシュ
 			err := vm.push(vm.constants[constIndex])
@@ -228,7 +617,7 @@ func (vm *VM) Run() error {
 				return err
 			}
 
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod:
 			//log.Println("OpAdd, OpSub, OpMul, OpDiv")
 			err := vm.executeBinaryOperation(op)
 
@@ -236,7 +625,18 @@ func (vm *VM) Run() error {
 				return err
 			}
 
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+		case code.OpAddConstant:
+
+			constIndex := readUint16(ins, ip+1)
+			frame.ip += 2
+
+			err := vm.executeAddConstant(vm.constants[constIndex])
+
+			if err != nil {
+				return err
+			}
+
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterEqual:
 			//log.Println("OpEqual, OpNotEqual, OpGreaterThan")
 			err := vm.executeComparison(op)
 
@@ -281,25 +681,54 @@ func (vm *VM) Run() error {
 				return err
 			}
 
-		case code.OpJump:
+		case code.OpJump, code.OpJumpWide, code.OpJumpRel:
 			//log.Println("OpJump")
-			pos := int(code.ReadUint16(ins[ip+1:]))
+			pos, _ := jumpTarget(op, ins, ip)
 
 			// ipはループによりインクリメントされるので、１つ減らしておく
-			vm.currentFrame().ip = pos - 1
+			frame.ip = pos - 1
 
-		case code.OpJumpNotTruthy:
+		case code.OpJumpNotTruthy, code.OpJumpNotTruthyWide, code.OpJumpNotTruthyRel:
 			//log.Println("OpJumpNotTruthy")
-			pos := int(code.ReadUint16(ins[ip+1:]))
+			pos, width := jumpTarget(op, ins, ip)
 
 			// ループのインクリメントプラスオペランドの2バイトを移動させる
-			vm.currentFrame().ip += 2
+			frame.ip += width
 
 			condition := vm.pop()
 
 			if !isTruthy(condition) {
 				// ループでインクリメントされるので１つ前にしておく
-				vm.currentFrame().ip = pos - 1
+				frame.ip = pos - 1
+			}
+
+		case code.OpTry:
+
+			pos := int(readUint32(ins, ip+1))
+
+			frame.ip += 4
+
+			vm.handlers = append(vm.handlers, handler{framesIndex: vm.framesIndex, sp: vm.sp, ip: pos})
+
+		case code.OpEndTry:
+
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+		case code.OpThrow:
+
+			return &thrownError{value: vm.pop()}
+
+		case code.OpYield:
+
+			// 値はスタックに残したままにして、resumeで取り出す (generator.go)
+			return errYield
+
+		case code.OpSpawn:
+
+			err := vm.executeSpawn()
+
+			if err != nil {
+				return err
 			}
 
 		case code.OpNull:
@@ -312,16 +741,28 @@ func (vm *VM) Run() error {
 
 		case code.OpSetGlobal:
 			// 2バイト読み取る
-			globalIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2 // 2バイト進める
+			globalIndex := readUint16(ins, ip+1)
+			frame.ip += 2 // 2バイト進める
+
+			if int(globalIndex) >= len(vm.globals) {
+				vm.ensureGlobals(int(globalIndex) + 1)
+			}
+
 			vm.globals[globalIndex] = vm.pop()
 
 		case code.OpGetGlobal:
 
-			globalIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+			globalIndex := readUint16(ins, ip+1)
+			frame.ip += 2
 
-			err := vm.push(vm.globals[globalIndex])
+			// まだ代入していない変数は領域の外にあることがある
+			var value object.Object
+
+			if int(globalIndex) < len(vm.globals) {
+				value = vm.globals[globalIndex]
+			}
+
+			err := vm.push(value)
 
 			if err != nil {
 				return err
@@ -329,21 +770,17 @@ func (vm *VM) Run() error {
 
 		case code.OpSetLocal:
 
-			localIndex := code.ReadUint8(ins[ip+1:])
-
-			vm.currentFrame().ip += 1
+			localIndex := ins[ip+1]
 
-			frame := vm.currentFrame()
+			frame.ip += 1
 
 			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
 
 		case code.OpGetLocal:
 
-			localIndex := code.ReadUint8(ins[ip+1:])
+			localIndex := ins[ip+1]
 
-			vm.currentFrame().ip += 1
-
-			frame := vm.currentFrame()
+			frame.ip += 1
 
 			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
 
@@ -353,13 +790,12 @@ func (vm *VM) Run() error {
 
 		case code.OpGetBuiltin:
 
-			builtinIndex := code.ReadUint8(ins[ip+1:])
-
-			vm.currentFrame().ip += 1
+			builtinIndex := ins[ip+1]
 
-			definition := object.Builtins[builtinIndex]
+			frame.ip += 1
 
-			err := vm.push(definition.Builtin)
+			// object.Builtinsの定義を参照せず、解決済みの表から直接取得する
+			err := vm.push(vm.builtins[builtinIndex])
 
 			if err != nil {
 				return err
@@ -367,11 +803,15 @@ func (vm *VM) Run() error {
 
 		case code.OpArray:
 
-			numElements := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+			numElements := int(readUint16(ins, ip+1))
+			frame.ip += 2
 			array := vm.buildArray(vm.sp-numElements, vm.sp)
 			vm.sp = vm.sp - numElements
 
+			if err := vm.allocate(array); err != nil {
+				return err
+			}
+
 			err := vm.push(array)
 
 			if err != nil {
@@ -380,8 +820,8 @@ func (vm *VM) Run() error {
 
 		case code.OpHash:
 
-			numElements := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+			numElements := int(readUint16(ins, ip+1))
+			frame.ip += 2
 
 			hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
 
@@ -391,12 +831,110 @@ func (vm *VM) Run() error {
 
 			vm.sp = vm.sp - numElements
 
+			if err := vm.allocate(hash); err != nil {
+				return err
+			}
+
 			err = vm.push(hash)
 
 			if err != nil {
 				return err
 			}
 
+		case code.OpSlice:
+
+			high := vm.pop()
+			low := vm.pop()
+			left := vm.pop()
+
+			err := vm.executeSliceExpression(left, low, high)
+
+			if err != nil {
+				return err
+			}
+
+		case code.OpToString:
+
+			operand := vm.pop()
+
+			if operand.Type() != object.STRING_OBJ {
+
+				operand = &object.String{Value: operand.Inspect()}
+
+				if err := vm.allocate(operand); err != nil {
+					return err
+				}
+			}
+
+			err := vm.push(operand)
+
+			if err != nil {
+				return err
+			}
+
+		case code.OpRange:
+
+			end := vm.pop()
+			start := vm.pop()
+
+			err := vm.executeRange(start, end)
+
+			if err != nil {
+				return err
+			}
+
+		case code.OpIterNew:
+
+			iterable := vm.pop()
+
+			iterator, err := newIterator(iterable)
+
+			if err != nil {
+				return err
+			}
+
+			err = vm.push(iterator)
+
+			if err != nil {
+				return err
+			}
+
+		case code.OpIterNext, code.OpIterNextWide:
+
+			pos, width := jumpTarget(op, ins, ip)
+
+			frame.ip += width
+
+			// イテレーターはスタック上に残したまま次の要素を取り出す
+			iterator := vm.stack[vm.sp-1].(*object.Iterator)
+
+			var el object.Object
+			var ok bool
+
+			if iterator.Generator != nil {
+
+				var err error
+
+				if el, ok, err = vm.resume(iterator.Generator, Null); err != nil {
+					return err
+				}
+			} else {
+				el, ok = iterator.Next()
+			}
+
+			if !ok {
+				// ループ終了、イテレーターを取り除く
+				vm.pop()
+				frame.ip = pos - 1
+				continue
+			}
+
+			err := vm.push(el)
+
+			if err != nil {
+				return err
+			}
+
 		case code.OpIndex:
 
 			index := vm.pop()
@@ -408,12 +946,54 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		// 組み込む側が追加した命令 (custom.go)
+		default:
+
+			if code.IsCustom(op) {
+
+				if err := vm.executeCustom(op, ins, ip); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
 	return nil
 }
 
+func newIterator(iterable object.Object) (*object.Iterator, error) {
+
+	switch iterable := iterable.(type) {
+
+	case *object.Array:
+		return &object.Iterator{Elements: iterable.Elements}, nil
+
+	case *object.Range:
+		// 要素の配列は作らない
+		return &object.Iterator{Range: iterable}, nil
+
+	case *object.String:
+		// 1文字ずつの文字列にする
+		elements := []object.Object{}
+
+		for _, r := range iterable.Value {
+			elements = append(elements, &object.String{Value: string(r)})
+		}
+
+		return &object.Iterator{Elements: elements}, nil
+
+	case *object.Hash:
+		// ハッシュの場合はキーを決まった順(Hash.Keys)に返す
+		return &object.Iterator{Elements: iterable.Keys()}, nil
+
+	case *object.Generator:
+		return &object.Iterator{Generator: iterable}, nil
+
+	default:
+		return nil, fmt.Errorf("not iterable: %s", iterable.Type())
+	}
+}
+
 func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 
 	hashedPairs := make(map[object.HashKey]object.HashPair)
@@ -459,6 +1039,10 @@ func isTruthy(obj object.Object) bool {
 	case *object.Null:
 		return false
 
+	// まだ値を保存していないグローバル変数 (importしたモジュールの結果など)
+	case nil:
+		return false
+
 	default:
 		return true
 	}
@@ -468,13 +1052,25 @@ func (vm *VM) executeMinusOperator() error {
 
 	operand := vm.pop()
 
+	if d, ok := operand.(*object.Decimal); ok {
+		return vm.push(negateDecimal(d))
+	}
+
+	if f, ok := operand.(*object.Float); ok {
+		return vm.push(&object.Float{Value: -f.Value})
+	}
+
 	if operand.Type() != object.INTEGER_OBJ {
 		return fmt.Errorf("unsupported type for negatin: %s", operand.Type())
 	}
 
-	value := operand.(*object.Integer).Value
+	value, overflow := object.NegInt64(operand.(*object.Integer).Value)
 
-	return vm.push(&object.Integer{Value: -value})
+	if overflow && vm.options.IntegerOverflow != OverflowWrap {
+		return vm.negationOverflow(operand.(*object.Integer))
+	}
+
+	return vm.push(newInteger(value))
 }
 
 func (vm *VM) executeBangOperator() error {
@@ -500,11 +1096,26 @@ func (vm *VM) executeBangOperator() error {
 }
 
 // スタックの先頭にプッシュ
-func (vm *VM) push(o object.Object) error {
+// ほとんどの命令が呼ぶので、インライン展開されるように短くしておく
+// (戻り値に名前を付けているのも展開のコストを抑えるため)
+// スタックを伸ばす処理は別の関数にし、スタックの最大の深さ(Report)は命令ごとに記録する
+func (vm *VM) push(o object.Object) (err error) {
+
+	if vm.sp >= len(vm.stack) {
+		return vm.growAndPush(o)
+	}
+
+	vm.stack[vm.sp] = o
+
+	vm.sp++
+
+	return
+}
 
-	if vm.sp >= StackSize {
+func (vm *VM) growAndPush(o object.Object) error {
 
-		return fmt.Errorf("stack overflow")
+	if err := vm.ensureStack(vm.sp + 1); err != nil {
+		return err
 	}
 
 	vm.stack[vm.sp] = o
@@ -543,6 +1154,11 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
+	// 整数同士が一番多いので、型の名前を比べる前に確かめる
+	if isIntegerOperation(left, right) {
+		return vm.executeBinaryIntegerOperation(op, left, right)
+	}
+
 	leftType := left.Type()
 	rightType := right.Type()
 
@@ -554,6 +1170,12 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
 		return vm.executeBinaryStringOperation(op, left, right)
 
+	case isDecimalOperation(left, right):
+		return vm.executeBinaryDecimalOperation(op, left, right)
+
+	case isFloatOperation(left, right):
+		return vm.executeBinaryFloatOperation(op, left, right)
+
 	default:
 		return fmt.Errorf("unsupported types for binary operation: %s %s",
 			leftType,
@@ -561,6 +1183,38 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	}
 }
 
+func isIntegerOperation(left, right object.Object) bool {
+
+	_, ok := left.(*object.Integer)
+	_, ok2 := right.(*object.Integer)
+
+	return ok && ok2
+}
+
+// 整数同士ならスタックの先頭をそのまま置き換える
+func (vm *VM) executeAddConstant(constant object.Object) error {
+
+	left, ok := vm.stack[vm.sp-1].(*object.Integer)
+	right, ok2 := constant.(*object.Integer)
+
+	if ok && ok2 {
+
+		sum, overflow := object.AddInt64(left.Value, right.Value)
+
+		// 範囲を超えたときは通常の足し算で設定どおりに扱う
+		if !overflow || vm.options.IntegerOverflow == OverflowWrap {
+			vm.stack[vm.sp-1] = newInteger(sum)
+			return nil
+		}
+	}
+
+	if err := vm.push(constant); err != nil {
+		return err
+	}
+
+	return vm.executeBinaryOperation(code.OpAdd)
+}
+
 func (vm *VM) executeBinaryStringOperation(
 	op code.Opcode,
 	left, right object.Object,
@@ -573,7 +1227,13 @@ func (vm *VM) executeBinaryStringOperation(
 	leftValue := left.(*object.String).Value
 	rightValue := right.(*object.String).Value
 
-	return vm.push(&object.String{Value: leftValue + rightValue})
+	result := &object.String{Value: leftValue + rightValue}
+
+	if err := vm.allocate(result); err != nil {
+		return err
+	}
+
+	return vm.push(result)
 }
 
 func (vm *VM) executeBinaryIntegerOperation(
@@ -585,27 +1245,42 @@ func (vm *VM) executeBinaryIntegerOperation(
 	rightValue := right.(*object.Integer).Value
 
 	var result int64
+	var overflow bool
 
 	switch op {
 
 	case code.OpAdd:
-		result = leftValue + rightValue
+		result, overflow = object.AddInt64(leftValue, rightValue)
 
 	case code.OpSub:
-		result = leftValue - rightValue
+		result, overflow = object.SubInt64(leftValue, rightValue)
 
 	case code.OpMul:
-		result = leftValue * rightValue
+		result, overflow = object.MulInt64(leftValue, rightValue)
 
 	case code.OpDiv:
-		result = leftValue / rightValue
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result, overflow = object.DivInt64(leftValue, rightValue)
+
+	// 符号は割られる数と同じ (-7 % 3 == -1)
+	case code.OpMod:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result = leftValue % rightValue
 
 	default:
 		return fmt.Errorf("unknown integer operator: %d", op)
 	}
 
+	if overflow && vm.options.IntegerOverflow != OverflowWrap {
+		return vm.integerOverflow(op, left, right)
+	}
+
 	// 計算結果をスタックにプッシュする
-	return vm.push(&object.Integer{Value: result})
+	return vm.push(newInteger(result))
 }
 
 func (vm *VM) executeComparison(op code.Opcode) error {
@@ -613,10 +1288,23 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
-	if left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ {
+	if isIntegerOperation(left, right) {
 		return vm.executeIntegerComparison(op, left, right)
 	}
 
+	if isDecimalOperation(left, right) {
+		return vm.executeDecimalComparison(op, left, right)
+	}
+
+	if isFloatOperation(left, right) {
+		return vm.executeFloatComparison(op, left, right)
+	}
+
+	// 文字列は中身で比べる。大小は辞書順(バイト列)
+	if left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ {
+		return vm.executeStringComparison(op, left, right)
+	}
+
 	switch op {
 
 	case code.OpEqual:
@@ -652,11 +1340,38 @@ func (vm *VM) executeIntegerComparison(
 	case code.OpGreaterThan:
 		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
 
+	case code.OpGreaterEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+
 	default:
 		return fmt.Errorf("unknown operator: %d", op)
 	}
 }
 
+func (vm *VM) executeStringComparison(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+
+	switch op {
+
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue == rightValue))
+
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
+
+	case code.OpGreaterEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+
+	default:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	}
+}
+
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
 
 	// 以下のTrue, FalseはMonkeyとして定義しているグローバルオブジェクト
@@ -675,15 +1390,45 @@ func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return vm.executeArrayIndex(left, index)
 
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return vm.executeStringIndex(left, index)
+
 	case left.Type() == object.HASH_OBJ:
 		return vm.executeHashIndex(left, index)
 
+	// arr[1..3] は arr[1:3] と同じ
+	case index.Type() == object.RANGE_OBJ &&
+		(left.Type() == object.ARRAY_OBJ || left.Type() == object.STRING_OBJ):
+		r := index.(*object.Range)
+		return vm.executeSliceExpression(left,
+			&object.Integer{Value: r.Start},
+			&object.Integer{Value: r.End})
+
 	default:
 		return fmt.Errorf("index operator not supported: %s",
 			left.Type())
 	}
 }
 
+func (vm *VM) executeRange(start, end object.Object) error {
+
+	s, ok := start.(*object.Integer)
+	e, ok2 := end.(*object.Integer)
+
+	if !ok || !ok2 {
+		return fmt.Errorf("range bounds must be INTEGER, got %s..%s",
+			start.Type(), end.Type())
+	}
+
+	r := &object.Range{Start: s.Value, End: e.Value}
+
+	if err := vm.allocate(r); err != nil {
+		return err
+	}
+
+	return vm.push(r)
+}
+
 func (vm *VM) executeArrayIndex(array, index object.Object) error {
 
 	arrayObject := array.(*object.Array)
@@ -692,6 +1437,11 @@ func (vm *VM) executeArrayIndex(array, index object.Object) error {
 
 	max := int64(len(arrayObject.Elements) - 1)
 
+	// 負のインデックスは末尾から数える (arr[-1] は最後の要素)
+	if i < 0 {
+		i += max + 1
+	}
+
 	if i < 0 || i > max {
 		return vm.push(Null)
 	}
@@ -699,6 +1449,125 @@ func (vm *VM) executeArrayIndex(array, index object.Object) error {
 	return vm.push(arrayObject.Elements[i])
 }
 
+// 文字列のインデックスはバイトではなく文字(rune)の位置
+// その1文字の文字列を返す
+func (vm *VM) executeStringIndex(str, index object.Object) error {
+
+	runes := []rune(str.(*object.String).Value)
+
+	i := index.(*object.Integer).Value
+
+	if i < 0 {
+		i += int64(len(runes))
+	}
+
+	if i < 0 || i >= int64(len(runes)) {
+		return vm.push(Null)
+	}
+
+	return vm.push(&object.String{Value: string(runes[i])})
+}
+
+func (vm *VM) executeSliceExpression(left, low, high object.Object) error {
+
+	switch left := left.(type) {
+
+	case *object.Array:
+
+		start, end, err := sliceBounds(low, high, len(left.Elements))
+
+		if err != nil {
+			return err
+		}
+
+		// 元の配列と要素を共有しないようにコピーする
+		elements := make([]object.Object, end-start)
+
+		copy(elements, left.Elements[start:end])
+
+		array := &object.Array{Elements: elements}
+
+		if err := vm.allocate(array); err != nil {
+			return err
+		}
+
+		return vm.push(array)
+
+	case *object.String:
+
+		// インデックスと同じく文字(rune)の位置で切り出す
+		runes := []rune(left.Value)
+
+		start, end, err := sliceBounds(low, high, len(runes))
+
+		if err != nil {
+			return err
+		}
+
+		str := &object.String{Value: string(runes[start:end])}
+
+		if err := vm.allocate(str); err != nil {
+			return err
+		}
+
+		return vm.push(str)
+
+	default:
+		return fmt.Errorf("slice operator not supported: %s", left.Type())
+	}
+}
+
+// スライスの範囲を求める
+// 負の値は末尾から数え、範囲外の値は0からlengthの間に丸める
+func sliceBounds(low, high object.Object, length int) (int, int, error) {
+
+	start, err := sliceBound(low, 0, length)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err := sliceBound(high, length, length)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start > end {
+		start = end
+	}
+
+	return start, end, nil
+}
+
+func sliceBound(bound object.Object, defaultValue int, length int) (int, error) {
+
+	if bound == Null {
+		return defaultValue, nil
+	}
+
+	integer, ok := bound.(*object.Integer)
+
+	if !ok {
+		return 0, fmt.Errorf("slice index must be INTEGER, got %s", bound.Type())
+	}
+
+	value := integer.Value
+
+	if value < 0 {
+		value += int64(length)
+	}
+
+	switch {
+	case value < 0:
+		return 0, nil
+	case value > int64(length):
+		return length, nil
+	default:
+		return int(value), nil
+	}
+}
+
 func (vm *VM) executeHashIndex(hash, index object.Object) error {
 
 	hashObject := hash.(*object.Hash)
@@ -743,12 +1612,38 @@ func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
 			numArgs)
 	}
 
-	frame := NewFrame(cl, vm.sp-numArgs)
+	// yieldがある関数は本体を実行せずにGeneratorを返す (generator.go)
+	if cl.Fn.Generator {
+		return vm.newGenerator(cl, numArgs)
+	}
+
+	return vm.enterClosure(cl, numArgs)
+}
+
+// 関数と引数を積んだ上にフレームを作る
+func (vm *VM) enterClosure(cl *object.Closure, numArgs int) error {
+
+	if vm.framesIndex >= vm.options.MaxFrames {
+		return vm.callDepthError()
+	}
+
+	frame := vm.nextFrame(cl, vm.sp-numArgs)
+
+	// ローカル変数の分を確保できなければ呼び出さない
+	if err := vm.ensureStack(frame.basePointer + cl.Fn.NumLocals); err != nil {
+		return err
+	}
 
 	vm.pushFrame(frame)
 
 	vm.sp = frame.basePointer + cl.Fn.NumLocals
 
+	vm.recordStack()
+
+	if vm.hooks != nil {
+		vm.hookCall()
+	}
+
 	return nil
 }
 
@@ -775,11 +1670,57 @@ func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
 
 	args := vm.stack[vm.sp-numArgs : vm.sp]
 
-	result := builtin.Fn(args...)
+	var result object.Object
+
+	if builtin == pmapBuiltin {
+
+		var err error
+
+		if result, err = vm.executeParallelMap(args); err != nil {
+			return err
+		}
+	} else if builtin == renderBuiltin {
+
+		var err error
+
+		if result, err = vm.executeRender(args); err != nil {
+			return err
+		}
+	} else if builtin == nextBuiltin {
+
+		var err error
+
+		if result, err = vm.executeNext(args); err != nil {
+			return err
+		}
+	} else if builtin == sendBuiltin {
+
+		var err error
+
+		if result, err = vm.executeSend(args); err != nil {
+			return err
+		}
+	} else if builtin == recvBuiltin {
+
+		var err error
+
+		if result, err = vm.executeRecv(args); err != nil {
+			return err
+		}
+	} else {
+		result = builtin.Fn(args...)
+	}
+
+	vm.recordBuiltinCall(builtin)
 
 	vm.sp = vm.sp - numArgs - 1
 
 	if result != nil {
+
+		if err := vm.allocate(result); err != nil {
+			return err
+		}
+
 		vm.push(result)
 	} else {
 		vm.push(Null)
@@ -809,5 +1750,63 @@ func (vm *VM) pushClosure(constIndex int, numFree int) error {
 
 	closure := &object.Closure{Fn: function, Free: free}
 
+	if err := vm.allocate(closure); err != nil {
+		return err
+	}
+
+	return vm.push(closure)
+}
+
+// 自由変数を持たないのでクロージャを共有しても問題ない
+func (vm *VM) pushFunction(constIndex int) error {
+
+	closure := vm.cachedFunction(constIndex)
+
+	if closure == nil {
+
+		constant := vm.constants[constIndex]
+
+		function, ok := constant.(*object.CompiledFunction)
+
+		if !ok {
+			return fmt.Errorf("not a function: %+v", constant)
+		}
+
+		closure = &object.Closure{Fn: function}
+
+		vm.cacheFunction(constIndex, closure)
+	}
+
 	return vm.push(closure)
 }
+
+func (vm *VM) cachedFunction(constIndex int) *object.Closure {
+
+	if vm.functions != nil {
+		return vm.functions[constIndex]
+	}
+
+	if vm.function != nil && vm.functionIndex == constIndex {
+		return vm.function
+	}
+
+	return nil
+}
+
+func (vm *VM) cacheFunction(constIndex int, closure *object.Closure) {
+
+	if vm.functions == nil && vm.function == nil {
+		vm.function = closure
+		vm.functionIndex = constIndex
+		return
+	}
+
+	// 2つ目の関数からは表に移す
+	if vm.functions == nil {
+		vm.functions = make([]*object.Closure, len(vm.constants))
+		vm.functions[vm.functionIndex] = vm.function
+		vm.function = nil
+	}
+
+	vm.functions[constIndex] = closure
+}
@@ -1,10 +1,17 @@
 package vm
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
+	"time"
 
 	"example.com/monkey/ast"
+	"example.com/monkey/code"
 	"example.com/monkey/compiler"
 	"example.com/monkey/lexer"
 	"example.com/monkey/object"
@@ -37,6 +44,11 @@ func runVmTests(t *testing.T, tests []vmTestCase) {
 			t.Fatalf("compiler error: %s", err)
 		}
 
+		// コンパイラーが壊れた命令を出していないか
+		if err := compiler.Verify(comp.Bytecode()); err != nil {
+			t.Fatalf("verify error: %s", err)
+		}
+
 		// 仮想マシンを作る
 		vm := New(comp.Bytecode())
 
@@ -70,6 +82,13 @@ func testExpectedObject(
 			t.Errorf("testIntegerObject failed: %s", err)
 		}
 
+	// intの範囲を超える値 (32ビット環境)
+	case int64:
+		err := testIntegerObject(expected, actual)
+		if err != nil {
+			t.Errorf("testIntegerObject failed: %s", err)
+		}
+
 	case bool:
 		err := testBooleanObject(bool(expected), actual)
 		if err != nil {
@@ -255,6 +274,10 @@ func TestIntegerArithmetic(t *testing.T) {
 		{"-10", -10},
 		{"-50 + 100 + -50", 0},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"1 + 10 % 4 * 2", 5},
+		{"let x = 0; try { 1 % x } catch (e) { e }", &object.Error{Message: "division by zero"}},
 	}
 
 	runVmTests(t, tests)
@@ -288,6 +311,13 @@ func TestBooleanExpressions(t *testing.T) {
 		{"!!true", true},
 		{"!!false", false},
 		{"!!5", true},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"2 >= 2", true},
+		{"1 >= 2", false},
+		{"2.5 >= 2", true},
+		{`decimal("1.5") <= 1`, false},
 		{"!(if(false){ 5; })", true},
 		{"if((if(false){ 10 })) { 10 } else { 20 }", 20},
 	}
@@ -331,6 +361,18 @@ func TestStringExpressions(t *testing.T) {
 		{`"monkey"`, "monkey"},
 		{`"mon" + "key"`, "monkey"},
 		{`"mon" + "key" + "banana"`, "monkeybanana"},
+		{`"apple" < "banana"`, true},
+		{`"apple" > "banana"`, false},
+		{`"b" > "abc"`, true},
+		{`"abc" <= "abc"`, true},
+		{`"abc" >= "abd"`, false},
+		{`"" < "a"`, true},
+		{`"Z" < "a"`, true},
+		// ==、!= も大小と同じく中身で比べる
+		{`"a" == "a"`, true},
+		{`let x = "a"; let y = x + "b"; [y == "ab", y != "ab", y <= "ab", y == x, y != x]`,
+			[]interface{}{true, false, true, false, true}},
+		{`let x = "1"; x == 1`, false},
 	}
 
 	runVmTests(t, tests)
@@ -383,7 +425,16 @@ func TestIndexExpressions(t *testing.T) {
 		{"[[1, 1, 1]][0][0]", 1},
 		{"[][0]", Null},
 		{"[1, 2, 3][99]", Null},
-		{"[1][-1]", Null},
+		{"[1][-1]", 1},
+		{"[1, 2, 3][-1]", 3},
+		{"[1, 2, 3][-3]", 1},
+		{"[1, 2, 3][-4]", Null},
+		{"[][-1]", Null},
+		{`"abc"[0]`, "a"},
+		{`"abc"[-1]`, "c"},
+		{`"abc"[3]`, Null},
+		{`"日本語"[1]`, "本"},
+		{`let s = "héllo"; s[len(s) - 1]`, "o"},
 		{"{1: 1, 2: 2}[1]", 1},
 		{"{1: 1, 2: 2}[2]", 2},
 		{"{1: 1}[0]", Null},
@@ -655,7 +706,7 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 			t.Fatalf("expected VM error but resulted in none.")
 		}
 
-		if err.Error() != tt.expected {
+		if errors.Unwrap(err).Error() != tt.expected {
 			t.Fatalf("wrong VM error: want=%q, got=%q",
 				tt.expected,
 				err)
@@ -877,3 +928,2417 @@ func TestRecursiveFibonacci(t *testing.T) {
 
 	runVmTests(t, tests)
 }
+
+// コンパイル済みのバイトコードを使い回してVMだけを毎回作り直す(warm start)
+func compileForBenchmark(tb testing.TB, input string) *compiler.Bytecode {
+
+	tb.Helper()
+
+	comp := compiler.New()
+
+	err := comp.Compile(parse(input))
+
+	if err != nil {
+		tb.Fatalf("compiler error: %s", err)
+	}
+
+	return comp.Bytecode()
+}
+
+func runWarmStart(tb testing.TB, bytecode *compiler.Bytecode) {
+
+	machine := New(bytecode)
+
+	err := machine.Run()
+
+	if err != nil {
+		tb.Fatalf("vm error: %s", err)
+	}
+}
+
+// 1回の実行あたりのアロケーション数が上限を超えていないことを検証する
+// オブジェクトのキャッシュ、フレームのプール、VMの再利用などによる改善を固定するため
+func testAllocationBudget(t *testing.T, input string, budget float64) {
+
+	t.Helper()
+
+	bytecode := compileForBenchmark(t, input)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		runWarmStart(t, bytecode)
+	})
+
+	if allocs > budget {
+		t.Errorf("too many allocations for %q. budget=%.0f, got=%.0f",
+			input,
+			budget,
+			allocs)
+	}
+}
+
+func TestAllocationBudget(t *testing.T) {
+
+	tests := []struct {
+		input  string
+		budget float64
+	}{
+		{"1 + 2", 7},
+		{"let a = 1; a * 2", 7},
+		{`fn(a, b){ a + b }(1, 2)`, 9},
+		// 自由変数を持たない関数はループの中で参照してもクロージャを作らない
+		{`for (x in [1, 2, 3, 4, 5, 6, 7, 8]) { let f = fn(){ x }; }`, 11},
+		// 小さな整数の計算結果は共有の整数を使う
+		{`let n = 0; for (x in [1, 2, 3, 4, 5, 6, 7, 8]) { n = n + x * 2 - 1 }`, 9},
+		// 戻ったフレームを次の呼び出しで使い回す
+		{`let f = fn(n) { if (n == 0) { return 0 }; f(n - 1) }; f(1); f(1); f(1); f(1)`, 10},
+	}
+
+	for _, tt := range tests {
+		testAllocationBudget(t, tt.input, tt.budget)
+	}
+}
+
+func BenchmarkWarmStartTrivialExpression(b *testing.B) {
+
+	bytecode := compileForBenchmark(b, "1 + 2")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		runWarmStart(b, bytecode)
+	}
+}
+
+func BenchmarkWarmStartFibonacci(b *testing.B) {
+
+	bytecode := compileForBenchmark(b, `
+	let fibonacci = fn(x){
+		if(x < 2){ return x; }
+		fibonacci(x - 1) + fibonacci(x - 2);
+	};
+	fibonacci(15);
+	`)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		runWarmStart(b, bytecode)
+	}
+}
+
+// 算術演算とローカル変数の読み書きだけのループ
+// 値は小さな整数に収まるので、命令の振り分けとオペランドの読み取りの速さを見る
+func BenchmarkArithmeticLoop(b *testing.B) {
+
+	bytecode := compileForBenchmark(b, `
+	let sum = fn(n) {
+		let total = 0;
+		let i = 0;
+		while (i < n) {
+			let j = 0;
+			while (j < 100) {
+				total = (total + j * 3) % 500 - 1;
+				j = j + 1;
+			}
+			i = i + 1;
+		}
+		total
+	};
+	sum(1000);
+	`)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		runWarmStart(b, bytecode)
+	}
+}
+
+// 再帰呼び出しが多いスクリプト
+// 呼び出しのたびにフレームを作らず、同じ深さのフレームを使い回す効果を見る
+func BenchmarkRecursiveFibonacci(b *testing.B) {
+
+	bytecode := compileForBenchmark(b, `
+	let fibonacci = fn(x) {
+		if (x < 2) { return x; }
+		fibonacci(x - 1) + fibonacci(x - 2);
+	};
+	fibonacci(20);
+	`)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		runWarmStart(b, bytecode)
+	}
+}
+
+func BenchmarkRecursiveAckermann(b *testing.B) {
+
+	bytecode := compileForBenchmark(b, `
+	let ackermann = fn(m, n) {
+		if (m == 0) { return n + 1; }
+		if (n == 0) { return ackermann(m - 1, 1); }
+		ackermann(m - 1, ackermann(m, n - 1));
+	};
+	ackermann(2, 50);
+	`)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		runWarmStart(b, bytecode)
+	}
+}
+
+func TestForInExpressions(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`for (x in [1, 2, 3]) { x }`, Null},
+		{`for (x in []) { x }`, Null},
+		{`let last = 0; for (x in [1, 2, 3]) { last = x; }; last`, 3},
+		{`let last = ""; for (c in "abc") { last = c; }; last`, "c"},
+		{`let last = 0; for (k in {"a": 1}) { last = k; }; last`, "a"},
+		{`
+		let lastOf = fn(arr){
+			let result = 0;
+			for (x in arr) { result = x * 2; };
+			result;
+		};
+		lastOf([1, 2, 3]);
+		`, 6},
+		{`
+		let f = fn(arr){
+			for (x in arr) {
+				if (x > 1) { return x; }
+			}
+		};
+		f([1, 5, 9]);
+		`, 5},
+		{`for (x in [1]) { for (y in [2, 3]) { y } }`, Null},
+		// ハッシュのキーは決まった順に取り出す
+		{`let s = ""; for (k in {"b": 1, "a": 2, "c": 3}) { s = s + k }; s`, "abc"},
+		{`let keys = []; for (k in {10: 1, 9: 2, -1: 3}) { keys = push(keys, k) }; keys`, []int{-1, 9, 10}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestSliceExpressions(t *testing.T) {
+
+	tests := []vmTestCase{
+		{"[1, 2, 3, 4][1:3]", []int{2, 3}},
+		{"[1, 2, 3, 4][:2]", []int{1, 2}},
+		{"[1, 2, 3, 4][2:]", []int{3, 4}},
+		{"[1, 2, 3, 4][:]", []int{1, 2, 3, 4}},
+		{"[1, 2, 3, 4][3:1]", []int{}},
+		{"[1, 2, 3, 4][2:100]", []int{3, 4}},
+		{"[][0:1]", []int{}},
+		{"let a = [1, 2, 3]; let b = a[1:]; len(a) + len(b)", 5},
+		{`"hello"[1:3]`, "el"},
+		{`"hello"[:2]`, "he"},
+		{`"hello"[3:]`, "lo"},
+		{`"hello"[10:]`, ""},
+		{`"hello"[-3:]`, "llo"},
+		{`"hello"[:-1]`, "hell"},
+		{"[1, 2, 3, 4][-2:]", []int{3, 4}},
+		{"[1, 2, 3, 4][-10:1]", []int{1}},
+		// 文字の位置で切り出す
+		{`"héllo"[1:3]`, "él"},
+		{`"日本語"[1:]`, "本語"},
+		{`"日本語"[1..2]`, "本"},
+	}
+
+	runVmTests(t, tests)
+}
+
+// len/pushなどの組み込み関数とグローバル変数を大量に参照するスクリプト
+// 100要素の配列の三重ループで100万回呼び出す
+func hotLoopInput() string {
+
+	elements := strings.Repeat("1, ", 99) + "1"
+
+	return `
+	let a = [` + elements + `];
+	let b = [];
+	let n = 0;
+	for (x in a) {
+		for (y in a) {
+			for (z in a) {
+				len(a);
+				push(b, n);
+			}
+		}
+	}
+	`
+}
+
+// OpGetGlobal/OpGetBuiltinはどちらもオペランドでスライスを直接引くだけなので、
+// 呼び出し位置ごとのキャッシュは持たない
+// このベンチマークでも参照にかかる時間は全体の数%で、大半は組み込み関数の呼び出しと割り当て
+func BenchmarkGlobalAndBuiltinLookups(b *testing.B) {
+
+	bytecode := compileForBenchmark(b, hotLoopInput())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		runWarmStart(b, bytecode)
+	}
+}
+
+func TestInterpolatedStrings(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`let name = "monkey"; "Hello ${name}!"`, "Hello monkey!"},
+		{`"1 + 2 = ${1 + 2}"`, "1 + 2 = 3"},
+		{`"${true}${[1, 2]}"`, "true[1, 2]"},
+		{`let f = fn(x){ "<${x}>" }; f("a") + f(1)`, "<a><1>"},
+		{`"${"nested ${1}"}"`, "nested 1"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCustomBuiltins(t *testing.T) {
+
+	symbolTable := compiler.NewSymbolTable()
+	symbolTable.DefineBuiltin(0, "answer")
+
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+
+	err := comp.Compile(parse("answer() + 1"))
+
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	answer := &object.Builtin{Fn: func(args ...object.Object) object.Object {
+		return &object.Integer{Value: 41}
+	}}
+
+	vm := NewWithBuiltins(comp.Bytecode(), []*object.Builtin{answer})
+
+	err = vm.Run()
+
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	testExpectedObject(t, 42, vm.LastPoppedStackElem())
+}
+
+func TestExecutionLimits(t *testing.T) {
+
+	tests := []struct {
+		input       string
+		fuel        int
+		memoryLimit int
+		expected    string
+	}{
+		// 十分な制限の中では普通に実行できる
+		{`let f = fn(x) { x * 2 }; f(21)`, 100, 1024, ""},
+		{`let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; f(100)`, 50, 0, "out of fuel"},
+		{`for (x in [1, 2, 3, 4, 5]) { x }`, 10, 0, "out of fuel"},
+		{`while (true) { 1 }`, 100, 0, "out of fuel"},
+		{`let f = fn(s) { f(s + s) }; f("ab")`, 0, 4096, "memory limit exceeded: 4096 bytes"},
+		{`let a = []; let f = fn(a) { f(push(a, 1)) }; f(a)`, 0, 4096, "memory limit exceeded: 4096 bytes"},
+		{`[1, 2, 3][0:2]`, 0, 40, "memory limit exceeded: 40 bytes"},
+	}
+
+	for _, tt := range tests {
+
+		comp := compiler.New()
+
+		err := comp.Compile(parse(tt.input))
+
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetFuel(tt.fuel)
+		vm.SetMemoryLimit(tt.memoryLimit)
+
+		err = vm.Run()
+
+		if tt.expected == "" {
+
+			if err != nil {
+				t.Errorf("unexpected vm error for %q: %s", tt.input, err)
+			}
+
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+
+		if errors.Unwrap(err).Error() != tt.expected {
+			t.Errorf("wrong VM error for %q: want=%q, got=%q",
+				tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`render("plain text", {})`, "plain text"},
+		{`render("", {})`, ""},
+		{`render("Hello $${name}!", {"name": "monkey"})`, "Hello monkey!"},
+		{`render("$${a} + $${b} = $${a + b}", {"a": 1, "b": 2})`, "1 + 2 = 3"},
+		{`render("$${len(items)} items, first $${items[0]}", {"items": ["x", "y"]})`,
+			"2 items, first x"},
+		{`render("$${cfg[key]}", {"cfg": {"port": 8080}, "key": "port"})`, "8080"},
+		// ${}はrenderを呼ぶ前に、$${}はrenderの中で評価される
+		{`let who = "outer"; render("${who}/$${who}", {"who": "inner"})`, "outer/inner"},
+		{`let t = "$${n * 2}"; render(t, {"n": 21})`, "42"},
+		// dataに入れた関数も呼べる
+		{`let f = fn() { "abc" + "def" }; render("$${g()}", {"g": f})`, "abcdef"},
+		{`render("$${missing}", {})`,
+			&object.Error{Message: "render: undefined variable missing"},
+		},
+		{`render("$${1 +}", {})`,
+			&object.Error{Message: "render: no prefix parse function for EOF found"},
+		},
+		{`render(1, {})`,
+			&object.Error{Message: "first argument to `render` must be STRING, got INTEGER"},
+		},
+		{`render("", [])`,
+			&object.Error{Message: "second argument to `render` must be HASH, got ARRAY"},
+		},
+	}
+
+	runVmTests(t, tests)
+
+	// 式の実行も呼び出し元の制限に数える
+	limitTests := []struct {
+		input    string
+		fuel     int
+		expected string
+	}{
+		{`render("$${f()}", {"f": fn() { while (true) { 1 } }})`, 1000, "out of fuel"},
+		{`try { render("$${f()}", {"f": fn() { while (true) { 1 } }}) } catch (e) { e }`, 1000,
+			"out of fuel"},
+		{`let r = fn(t) { render("$${r(t)}", {"r": r, "t": t}) }; r(1)`, 0,
+			"render nested too deeply: 16 levels"},
+	}
+
+	for _, tt := range limitTests {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := NewWithOptions(comp.Bytecode(), Options{MaxFrames: 16})
+		vm.SetFuel(tt.fuel)
+
+		err := vm.Run()
+
+		if err == nil || !strings.HasSuffix(err.Error(), tt.expected) {
+			t.Errorf("wrong VM error for %q: want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestNullLiteral(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`null`, Null},
+		{`null == null`, true},
+		{`null != 1`, true},
+		{`!null`, true},
+		{`if (null) { 1 } else { 2 }`, 2},
+		{`first([]) == null`, true},
+		{`let h = {"a": null}; h["a"] == h["b"]`, true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRangeExpressions(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`len(1..10)`, 9},
+		{`len(5..1)`, 0},
+		{`let n = 3; len(0..n * 2)`, 6},
+		{`let last = 0; for (i in 1..4) { last = i; }; last`, 3},
+		{`for (i in 3..3) { i }`, Null},
+		{`
+		let find = fn(n) {
+			for (i in 0..n) {
+				if (i * i > 10) { return i; }
+			}
+		};
+		find(10)
+		`, 4},
+		{`[1, 2, 3, 4][1..3]`, []int{2, 3}},
+		{`[1, 2, 3][1..10]`, []int{2, 3}},
+		{`"monkey"[0..3]`, "mon"},
+	}
+
+	runVmTests(t, tests)
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`1.."a"`, "range bounds must be INTEGER, got INTEGER..STRING"},
+		{`(1..2)[0]`, "index operator not supported: RANGE"},
+	}
+
+	for _, tt := range errorTests {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+
+		err := vm.Run()
+
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+
+		if errors.Unwrap(err).Error() != tt.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestDateTimeBuiltins(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`date_format(datetime("2024-01-31T10:00:00Z"))`, "2024-01-31T10:00:00Z"},
+		{`date_format(datetime("2024-01-31"), "2006/01/02")`, "2024/01/31"},
+		{`date_format(datetime("2024-01-31T10:00:00+09:00"), "15:04 -07:00")`, "10:00 +09:00"},
+		{`date_format(date_add(datetime("2024-01-31T23:30:00Z"), duration("PT45M")))`,
+			"2024-02-01T00:15:00Z"},
+		{`date_format(date_diff(datetime("2024-03-01"), datetime("2024-02-28")))`, "P2D"},
+		{`date_format(date_diff(datetime("2024-01-01"), datetime("2024-01-01T01:30:00Z")))`,
+			"-PT1H30M"},
+		{`date_format(duration("P1W2DT3H"))`, "P9DT3H"},
+		{`date_format(date_add(duration("1h"), duration(1500)))`, "PT1H1.5S"},
+		{`date_format(duration("PT2.25S"), "ms")`, 2250},
+		{`date_format(duration(0))`, "PT0S"},
+		{`date_format(now()) == ""`, false},
+		{`datetime("yesterday")`, &object.Error{Message: `datetime: invalid datetime "yesterday"`}},
+		{`duration("P1M")`, &object.Error{Message: `duration: invalid duration "P1M"`}},
+		{`duration("P")`, &object.Error{Message: `duration: invalid duration "P"`}},
+		{`date_add(datetime("2024-01-01"), 1)`,
+			&object.Error{Message: "second argument to `date_add` must be DURATION, got INTEGER"}},
+		{`date_diff(datetime("2024-01-01"), 1)`,
+			&object.Error{Message: "arguments to `date_diff` must be DATETIME, got DATETIME and INTEGER"}},
+		{`date_format(duration(1), "x")`, &object.Error{Message: `unknown duration format "x"`}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFloatArithmetic(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`let f = 1.5 + 2.25; "${f}"`, "3.75"},
+		{`let f = 0.5 * 4; "${f}"`, "2.0"},
+		{`let f = 1 / 4.0; "${f}"`, "0.25"},
+		{`let f = 10 - 0.5; "${f}"`, "9.5"},
+		{`let f = -1.5; "${f}"`, "-1.5"},
+		{`let f = 5.5 % 2; "${f}"`, "1.5"},
+		// 整数同士の割り算は整数のまま
+		{`1 / 4`, 0},
+		{`2.5 > 2`, true},
+		{`1 < 1.5`, true},
+		{`1 == 1.0`, true},
+		{`0.1 + 0.2 == 0.3`, false},
+		{`1.5 != 1.5`, false},
+		{`try { 1.5 / 0 } catch (e) { e }`, &object.Error{Message: "division by zero"}},
+		{`try { 1.5 + "a" } catch (e) { e }`, &object.Error{Message: "unsupported types for binary operation: FLOAT STRING"}},
+		{`try { 1.5 + decimal("1") } catch (e) { e }`, &object.Error{Message: "unsupported types for binary operation: FLOAT DECIMAL"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`decimal("0.1") + decimal("0.2") == decimal("0.3")`, true},
+		{`let d = decimal("0.1") + decimal("0.2"); "${d}"`, "0.3"},
+		{`let d = decimal("19.99") * 3; "${d}"`, "59.97"},
+		{`let d = decimal("10") - decimal("0.01"); "${d}"`, "9.99"},
+		{`let d = decimal("1.50") / 4; "${d}"`, "0.375"},
+		{`let d = decimal(1) / 3; "${d}"`, "0.33333333333333333333"},
+		{`decimal(1) / 3 * 3 == 1`, true},
+		{`let d = -decimal("2.5"); "${d}"`, "-2.5"},
+		{`let d = decimal("1e3"); "${d}"`, "1000"},
+		{`decimal("0.1") < decimal("0.2")`, true},
+		{`decimal("2.5") > 2`, true},
+		{`1 == decimal("1.0")`, true},
+		{`decimal("0.3") != decimal("0.30")`, false},
+		{`decimal("abc")`, &object.Error{Message: `decimal: invalid decimal "abc"`}},
+		{`decimal("1/3")`, &object.Error{Message: `decimal: invalid decimal "1/3"`}},
+		{`decimal(true)`,
+			&object.Error{Message: "argument to `decimal` must be STRING or INTEGER, got BOOLEAN"}},
+	}
+
+	runVmTests(t, tests)
+
+	comp := compiler.New()
+
+	if err := comp.Compile(parse(`decimal(1) / decimal("0")`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	if err := New(comp.Bytecode()).Run(); err == nil || errors.Unwrap(err).Error() != "division by zero" {
+		t.Errorf("expected division by zero error. got=%v", err)
+	}
+}
+
+func TestNumericBuiltins(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`dot([1, 2, 3], [4, 5, 6])`, 32},
+		{`dot([], [])`, 0},
+		{`let m = matmul([[1, 2], [3, 4]], [[5, 6], [7, 8]]); "${m}"`, "[[19, 22], [43, 50]]"},
+		{`let m = matmul([[1, 2, 3]], [[1], [2], [3]]); "${m}"`, "[[14]]"},
+		{`let m = transpose([[1, 2, 3], [4, 5, 6]]); "${m}"`, "[[1, 4], [2, 5], [3, 6]]"},
+		{`transpose([])`, []int{}},
+		{`dot([1, 2], [1])`,
+			&object.Error{Message: "dot: vectors must have the same length, got 2 and 1"}},
+		{`dot([1, "a"], [1, 2])`,
+			&object.Error{Message: "argument to `dot` must be ARRAY of INTEGER, got STRING"}},
+		{`matmul([[1, 2]], [[1, 2]])`,
+			&object.Error{Message: "matmul: cannot multiply 1x2 and 1x2 matrices"}},
+		{`transpose([[1, 2], [3]])`,
+			&object.Error{Message: "transpose: rows must have the same length"}},
+		{`transpose(1)`, &object.Error{Message: "argument to `transpose` must be ARRAY, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestParallelMap(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`pmap([1, 2, 3, 4, 5], fn(x) { x * x })`, []int{1, 4, 9, 16, 25}},
+		{`pmap([], fn(x) { x })`, []int{}},
+		{`let base = 100; pmap([1, 2, 3], fn(x) { base + x }, 2)`, []int{101, 102, 103}},
+		{`let add = fn(n) { fn(x) { x + n } }; pmap([1, 2, 3], add(10), 1)`, []int{11, 12, 13}},
+		{`
+		let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+		pmap([10, 15, 20, 5], fib)
+		`, []int{55, 610, 6765, 5}},
+		{`pmap([[1], [1, 2], []], len)`, []int{1, 2, 0}},
+		// 自由変数はワーカーごとに複製する
+		{`let counter = fn() { let n = 0; fn(x) { n = n + x; n } }; pmap([1, 2, 3], counter(), 1)`,
+			[]int{1, 3, 6}},
+		{`let f = fn() { let n = 0; fn(x) { n = n + x; n } }(); pmap([1, 2, 3], f, 1); f(10)`, 10},
+		// グローバル変数や要素から辿れるクロージャもワーカーごとに複製する
+		// (共有していると go test -race で競合が見つかる)
+		{`
+		let counter = fn() { let n = 0; fn() { n = n + 1; n } }();
+		let boxed = {"c": [counter]};
+		pmap([counter, counter, counter, counter, counter, counter, counter, counter],
+			fn(c) { counter(); boxed["c"][0](); c() }, 4);
+		counter()
+		`, 1},
+		{`pmap(1, len)`, &object.Error{Message: "first argument to `pmap` must be ARRAY, got INTEGER"}},
+		{`pmap([1], 1)`, &object.Error{Message: "second argument to `pmap` must be FUNCTION, got INTEGER"}},
+		{`pmap([1], len, 0)`,
+			&object.Error{Message: "third argument to `pmap` must be a positive INTEGER, got 0"}},
+	}
+
+	runVmTests(t, tests)
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`pmap([1, 2], fn() { 1 })`, "pmap: wrong number of arguments: want=0, got=1"},
+		{`pmap([1, "a"], fn(x) { -x })`, "pmap: unsupported type for negatin: STRING"},
+	}
+
+	for _, tt := range errorTests {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err := New(comp.Bytecode()).Run()
+
+		if err == nil || errors.Unwrap(err).Error() != tt.expected {
+			t.Errorf("wrong VM error for %q: want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+
+	// 各VMで使った燃料は呼び出し元から差し引かれる
+	// 組み込み関数ならワーカーのVMは命令を実行しない
+	fuelLeft := func(mapper string) int {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(`let f = fn(x) { x + 1 }; pmap([1, 2, 3], ` + mapper + `)`)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetFuel(1000)
+
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		// 共有の方に残っている燃料も数える
+		return vm.fuel + int(vm.budget.fuel)
+	}
+
+	// fは1回につき3命令(OpGetLocal, OpAddConstant, OpReturnValue)
+	if used := fuelLeft("len") - fuelLeft("f"); used != 3*3 {
+		t.Errorf("wrong fuel charged for workers. want=%d, got=%d", 3*3, used)
+	}
+
+	limitTests := []struct {
+		input       string
+		fuel        int
+		memoryLimit int
+		expected    string
+	}{
+		// 1回分は足りるが、全部のワーカーを合わせると足りない
+		{`pmap([1, 2, 3, 4], fn(x) { let n = 0; while (n < 200) { n = n + 1 }; n }, 4)`, 3000, 0,
+			"pmap: out of fuel"},
+		// ワーカーのスタックもメモリの上限に数える
+		{`pmap([1, 2, 3, 4], fn(x) { x }, 2)`, 0, 100000, ""},
+		{`pmap([1, 2, 3, 4], fn(x) { x }, 4)`, 0, 100000, "memory limit exceeded: 100000 bytes"},
+		// 入れ子は呼び出しの深さの上限まで
+		{`let f = fn(x) { pmap([x], f) }; f(1)`, 0, 0, "pmap: pmap nested too deeply: 16 levels"},
+	}
+
+	for _, tt := range limitTests {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := NewWithOptions(comp.Bytecode(), Options{MaxFrames: 16})
+		vm.SetFuel(tt.fuel)
+		vm.SetMemoryLimit(tt.memoryLimit)
+
+		err := vm.Run()
+
+		if tt.expected == "" {
+
+			if err != nil {
+				t.Errorf("unexpected vm error for %q: %s", tt.input, err)
+			}
+
+			continue
+		}
+
+		if err == nil || !strings.HasSuffix(err.Error(), tt.expected) {
+			t.Errorf("wrong VM error for %q: want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestRuntimeErrorPosition(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`1 + true`, "runtime error at line 1: unsupported types for binary operation: INTEGER BOOLEAN"},
+		{`let x = 1;
+let y = 2;
+-"a"`, "runtime error at line 3: unsupported type for negatin: STRING"},
+		{`let foo = fn(a) {
+	let b = a * 2;
+	b + "x"
+};
+foo(1)`, "runtime error at line 3 in fn foo: unsupported types for binary operation: INTEGER STRING"},
+		{`let apply = fn(f) { f() };
+apply(fn() {
+	1;
+	[1][true]
+})`, "runtime error at line 4 in anonymous fn: index operator not supported: ARRAY"},
+		{`let f = fn() { 1 };
+f(
+  1
+)`, "runtime error at line 2: wrong number of arguments: want=0, got=1"},
+		{`pmap([1, 2],
+fn(x) {
+	x + "a"
+})`, "runtime error at line 3 in anonymous fn: pmap: unsupported types for binary operation: INTEGER STRING"},
+	}
+
+	for _, tt := range tests {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err := New(comp.Bytecode()).Run()
+
+		if err == nil {
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error for %q:\nwant=%q\ngot=%q", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+
+	input := `
+	let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } };
+	f(3);
+	let s = "a" + "b";
+	len([1, 2, 3]) + len(s);
+	pmap([1, 2], fn(x) { [x] });
+	`
+
+	comp := compiler.New()
+
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+
+	if report := vm.Report(); report.Instructions != 0 {
+		t.Errorf("expected an empty report before EnableReport. got=%+v", report)
+	}
+
+	vm.EnableReport()
+
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	report := vm.Report()
+
+	if report.Instructions == 0 {
+		t.Errorf("no instructions recorded")
+	}
+
+	// mainとf(3)からf(0)まで
+	if report.PeakFrames != 5 {
+		t.Errorf("wrong peak frames. want=5, got=%d", report.PeakFrames)
+	}
+
+	if report.PeakStack == 0 {
+		t.Errorf("no stack depth recorded")
+	}
+
+	// pmapのワーカーで作った配列も数える
+	if report.Allocations[object.ARRAY_OBJ] < 4 {
+		t.Errorf("wrong array allocations. got=%d", report.Allocations[object.ARRAY_OBJ])
+	}
+
+	if report.BuiltinCalls["len"] != 2 || report.BuiltinCalls["pmap"] != 1 {
+		t.Errorf("wrong builtin calls. got=%v", report.BuiltinCalls)
+	}
+}
+
+func TestLogicalOperators(t *testing.T) {
+
+	tests := []vmTestCase{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || false", false},
+		{"false || 1", true},
+		{"null || null", false},
+		{"1 < 2 && 2 < 3", true},
+		{"1 > 2 || 2 > 3", false},
+		// 右辺を評価するとエラーになる
+		{`false && (1 + "a")`, false},
+		{`true || (1 + "a")`, true},
+		{`let n = 0; let f = fn() { n + "a" }; n > 0 && f()`, false},
+		{`let xs = []; len(xs) == 0 || xs[0] > 1`, true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestWhileExpressions(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`while (false) { 1 }`, Null},
+		{`let x = while (1 > 2) { 3 }; x`, Null},
+		{`let f = fn() { while (true) { return 5; } }; f()`, 5},
+		// 条件が偽なら本体を実行しない
+		{`let f = fn(n) { while (n > 0) { return n * 2; } }; f(0)`, Null},
+		{`let f = fn(n) { while (n > 0) { return n * 2; } }; f(3)`, 6},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBreakAndContinue(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`let f = fn() { while (true) { break; } 5 }; f()`, 5},
+		{`for (x in [1, 2, 3]) { break }`, Null},
+		{`let f = fn() { for (x in [1, 2, 3]) { if (x == 2) { return x; } continue; return 100; } }; f()`, 2},
+		{`let f = fn(xs) { for (x in xs) { if (x > 2) { break; } } 9 }; f([1, 2, 3, 4])`, 9},
+		{`for (x in 1..1000000) { if (x > 3) { break } }; 7`, 7},
+		// 内側のループだけを抜ける
+		{`
+		let f = fn() {
+			for (x in [1, 2]) {
+				while (true) { break; }
+				for (y in [1, 2, 3]) { if (y == 2) { break; } }
+				if (x == 2) { return x * 10; }
+			}
+		};
+		f()
+		`, 20},
+		// breakで抜けた後、スタックにイテレーターが残らない
+		{`let f = fn() { for (x in [1]) { break; } }; let g = fn() { f(); f(); 3 }; g()`, 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestAssignExpressions(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`let x = 1; x = x + 1; x`, 2},
+		{`let x = 1; let y = 0; y = x = 5; x + y`, 10},
+		{`let n = 0; let inc = fn() { n = n + 1 }; inc(); inc(); n`, 2},
+		{`let f = fn(a) { a = a * 2; a }; f(4)`, 8},
+		{`let f = fn() { let s = 0; for (x in 1..5) { s = s + x; } s }; f()`, 10},
+		{`let i = 0; while (i < 10) { i = i + 1; } i`, 10},
+		{`let i = 0; let s = 0; while (true) { i = i + 1; if (i > 5) { break; } if (i == 3) { continue; } s = s + i; } s`, 12},
+		// 自由変数への代入はそのクロージャの中だけに残る
+		{`
+		let counter = fn() { let n = 0; fn() { n = n + 1 } };
+		let c = counter();
+		c(); c();
+		c()
+		`, 3},
+		{`let make = fn() { let n = 0; let inc = fn() { n = n + 1 }; inc(); n }; make()`, 0},
+		// pmapのVMでの代入は呼び出し元に反映されない
+		{`let total = 0; pmap([1, 2, 3], fn(x) { total = total + x }, 3); total`, 0},
+	}
+
+	runVmTests(t, tests)
+}
+
+// 64KBを超える関数でもジャンプ先が壊れない
+func TestWideJumps(t *testing.T) {
+
+	body := strings.Repeat("x = x + 1; ", 8000)
+
+	tests := []vmTestCase{
+		{`let f = fn() { let x = 0; let i = 0; while (i < 2) { i = i + 1; ` + body + ` } x }; f()`, 16000},
+		{`let f = fn() { let x = 0; for (k in [1, 2, 3]) { if (k == 2) { continue; } ` + body + ` } x }; f()`, 16000},
+		{`let f = fn() { let x = 0; while (true) { if (x > 0) { break; } ` + body + ` } x }; f()`, 8000},
+		{`let x = 0; if (x > 0) { ` + body + ` } else { 5 }`, 5},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBlockScopes(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`let x = 1; if (true) { let x = 2; }; x`, 1},
+		{`let x = 1; if (true) { let x = 2; x }`, 2},
+		{`let f = fn() { let x = 1; if (x > 0) { let x = 10; x = x + 1; } x }; f()`, 1},
+		// ブロックの中で外側の変数に代入する
+		{`let f = fn() { let x = 1; if (true) { x = 5; } x }; f()`, 5},
+		// ブロックの変数をキャプチャしたクロージャ
+		{`let f = fn() { let g = 0; if (true) { let y = 7; g = fn() { y }; } g() }; f()`, 7},
+		{`let f = fn() { let sum = 0; for (i in 1..4) { let sq = i * i; sum = sum + sq; } sum }; f()`, 14},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestImports(t *testing.T) {
+
+	modules := compiler.MapResolver{
+		"math":   `let double = fn(x) { x * 2 }; let helper = fn(x) { x + 1 }; let inc = fn(x) { helper(x) };`,
+		"list":   `let m = import "math"; let doubled = fn(xs) { let out = []; for (x in xs) { out = push(out, m["double"](x)); } out }; const size = len;`,
+		"config": `let items = [1, 2]; let items = [1, 2, 3];`,
+	}
+
+	tests := []vmTestCase{
+		{`let m = import "math"; m["double"](21)`, 42},
+		{`let m = import("math"); m["inc"](1)`, 2},
+		// 何度importしても同じ結果
+		{`let a = import "config"; let b = import "config"; a == b`, true},
+		{`let f = fn() { import "config" }; f() == import "config"`, true},
+		// 定義し直した変数は最後の値
+		{`len((import "config")["items"])`, 3},
+		{`let l = import "list"; l["doubled"]([1, 2])`, []int{2, 4}},
+		{`(import "list")["size"]("abc")`, 3},
+		{`let x = 0; if (x > 0) { import "math" }; (import "math")["double"](2)`, 4},
+	}
+
+	for _, tt := range tests {
+
+		comp := compiler.New()
+		comp.SetModuleResolver(modules)
+
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error for %q: %s", tt.input, err)
+		}
+
+		vm := New(comp.Bytecode())
+
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestInlinedCalls(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`let double = fn(x) { x * 2 }; double(21)`, 42},
+		{`let add = fn(a, b) { a + b }; let double = fn(x) { x * 2 }; add(double(1), double(2))`, 6},
+		{`let sub = fn(a, b) { a - b }; sub(sub(10, 3), sub(2, 1))`, 6},
+		// 呼び出し側の同じ名前の変数とは関係ない
+		{`let double = fn(x) { x * 2 }; let f = fn(x) { double(x + 1) }; f(4)`, 10},
+		{`let second = fn(xs) { xs[1] }; let f = fn() { let s = 0; for (i in 0..3) { s = s + second([i, i * 10]); } s }; f()`, 30},
+		{`let pair = fn(a, b) { [b, a] }; pair(1, 2)`, []int{2, 1}},
+		// 展開した関数も値として使える
+		{`let double = fn(x) { x * 2 }; let apply = fn(f, x) { f(x) }; apply(double, 5)`, 10},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestMalformedBytecode(t *testing.T) {
+
+	tests := []struct {
+		bytecode *compiler.Bytecode
+		expected string
+	}{
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpConstant, 0)[:2]},
+			"malformed bytecode: main: 0000: OpConstant is truncated: want 2 operand bytes, got 1",
+		},
+		{
+			&compiler.Bytecode{
+				Instructions: code.Make(code.OpNull),
+				Constants: []object.Object{
+					&object.Integer{Value: 1},
+					&object.CompiledFunction{Instructions: code.Instructions{255}},
+				},
+			},
+			"malformed bytecode: constant 1: 0000: opcode 255 undefined",
+		},
+	}
+
+	for _, tt := range tests {
+
+		err := New(tt.bytecode).Run()
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+// 整数をオペランドの値以下に切り詰める独自の命令
+var opClamp, errClamp = code.RegisterOpcode("OpClamp", []int{1}, 1, 1)
+
+func init() {
+
+	HandleOpcode(opClamp, func(operands []int, args []object.Object) ([]object.Object, error) {
+
+		n, ok := args[0].(*object.Integer)
+
+		if !ok {
+			return nil, fmt.Errorf("OpClamp: not an integer: %s", args[0].Type())
+		}
+
+		if n.Value > int64(operands[0]) {
+			n = &object.Integer{Value: int64(operands[0])}
+		}
+
+		return []object.Object{n}, nil
+	})
+}
+
+func TestCustomOpcodes(t *testing.T) {
+
+	if errClamp != nil {
+		t.Fatalf("register error: %s", errClamp)
+	}
+
+	bytecode := &compiler.Bytecode{
+		Instructions: append(append(
+			code.Make(code.OpConstant, 0),
+			code.Make(opClamp, 100)...),
+			code.Make(code.OpPop)...),
+		Constants: []object.Object{&object.Integer{Value: 300}},
+	}
+
+	if err := compiler.Verify(bytecode); err != nil {
+		t.Fatalf("verify error: %s", err)
+	}
+
+	machine := New(bytecode)
+
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if err := testIntegerObject(100, machine.LastPoppedStackElem()); err != nil {
+		t.Errorf("testIntegerObject failed: %s", err)
+	}
+
+	bytecode.Constants[0] = &object.String{Value: "x"}
+
+	err := New(bytecode).Run()
+
+	if err == nil || !strings.Contains(err.Error(), "OpClamp: not an integer: STRING") {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	if err := HandleOpcode(code.OpAdd, nil); err == nil {
+		t.Errorf("expected an error for a built-in opcode")
+	}
+}
+
+func TestSuperinstructions(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`let f = fn(x) { x + 1 }; f(41)`, 42},
+		{`let f = fn(s) { s + "!" }; f("hi")`, "hi!"},
+		{`let apply = fn(g, x) { g(x) }; apply(fn(n) { n * 2 }, 21)`, 42},
+		{`let call = fn(g) { g() }; call(fn() { 7 })`, 7},
+		{`let twice = fn(g, x) { g(g(x)) + 0 }; twice(fn(n) { n * 3 }, 2)`, 18},
+	}
+
+	runVmTests(t, tests)
+
+	comp := compiler.New()
+
+	if err := comp.Compile(parse(`let f = fn(x) { x + "a" }; f(1)`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err := New(comp.Bytecode()).Run()
+
+	if err == nil || !strings.Contains(err.Error(), "unsupported types for binary operation: INTEGER STRING") {
+		t.Errorf("wrong VM error. got=%v", err)
+	}
+}
+
+// 足し算と関数呼び出しを繰り返すループを、スーパー命令の有無で比べる
+func BenchmarkSuperinstructions(b *testing.B) {
+
+	input := `
+	let inc = fn(x) { x + 1 };
+	let loop = fn(f, n, acc) { if (n > 0) { loop(f, n - 1, f(acc)) } else { acc } };
+	loop(inc, 500, 0);
+	`
+
+	for _, enabled := range []bool{false, true} {
+
+		b.Run(fmt.Sprintf("enabled=%t", enabled), func(b *testing.B) {
+
+			opts := compiler.DefaultOptions()
+			opts.EnableSuperinstructions = enabled
+
+			comp := compiler.NewWithOptions(opts)
+
+			if err := comp.Compile(parse(input)); err != nil {
+				b.Fatalf("compiler error: %s", err)
+			}
+
+			bytecode := comp.Bytecode()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				runWarmStart(b, bytecode)
+			}
+		})
+	}
+}
+
+func TestStackOptions(t *testing.T) {
+
+	// 5000段の再帰は既定のスタックに収まらない
+	input := `
+	let depth = fn(n) { if (n == 0) { 0 } else { 1 + depth(n - 1) } };
+	depth(5000);
+	`
+
+	run := func(opts Options) (*VM, error) {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		machine := NewWithOptions(comp.Bytecode(), opts)
+
+		return machine, machine.Run()
+	}
+
+	if _, err := run(DefaultOptions()); err == nil || !strings.Contains(err.Error(), "stack overflow") {
+		t.Errorf("expected stack overflow. got=%v", err)
+	}
+
+	// 小さく始めて伸ばす
+	machine, err := run(Options{StackSize: 16, MaxStackSize: 1 << 16, MaxFrames: 10000})
+
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if err := testIntegerObject(5000, machine.LastPoppedStackElem()); err != nil {
+		t.Errorf("testIntegerObject failed: %s", err)
+	}
+
+	// 上限を超えれば伸ばさない
+	if _, err := run(Options{StackSize: 16, MaxStackSize: 4096, MaxFrames: 10000}); err == nil || !strings.Contains(err.Error(), "stack overflow") {
+		t.Errorf("expected stack overflow. got=%v", err)
+	}
+}
+
+func TestGlobalsStore(t *testing.T) {
+
+	compile := func(input string) *compiler.Bytecode {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		return comp.Bytecode()
+	}
+
+	// グローバル変数を使わなければ領域を確保しない
+	machine := New(compile("1 + 2"))
+
+	if err := machine.Run(); err != nil || len(machine.Globals()) != 0 {
+		t.Errorf("globals allocated. len=%d (err=%v)", len(machine.Globals()), err)
+	}
+
+	// 渡した領域が足りなければ伸ばす
+	store := []object.Object{}
+	machine = NewWithGlobalsStore(compile("let a = 1; let b = a + 1; b"), store)
+
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if err := testIntegerObject(2, machine.Global(1)); err != nil {
+		t.Errorf("testIntegerObject failed: %s", err)
+	}
+
+	if machine.Global(100) != nil {
+		t.Errorf("expected nil outside the store. got=%v", machine.Global(100))
+	}
+
+	// 十分な大きさを渡せばそのまま使う
+	store = make([]object.Object, 2)
+	machine = NewWithGlobalsStore(compile("let a = 1; let b = a + 1; b"), store)
+
+	if err := machine.Run(); err != nil || store[1] == nil {
+		t.Errorf("store not shared. got=%v (err=%v)", store, err)
+	}
+
+	machine = NewWithOptions(compile("1"), Options{GlobalsSize: 300})
+
+	if len(machine.Globals()) != 300 {
+		t.Errorf("wrong globals size. want=300, got=%d", len(machine.Globals()))
+	}
+}
+
+func TestCallDepthLimit(t *testing.T) {
+
+	run := func(input string, maxFrames int) error {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		return NewWithOptions(comp.Bytecode(), Options{MaxFrames: maxFrames}).Run()
+	}
+
+	tests := []struct {
+		input     string
+		maxFrames int
+		expected  string
+	}{
+		{
+			`let loop = fn() { loop() }; loop()`,
+			0,
+			"recursion limit of 1024 exceeded in loop -> loop -> loop -> loop -> loop -> ...",
+		},
+		{
+			`let ping = fn(other) { other(ping) }; let pong = fn(other) { other(pong) }; ping(pong)`,
+			3,
+			"recursion limit of 3 exceeded in ping -> pong",
+		},
+		{
+			`let f = fn() { fn() { f() }() }; f()`,
+			4,
+			"recursion limit of 4 exceeded in f -> anonymous fn -> f",
+		},
+	}
+
+	for _, tt := range tests {
+
+		err := run(tt.input, tt.maxFrames)
+
+		if err == nil || errors.Unwrap(err).Error() != tt.expected {
+			t.Errorf("wrong error for %q.\nwant=%q\ngot=%v", tt.input, tt.expected, err)
+		}
+	}
+
+	if err := run(`let f = fn(n) { if (n > 0) { f(n - 1) } }; f(5)`, 7); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestStep(t *testing.T) {
+
+	comp := compiler.New()
+	comp.DisableOptimizations()
+
+	input := `let add = fn(a, b) { let c = a + b; c };
+add(1, 2);`
+
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	machine := New(comp.Bytecode())
+
+	var states []*StepState
+
+	for {
+
+		state, err := machine.Step()
+
+		if err != nil {
+			t.Fatalf("step error: %s", err)
+		}
+
+		states = append(states, state)
+
+		// addの中でcに代入した直後
+		if state.Function == "add" && state.Op == code.OpGetLocal && state.IP > 2 {
+
+			locals := machine.Locals()
+
+			if len(locals) != 3 || testIntegerObject(3, locals[2]) != nil {
+				t.Errorf("wrong locals. got=%v", locals)
+			}
+
+			if state.Depth != 2 || state.IsMain || state.Line != 1 {
+				t.Errorf("wrong state. got=%+v", state)
+			}
+		}
+
+		if state.Done {
+			break
+		}
+	}
+
+	// OpFunction, OpSetGlobal, OpGetGlobal, OpConstant, OpConstant, OpCall,
+	// (add) OpGetLocal, OpGetLocal, OpAdd, OpSetLocal, OpGetLocal, OpReturnValue, OpPop
+	if len(states) != 13 {
+		t.Fatalf("wrong number of steps. want=13, got=%d", len(states))
+	}
+
+	// 関数、引数2つ、ローカル変数cの領域
+	if states[5].Function != "add" || states[5].IP != 0 || len(states[5].Stack) != 4 {
+		t.Errorf("wrong state after the call. got=%+v", states[5])
+	}
+
+	if err := testIntegerObject(3, machine.LastPoppedStackElem()); err != nil {
+		t.Errorf("testIntegerObject failed: %s", err)
+	}
+
+	// 途中からRunで続けられる
+	machine = New(comp.Bytecode())
+
+	for i := 0; i < 3; i++ {
+		machine.Step()
+	}
+
+	if err := machine.Run(); err != nil || testIntegerObject(3, machine.LastPoppedStackElem()) != nil {
+		t.Errorf("wrong result after Run. got=%v (err=%v)", machine.LastPoppedStackElem(), err)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+
+	input := `let double = fn(x) {
+	let y = x * 2;
+	y
+};
+double(1);
+double(5);`
+
+	comp := compiler.New()
+
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := comp.Bytecode()
+
+	fnIndex := -1
+
+	for i, c := range bytecode.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok && fn.Name == "double" {
+			fnIndex = i
+		}
+	}
+
+	machine := New(bytecode)
+
+	hits := []string{}
+
+	machine.OnBreakpoint(func(state *StepState) error {
+		hits = append(hits, fmt.Sprintf("%s:%d %v", state.Function, state.Line, machine.Locals()[0].Inspect()))
+		return nil
+	})
+
+	if err := machine.SetBreakpoint(fnIndex, 3); err != nil {
+		t.Fatalf("breakpoint error: %s", err)
+	}
+
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if strings.Join(hits, ",") != "double:3 1,double:3 5" {
+		t.Errorf("wrong hits. got=%v", hits)
+	}
+
+	if err := testIntegerObject(10, machine.LastPoppedStackElem()); err != nil {
+		t.Errorf("testIntegerObject failed: %s", err)
+	}
+
+	// ハンドラーのエラーでRunを止める
+	machine = New(bytecode)
+	machine.OnBreakpoint(func(state *StepState) error { return fmt.Errorf("stopped") })
+
+	if err := machine.SetBreakpointAt(MainFunction, 0); err != nil {
+		t.Fatalf("breakpoint error: %s", err)
+	}
+
+	if err := machine.Run(); err == nil || errors.Unwrap(err).Error() != "stopped" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	tests := []struct {
+		set      func() error
+		expected string
+	}{
+		{func() error { return machine.SetBreakpoint(fnIndex, 9) }, fmt.Sprintf("no instructions on line 9 in function %d", fnIndex)},
+		{func() error { return machine.SetBreakpointAt(MainFunction, 1) }, "offset 1 is not an instruction in function -1"},
+		{func() error { return machine.SetBreakpoint(100, 1) }, fmt.Sprintf("constant 100 out of range (%d constants)", len(bytecode.Constants))},
+	}
+
+	for _, tt := range tests {
+		if err := tt.set(); err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+
+	comp := compiler.New()
+	comp.DisableOptimizations()
+
+	if err := comp.Compile(parse(`let f = fn(x) { x }; f(7);`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+
+	machine := NewWithOptions(comp.Bytecode(), Options{Trace: &out})
+
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	expected := `main 0000 OpFunction 0 top=-
+main 0003 OpSetGlobal 0 top=Closure[` + "%p" + `]
+main 0006 OpGetGlobal 0 top=-
+main 0009 OpConstant 1 top=Closure[` + "%p" + `]
+main 0012 OpCall 1 top=7
+  f 0000 OpGetLocal 0 top=7
+  f 0002 OpReturnValue top=7
+main 0014 OpPop top=7
+`
+
+	lines := strings.Split(out.String(), "\n")
+	want := strings.Split(expected, "\n")
+
+	if len(lines) != len(want) {
+		t.Fatalf("wrong trace.\nwant=\n%s\ngot=\n%s", expected, out.String())
+	}
+
+	// クロージャのアドレスは比べない
+	for i := range want {
+		prefix := strings.Split(want[i], "%p")[0]
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("wrong line %d. want=%q, got=%q", i, want[i], lines[i])
+		}
+	}
+}
+
+func TestMaxInstructions(t *testing.T) {
+
+	run := func(input string, max int) (*VM, error) {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		machine := New(comp.Bytecode())
+		machine.SetMaxInstructions(max)
+
+		return machine, machine.Run()
+	}
+
+	_, err := run(`while (true) { 1 }`, 1000)
+
+	if err == nil || errors.Unwrap(err).Error() != "instruction budget exceeded: 1000 instructions" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	// pmapのワーカーで使い切っても同じエラー
+	_, err = run(`pmap([1, 2], fn(x) { while (true) { x } })`, 1000)
+
+	if err == nil || !strings.Contains(err.Error(), "instruction budget exceeded: 1000 instructions") {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	// 上限ちょうどまでは実行できる (OpConstant, OpPop)
+	if _, err := run(`1;`, 2); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+
+	comp := compiler.New()
+
+	if err := comp.Compile(parse(`while (true) { 1 }`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := New(comp.Bytecode()).RunContext(ctx)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	// 始める前にキャンセルされていれば、最初の命令の前で止まる
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	comp = compiler.New()
+
+	if err := comp.Compile(parse(`1`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	if err := New(comp.Bytecode()).RunContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	if err := New(comp.Bytecode()).RunContext(context.Background()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestProfile(t *testing.T) {
+
+	comp := compiler.New()
+	comp.DisableOptimizations()
+
+	if err := comp.Compile(parse(`let double = fn(x) { x * 2 }; double(1) + double(2);`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	machine := New(comp.Bytecode())
+
+	if len(machine.Profile().Opcodes) != 0 {
+		t.Errorf("profile recorded before EnableProfile")
+	}
+
+	machine.EnableProfile()
+
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	profile := machine.Profile()
+
+	counts := map[string]int{}
+	for _, e := range profile.Opcodes {
+		counts[e.Name] = e.Count
+	}
+
+	for name, want := range map[string]int{"OpCall": 2, "OpMul": 2, "OpAdd": 1, "OpGetLocal": 2, "OpPop": 1} {
+		if counts[name] != want {
+			t.Errorf("wrong count for %s. want=%d, got=%d", name, want, counts[name])
+		}
+	}
+
+	functions := map[string]int{}
+	for _, e := range profile.Functions {
+		functions[e.Name] = e.Count
+	}
+
+	// doubleは1回につきOpGetLocal, OpConstant, OpMul, OpReturnValue
+	if functions["double"] != 8 || functions["main"] != 10 {
+		t.Errorf("wrong function counts. got=%v", functions)
+	}
+
+	for i := 1; i < len(profile.Opcodes); i++ {
+		if profile.Opcodes[i-1].Time < profile.Opcodes[i].Time {
+			t.Errorf("opcodes are not sorted by time. got=%v", profile.Opcodes)
+		}
+	}
+
+	report := profile.String()
+
+	if !strings.HasPrefix(report, "opcode ") || !strings.Contains(report, "\nfunction ") ||
+		!strings.Contains(report, "\ndouble ") {
+		t.Errorf("wrong report.\n%s", report)
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`try { 1 } catch (e) { 2 }`, 1},
+		{`try { throw "boom"; 1 } catch (e) { e }`, "boom"},
+		{`try { } catch (e) { 2 }`, Null},
+		{`1 + try { throw 2 } catch (e) { e * 10 }`, 21},
+		// 実行時エラーはERRORオブジェクトとして受け取る
+		{`try { 1 + "a" } catch (e) { e }`, &object.Error{Message: "unsupported types for binary operation: INTEGER STRING"}},
+		{`try { 1[0] } catch (e) { e }`, &object.Error{Message: "index operator not supported: INTEGER"}},
+		{`try { 1 / 0 } catch (e) { e }`, &object.Error{Message: "division by zero"}},
+		// 関数の中で起きた例外は呼び出し元のハンドラーまでフレームを戻す
+		{`
+		let fail = fn(n) { if (n == 0) { throw "bottom" }; fail(n - 1) };
+		[1, try { fail(5) } catch (e) { e }][1]
+		`, "bottom"},
+		{`
+		let safe = fn(x) { try { x[0] } catch (e) { -1 } };
+		[safe([7]), safe(1), safe([8])]
+		`, []int{7, -1, 8}},
+		// 内側のハンドラーが先に受け取り、そこから投げ直せば外側が受け取る
+		{`
+		try {
+			try { throw 1 } catch (e) { throw e + 1 }
+		} catch (e) { e + 10 }
+		`, 12},
+		// returnで抜けた関数のハンドラーは使わない
+		{`
+		let f = fn() { try { return 1 } catch (e) { 2 } };
+		try { f(); throw 3 } catch (e) { e }
+		`, 3},
+		// breakとcontinueで抜けたtryのハンドラーも使わない
+		{`
+		let n = 0;
+		for (x in 0..5) {
+			try { if (x == 1) { continue }; if (x == 3) { break }; n = n + x } catch (e) { }
+		};
+		try { throw n } catch (e) { e }
+		`, 2},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestUncaughtException(t *testing.T) {
+
+	run := func(input string) error {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		machine := New(comp.Bytecode())
+		machine.SetFuel(100)
+
+		return machine.Run()
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`throw "boom"`, "runtime error at line 1: uncaught exception: boom"},
+		{`let f = fn() { throw [1] }; f()`, "runtime error at line 1 in fn f: uncaught exception: [1]"},
+		{`try { 1 } catch (e) { e }; throw 2`, "runtime error at line 1: uncaught exception: 2"},
+		// 燃料切れは受け取れない
+		{`try { let loop = fn() { loop() }; loop() } catch (e) { 1 }`, "runtime error at line 1 in fn loop: out of fuel"},
+	}
+
+	for _, tt := range tests {
+
+		err := run(tt.input)
+
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error for %q.\nwant=%q\ngot=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestSpawn(t *testing.T) {
+
+	tests := []vmTestCase{
+		// 戻り値はspawnが返すチャンネルで受け取る
+		{`recv(spawn fn() { 1 + 2 })`, 3},
+		{`let task = spawn fn() { 1 }; recv(task); recv(task)`, Null},
+		{`let work = fn() { "done" }; recv(spawn work)`, "done"},
+		// グローバル変数はspawnした時点の複製を使う
+		{`
+		let n = 1;
+		let task = spawn fn() { n = n + 10; n };
+		[recv(task), n]
+		`, []int{11, 1}},
+		// チャンネルでタスクの間で値を受け渡す
+		{`
+		let ch = channel();
+		let producer = spawn fn() {
+			for (i in 0..5) { send(ch, i) };
+			close(ch)
+		};
+		let sum = 0;
+		let v = recv(ch);
+		while (v != null) { sum = sum + v; v = recv(ch) };
+		sum
+		`, 10},
+		{`
+		let ch = channel(2);
+		for (x in [1, 2, 3]) { spawn fn() { send(ch, x * x) } };
+		recv(ch) + recv(ch) + recv(ch)
+		`, 14},
+		// タスクの中のエラーはERRORオブジェクトとして受け取る
+		{`recv(spawn fn() { 1 + "a" })`, &object.Error{Message: "runtime error at line 1 in anonymous fn: unsupported types for binary operation: INTEGER STRING"}},
+		{`let ch = channel(); close(ch); send(ch, 1)`, &object.Error{Message: "send on closed channel"}},
+		{`let ch = channel(); close(ch); close(ch)`, &object.Error{Message: "close of closed channel"}},
+		{`try { spawn fn(x) { x } } catch (e) { e }`, &object.Error{Message: "spawned function must take no arguments, got 1"}},
+		{`try { spawn 1 } catch (e) { e }`, &object.Error{Message: "cannot spawn INTEGER"}},
+		{`channel(65537)`, &object.Error{Message: "channel capacity must be at most 65536, got 65537"}},
+		// 別のタスクから呼ぶクロージャも複製する
+		{`
+		let counter = fn() { let n = 0; fn() { n = n + 1; n } }();
+		recv(spawn fn() { counter(); counter() });
+		counter()
+		`, 1},
+	}
+
+	runVmTests(t, tests)
+
+	compile := func(input string) *compiler.Bytecode {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		return comp.Bytecode()
+	}
+
+	// 埋め込む側でspawnを使えなくできる
+	err := NewWithOptions(compile(`spawn fn() { 1 }`), Options{DisableSpawn: true}).Run()
+
+	if err == nil || !strings.HasSuffix(err.Error(), "spawn is disabled") {
+		t.Errorf("wrong error for disabled spawn. got=%v", err)
+	}
+
+	// タスクの中のpanicはERRORオブジェクトになる
+	builtins := Builtins()
+
+	for i, def := range object.Builtins {
+		if def.Name == "len" {
+			builtins[i] = &object.Builtin{Fn: func(args ...object.Object) object.Object { panic("boom") }}
+		}
+	}
+
+	machine := NewWithBuiltins(compile(`recv(spawn fn() { len([]) })`), builtins)
+
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	testExpectedObject(t, &object.Error{Message: "task panicked: boom"}, machine.LastPoppedStackElem())
+
+	// 燃料は呼び出し元とタスクで共有する
+	machine = New(compile(`
+	let work = fn() { let n = 0; while (n < 200) { n = n + 1 }; n };
+	let tasks = [spawn work, spawn work, spawn work, spawn work];
+	[recv(tasks[0]), recv(tasks[1]), recv(tasks[2]), recv(tasks[3])]
+	`))
+	machine.SetFuel(3000)
+
+	if err := machine.Run(); err == nil {
+
+		results := machine.LastPoppedStackElem().(*object.Array)
+
+		if !strings.Contains(results.Inspect(), "out of fuel") {
+			t.Errorf("expected a task to run out of fuel. got=%s", results.Inspect())
+		}
+	} else if !strings.Contains(err.Error(), "out of fuel") {
+		t.Errorf("wrong error. got=%s", err)
+	}
+
+	// Runが終わるとタスクは止まる。send/recvで待っていても止まる
+	for _, input := range []string{
+		`spawn fn() { while (true) { 1 } }`,
+		`spawn fn() { recv(channel()) }`,
+		`spawn fn() { send(channel(), 1) }`,
+	} {
+
+		machine = New(compile(input))
+
+		if err := machine.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		select {
+		case result := <-machine.LastPoppedStackElem().(*object.Channel).Value:
+			if result.Type() != object.ERROR_OBJ || !strings.Contains(result.Inspect(), "context canceled") {
+				t.Errorf("wrong task result for %q. got=%s", input, result.Inspect())
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("task did not stop after Run returned for %q", input)
+		}
+	}
+
+	// 待っている間も期限で止まる
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := New(compile(`recv(channel())`)).RunContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded. got=%v", err)
+	}
+
+	// チャンネルのバッファもメモリの上限に数える
+	machine = New(compile(`channel(1000)`))
+	machine.SetMemoryLimit(10000)
+
+	if err := machine.Run(); err == nil || !strings.HasSuffix(err.Error(), "memory limit exceeded: 10000 bytes") {
+		t.Errorf("wrong error for channel buffer. got=%v", err)
+	}
+}
+
+func TestGenerator(t *testing.T) {
+
+	tests := []vmTestCase{
+		{`let g = fn() { yield 1; yield 2 }(); [next(g), next(g), next(g)]`, []interface{}{1, 2, Null}},
+		// 最初に呼んだときは本体を実行しない
+		{`let n = 0; let g = fn() { n = n + 1; yield n }(); n`, 0},
+		{`let n = 0; let g = fn() { n = n + 1; yield n }(); [next(g), n]`, []int{1, 1}},
+		// 引数とローカル変数は止めている間も残る
+		{`
+		let count = fn(from, to) { let i = from; while (i < to) { yield i; i = i + 1 } };
+		let g = count(3, 6);
+		[next(g), next(g), next(g), next(g)]
+		`, []interface{}{3, 4, 5, Null}},
+		// next(g, v)のvがyield式の値になる
+		{`
+		let acc = fn() { let total = 0; while (true) { total = total + yield total } };
+		let g = acc();
+		next(g); next(g, 5); next(g, 10)
+		`, 15},
+		// for-inでyieldした値を順に受け取る
+		{`
+		let fib = fn() { let a = 0; let b = 1; while (true) { yield a; let t = a + b; a = b; b = t } };
+		let out = [];
+		for (x in fib()) { if (x > 20) { break }; out = push(out, x) };
+		out
+		`, []int{0, 1, 1, 2, 3, 5, 8, 13}},
+		{`let s = 0; for (x in fn() { yield 1; yield 2; yield 3 }()) { s = s + x }; s`, 6},
+		// generatorの中のtryはyieldをまたいでも使える
+		{`
+		let g = fn() { try { yield 1; throw "in" } catch (e) { yield e }; yield 3 };
+		let out = [];
+		for (x in g()) { out = push(out, x) };
+		out
+		`, []interface{}{1, "in", 3}},
+		// 中で投げた例外は呼び出し元で受け取れ、その後は終わる
+		{`
+		let g = fn() { yield 1; throw "boom" }();
+		[next(g), try { next(g) } catch (e) { e }, next(g)]
+		`, []interface{}{1, "boom", Null}},
+		{`let g = fn() { yield next(g) }(); try { next(g) } catch (e) { e }`,
+			&object.Error{Message: "runtime error at line 1 in anonymous fn: generator is already running"}},
+		{`next(1)`, &object.Error{Message: "first argument to `next` must be GENERATOR, got INTEGER"}},
+		// 別のgeneratorの中からでも、同じgoroutineなら再開できる
+		{`
+		let g = fn() { yield 1; yield 2 }();
+		let h = fn() { yield next(g) }();
+		[next(g), next(h)]
+		`, []int{1, 2}},
+		// 始めていなければpmapのワーカーは複製を使う
+		{`
+		let g = fn() { yield 1; yield 2 }();
+		[pmap([1, 2], fn(x) { next(g) }, 1), next(g)]
+		`, []interface{}{[]int{1, 2}, 1}},
+		// 始めたgeneratorは他のワーカーやタスクでは再開できない
+		// (共有していると go test -race で競合が見つかる)
+		{`
+		let g = fn() { yield 1; yield 2 }();
+		next(g);
+		try { pmap([1, 2, 3, 4], fn(x) { next(g) }, 4) } catch (e) { e }
+		`, &object.Error{Message: "runtime error at line 4 in anonymous fn: pmap: generator belongs to another pmap worker or task"}},
+		{`let g = fn() { yield 1 }(); next(g); recv(spawn fn() { next(g) })`,
+			&object.Error{Message: "runtime error at line 1 in anonymous fn: generator belongs to another pmap worker or task"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestIntegerCache(t *testing.T) {
+
+	for _, v := range []int64{MinCachedInteger, -1, 0, 1, MaxCachedInteger} {
+
+		if newInteger(v) != newInteger(v) {
+			t.Errorf("integer %d is not shared", v)
+		}
+
+		if newInteger(v).Value != v {
+			t.Errorf("wrong value. want=%d, got=%d", v, newInteger(v).Value)
+		}
+	}
+
+	for _, v := range []int64{MinCachedInteger - 1, MaxCachedInteger + 1} {
+
+		if newInteger(v) == newInteger(v) {
+			t.Errorf("integer %d is shared", v)
+		}
+	}
+
+	// 共有の整数を使っても計算結果は変わらない
+	tests := []vmTestCase{
+		{`let a = 1 + 1; let b = 3 - 1; [a, b, a == b]`, []interface{}{2, 2, true}},
+		{`-(1000 + 100)`, -1100},
+		{`1024 + 1`, 1025},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestSnapshot(t *testing.T) {
+
+	compile := func(input string) *compiler.Bytecode {
+		comp := compiler.New()
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		return comp.Bytecode()
+	}
+
+	tests := []struct {
+		input    string
+		steps    int
+		expected interface{}
+	}{
+		{`let total = 0; let i = 0; while (i < 10) { total = total + i; i = i + 1 }; total`, 30, 45},
+		// 関数の中で止めて、自由変数とローカル変数を持ったまま戻す
+		{`
+		let counter = fn(start) { let n = start; fn(step) { n = n + step; n } };
+		let c = counter(10);
+		let sum = fn(xs) { let s = 0; for (x in xs) { s = s + c(x) }; s };
+		sum([1, 2, 3, 4])
+		`, 40, 11 + 13 + 16 + 20},
+		// 同じ配列を指す変数は戻しても同じ配列を指す
+		{`
+		let a = [1, 2];
+		let h = {"a": a, "b": [a, 1.5, "x", null, true]};
+		let r = 1..3;
+		let i = 0; while (i < 3) { i = i + 1 };
+		[h["a"] == h["b"][0], h["b"][0][1], len(r), h["b"][1]]
+		`, 25, []interface{}{true, 2, 2, 1.5}},
+		{`let f = fn() { try { throw "x" } catch (e) { e + "!" } }; f()`, 6, "x!"},
+	}
+
+	for _, tt := range tests {
+
+		bytecode := compile(tt.input)
+
+		machine := New(bytecode)
+
+		for i := 0; i < tt.steps; i++ {
+			if _, err := machine.Step(); err != nil {
+				t.Fatalf("step error: %s", err)
+			}
+		}
+
+		var buf bytes.Buffer
+
+		if err := machine.Snapshot(&buf); err != nil {
+			t.Fatalf("snapshot error: %s", err)
+		}
+
+		resumed := New(bytecode)
+
+		if err := resumed.Restore(&buf); err != nil {
+			t.Fatalf("restore error: %s", err)
+		}
+
+		if err := resumed.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, resumed.LastPoppedStackElem())
+
+		// 元のVMも続けられる
+		if err := machine.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, machine.LastPoppedStackElem())
+	}
+
+	// 別のプログラムには戻せない
+	machine := New(compile(`let a = 1; a`))
+	machine.Step()
+
+	var buf bytes.Buffer
+
+	if err := machine.Snapshot(&buf); err != nil {
+		t.Fatalf("snapshot error: %s", err)
+	}
+
+	data := buf.Bytes()
+
+	if err := New(compile(`let a = 2; a`)).Restore(bytes.NewReader(data)); err == nil || err.Error() != "snapshot was taken from a different program" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	if err := New(compile(`1`)).Restore(strings.NewReader("not a snapshot")); err != ErrNotSnapshot {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	// 途中で切れている
+	if err := New(compile(`let a = 1; a`)).Restore(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Errorf("expected error for truncated snapshot")
+	}
+
+	// 壊れた長さを読んでも、先に大きな領域を確保しない
+	machine = New(compile(`1`))
+
+	for _, field := range []string{"stack", "frames"} {
+
+		forged := &snapshotWriter{vm: machine}
+		forged.w.WriteString(SnapshotMagic)
+		forged.w.WriteByte(SnapshotVersion)
+		forged.uint(len(machine.constants))
+		forged.uint64(machine.programHash())
+		// 値とグローバル変数
+		forged.uint(0)
+		forged.uint(0)
+
+		if field == "frames" {
+			forged.uint(0)
+		}
+
+		forged.uint(math.MaxInt32)
+
+		err := machine.Restore(&forged.w)
+
+		if err == nil || !strings.Contains(err.Error(), "exceeds the remaining") {
+			t.Errorf("wrong error for forged %s. got=%v", field, err)
+		}
+	}
+
+	// チャンネルは書き出せない
+	machine = New(compile(`let ch = channel(1); ch`))
+
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if err := machine.Snapshot(&buf); err == nil || err.Error() != "cannot snapshot CHANNEL" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+
+	globals := make([]object.Object, GlobalsSize)
+	symbolTable := compiler.NewSymbolTable()
+
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
+	constants := []object.Object{}
+
+	compile := func(input string) *compiler.Bytecode {
+		comp := compiler.NewWithState(symbolTable, constants)
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		constants = comp.Bytecode().Constants
+		return comp.Bytecode()
+	}
+
+	machine := NewWithGlobalsStore(compile(`let add = fn(a, b) { a + b }; let x = 1;`), globals)
+
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	stack := &machine.stack[0]
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`add(x, 2)`, 3},
+		// 例外で途中のフレームとtryのハンドラーが残っていても、次は最初から実行する
+		{`let f = fn() { try { throw "x" } catch (e) { e } }; let g = fn() { [1, 2][5] + 1 }; g()`, nil},
+		{`f()`, "x"},
+		{`let y = add(x, 10); y`, 11},
+		{`[x, y, len("abc")]`, []int{1, 11, 3}},
+	}
+
+	for _, tt := range tests {
+
+		machine.Reset(compile(tt.input))
+
+		err := machine.Run()
+
+		if tt.expected == nil {
+			if err == nil {
+				t.Errorf("expected error for %q", tt.input)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, machine.LastPoppedStackElem())
+
+		if len(machine.handlers) != 0 || machine.framesIndex != 1 {
+			t.Errorf("frames or handlers left. frames=%d, handlers=%d", machine.framesIndex, len(machine.handlers))
+		}
+	}
+
+	if &machine.stack[0] != stack {
+		t.Errorf("stack was reallocated")
+	}
+
+	// 命令数の上限と燃料はReset後も同じだけ使える
+	for _, limit := range []func(int){machine.SetMaxInstructions, machine.SetFuel} {
+
+		limit(100)
+
+		for i := 0; i < 3; i++ {
+
+			machine.Reset(compile(`let i = 0; while (i < 5) { i = i + 1 }; i`))
+
+			if err := machine.Run(); err != nil {
+				t.Fatalf("vm error: %s", err)
+			}
+		}
+	}
+
+	bytecode := compile(`x`)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		machine.Reset(bytecode)
+	})
+
+	// 関数とクロージャとフレームだけ
+	if allocs > 3 {
+		t.Errorf("too many allocations in Reset. got=%v", allocs)
+	}
+}
+
+func TestHooks(t *testing.T) {
+
+	input := `let add = fn(a, b) { a + b };
+let nothing = fn() { };
+let fail = fn() { try { throw "x" } catch (e) { e } };
+add(1, 2);
+nothing();
+fail();
+[1][0] + "a"`
+
+	comp := compiler.New()
+	comp.DisableOptimizations()
+
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var events []string
+	instructions := 0
+
+	hooks := &Hooks{
+		OnCall: func(state *StepState) {
+			events = append(events, fmt.Sprintf("call %s depth=%d ip=%d", state.Function, state.Depth, state.IP))
+		},
+		OnReturn: func(state *StepState, value object.Object) {
+			events = append(events, fmt.Sprintf("return %s depth=%d top=%s", value.Inspect(), state.Depth, state.Stack[len(state.Stack)-1].Inspect()))
+		},
+		OnInstruction: func(state *StepState) {
+			instructions++
+		},
+		OnError: func(state *StepState, err error) {
+			def, _ := code.Lookup(byte(state.Op))
+			events = append(events, fmt.Sprintf("error %s line=%d op=%s: %s", state.Function, state.Line, def.Name, err))
+		},
+	}
+
+	machine := NewWithOptions(comp.Bytecode(), Options{Hooks: hooks})
+	machine.EnableReport()
+
+	err := machine.Run()
+
+	if err == nil || err.Error() != "runtime error at line 7: unsupported types for binary operation: INTEGER STRING" {
+		t.Fatalf("wrong error. got=%v", err)
+	}
+
+	expected := []string{
+		"call add depth=2 ip=0",
+		"return 3 depth=1 top=3",
+		"call nothing depth=2 ip=0",
+		"return null depth=1 top=null",
+		"call fail depth=2 ip=0",
+		"error fail line=3 op=OpThrow: uncaught exception: x",
+		"return x depth=1 top=x",
+		"error  line=7 op=OpAdd: unsupported types for binary operation: INTEGER STRING",
+	}
+
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("wrong events.\nwant=%q\ngot=%q", expected, events)
+	}
+
+	if report := machine.Report(); instructions != report.Instructions {
+		t.Errorf("wrong number of instructions. want=%d, got=%d", report.Instructions, instructions)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+
+	sandbox, err := NewSandbox("len", "pmap", "push")
+
+	if err != nil {
+		t.Fatalf("sandbox error: %s", err)
+	}
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`len(push([1, 2], 3))`, 3},
+		// VMが差し替えたpmapも使える
+		{`pmap([1, 2, 3], fn(x) { x * 2 })`, []int{2, 4, 6}},
+	}
+
+	for _, tt := range tests {
+
+		comp := sandbox.Compiler()
+
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		machine := sandbox.VM(comp.Bytecode())
+
+		if err := machine.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, machine.LastPoppedStackElem())
+	}
+
+	// 許可していない組み込み関数はコンパイルできない
+	for _, input := range []string{`puts("x")`, `let f = fn() { first([1]) }; f()`} {
+
+		err := sandbox.Compiler().Compile(parse(input))
+
+		if err == nil || !strings.HasPrefix(err.Error(), "undefined variable") {
+			t.Errorf("expected undefined variable error for %q. got=%v", input, err)
+		}
+	}
+
+	// spawnはコンパイルできない
+	if err := sandbox.Compiler().Compile(parse(`spawn fn() { 1 }`)); err == nil || err.Error() != "spawn is not allowed" {
+		t.Errorf("wrong error for spawn. got=%v", err)
+	}
+
+	// 別に作ったコンパイラーでコンパイルしても実行しない
+	comp := compiler.NewWithState(sandbox.SymbolTable(), []object.Object{})
+
+	if err := comp.Compile(parse(`spawn fn() { 1 }`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	if err := sandbox.VM(comp.Bytecode()).Run(); err == nil || !strings.HasSuffix(err.Error(), "spawn is disabled") {
+		t.Errorf("wrong error for spawn. got=%v", err)
+	}
+
+	// renderのテンプレートでも許可した組み込み関数だけを使う
+	templates, err := NewSandbox("push", "render", "len")
+
+	if err != nil {
+		t.Fatalf("sandbox error: %s", err)
+	}
+
+	for _, tt := range []struct {
+		input    string
+		expected interface{}
+	}{
+		{`render("$${len(xs)}", {"xs": push([1], 2)})`, "2"},
+		{`render("$${puts(1)}", {})`, &object.Error{Message: "render: undefined variable puts"}},
+		{`render("$${first([1])}", {})`, &object.Error{Message: "render: undefined variable first"}},
+	} {
+
+		comp := templates.Compiler()
+
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		machine := templates.VM(comp.Bytecode())
+
+		if err := machine.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, machine.LastPoppedStackElem())
+	}
+
+	// pmapのワーカーもVMの命令数の上限で止まる
+	comp = sandbox.Compiler()
+
+	if err := comp.Compile(parse(`pmap([1, 2, 3, 4], fn(x) { while (true) { x } })`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	machine := sandbox.VM(comp.Bytecode())
+	machine.SetMaxInstructions(1000)
+
+	if err := machine.Run(); err == nil || !strings.HasSuffix(err.Error(), "instruction budget exceeded: 1000 instructions") {
+		t.Errorf("wrong error for pmap. got=%v", err)
+	}
+
+	if _, err := NewSandbox("len", "open_file"); err == nil || err.Error() != "unknown built-in function: open_file" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+
+	if _, err := NewSandbox("len", "len"); err == nil {
+		t.Errorf("expected error for duplicate built-in function")
+	}
+}
+
+func TestIntegerOverflow(t *testing.T) {
+
+	tests := []struct {
+		input    string
+		mode     OverflowMode
+		expected interface{}
+	}{
+		// これまでどおり折り返す
+		{`let max = 9223372036854775807; max + 1`, OverflowWrap, int64(-9223372036854775808)},
+		{`let max = 9223372036854775807; max * 2`, OverflowWrap, -2},
+		{`let max = 9223372036854775807; max + 1`, OverflowError,
+			&object.Error{Message: "runtime error at line 1: integer overflow: 9223372036854775807 + 1"}},
+		{`let min = -9223372036854775807 - 1; -min`, OverflowError,
+			&object.Error{Message: "runtime error at line 1: integer overflow: -(-9223372036854775808)"}},
+		{`let min = -9223372036854775807 - 1; min / -1`, OverflowError,
+			&object.Error{Message: "runtime error at line 1: integer overflow: (-9223372036854775808) / (-1)"}},
+		// tryで受け取れる
+		{`let max = 9223372036854775807; try { max * max } catch (e) { "caught" }`, OverflowError, "caught"},
+		// 範囲内なら整数のまま
+		{`let max = 9223372036854775807; max - 1`, OverflowError, int64(9223372036854775806)},
+		{`let max = 9223372036854775807; max + 1`, OverflowPromote, "9223372036854775808"},
+		{`let max = 9223372036854775807; max * max`, OverflowPromote, "85070591730234615847396907784232501249"},
+		{`let min = -9223372036854775807 - 1; -min`, OverflowPromote, "9223372036854775808"},
+		{`let max = 9223372036854775807; max + 1 > max`, OverflowPromote, true},
+		{`let max = 9223372036854775807; max + 1 - 1 == max`, OverflowPromote, true},
+	}
+
+	for _, tt := range tests {
+
+		comp := compiler.New()
+
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		machine := NewWithOptions(comp.Bytecode(), Options{IntegerOverflow: tt.mode})
+
+		err := machine.Run()
+
+		if expected, ok := tt.expected.(*object.Error); ok {
+			if err == nil || err.Error() != expected.Message {
+				t.Errorf("wrong error for %q. want=%q, got=%v", tt.input, expected.Message, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+
+		result := machine.LastPoppedStackElem()
+
+		if decimal, ok := tt.expected.(string); ok && tt.mode == OverflowPromote {
+			if result.Type() != object.DECIMAL_OBJ || result.Inspect() != decimal {
+				t.Errorf("wrong result for %q. want=%s, got=%s (%s)", tt.input, decimal, result.Inspect(), result.Type())
+			}
+			continue
+		}
+
+		testExpectedObject(t, tt.expected, result)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/wasm"
+)
+
+// monkey wasm file
+// バイトコードとVMを埋め込んだGoのソースを標準出力に書く(実験的)
+// GOOS=js GOARCH=wasm go build でWebAssemblyにできる
+func wasmCommand(args []string) int {
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: monkey wasm file")
+		return 2
+	}
+
+	path := args[0]
+
+	bytecode, ok := compileFile(path, compiler.DefaultOptions())
+
+	if !ok {
+		return 1
+	}
+
+	out, err := wasm.Bundle(bytecode)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return 1
+	}
+
+	fmt.Print(out)
+
+	return 0
+}
@@ -0,0 +1,93 @@
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+
+	"example.com/monkey/compiler"
+)
+
+// 実験的なWebAssemblyのバックエンド
+// バイトコードをVMと一緒に一つのGoのプログラムに埋め込み、
+// それを GOOS=js GOARCH=wasm でビルドしてブラウザで動かす
+//
+//	monkey wasm file.monkey > main.go
+//	GOOS=js GOARCH=wasm go build -o main.wasm main.go
+//
+// ブラウザでは Go の misc/wasm/wasm_exec.js から読み込む。putsの出力はコンソールに出る
+
+// 埋め込むバイトコードの1行のバイト数
+const bytesPerLine = 16
+
+// バイトコードを埋め込んだ package main のソースを返す
+func Bundle(bytecode *compiler.Bytecode) (string, error) {
+
+	var encoded bytes.Buffer
+
+	if err := bytecode.Encode(&encoded); err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+
+	fmt.Fprint(&out, `// Code generated by monkey wasm. DO NOT EDIT.
+
+// +build js,wasm
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/vm"
+)
+
+func main() {
+
+	bytecode, err := compiler.DecodeBytecode(bytes.NewReader(program))
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := vm.New(bytecode).Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+var program = []byte{
+`)
+
+	data := encoded.Bytes()
+
+	for i := 0; i < len(data); i += bytesPerLine {
+
+		end := i + bytesPerLine
+
+		if end > len(data) {
+			end = len(data)
+		}
+
+		for _, b := range data[i:end] {
+			fmt.Fprintf(&out, "0x%02x, ", b)
+		}
+
+		fmt.Fprintln(&out)
+	}
+
+	fmt.Fprintln(&out, "}")
+
+	src, err := format.Source(out.Bytes())
+
+	if err != nil {
+		return "", fmt.Errorf("generated invalid Go source: %s", err)
+	}
+
+	return string(src), nil
+}
@@ -0,0 +1,105 @@
+package wasm
+
+import (
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"example.com/monkey/compiler"
+	"example.com/monkey/lexer"
+	monkeyparser "example.com/monkey/parser"
+)
+
+func bundle(t *testing.T, input string) string {
+
+	p := monkeyparser.New(lexer.New(input))
+
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	comp := compiler.New()
+
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	src, err := Bundle(comp.Bytecode())
+
+	if err != nil {
+		t.Fatalf("bundle error: %s", err)
+	}
+
+	return src
+}
+
+func TestBundle(t *testing.T) {
+
+	src := bundle(t, `let f = fn(x) { x * 2 }; puts(f(21));`)
+
+	if _, err := parser.ParseFile(token.NewFileSet(), "main.go", src, 0); err != nil {
+		t.Fatalf("bundle does not parse: %s\n%s", err, src)
+	}
+}
+
+// WebAssemblyにビルドし、nodeがあればGo付属のwasm_exec.jsで実行する
+func TestBundleBuildsForWasm(t *testing.T) {
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	dir, err := ioutil.TempDir(".", "bundle")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	src := bundle(t, `let f = fn(x) { x * 2 }; puts(f(21));`)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "main.wasm")
+
+	build := exec.Command("go", "build", "-o", out, "./"+dir)
+	build.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
+
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build failed: %s\n%s", err, output)
+	}
+
+	// wasm_exec.js の場所はGoのバージョンによって違う
+	var runner string
+
+	for _, d := range []string{"lib/wasm", "misc/wasm"} {
+		p := filepath.Join(runtime.GOROOT(), d, "go_js_wasm_exec")
+		if _, err := os.Stat(p); err == nil {
+			runner = p
+		}
+	}
+
+	if _, err := exec.LookPath("node"); err != nil || runner == "" {
+		t.Skip("node or go_js_wasm_exec not found")
+	}
+
+	output, err := exec.Command(runner, out).CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("run failed: %s\n%s", err, output)
+	}
+
+	if string(output) != "42\n" {
+		t.Errorf("wrong output. want=%q, got=%q", "42\n", output)
+	}
+}